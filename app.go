@@ -4,14 +4,17 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/ridge/must"
 	"github.com/ridge/parallel"
 	"github.com/wojciech-malota-wojcik/ioc"
 	"github.com/wojciech-malota-wojcik/logger"
 	"github.com/wojciech-malota-wojcik/netdata/infra"
 	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
 	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
 	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
 	"github.com/wojciech-malota-wojcik/netdata/lib/libctx"
+	"go.uber.org/zap"
 )
 
 const localShardBufferSize = 100
@@ -19,17 +22,69 @@ const localShardBufferSize = 100
 // IoCBuilder configures IoC container
 func IoCBuilder(c *ioc.Container) {
 	c.Singleton(infra.NewConfigFromCLI)
-	c.Transient(sharding.NewXORModuloIDGenerator)
+	c.Transient(func(config infra.Config) sharding.IDGenerator {
+		generator, err := sharding.NewIDGenerator(config.ShardIDGenerator)
+		must.OK(err)
+		return generator
+	})
+	c.Singleton(func(config infra.Config) *sharding.Map {
+		return sharding.NewMap(config.NumOfShards)
+	})
 	c.Transient(bus.NewDispatcherFactory)
-	c.Singleton(bus.NewNATSConnection)
+	c.Singleton(func(config infra.Config, dispatcherF bus.DispatcherFactory) bus.Connection {
+		if config.JetStream {
+			return bus.NewJetStreamConnection(config, dispatcherF)
+		}
+		return bus.NewNATSConnection(config, dispatcherF)
+	})
+	c.Singleton(func(config infra.Config) election.Leadership {
+		if config.LeaderElection {
+			return election.NewLease(config)
+		}
+		return election.NewStaticLeadership()
+	})
 }
 
 // App is the main function running application logic
-func App(ctx context.Context, config infra.Config, conn bus.Connection) error {
+func App(ctx context.Context, config infra.Config, shardIDGen sharding.IDGenerator, shardMap *sharding.Map, conn bus.Connection, leadership election.Leadership) error {
 	if !config.VerboseLogging {
 		logger.VerboseOff()
 	}
 
+	if config.Router {
+		return runRouter(ctx, config, shardIDGen, shardMap, conn)
+	}
+
+	if err := prepareStateDir(config, shardMap); err != nil {
+		return err
+	}
+
+	// State is restored before subscribing to the bus so messages are applied on top of it
+	log := logger.Get(ctx)
+	states := make([]*shardState, 0, config.NumOfLocalShards)
+	journals := make([]journal, 0, config.NumOfLocalShards)
+	defer func() {
+		for _, j := range journals {
+			if err := j.Close(); err != nil {
+				log.Error("Closing journal failed", zap.Error(err))
+			}
+		}
+	}()
+	for i := uint64(0); i < config.NumOfLocalShards; i++ {
+		j, state, err := openJournal(config, i, log.With(zap.Uint64("localShardID", i)))
+		if err != nil {
+			return fmt.Errorf("restoring state of local shard %d failed: %w", i, err)
+		}
+		journals = append(journals, j)
+		states = append(states, state)
+	}
+
+	// Resharding is restored before local shards start, so they resume their handoffs
+	r := newResharder(config, shardIDGen, shardMap)
+	if err := r.restore(); err != nil {
+		return fmt.Errorf("restoring resharding progress failed: %w", err)
+	}
+
 	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
 		tx := make(chan interface{})
 		rxes := make([]chan interface{}, 0, config.NumOfLocalShards)
@@ -39,6 +94,7 @@ func App(ctx context.Context, config infra.Config, conn bus.Connection) error {
 		}
 
 		spawn("bus", parallel.Fail, conn.Run(tx))
+		spawn("leadership", parallel.Fail, leadership.Run)
 		spawn("localShards", parallel.Fail, func(ctx context.Context) error {
 			defer close(tx)
 
@@ -47,7 +103,7 @@ func App(ctx context.Context, config infra.Config, conn bus.Connection) error {
 
 			return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
 				for i, rx := range rxes {
-					spawn(fmt.Sprintf("%d", i), parallel.Continue, runLocalShard(rx, tx))
+					spawn(fmt.Sprintf("%d", i), parallel.Continue, runLocalShard(config, states[i], journals[i], r, leadership, rx, tx))
 				}
 				return nil
 			})
@@ -68,6 +124,24 @@ func App(ctx context.Context, config infra.Config, conn bus.Connection) error {
 			return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
 				spawn("subscription-rx", parallel.Fail, conn.Subscribe(ctx, &wire.AlarmStatusChanged{}, txes))
 				spawn("subscription-tx", parallel.Fail, conn.Subscribe(ctx, &wire.SendAlarmDigest{}, txes))
+				spawn("subscription-ack", parallel.Fail, conn.Subscribe(ctx, &wire.AcknowledgeAlarm{}, txes))
+				spawn("subscription-schedule", parallel.Fail, conn.Subscribe(ctx, &wire.SetDigestSchedule{}, txes))
+				spawn("subscription-preferences", parallel.Fail, conn.Subscribe(ctx, &wire.SetDigestPreferences{}, txes))
+				spawn("subscription-silence-create", parallel.Fail, conn.Subscribe(ctx, &wire.CreateSilence{}, txes))
+				spawn("subscription-silence-delete", parallel.Fail, conn.Subscribe(ctx, &wire.DeleteSilence{}, txes))
+				spawn("subscription-handoff", parallel.Fail, conn.Subscribe(ctx, &wire.AlarmsHandedOff{}, txes))
+				spawn("subscription-query", parallel.Fail, conn.Subscribe(ctx, &wire.QueryAlarms{}, txes))
+				if config.LeaderElection {
+					spawn("subscription-published", parallel.Fail, conn.Subscribe(ctx, &wire.DigestPublished{}, txes))
+				}
+
+				// Resharder is stopped before channels of local shards are closed
+				reshardCh := make(chan interface{})
+				reshardTxes := []chan<- interface{}{reshardCh}
+				spawn("subscription-reshard", parallel.Fail, conn.Subscribe(ctx, &wire.ReshardRequested{}, reshardTxes))
+				spawn("subscription-prepared", parallel.Fail, conn.Subscribe(ctx, &wire.ReshardPrepared{}, reshardTxes))
+				spawn("subscription-completed", parallel.Fail, conn.Subscribe(ctx, &wire.HandoffCompleted{}, reshardTxes))
+				spawn("resharder", parallel.Fail, r.run(reshardCh, txes, tx))
 				return nil
 			})
 		})
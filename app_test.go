@@ -11,6 +11,8 @@ import (
 	"github.com/wojciech-malota-wojcik/logger"
 	"github.com/wojciech-malota-wojcik/netdata/infra"
 	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
 	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
 	"github.com/wojciech-malota-wojcik/netdata/lib/libctx"
 )
@@ -43,7 +45,11 @@ func (c *busConn) Run(publishCh <-chan interface{}) parallel.Task {
 						if !ok {
 							return nil
 						}
-						ad, ok := msg.(*wire.AlarmDigest)
+						out, ok := msg.(bus.Outgoing)
+						if !ok {
+							panic("wrong type")
+						}
+						ad, ok := out.Msg.(*wire.AlarmDigest)
 						if !ok {
 							panic("wrong type")
 						}
@@ -51,6 +57,8 @@ func (c *busConn) Run(publishCh <-chan interface{}) parallel.Task {
 						c.mu.Lock()
 						c.digests[ad.UserID] = append(c.digests[ad.UserID], *ad)
 						c.mu.Unlock()
+
+						out.Confirm(nil)
 					}
 				}
 			})
@@ -108,6 +116,7 @@ func (c *busConn) Subscribe(ctx context.Context, templatePtr bus.Entity, recvChs
 	case *wire.SendAlarmDigest:
 		c.requestsRecvChs = recvChs
 		close(c.ready2)
+	case *wire.AlarmsHandedOff, *wire.DigestPublished, *wire.AcknowledgeAlarm, *wire.SetDigestSchedule, *wire.SetDigestPreferences, *wire.CreateSilence, *wire.DeleteSilence, *wire.QueryAlarms, *wire.ReshardRequested, *wire.ReshardPrepared, *wire.HandoffCompleted:
 	default:
 		panic("invalid subscription")
 	}
@@ -153,7 +162,7 @@ func TestApp(t *testing.T) {
 		digests: map[wire.UserID][]wire.AlarmDigest{},
 	}
 
-	require.ErrorIs(t, context.Canceled, App(ctx, config, conn))
+	require.ErrorIs(t, context.Canceled, App(ctx, config, sharding.NewXORModuloIDGenerator(), sharding.NewMap(config.NumOfShards), conn, election.NewStaticLeadership()))
 	assert.Equal(t, map[wire.UserID][]wire.AlarmDigest{
 		user1: {
 			{
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/pflag"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/run"
+	"go.uber.org/zap"
+)
+
+// Lists dead letters stored in JetStream and replays them once producer is fixed
+func main() {
+	run.Tool("deadletters", nil, func(ctx context.Context) error {
+		var natsAddresses []string
+		var topic string
+		var seq uint64
+		var replay bool
+		pflag.StringSliceVar(&natsAddresses, "nats-addr", []string{nats.DefaultURL}, "Addresses of NATS cluster")
+		pflag.StringVar(&topic, "topic", "", "Process dead letters of the topic only")
+		pflag.Uint64Var(&seq, "seq", 0, "Process dead letter of the sequence number only")
+		pflag.BoolVar(&replay, "replay", false, "Publish rejected messages again to their topics and remove them from dead letters")
+		pflag.Parse()
+
+		nc, err := nats.Connect(strings.Join(natsAddresses, ","), nats.Name("Netdata dead letters"))
+		if err != nil {
+			return fmt.Errorf("can't connect to NATS: %w", err)
+		}
+		defer nc.Close()
+
+		js, err := nc.JetStream()
+		if err != nil {
+			return fmt.Errorf("creating JetStream context failed: %w", err)
+		}
+
+		deadLetters, err := bus.ListDeadLetters(js)
+		if err != nil {
+			return err
+		}
+
+		log := logger.Get(ctx)
+		encoder := json.NewEncoder(os.Stdout)
+		for _, dl := range deadLetters {
+			if (topic != "" && dl.Topic != topic) || (seq != 0 && dl.Seq != seq) {
+				continue
+			}
+			if err := encoder.Encode(dl); err != nil {
+				return err
+			}
+			if replay {
+				if err := bus.ReplayDeadLetter(nc, js, dl); err != nil {
+					return err
+				}
+				log.Info("Dead letter replayed", zap.Uint64("seq", dl.Seq), zap.String("topic", dl.Topic))
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,158 @@
+package netdata
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"go.uber.org/zap"
+)
+
+// escalationCheckInterval is the interval of checking if WARNING alarms persisted long enough to be escalated
+const escalationCheckInterval = time.Second
+
+// escalateChanged escalates alarm which has just become CRITICAL and queues WARNING alarm for later escalation
+func (s *localShard) escalateChanged(ctx context.Context, log *zap.Logger, m wire.AlarmStatusChanged) error {
+	alarm := s.Users[m.UserID][m.AlarmID]
+	if alarm == nil || !alarm.ToSend || alarm.Flapping || !alarm.StatusChangedAt.Equal(m.ChangedAt) {
+		return nil
+	}
+
+	switch {
+	case alarm.Status == wire.StatusCritical && s.config.EscalateCritical:
+		return s.escalate(ctx, log, m.UserID, m.AlarmID)
+	case alarm.Status == wire.StatusWarning:
+		s.enqueueEscalation(m.UserID, m.AlarmID, alarm)
+	}
+	return nil
+}
+
+// escalateWarnings escalates WARNING alarms which haven't changed their status for long enough
+func (s *localShard) escalateWarnings(ctx context.Context, log *zap.Logger, now time.Time) error {
+	for s.escalations.Len() > 0 && !s.escalations[0].At.After(now) {
+		item := heap.Pop(&s.escalations).(pendingEscalation)
+
+		// Entry is outdated if status has been changed or alarm has been sent or handed off since it was queued
+		alarm := s.Users[item.UserID][item.AlarmID]
+		if alarm == nil || alarm.Status != wire.StatusWarning || alarm.Revision != item.Revision || !alarm.ToSend || alarm.Flapping {
+			continue
+		}
+		if err := s.escalate(ctx, log.With(zap.Any("userID", item.UserID)), item.UserID, item.AlarmID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escalate publishes digest containing single alarm immediately. Alarm is staged with its revision,
+// so it is not included in the regular digest and it is marked as sent once digest is confirmed.
+func (s *localShard) escalate(ctx context.Context, log *zap.Logger, userID wire.UserID, alarmID wire.AlarmID) error {
+	now := time.Now()
+	alarm := s.Users[userID][alarmID]
+	log = log.With(zap.Any("alarmID", alarmID))
+	if revision, exists := s.stagedRevisions(userID)[alarmID]; exists && revision == alarm.Revision {
+		log.Info("Alarm is waiting in the outbox already, it won't be escalated")
+		return nil
+	}
+	if alarm.acknowledged(now) {
+		log.Info("Alarm acknowledged by the user, it won't be escalated")
+		return nil
+	}
+	if !meetsMinSeverity(s.Preferences[userID], alarm.Status) {
+		log.Info("Alarm is below minimum severity, it won't be escalated")
+		return nil
+	}
+	if s.silenced(userID, alarmID, now) {
+		log.Info("Alarm silenced, it won't be escalated")
+		return nil
+	}
+
+	digest := &stagedDigest{
+		Digest: wire.AlarmDigest{
+			UserID:       userID,
+			ActiveAlarms: []wire.Alarm{alarm.digestEntry(alarmID)},
+		},
+		Revisions: map[wire.AlarmID]uint64{alarmID: alarm.Revision},
+		StagedAt:  now,
+	}
+	groupAlarms(&digest.Digest, s.Preferences[userID].GroupByLabel)
+	digest.ID = s.digestID(digest)
+	s.stage(digest)
+	if err := s.record(log, journalRecord{DigestStaged: digest}); err != nil {
+		return fmt.Errorf("recording staged digest failed: %w", err)
+	}
+
+	log.Info("Alarm escalated", zap.String("digestID", digest.ID), zap.Any("status", alarm.Status))
+	return s.release(ctx, log, digest)
+}
+
+// enqueueUserEscalations queues escalations of all WARNING alarms of the user
+func (s *localShard) enqueueUserEscalations(userID wire.UserID) {
+	for alarmID, alarm := range s.Users[userID] {
+		if alarm.Status == wire.StatusWarning && alarm.ToSend {
+			s.enqueueEscalation(userID, alarmID, alarm)
+		}
+	}
+}
+
+// enqueueEscalation queues escalation of WARNING alarm if it is turned on
+func (s *localShard) enqueueEscalation(userID wire.UserID, alarmID wire.AlarmID, alarm *alarmStatus) {
+	if s.config.EscalateWarningAfter <= 0 {
+		return
+	}
+
+	// State stored before status change time was tracked doesn't contain it
+	since := alarm.StatusChangedAt
+	if since.IsZero() {
+		since = alarm.LatestChangedAt
+	}
+	heap.Push(&s.escalations, pendingEscalation{
+		UserID:   userID,
+		AlarmID:  alarmID,
+		Revision: alarm.Revision,
+		At:       since.Add(s.config.EscalateWarningAfter),
+	})
+}
+
+// pendingEscalation is the escalation of WARNING alarm due at the time
+type pendingEscalation struct {
+	// UserID is the user ID
+	UserID wire.UserID
+
+	// AlarmID is the alarm ID
+	AlarmID wire.AlarmID
+
+	// Revision is the revision of the alarm when escalation was queued
+	Revision uint64
+
+	// At is the time when alarm is escalated
+	At time.Time
+}
+
+// escalationQueue is the priority queue of pending escalations, the earliest one is at index 0
+type escalationQueue []pendingEscalation
+
+func (q escalationQueue) Len() int {
+	return len(q)
+}
+
+func (q escalationQueue) Less(i, j int) bool {
+	return q[i].At.Before(q[j].At)
+}
+
+func (q escalationQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *escalationQueue) Push(x interface{}) {
+	*q = append(*q, x.(pendingEscalation))
+}
+
+func (q *escalationQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,137 @@
+package netdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func TestCriticalAlarmIsEscalated(t *testing.T) {
+	result := runLocalShardWithStateTest(t, infra.Config{EscalateCritical: true}, newShardState(), noJournal{},
+		change(user1, alarm1, wire.StatusCritical, time1),
+		change(user1, alarm2, wire.StatusWarning, time1),
+		change(user1, alarm1, wire.StatusCritical, time2),
+		send(user1),
+		send(user1),
+	)
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusCritical,
+					LatestChangedAt: time1,
+				},
+			},
+		},
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm2,
+					Status:          wire.StatusWarning,
+					LatestChangedAt: time1,
+				},
+			},
+		},
+	}, result)
+}
+
+func TestCriticalAlarmIsEscalatedAgainAfterStatusChange(t *testing.T) {
+	result := runLocalShardWithStateTest(t, infra.Config{EscalateCritical: true}, newShardState(), noJournal{},
+		change(user1, alarm1, wire.StatusCritical, time1),
+		change(user1, alarm1, wire.StatusCleared, time2),
+		change(user1, alarm1, wire.StatusCritical, time1),
+		change(user1, alarm1, wire.StatusCritical, time3),
+		send(user1),
+	)
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusCritical,
+					LatestChangedAt: time1,
+				},
+			},
+		},
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusCritical,
+					LatestChangedAt: time3,
+				},
+			},
+		},
+	}, result)
+}
+
+func TestPersistingWarningIsEscalated(t *testing.T) {
+	now := time.Now()
+	result := runLocalShardWithStateTest(t, infra.Config{EscalateWarningAfter: time.Hour}, newShardState(), noJournal{},
+		change(user1, alarm1, wire.StatusWarning, now),
+		change(user1, alarm2, wire.StatusWarning, time1),
+		change(user1, alarm3, wire.StatusCritical, time1),
+		send(user1),
+	)
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm2,
+					Status:          wire.StatusWarning,
+					LatestChangedAt: time1,
+				},
+			},
+		},
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm3,
+					Status:          wire.StatusCritical,
+					LatestChangedAt: time1,
+				},
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusWarning,
+					LatestChangedAt: now,
+				},
+			},
+		},
+	}, result)
+}
+
+func TestWarningIsEscalatedOncePerStatusChange(t *testing.T) {
+	now := time.Now()
+	state := newShardState()
+	result := runLocalShardWithStateTest(t, infra.Config{EscalateWarningAfter: time.Hour}, state, noJournal{},
+		change(user1, alarm1, wire.StatusWarning, now.Add(-2*time.Hour)),
+		change(user1, alarm1, wire.StatusWarning, now.Add(-time.Hour)),
+		change(user1, alarm1, wire.StatusCritical, now.Add(-time.Hour)),
+		change(user1, alarm1, wire.StatusWarning, now),
+	)
+
+	// Warning reported again after status changed hasn't persisted long enough yet
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusWarning,
+					LatestChangedAt: now.Add(-2 * time.Hour),
+				},
+			},
+		},
+	}, result)
+	assert.True(t, state.Users[user1][alarm1].ToSend)
+}
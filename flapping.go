@@ -0,0 +1,112 @@
+package netdata
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"go.uber.org/zap"
+)
+
+// flappingPolicy defines when alarm is considered to be flapping
+type flappingPolicy struct {
+	// Window is the period in which status transitions are counted, 0 turns detection off
+	Window time.Duration
+
+	// Threshold is the number of transitions in the window after which alarm is flapping
+	Threshold int
+}
+
+func newFlappingPolicy(config infra.Config) flappingPolicy {
+	return flappingPolicy{
+		Window:    config.FlappingWindow,
+		Threshold: int(config.FlappingThreshold),
+	}
+}
+
+// recordTransition stores status transition in the history of the alarm and detects flapping.
+// Flapping alarm settles if there was no transition during the whole window. True is returned if alarm
+// has just started flapping.
+func (p flappingPolicy) recordTransition(alarm *alarmStatus, at time.Time) bool {
+	if p.Window <= 0 {
+		return false
+	}
+
+	// Transition is never older than the ones already stored because outdated updates are ignored
+	since := at.Add(-p.Window)
+	transitions := make([]time.Time, 0, len(alarm.Transitions)+1)
+	for _, t := range alarm.Transitions {
+		if t.After(since) {
+			transitions = append(transitions, t)
+		}
+	}
+	if len(transitions) == 0 {
+		alarm.Flapping = false
+	}
+	alarm.Transitions = append(transitions, at)
+
+	if alarm.Flapping || len(alarm.Transitions) < p.Threshold {
+		return false
+	}
+	alarm.Flapping = true
+	return true
+}
+
+// settled returns true if flapping alarm hasn't changed its status for the whole window
+func (p flappingPolicy) settled(alarm *alarmStatus, now time.Time) bool {
+	return alarm.Flapping && !alarm.StatusChangedAt.After(now.Add(-p.Window))
+}
+
+// settledAlarms contains alarms of the user which stopped flapping
+type settledAlarms struct {
+	// UserID is the user ID
+	UserID wire.UserID
+
+	// AlarmIDs are IDs of settled alarms
+	AlarmIDs []wire.AlarmID
+}
+
+// settle marks alarms as not flapping anymore. Active alarm is sent again, so user gets its status without the marker.
+// Cleared alarm is sent as resolved if user has been notified about it being active.
+func (st *shardState) settle(settled *settledAlarms) {
+	alarms := st.Users[settled.UserID]
+	for _, alarmID := range settled.AlarmIDs {
+		alarm := alarms[alarmID]
+		if alarm == nil {
+			continue
+		}
+		alarm.Flapping = false
+		alarm.Transitions = nil
+		if alarm.Status == wire.StatusCleared {
+			alarm.ToSend = st.resolve && alarm.Notified
+			if alarm.ToSend {
+				alarm.Revision++
+			}
+			continue
+		}
+		alarm.ToSend = true
+		alarm.Revision++
+	}
+}
+
+// settleFlapping settles alarms of the user which haven't changed their status for the whole window
+func (s *localShard) settleFlapping(log *zap.Logger, userID wire.UserID, now time.Time) error {
+	settled := &settledAlarms{UserID: userID}
+	for alarmID, alarm := range s.Users[userID] {
+		if s.flapping.settled(alarm, now) {
+			settled.AlarmIDs = append(settled.AlarmIDs, alarmID)
+		}
+	}
+	if len(settled.AlarmIDs) == 0 {
+		return nil
+	}
+
+	s.settle(settled)
+	if err := s.record(log, journalRecord{FlappingSettled: settled}); err != nil {
+		return fmt.Errorf("recording settled alarms failed: %w", err)
+	}
+
+	log.Info("Alarms stopped flapping", zap.Any("alarmIDs", settled.AlarmIDs))
+	return nil
+}
@@ -0,0 +1,139 @@
+package netdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func TestFlappingIsDetected(t *testing.T) {
+	policy := flappingPolicy{Window: time.Hour, Threshold: 3}
+	alarm := &alarmStatus{}
+
+	assert.False(t, policy.recordTransition(alarm, time1))
+	assert.False(t, policy.recordTransition(alarm, time1.Add(10*time.Minute)))
+	assert.True(t, policy.recordTransition(alarm, time1.Add(20*time.Minute)))
+	assert.True(t, alarm.Flapping)
+	assert.False(t, policy.recordTransition(alarm, time1.Add(30*time.Minute)))
+	assert.True(t, alarm.Flapping)
+	assert.Len(t, alarm.Transitions, 4)
+
+	// Transitions older than window are forgotten
+	assert.False(t, policy.recordTransition(alarm, time1.Add(85*time.Minute)))
+	assert.True(t, alarm.Flapping)
+	assert.Len(t, alarm.Transitions, 2)
+
+	// There was no transition during the whole window so alarm settles
+	assert.False(t, policy.recordTransition(alarm, time1.Add(3*time.Hour)))
+	assert.False(t, alarm.Flapping)
+	assert.Len(t, alarm.Transitions, 1)
+
+	assert.False(t, flappingPolicy{}.recordTransition(alarm, time1.Add(4*time.Hour)))
+	assert.Len(t, alarm.Transitions, 1)
+}
+
+func TestFlappingAlarmIsSentOnce(t *testing.T) {
+	base := time.Now().Add(-10 * time.Minute)
+	result := runLocalShardWithStateTest(t, infra.Config{FlappingWindow: time.Hour, FlappingThreshold: 3}, newShardState(), noJournal{},
+		change(user1, alarm1, wire.StatusWarning, base),
+		send(user1),
+		change(user1, alarm1, wire.StatusCleared, base.Add(time.Minute)),
+		change(user1, alarm1, wire.StatusWarning, base.Add(2*time.Minute)),
+		change(user1, alarm1, wire.StatusCleared, base.Add(3*time.Minute)),
+		send(user1),
+		change(user1, alarm1, wire.StatusWarning, base.Add(4*time.Minute)),
+		change(user1, alarm1, wire.StatusCritical, base.Add(5*time.Minute)),
+		send(user1),
+	)
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusWarning,
+					LatestChangedAt: base,
+				},
+			},
+		},
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusCleared,
+					LatestChangedAt: base.Add(3 * time.Minute),
+					Flapping:        true,
+					Transitions:     4,
+				},
+			},
+		},
+	}, result)
+}
+
+func TestSettledAlarmIsSentWithoutMarker(t *testing.T) {
+	state := newShardState()
+	result := runLocalShardWithStateTest(t, infra.Config{FlappingWindow: time.Hour, FlappingThreshold: 3}, state, noJournal{},
+		change(user1, alarm1, wire.StatusWarning, time1),
+		change(user1, alarm1, wire.StatusCleared, time1.Add(time.Minute)),
+		change(user1, alarm1, wire.StatusWarning, time1.Add(2*time.Minute)),
+		change(user1, alarm2, wire.StatusWarning, time1),
+		change(user1, alarm2, wire.StatusCleared, time1.Add(time.Minute)),
+		change(user1, alarm2, wire.StatusWarning, time1.Add(2*time.Minute)),
+		change(user1, alarm2, wire.StatusCleared, time1.Add(3*time.Minute)),
+		send(user1),
+	)
+
+	// Alarms haven't changed for much longer than the window, so they settled before digest was sent
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusWarning,
+					LatestChangedAt: time1.Add(2 * time.Minute),
+				},
+			},
+		},
+	}, result)
+	assert.False(t, state.Users[user1][alarm1].Flapping)
+	assert.False(t, state.Users[user1][alarm2].Flapping)
+	assert.Empty(t, state.Users[user1][alarm2].Transitions)
+}
+
+func TestSettledAlarmsAreReplayed(t *testing.T) {
+	state := newShardState()
+	state.flapping = flappingPolicy{Window: time.Hour, Threshold: 2}
+	log := logger.New()
+	require.NoError(t, state.replay(log, journalRecord{AlarmStatusChanged: &wire.AlarmStatusChanged{
+		ShardedEntity: wire.ShardedEntity{UserID: user1},
+		AlarmID:       alarm1,
+		Status:        wire.StatusWarning,
+		ChangedAt:     time1,
+	}}))
+	require.NoError(t, state.replay(log, journalRecord{AlarmStatusChanged: &wire.AlarmStatusChanged{
+		ShardedEntity: wire.ShardedEntity{UserID: user1},
+		AlarmID:       alarm1,
+		Status:        wire.StatusCritical,
+		ChangedAt:     time2,
+	}}))
+	require.NoError(t, state.replay(log, journalRecord{AlarmStatusChanged: &wire.AlarmStatusChanged{
+		ShardedEntity: wire.ShardedEntity{UserID: user1},
+		AlarmID:       alarm1,
+		Status:        wire.StatusWarning,
+		ChangedAt:     time2.Add(time.Minute),
+	}}))
+	require.True(t, state.Users[user1][alarm1].Flapping)
+	revision := state.Users[user1][alarm1].Revision
+
+	require.NoError(t, state.replay(log, journalRecord{FlappingSettled: &settledAlarms{UserID: user1, AlarmIDs: []wire.AlarmID{alarm1}}}))
+	assert.False(t, state.Users[user1][alarm1].Flapping)
+	assert.True(t, state.Users[user1][alarm1].ToSend)
+	assert.Equal(t, revision+1, state.Users[user1][alarm1].Revision)
+}
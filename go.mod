@@ -5,14 +5,16 @@ go 1.16
 replace github.com/ridge/parallel => github.com/wojciech-malota-wojcik/parallel v0.1.2
 
 require (
+	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/google/uuid v1.3.0
-	github.com/nats-io/nats-server/v2 v2.6.3 // indirect
+	github.com/nats-io/nats-server/v2 v2.6.3
 	github.com/nats-io/nats.go v1.13.1-0.20211018182449-f2416a8b1483
 	github.com/ridge/must v0.6.0
 	github.com/ridge/parallel v0.1.1
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.7.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	github.com/wojciech-malota-wojcik/build v0.0.0-20210131144749-3ef5b00b908f
 	github.com/wojciech-malota-wojcik/buildgo v0.1.1
 	github.com/wojciech-malota-wojcik/ioc v1.3.1-0.20210829092813-3edb43f522c7
@@ -23,5 +25,5 @@ require (
 	go.uber.org/multierr v1.7.0 // indirect
 	go.uber.org/zap v1.19.1
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
-	google.golang.org/protobuf v1.27.1 // indirect
+	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,111 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/wojciech-malota-wojcik/netdata/infra/codec"
+)
+
+// DeadLetterStream is the name of JetStream stream storing dead letters
+const DeadLetterStream = "DeadLetters"
+
+// StoredDeadLetter is the dead letter stored in JetStream stream
+type StoredDeadLetter struct {
+	DeadLetter
+
+	// Seq is the sequence number of the dead letter in the stream
+	Seq uint64
+}
+
+// ListDeadLetters returns dead letters stored in the dead-letter stream
+func ListDeadLetters(js nats.JetStreamContext) ([]StoredDeadLetter, error) {
+	info, err := js.StreamInfo(DeadLetterStream)
+	if err != nil {
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("fetching stream info failed: %w", err)
+	}
+
+	var deadLetters []StoredDeadLetter
+	for seq := info.State.FirstSeq; info.State.Msgs > 0 && seq <= info.State.LastSeq; seq++ {
+		m, err := js.GetMsg(DeadLetterStream, seq)
+		if err != nil {
+			if errors.Is(err, nats.ErrMsgNotFound) {
+				// Dead letter has been replayed already
+				continue
+			}
+			return nil, fmt.Errorf("fetching dead letter %d failed: %w", seq, err)
+		}
+
+		c, err := codec.ForContentType(envelopeFromHeader(m.Header).ContentType)
+		if err != nil {
+			return nil, fmt.Errorf("decoding dead letter %d failed: %w", seq, err)
+		}
+		dl := StoredDeadLetter{Seq: seq}
+		if err := c.Decode(m.Data, &dl.DeadLetter); err != nil {
+			return nil, fmt.Errorf("decoding dead letter %d failed: %w", seq, err)
+		}
+		deadLetters = append(deadLetters, dl)
+	}
+	return deadLetters, nil
+}
+
+// ReplayDeadLetter publishes the rejected message again to its original topic and removes dead letter from the stream
+func ReplayDeadLetter(nc *nats.Conn, js nats.JetStreamContext, dl StoredDeadLetter) error {
+	m := nats.NewMsg(dl.Topic)
+	envelope := dl.Envelope
+	// Message is published with new ID, so JetStream doesn't discard it as a duplicate of the rejected one
+	envelope.MessageID = uuid.New().String()
+	setEnvelope(m.Header, envelope)
+	m.Data = dl.Data
+
+	if err := nc.PublishMsg(m); err != nil {
+		return fmt.Errorf("publishing message failed: %w", err)
+	}
+	if err := nc.Flush(); err != nil {
+		return fmt.Errorf("publishing message failed: %w", err)
+	}
+
+	if err := js.DeleteMsg(DeadLetterStream, dl.Seq); err != nil {
+		return fmt.Errorf("deleting dead letter %d failed: %w", dl.Seq, err)
+	}
+	return nil
+}
+
+// ensureDeadLetterStream creates the dead-letter stream capturing the subject if it doesn't exist. If subject has been
+// changed, it is added to the existing stream, so dead letters published to the previous one are kept.
+// Dead letters older than maxAge are removed from the stream.
+func ensureDeadLetterStream(js nats.JetStreamContext, subject string, maxAge time.Duration) error {
+	info, err := js.StreamInfo(DeadLetterStream)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		if _, err := js.AddStream(&nats.StreamConfig{
+			Name:     DeadLetterStream,
+			Subjects: []string{subject},
+			MaxAge:   maxAge,
+		}); err != nil {
+			return fmt.Errorf("creating stream failed: %w", err)
+		}
+		return nil
+	case err != nil:
+		return fmt.Errorf("fetching stream info failed: %w", err)
+	}
+
+	config := info.Config
+	for _, s := range config.Subjects {
+		if s == subject {
+			return updateMaxAge(js, config, maxAge)
+		}
+	}
+	config.Subjects = append(config.Subjects, subject)
+	config.MaxAge = maxAge
+	if _, err := js.UpdateStream(&config); err != nil {
+		return fmt.Errorf("updating stream failed: %w", err)
+	}
+	return nil
+}
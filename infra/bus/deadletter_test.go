@@ -0,0 +1,135 @@
+package bus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+)
+
+func TestRejectedMessageIsStoredAsDeadLetterAndReplayed(t *testing.T) {
+	ctx := logger.WithLogger(context.Background(), logger.New())
+	s := runJetStreamServer(t)
+
+	config := infra.Config{
+		NATSAddresses:     []string{s.ClientURL()},
+		NumOfShards:       1,
+		NumOfLocalShards:  1,
+		JetStreamAckWait:  time.Second,
+		DeadLetterSubject: "DeadLetter",
+	}
+
+	recvCh := make(chan interface{})
+	cancel, errCh := runJetStreamConnection(ctx, config, &jsEntity{}, recvCh)
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := js.ConsumerInfo("jsEntity", "shard-0")
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	_, err = js.Publish("jsEntity", []byte(`{`), nats.MsgId("invalid"))
+	require.NoError(t, err)
+
+	var deadLetters []StoredDeadLetter
+	require.Eventually(t, func() bool {
+		deadLetters, err = ListDeadLetters(js)
+		require.NoError(t, err)
+		return len(deadLetters) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	require.Len(t, deadLetters, 1)
+	dl := deadLetters[0]
+	assert.Equal(t, "jsEntity", dl.Topic)
+	assert.Equal(t, []byte(`{`), dl.Data)
+	assert.Equal(t, "invalid", dl.Envelope.MessageID)
+	assert.NotEmpty(t, dl.Error)
+	assert.False(t, dl.RejectedAt.IsZero())
+
+	// Rejected message is acknowledged once dead letter is published
+	require.Eventually(t, func() bool {
+		info, err := js.ConsumerInfo("jsEntity", "shard-0")
+		require.NoError(t, err)
+		return info.NumAckPending == 0 && info.NumRedelivered == 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+
+	require.NoError(t, ReplayDeadLetter(nc, js, dl))
+
+	info, err := js.StreamInfo("jsEntity")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), info.State.Msgs)
+	m, err := js.GetMsg("jsEntity", info.State.LastSeq)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`{`), m.Data)
+	assert.NotEqual(t, "invalid", m.Header.Get(nats.MsgIdHdr))
+
+	deadLetters, err = ListDeadLetters(js)
+	require.NoError(t, err)
+	assert.Empty(t, deadLetters)
+}
+
+func TestDeadLettersAreStoredWithoutJetStreamSubscriptions(t *testing.T) {
+	ctx := logger.WithLogger(context.Background(), logger.New())
+	s := runJetStreamServer(t)
+
+	// Stream has explicit name, so subject may contain dots
+	config := infra.Config{
+		NATSAddresses:     []string{s.ClientURL()},
+		NumOfShards:       1,
+		NumOfLocalShards:  1,
+		DeadLetterSubject: "netdata.dead-letters",
+	}
+
+	recvCh := make(chan interface{})
+	cancel, errCh := runConnection(ctx, NewNATSConnection, config, &jsEntity{}, recvCh)
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	// Subscription is ready once the message published to the subject is received
+	require.Eventually(t, func() bool {
+		_ = nc.Publish("jsEntity", []byte(`{}`))
+		select {
+		case <-recvCh:
+			return true
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}, 10*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, nc.Publish("jsEntity", []byte(`{`)))
+
+	var deadLetters []StoredDeadLetter
+	require.Eventually(t, func() bool {
+		deadLetters, err = ListDeadLetters(js)
+		require.NoError(t, err)
+		return len(deadLetters) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	require.Len(t, deadLetters, 1)
+	assert.Equal(t, "jsEntity", deadLetters[0].Topic)
+	assert.Equal(t, []byte(`{`), deadLetters[0].Data)
+
+	info, err := js.StreamInfo(DeadLetterStream)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"netdata.dead-letters"}, info.Config.Subjects)
+
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+}
@@ -2,34 +2,39 @@ package bus
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"reflect"
+	"sync/atomic"
 
 	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/codec"
+	"github.com/wojciech-malota-wojcik/netdata/infra/schema"
 	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
 	"go.uber.org/zap"
 )
 
 // NewDispatcherFactory creates new dispatcher factory
-func NewDispatcherFactory(config infra.Config, shardIDGen sharding.IDGenerator) DispatcherFactory {
+func NewDispatcherFactory(config infra.Config, shardIDGen sharding.IDGenerator, shardMap *sharding.Map) DispatcherFactory {
 	return &dispatcherFactory{
 		config:     config,
 		shardIDGen: shardIDGen,
+		shardMap:   shardMap,
 	}
 }
 
 type dispatcherFactory struct {
 	config     infra.Config
 	shardIDGen sharding.IDGenerator
+	shardMap   *sharding.Map
 }
 
 func (df *dispatcherFactory) Create(templatePtr Entity, recvChs []chan<- interface{}, log *zap.Logger) Dispatcher {
 	return &dispatcher{
 		config:     df.config,
 		shardIDGen: df.shardIDGen,
+		shardMap:   df.shardMap,
 		log:        log,
 
-		templatePtr:   templatePtr,
 		templateValue: reflect.ValueOf(templatePtr).Elem(),
 		recvChs:       recvChs,
 	}
@@ -38,32 +43,109 @@ func (df *dispatcherFactory) Create(templatePtr Entity, recvChs []chan<- interfa
 type dispatcher struct {
 	config     infra.Config
 	shardIDGen sharding.IDGenerator
+	shardMap   *sharding.Map
 	log        *zap.Logger
 
-	templatePtr   Entity
 	templateValue reflect.Value
 	recvChs       []chan<- interface{}
 }
 
-func (d *dispatcher) Dispatch(ctx context.Context, msg []byte) {
-	d.log.Debug("Message received", zap.ByteString("msg", msg))
-	if err := json.Unmarshal(msg, d.templatePtr); err != nil {
-		d.log.Error("Decoding message failed", zap.Error(err))
-		return
+func (d *dispatcher) Dispatch(ctx context.Context, envelope schema.Envelope, msg []byte, ack AckFunc) error {
+	d.log.Debug("Message received", zap.Any("envelope", envelope), zap.Binary("msg", msg))
+
+	c, err := codec.ForContentType(envelope.ContentType)
+	if err != nil {
+		return fmt.Errorf("decoding message failed: %w", err)
+	}
+
+	// Message is decoded into the copy of template so slices and maps of previously dispatched entities are not reused
+	entityValue := reflect.New(d.templateValue.Type())
+	entityValue.Elem().Set(d.templateValue)
+	entity := entityValue.Interface().(Entity)
+
+	if version := schema.VersionOf(entity); envelope.SchemaVersion > version {
+		d.log.Warn("Message of newer schema version received, decoding it using the current one",
+			zap.Uint64("version", envelope.SchemaVersion), zap.Uint64("currentVersion", version),
+			zap.String("producer", envelope.Producer), zap.String("messageID", envelope.MessageID))
+	}
+	if err := schema.Decode(c.Decode, msg, envelope.SchemaVersion, entity); err != nil {
+		return fmt.Errorf("decoding message failed: %w", err)
+	}
+	if err := entity.Validate(); err != nil {
+		return fmt.Errorf("received entity is in invalid state: %w", err)
 	}
-	if err := d.templatePtr.Validate(); err != nil {
-		d.log.Error("Received entity is in invalid state", zap.Error(err))
-		return
+
+	var value interface{} = entityValue.Elem().Interface()
+	if _, ok := entity.(RequestEntity); ok && envelope.Reply != "" {
+		value = Request{Entity: value, Reply: envelope.Reply}
+	}
+
+	if d.config.Router {
+		// Router receives all the entities, it decides where to publish them
+		select {
+		case <-ctx.Done():
+		case d.recvChs[0] <- withAck(value, envelope.MessageID, ack):
+		}
+		return nil
+	}
+
+	if _, ok := entity.(BroadcastEntity); ok {
+		// Broadcast entity is delivered to all the receiving channels, it is acknowledged once all of them handled it,
+		// so broker redelivers it if any of them fails
+		if ack != nil {
+			ack = ackAfter(ack, len(d.recvChs))
+		}
+		for _, recvCh := range d.recvChs {
+			select {
+			case <-ctx.Done():
+				return nil
+			case recvCh <- withAck(value, envelope.MessageID, ack):
+			}
+		}
+		return nil
 	}
-	shardIDs := d.shardIDGen.Generate(d.templatePtr.ShardSeed(), d.config.NumOfShards, uint64(len(d.recvChs)))
+
+	seed := entity.ShardSeed()
+	_, numOfShards := d.shardMap.Current()
+	shardIDs := d.shardIDGen.Generate(seed, numOfShards, uint64(len(d.recvChs)))
 	if shardID := shardIDs[0]; shardID != d.config.ShardID {
-		d.log.Debug("Entity not for this shard received, ignoring", zap.Any("dstShardID", shardID), zap.Any("shardID", d.config.ShardID))
-		return
+		// During resharding messages owned by this shard in the next shard map are received too
+		if _, next := d.shardMap.Next(); next == 0 || sharding.Owner(d.shardIDGen, seed, next) != d.config.ShardID {
+			d.log.Debug("Entity not for this shard received, ignoring", zap.Any("dstShardID", shardID), zap.Any("shardID", d.config.ShardID))
+			d.ack(ack)
+			return nil
+		}
 	}
 
 	localShardID := shardIDs[1]
 	select {
 	case <-ctx.Done():
-	case d.recvChs[localShardID] <- d.templateValue.Interface():
+	case d.recvChs[localShardID] <- withAck(value, envelope.MessageID, ack):
+	}
+	return nil
+}
+
+// withAck wraps the value with Delivery if broker expects message to be acknowledged
+func withAck(value interface{}, messageID string, ack AckFunc) interface{} {
+	if ack == nil {
+		return value
+	}
+	return Delivery{Entity: value, MessageID: messageID, Ack: ack}
+}
+
+// ackAfter returns function acknowledging message once it has been called n times
+func ackAfter(ack AckFunc, n int) AckFunc {
+	remaining := int32(n)
+	return func() {
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			ack()
+		}
+	}
+}
+
+// ack acknowledges message which is not going to be delivered to local shard
+func (d *dispatcher) ack(ack AckFunc) {
+	if ack != nil {
+		ack()
 	}
 }
@@ -9,6 +9,8 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/wojciech-malota-wojcik/logger"
 	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/codec"
+	"github.com/wojciech-malota-wojcik/netdata/infra/schema"
 	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
 )
 
@@ -59,12 +61,12 @@ func TestDispatcherFactory(t *testing.T) {
 
 	e := &entity{}
 
-	df := NewDispatcherFactory(config, shardIDGen)
+	df := NewDispatcherFactory(config, shardIDGen, sharding.NewMap(config.NumOfShards))
 	disp := df.Create(e, recvChs, logger.New())
 
 	// Action 1 - correct channel
 
-	disp.Dispatch(ctx, []byte("{}"))
+	disp.Dispatch(ctx, schema.Envelope{}, []byte("{}"), nil)
 	require.Len(t, chs[1], 1)
 	assert.Equal(t, *e, <-chs[1])
 
@@ -72,29 +74,195 @@ func TestDispatcherFactory(t *testing.T) {
 
 	shardIDGen.ids = []sharding.ID{3, 2}
 
-	disp.Dispatch(ctx, []byte("{}"))
+	disp.Dispatch(ctx, schema.Envelope{}, []byte("{}"), nil)
 	require.Len(t, chs[2], 1)
 	assert.Equal(t, *e, <-chs[2])
 
 	// Action 3 - invalid json
 
-	disp.Dispatch(ctx, []byte("{"))
+	assert.Error(t, disp.Dispatch(ctx, schema.Envelope{}, []byte("{"), nil))
 	assert.Len(t, chs[2], 0)
 
 	// Action 4 - invalid entity
 
 	e.err = errors.New("error")
 
-	disp.Dispatch(ctx, []byte("{}"))
+	assert.Error(t, disp.Dispatch(ctx, schema.Envelope{}, []byte("{}"), nil))
 	assert.Len(t, chs[2], 0)
 
 	// Action 5 - not my shard
 
 	e.err = nil
 	config.ShardID = 1
-	df = NewDispatcherFactory(config, shardIDGen)
+	df = NewDispatcherFactory(config, shardIDGen, sharding.NewMap(config.NumOfShards))
 	disp = df.Create(e, recvChs, logger.New())
 
-	disp.Dispatch(ctx, []byte("{}"))
+	disp.Dispatch(ctx, schema.Envelope{}, []byte("{}"), nil)
 	assert.Len(t, chs[2], 0)
 }
+
+// numOfShardsIDGenerator returns shard ID depending on the number of shards
+type numOfShardsIDGenerator map[uint64]sharding.ID
+
+func (g numOfShardsIDGenerator) Generate(seed []byte, counts ...uint64) []sharding.ID {
+	ids := make([]sharding.ID, 0, len(counts))
+	for _, c := range counts {
+		ids = append(ids, g[c])
+	}
+	return ids
+}
+
+func TestDispatcherDuringResharding(t *testing.T) {
+	ctx := context.Background()
+
+	config := infra.Config{
+		ShardID:          4,
+		NumOfShards:      5,
+		NumOfLocalShards: 3,
+	}
+	shardMap := sharding.NewMap(config.NumOfShards)
+
+	// Entity belongs to shard 2 now and to shard 4 after resharding, it goes to local shard 1
+	shardIDGen := numOfShardsIDGenerator{5: 2, 6: 4, 3: 1}
+
+	chs := make([]chan interface{}, 0, config.NumOfLocalShards)
+	recvChs := make([]chan<- interface{}, 0, config.NumOfLocalShards)
+	for i := uint64(0); i < config.NumOfLocalShards; i++ {
+		ch := make(chan interface{}, 1)
+		chs = append(chs, ch)
+		recvChs = append(recvChs, ch)
+	}
+
+	disp := NewDispatcherFactory(config, shardIDGen, shardMap).Create(&entity{}, recvChs, logger.New())
+
+	disp.Dispatch(ctx, schema.Envelope{}, []byte("{}"), nil)
+	assert.Len(t, chs[1], 0)
+
+	shardMap.Prepare(1, 6)
+	disp.Dispatch(ctx, schema.Envelope{}, []byte("{}"), nil)
+	require.Len(t, chs[1], 1)
+	<-chs[1]
+
+	shardMap.Commit()
+	disp.Dispatch(ctx, schema.Envelope{}, []byte("{}"), nil)
+	require.Len(t, chs[1], 1)
+	<-chs[1]
+
+	shardMap.Prepare(2, 5)
+	shardIDGen[6] = 0
+	disp.Dispatch(ctx, schema.Envelope{}, []byte("{}"), nil)
+	assert.Len(t, chs[1], 0)
+}
+
+type broadcastEntity struct {
+	entity
+}
+
+func (e *broadcastEntity) Broadcast() {}
+
+func TestBroadcastEntityIsDeliveredToAllChannels(t *testing.T) {
+	ctx := context.Background()
+
+	config := infra.Config{
+		ShardID:          3,
+		NumOfShards:      5,
+		NumOfLocalShards: 3,
+	}
+
+	chs := make([]chan interface{}, 0, config.NumOfLocalShards)
+	recvChs := make([]chan<- interface{}, 0, config.NumOfLocalShards)
+	for i := uint64(0); i < config.NumOfLocalShards; i++ {
+		ch := make(chan interface{}, 1)
+		chs = append(chs, ch)
+		recvChs = append(recvChs, ch)
+	}
+
+	shardIDGen := &deterministicShardIDGenerator{
+		ids: []sharding.ID{1, 1},
+	}
+	disp := NewDispatcherFactory(config, shardIDGen, sharding.NewMap(config.NumOfShards)).Create(&broadcastEntity{}, recvChs, logger.New())
+
+	disp.Dispatch(ctx, schema.Envelope{}, []byte("{}"), nil)
+	for _, ch := range chs {
+		assert.Len(t, ch, 1)
+	}
+}
+
+func TestBroadcastEntityIsAcknowledgedByAllChannels(t *testing.T) {
+	ctx := context.Background()
+
+	config := infra.Config{
+		ShardID:          3,
+		NumOfShards:      5,
+		NumOfLocalShards: 3,
+	}
+
+	chs := make([]chan interface{}, 0, config.NumOfLocalShards)
+	recvChs := make([]chan<- interface{}, 0, config.NumOfLocalShards)
+	for i := uint64(0); i < config.NumOfLocalShards; i++ {
+		ch := make(chan interface{}, 1)
+		chs = append(chs, ch)
+		recvChs = append(recvChs, ch)
+	}
+
+	shardIDGen := &deterministicShardIDGenerator{
+		ids: []sharding.ID{1, 1},
+	}
+	disp := NewDispatcherFactory(config, shardIDGen, sharding.NewMap(config.NumOfShards)).Create(&broadcastEntity{}, recvChs, logger.New())
+
+	var acked int
+	require.NoError(t, disp.Dispatch(ctx, schema.Envelope{}, []byte("{}"), func() { acked++ }))
+	for _, ch := range chs {
+		assert.Equal(t, 0, acked)
+		(<-ch).(Delivery).Ack()
+	}
+	assert.Equal(t, 1, acked)
+}
+
+func TestRouterReceivesEntitiesOfAllShards(t *testing.T) {
+	ctx := context.Background()
+
+	config := infra.Config{
+		ShardID:          3,
+		NumOfShards:      5,
+		NumOfLocalShards: 1,
+		Router:           true,
+	}
+
+	ch := make(chan interface{}, 1)
+	shardIDGen := &deterministicShardIDGenerator{
+		ids: []sharding.ID{1, 0},
+	}
+	disp := NewDispatcherFactory(config, shardIDGen, sharding.NewMap(config.NumOfShards)).Create(&entity{}, []chan<- interface{}{ch}, logger.New())
+
+	disp.Dispatch(ctx, schema.Envelope{}, []byte("{}"), nil)
+	assert.Len(t, ch, 1)
+}
+
+func TestEntityIsDecodedUsingCodecOfContentType(t *testing.T) {
+	ctx := context.Background()
+
+	config := infra.Config{
+		ShardID:          0,
+		NumOfShards:      1,
+		NumOfLocalShards: 1,
+	}
+
+	ch := make(chan interface{}, 1)
+	shardIDGen := &deterministicShardIDGenerator{
+		ids: []sharding.ID{0, 0},
+	}
+	disp := NewDispatcherFactory(config, shardIDGen, sharding.NewMap(config.NumOfShards)).Create(&jsEntity{}, []chan<- interface{}{ch}, logger.New())
+
+	c := codec.NewMsgPackCodec()
+	data, err := c.Encode(jsEntity{Value: "value"})
+	require.NoError(t, err)
+
+	disp.Dispatch(ctx, schema.Envelope{ContentType: c.ContentType()}, data, nil)
+	require.Len(t, ch, 1)
+	assert.Equal(t, jsEntity{Value: "value"}, <-ch)
+
+	// Message of unknown content type is rejected
+	assert.Error(t, disp.Dispatch(ctx, schema.Envelope{ContentType: "text/plain"}, data, nil))
+	assert.Len(t, ch, 0)
+}
@@ -0,0 +1,227 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/ridge/parallel"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"go.uber.org/zap"
+)
+
+// NewJetStreamConnection creates new NATS connection receiving messages from JetStream durable consumers.
+// Messages are acknowledged once they are applied by local shard so those which were received but not applied
+// before node terminated are redelivered after restart.
+func NewJetStreamConnection(config infra.Config, dispatcherF DispatcherFactory) Connection {
+	return &jetStreamConnection{
+		natsConnection: newNATSConnection(config, dispatcherF),
+	}
+}
+
+// jetStreamConnection is NATS JetStream-specific implementation of Connection interface
+type jetStreamConnection struct {
+	*natsConnection
+}
+
+// Run is a task which maintains and closes connection, messages which have to be confirmed are published to JetStream
+// so they are confirmed by PubAck
+func (conn *jetStreamConnection) Run(publishCh <-chan interface{}) parallel.Task {
+	return conn.run(publishCh, func() (confirmedPublishFunc, error) {
+		js, err := conn.nc.JetStream()
+		if err != nil {
+			return nil, fmt.Errorf("creating JetStream context failed: %w", err)
+		}
+
+		// Function is called by subscriptions publishing dead letters too, dead-letter stream is created on start
+		var mu sync.Mutex
+		streams := map[string]bool{conn.config.DeadLetterSubject: true}
+		return func(m *nats.Msg, id string, confirm func(err error)) {
+			mu.Lock()
+			if !streams[m.Subject] {
+				if err := ensureStream(js, m.Subject, conn.config.JetStreamMaxAge); err != nil {
+					mu.Unlock()
+					confirm(err)
+					return
+				}
+				streams[m.Subject] = true
+			}
+			mu.Unlock()
+
+			// ID is used by JetStream to discard duplicates if message is retried
+			future, err := js.PublishMsgAsync(m, nats.MsgId(id))
+			if err != nil {
+				confirm(err)
+				return
+			}
+			go func() {
+				timer := time.NewTimer(conn.opts.Timeout)
+				defer timer.Stop()
+
+				select {
+				case <-future.Ok():
+					confirm(nil)
+				case err := <-future.Err():
+					confirm(err)
+				case <-timer.C:
+					confirm(nats.ErrTimeout)
+				}
+			}()
+		}, nil
+	})
+}
+
+// Subscribe returns task subscribing to the durable consumer of type-specific stream, receiving messages from there and distributing them between receiving channels
+func (conn *jetStreamConnection) Subscribe(ctx context.Context, templatePtr Entity, recvChs []chan<- interface{}) parallel.Task {
+	if _, ok := templatePtr.(RequestEntity); ok {
+		// Requests are not stored in streams, requester waits for the reply and sends request again if needed
+		return conn.natsConnection.Subscribe(ctx, templatePtr, recvChs)
+	}
+	return func(ctx context.Context) error {
+		if err := waitReady(ctx, conn.ready); err != nil {
+			return err
+		}
+
+		return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+			subject := conn.subjectForTemplate(templatePtr)
+			stream, _ := streamForSubject(subject)
+			group := conn.queueGroup(templatePtr)
+			consumer := fmt.Sprintf("shard-%d", conn.config.ShardID)
+			if conn.config.LeaderElection {
+				// Each replica applies all the messages of the shard to keep its state warm, so it needs its own consumer
+				consumer = fmt.Sprintf("shard-%d-replica-%s", conn.config.ShardID, conn.config.ReplicaID)
+			}
+			if conn.config.Router {
+				consumer = "router"
+				if conn.config.QueueGroup != "" && group == "" {
+					// Each router of the group receives all the entities which are not split between them
+					consumer = fmt.Sprintf("router-%s", conn.config.ReplicaID)
+				}
+			}
+
+			log := logger.Get(ctx).With(zap.String("stream", stream), zap.String("consumer", consumer))
+			log.Info("Subscribing to stream")
+
+			js, err := conn.nc.JetStream()
+			if err != nil {
+				return fmt.Errorf("creating JetStream context failed: %w", err)
+			}
+			if err := ensureConsumer(js, subject, consumer, group, conn.config.JetStreamAckWait, conn.config.JetStreamMaxAge); err != nil {
+				return err
+			}
+
+			dispatcher := conn.dispatcherF.Create(templatePtr, recvChs, log)
+
+			msgCh := make(chan *nats.Msg, subscriptionBufferSize)
+			// Consumer is bound, not created by the subscription, so it is not deleted when subscription is drained
+			var sub *nats.Subscription
+			if group != "" {
+				log.Info("Joining queue group", zap.String("queueGroup", group))
+				sub, err = js.ChanQueueSubscribe(subject, group, msgCh, nats.Bind(stream, consumer), nats.ManualAck())
+			} else {
+				sub, err = js.ChanSubscribe(subject, msgCh, nats.Bind(stream, consumer), nats.ManualAck())
+			}
+			if err != nil {
+				return fmt.Errorf("subscription failed: %w", err)
+			}
+
+			consume(spawn, sub, msgCh, func(ctx context.Context, m *nats.Msg) {
+				ack := func() {
+					// If ack is lost message is redelivered, it is fine because applying it again doesn't change the state
+					if err := m.Ack(); err != nil {
+						log.Warn("Acknowledging message failed", zap.Error(err))
+					}
+				}
+
+				envelope := envelopeFromHeader(m.Header)
+				if envelope.MessageID == "" {
+					// Message published without envelope is identified by its position in the stream,
+					// so it gets the same ID when it is redelivered
+					if meta, err := m.Metadata(); err == nil {
+						envelope.MessageID = fmt.Sprintf("%s-%d", meta.Stream, meta.Sequence.Stream)
+					}
+				}
+				if err := dispatcher.Dispatch(ctx, envelope, m.Data, ack); err != nil {
+					// Rejected message is acknowledged once dead letter is published, otherwise it is redelivered
+					if err := conn.reject(log, m, envelope, err); err == nil {
+						ack()
+					}
+				}
+			})
+
+			log.Info("Subscribed to stream")
+			return nil
+		})
+	}
+}
+
+// streamForSubject returns name of the stream storing messages published to the subject and subjects captured by it.
+// Messages published to subjects of shards are stored in separate stream, one per topic.
+func streamForSubject(subject string) (string, string) {
+	if i := strings.Index(subject, "."); i >= 0 {
+		topic := subject[:i]
+		return topic + "Shards", topic + ".*"
+	}
+	return subject, subject
+}
+
+// ensureStream creates stream capturing the subject if it doesn't exist. Messages older than maxAge are removed
+// from the stream, limit of the existing stream is updated if it is different.
+func ensureStream(js nats.JetStreamContext, subject string, maxAge time.Duration) error {
+	stream, subjects := streamForSubject(subject)
+	info, err := js.StreamInfo(stream)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		if _, err := js.AddStream(&nats.StreamConfig{
+			Name:     stream,
+			Subjects: []string{subjects},
+			MaxAge:   maxAge,
+		}); err != nil {
+			return fmt.Errorf("creating stream failed: %w", err)
+		}
+		return nil
+	case err != nil:
+		return fmt.Errorf("fetching stream info failed: %w", err)
+	}
+	return updateMaxAge(js, info.Config, maxAge)
+}
+
+// updateMaxAge updates the limit of message age in the stream if it is different
+func updateMaxAge(js nats.JetStreamContext, config nats.StreamConfig, maxAge time.Duration) error {
+	if config.MaxAge == maxAge {
+		return nil
+	}
+	config.MaxAge = maxAge
+	if _, err := js.UpdateStream(&config); err != nil {
+		return fmt.Errorf("updating stream failed: %w", err)
+	}
+	return nil
+}
+
+// ensureConsumer creates stream and durable consumer receiving messages published to the subject if they don't exist.
+// If group is not empty, messages are split between subscribers of that queue group.
+func ensureConsumer(js nats.JetStreamContext, subject string, consumer string, group string, ackWait, maxAge time.Duration) error {
+	if err := ensureStream(js, subject, maxAge); err != nil {
+		return err
+	}
+
+	// If consumer exists and its config is the same, server returns the existing one
+	stream, _ := streamForSubject(subject)
+	if _, err := js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:        consumer,
+		DeliverSubject: fmt.Sprintf("deliver.%s.%s", stream, consumer),
+		DeliverGroup:   group,
+		DeliverPolicy:  nats.DeliverAllPolicy,
+		AckPolicy:      nats.AckExplicitPolicy,
+		AckWait:        ackWait,
+		FilterSubject:  subject,
+	}); err != nil {
+		return fmt.Errorf("creating consumer failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/ridge/parallel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
+)
+
+type jsEntity struct {
+	Value string
+}
+
+func (e *jsEntity) ShardSeed() []byte {
+	return nil
+}
+
+func (e jsEntity) Validate() error {
+	return nil
+}
+
+type jsRoutableEntity struct {
+	jsEntity
+}
+
+func (e jsRoutableEntity) Routable() {}
+
+func runJetStreamServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	require.True(t, s.ReadyForConnections(10*time.Second))
+	return s
+}
+
+// runJetStreamConnection runs JetStream connection until cancel returned by it is called
+func runJetStreamConnection(ctx context.Context, config infra.Config, templatePtr Entity, recvCh chan<- interface{}) (context.CancelFunc, <-chan error) {
+	return runConnection(ctx, NewJetStreamConnection, config, templatePtr, recvCh)
+}
+
+// runConnection runs connection until cancel returned by it is called
+func runConnection(ctx context.Context, newConnection func(config infra.Config, dispatcherF DispatcherFactory) Connection,
+	config infra.Config, templatePtr Entity, recvCh chan<- interface{}) (context.CancelFunc, <-chan error) {
+	ctx, cancel := context.WithCancel(ctx)
+	conn := newConnection(config, NewDispatcherFactory(config, &deterministicShardIDGenerator{ids: []sharding.ID{0, 0}}, sharding.NewMap(config.NumOfShards)))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+			publishCh := make(chan interface{})
+			spawn("bus", parallel.Fail, conn.Run(publishCh))
+			spawn("subscription", parallel.Fail, conn.Subscribe(ctx, templatePtr, []chan<- interface{}{recvCh}))
+			spawn("closer", parallel.Fail, func(ctx context.Context) error {
+				<-ctx.Done()
+				close(publishCh)
+				return ctx.Err()
+			})
+			return nil
+		})
+	}()
+	return cancel, errCh
+}
+
+func receive(t *testing.T, ch <-chan interface{}) Delivery {
+	select {
+	case msg := <-ch:
+		d, ok := msg.(Delivery)
+		require.True(t, ok)
+		return d
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "message not received")
+		return Delivery{}
+	}
+}
+
+func TestJetStreamRedeliversNotAcknowledgedMessages(t *testing.T) {
+	ctx := logger.WithLogger(context.Background(), logger.New())
+	s := runJetStreamServer(t)
+
+	config := infra.Config{
+		NATSAddresses:    []string{s.ClientURL()},
+		NumOfShards:      1,
+		NumOfLocalShards: 1,
+		JetStreamAckWait: time.Second,
+	}
+
+	recvCh := make(chan interface{})
+	cancel, errCh := runJetStreamConnection(ctx, config, &jsEntity{}, recvCh)
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	// Stream is created by subscription
+	require.Eventually(t, func() bool {
+		_, err := js.ConsumerInfo("jsEntity", "shard-0")
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	_, err = js.Publish("jsEntity", []byte(`{"Value":"acked"}`))
+	require.NoError(t, err)
+	_, err = js.Publish("jsEntity", []byte(`{"Value":"not-acked"}`))
+	require.NoError(t, err)
+
+	d := receive(t, recvCh)
+	assert.Equal(t, jsEntity{Value: "acked"}, d.Entity)
+	d.Ack()
+
+	d = receive(t, recvCh)
+	assert.Equal(t, jsEntity{Value: "not-acked"}, d.Entity)
+	// Message published without envelope is identified by its position in the stream
+	assert.Equal(t, "jsEntity-2", d.MessageID)
+
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+
+	// After restart only the message which wasn't acknowledged is delivered again
+
+	cancel, errCh = runJetStreamConnection(ctx, config, &jsEntity{}, recvCh)
+
+	d = receive(t, recvCh)
+	assert.Equal(t, jsEntity{Value: "not-acked"}, d.Entity)
+	assert.Equal(t, "jsEntity-2", d.MessageID)
+	d.Ack()
+
+	select {
+	case msg := <-recvCh:
+		assert.Fail(t, "unexpected message received", "%v", msg)
+	case <-time.After(2 * config.JetStreamAckWait):
+	}
+
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+}
+
+func TestShardSubjectsAreStoredInSeparateStream(t *testing.T) {
+	stream, subjects := streamForSubject("jsEntity")
+	assert.Equal(t, "jsEntity", stream)
+	assert.Equal(t, "jsEntity", subjects)
+
+	stream, subjects = streamForSubject("jsEntity.3")
+	assert.Equal(t, "jsEntityShards", stream)
+	assert.Equal(t, "jsEntity.*", subjects)
+}
+
+func TestJetStreamSplitsMessagesBetweenRoutersOfQueueGroup(t *testing.T) {
+	const numOfMsgs = 10
+
+	ctx := logger.WithLogger(context.Background(), logger.New())
+	s := runJetStreamServer(t)
+
+	config := infra.Config{
+		NATSAddresses:    []string{s.ClientURL()},
+		NumOfShards:      1,
+		NumOfLocalShards: 1,
+		JetStreamAckWait: time.Second,
+		Router:           true,
+		QueueGroup:       "routers",
+	}
+
+	recvCh := make(chan interface{})
+	cancel1, errCh1 := runJetStreamConnection(ctx, config, &jsRoutableEntity{}, recvCh)
+	cancel2, errCh2 := runJetStreamConnection(ctx, config, &jsRoutableEntity{}, recvCh)
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	// Both routers are bound to the same consumer
+	require.Eventually(t, func() bool {
+		info, err := js.ConsumerInfo("jsRoutableEntity", "router")
+		return err == nil && info.PushBound
+	}, 10*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < numOfMsgs; i++ {
+		_, err = js.Publish("jsRoutableEntity", []byte(fmt.Sprintf(`{"Value":"%d"}`, i)))
+		require.NoError(t, err)
+	}
+
+	// Each message is received by one router only
+	received := map[string]int{}
+	for i := 0; i < numOfMsgs; i++ {
+		d := receive(t, recvCh)
+		received[d.Entity.(jsRoutableEntity).Value]++
+		d.Ack()
+	}
+	assert.Len(t, received, numOfMsgs)
+
+	select {
+	case msg := <-recvCh:
+		assert.Fail(t, "unexpected message received", "%v", msg)
+	case <-time.After(2 * config.JetStreamAckWait):
+	}
+
+	cancel1()
+	cancel2()
+	assert.ErrorIs(t, <-errCh1, context.Canceled)
+	assert.ErrorIs(t, <-errCh2, context.Canceled)
+}
+
+func TestEachReplicaReceivesAllMessagesOfShard(t *testing.T) {
+	const numOfMsgs = 10
+
+	ctx := logger.WithLogger(context.Background(), logger.New())
+	s := runJetStreamServer(t)
+
+	config := infra.Config{
+		NATSAddresses:    []string{s.ClientURL()},
+		NumOfShards:      1,
+		NumOfLocalShards: 1,
+		JetStream:        true,
+		JetStreamAckWait: time.Second,
+		LeaderElection:   true,
+		LeaderLease:      time.Second,
+	}
+
+	config1 := config
+	config1.ReplicaID = "replica1"
+	recvCh1 := make(chan interface{})
+	cancel1, errCh1 := runJetStreamConnection(ctx, config1, &jsEntity{}, recvCh1)
+
+	config2 := config
+	config2.ReplicaID = "replica2"
+	recvCh2 := make(chan interface{})
+	cancel2, errCh2 := runJetStreamConnection(ctx, config2, &jsEntity{}, recvCh2)
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	// Each replica is bound to its own consumer
+	for _, consumer := range []string{"shard-0-replica-replica1", "shard-0-replica-replica2"} {
+		consumer := consumer
+		require.Eventually(t, func() bool {
+			info, err := js.ConsumerInfo("jsEntity", consumer)
+			return err == nil && info.PushBound
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+
+	for i := 0; i < numOfMsgs; i++ {
+		_, err = js.Publish("jsEntity", []byte(fmt.Sprintf(`{"Value":"%d"}`, i)))
+		require.NoError(t, err)
+	}
+
+	for _, recvCh := range []chan interface{}{recvCh1, recvCh2} {
+		received := map[string]bool{}
+		for i := 0; i < numOfMsgs; i++ {
+			d := receive(t, recvCh)
+			received[d.Entity.(jsEntity).Value] = true
+			d.Ack()
+		}
+		assert.Len(t, received, numOfMsgs)
+	}
+
+	cancel1()
+	cancel2()
+	assert.ErrorIs(t, <-errCh1, context.Canceled)
+	assert.ErrorIs(t, <-errCh2, context.Canceled)
+}
+
+func TestSlowConfirmationDoesNotBlockOtherMessages(t *testing.T) {
+	const numOfMsgs = 10
+
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+	s := runJetStreamServer(t)
+
+	config := infra.Config{
+		NATSAddresses:   []string{s.ClientURL()},
+		JetStream:       true,
+		JetStreamMaxAge: time.Hour,
+	}
+	conn := NewJetStreamConnection(config, NewDispatcherFactory(config, &deterministicShardIDGenerator{}, sharding.NewMap(1)))
+
+	publishCh := make(chan interface{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.Run(publishCh)(ctx)
+	}()
+
+	// Handler of the first confirmation waits until all the other messages are confirmed
+	release := make(chan struct{})
+	confirmed := make(chan error, numOfMsgs)
+	for i := 0; i < numOfMsgs; i++ {
+		i := i
+		out := Outgoing{
+			ID:  fmt.Sprintf("message-%d", i),
+			Msg: &jsEntity{Value: fmt.Sprintf("%d", i)},
+			Confirm: func(err error) {
+				if i == 0 {
+					<-release
+				}
+				confirmed <- err
+			},
+		}
+		select {
+		case publishCh <- out:
+		case <-time.After(10 * time.Second):
+			require.Fail(t, "message not accepted")
+		}
+	}
+	for i := 1; i < numOfMsgs; i++ {
+		select {
+		case err := <-confirmed:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			require.Fail(t, "message not confirmed")
+		}
+	}
+	close(release)
+	require.NoError(t, <-confirmed)
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	// Streams created by the node are limited
+	info, err := js.StreamInfo("jsEntity")
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, info.Config.MaxAge)
+	assert.EqualValues(t, numOfMsgs, info.State.Msgs)
+
+	close(publishCh)
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+}
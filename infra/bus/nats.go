@@ -2,23 +2,51 @@ package bus
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 	"github.com/ridge/must"
 	"github.com/ridge/parallel"
 	"github.com/wojciech-malota-wojcik/logger"
 	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/codec"
+	"github.com/wojciech-malota-wojcik/netdata/infra/schema"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
 	"github.com/wojciech-malota-wojcik/netdata/lib/retry"
 	"go.uber.org/zap"
 )
 
+// subscriptionBufferSize is the number of messages buffered by subscription, NATS drops messages which don't fit
+// into the buffer if they arrive faster than they are dispatched
+const subscriptionBufferSize = 1000
+
+// Headers of the message envelope, content type is stored in codec.HeaderContentType
+const (
+	// headerSchemaVersion is the name of header carrying schema version of the message
+	headerSchemaVersion = "Schema-Version"
+
+	// headerMessageID is the name of header carrying unique ID of the message, JetStream uses it to discard duplicates
+	headerMessageID = nats.MsgIdHdr
+
+	// headerProducer is the name of header carrying ID of the node which produced the message
+	headerProducer = "Producer"
+
+	// headerTimestamp is the name of header carrying time when message was produced
+	headerTimestamp = "Timestamp"
+)
+
 // NewNATSConnection creates new NATS connection
 func NewNATSConnection(config infra.Config, dispatcherF DispatcherFactory) Connection {
+	return newNATSConnection(config, dispatcherF)
+}
+
+func newNATSConnection(config infra.Config, dispatcherF DispatcherFactory) *natsConnection {
 	opts := nats.GetDefaultOptions()
 	opts.Url = strings.Join(config.NATSAddresses, ",")
 	opts.Name = "Netdata"
@@ -27,8 +55,11 @@ func NewNATSConnection(config infra.Config, dispatcherF DispatcherFactory) Conne
 	opts.MaxPingsOut = 3
 	opts.NoEcho = true
 	opts.Verbose = config.VerboseLogging
+	c, err := codec.New(config.Codec)
+	must.OK(err)
 	return &natsConnection{
 		config:      config,
+		codec:       c,
 		dispatcherF: dispatcherF,
 		opts:        opts,
 		ready:       make(chan struct{}),
@@ -38,14 +69,41 @@ func NewNATSConnection(config infra.Config, dispatcherF DispatcherFactory) Conne
 // natsConnection is NATS-specific implementation of Connection interface
 type natsConnection struct {
 	config      infra.Config
+	codec       codec.Codec
 	dispatcherF DispatcherFactory
 	opts        nats.Options
 	nc          *nats.Conn
 	ready       chan struct{}
+
+	// publishConfirmed is set before connection becomes ready, it is used to publish dead letters
+	publishConfirmed confirmedPublishFunc
 }
 
+// confirmedPublishFunc publishes message and calls confirm once broker confirms it or publishing fails, id is the unique
+// ID of the message. It doesn't wait for the confirmation, so one slow confirmation doesn't hold up other messages.
+type confirmedPublishFunc func(m *nats.Msg, id string, confirm func(err error))
+
 // Run is a task which maintains and closes connection
 func (conn *natsConnection) Run(publishCh <-chan interface{}) parallel.Task {
+	return conn.run(publishCh, func() (confirmedPublishFunc, error) {
+		return conn.publishFlushed, nil
+	})
+}
+
+// publishFlushed publishes message and flushes connection so message is known to be received by the server
+func (conn *natsConnection) publishFlushed(m *nats.Msg, id string, confirm func(err error)) {
+	if err := conn.nc.PublishMsg(m); err != nil {
+		confirm(err)
+		return
+	}
+	go func() {
+		confirm(conn.nc.FlushTimeout(conn.opts.Timeout))
+	}()
+}
+
+// run is a task which maintains and closes connection, newConfirmedPublish is called once connection is established
+// to create function used to publish messages which have to be confirmed
+func (conn *natsConnection) run(publishCh <-chan interface{}, newConfirmedPublish func() (confirmedPublishFunc, error)) parallel.Task {
 	return func(ctx context.Context) error {
 		log := logger.Get(ctx).With(zap.String("servers", conn.opts.Url))
 		log.Info("Connecting to NATS")
@@ -61,19 +119,49 @@ func (conn *natsConnection) Run(publishCh <-chan interface{}) parallel.Task {
 		defer conn.nc.Close()
 
 		log.Info("Connected to NATS")
+
+		// Dead letters are stored in JetStream no matter how messages are received, otherwise they would be lost
+		if conn.config.DeadLetterSubject != "" {
+			js, err := conn.nc.JetStream()
+			if err != nil {
+				return fmt.Errorf("creating JetStream context failed: %w", err)
+			}
+			if err := ensureDeadLetterStream(js, conn.config.DeadLetterSubject, conn.config.JetStreamMaxAge); err != nil {
+				return fmt.Errorf("preparing dead-letter stream failed, JetStream has to be enabled on the server: %w", err)
+			}
+		}
+
+		publishConfirmed, err := newConfirmedPublish()
+		if err != nil {
+			return err
+		}
+		conn.publishConfirmed = publishConfirmed
 		close(conn.ready)
 
 		defer log.Info("Terminating NATS connection")
 
+		// Connection is closed once all the published messages are confirmed
+		var pending sync.WaitGroup
+		defer pending.Wait()
+
 		log.Info("Starting outgoing loop")
 
 		for msg := range publishCh {
 			log.Debug("Sending message", zap.Any("msg", msg))
 
+			if out, ok := msg.(Outgoing); ok {
+				pending.Add(1)
+				publishConfirmed(conn.newMsg(out.Msg, out.ID), out.ID, func(err error) {
+					defer pending.Done()
+					out.Confirm(err)
+				})
+				continue
+			}
+
 			// Publish method of NATS doesn't send message over the network, it only buffers it.
 			// If it fails it means there is a serious problem on the server (no more memory etc.)
 			// So I decided it's better to panic in this case rather than hide the real issue in retry loop
-			if err := conn.nc.Publish(topicForValue(msg), must.Bytes(json.Marshal(msg))); err != nil {
+			if err := conn.nc.PublishMsg(conn.newMsg(msg, uuid.New().String())); err != nil {
 				panic(err)
 			}
 		}
@@ -90,33 +178,32 @@ func (conn *natsConnection) Subscribe(ctx context.Context, templatePtr Entity, r
 		}
 
 		return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
-			topic := topicForValue(templatePtr)
+			topic := conn.subjectForTemplate(templatePtr)
 
 			log := logger.Get(ctx).With(zap.String("topic", topic))
 			log.Info("Subscribing to topic")
 
 			dispatcher := conn.dispatcherF.Create(templatePtr, recvChs, log)
 
-			msgCh := make(chan *nats.Msg)
-			sub, err := conn.nc.ChanSubscribe(topic, msgCh)
+			msgCh := make(chan *nats.Msg, subscriptionBufferSize)
+			var sub *nats.Subscription
+			var err error
+			if group := conn.queueGroup(templatePtr); group != "" {
+				log.Info("Joining queue group", zap.String("queueGroup", group))
+				sub, err = conn.nc.ChanQueueSubscribe(topic, group, msgCh)
+			} else {
+				sub, err = conn.nc.ChanSubscribe(topic, msgCh)
+			}
 			if err != nil {
 				return fmt.Errorf("subscription failed: %w", err)
 			}
 
-			spawn("handler", parallel.Fail, func(ctx context.Context) error {
-				for m := range msgCh {
-					dispatcher.Dispatch(ctx, m.Data)
+			consume(spawn, sub, msgCh, func(ctx context.Context, m *nats.Msg) {
+				envelope := envelopeFromHeader(m.Header)
+				envelope.Reply = m.Reply
+				if err := dispatcher.Dispatch(ctx, envelope, m.Data, nil); err != nil {
+					_ = conn.reject(log, m, envelope, err)
 				}
-				return ctx.Err()
-			})
-			spawn("closer", parallel.Fail, func(ctx context.Context) error {
-				defer close(msgCh)
-
-				<-ctx.Done()
-				if err := sub.Drain(); err != nil {
-					return err
-				}
-				return ctx.Err()
 			})
 
 			log.Info("Subscribed to topic")
@@ -125,7 +212,153 @@ func (conn *natsConnection) Subscribe(ctx context.Context, templatePtr Entity, r
 	}
 }
 
+// consume spawns tasks passing messages received by subscription to the handler and draining subscription on exit
+func consume(spawn parallel.SpawnFn, sub *nats.Subscription, msgCh chan *nats.Msg, handler func(ctx context.Context, m *nats.Msg)) {
+	spawn("handler", parallel.Fail, func(ctx context.Context) error {
+		for m := range msgCh {
+			handler(ctx, m)
+		}
+		return ctx.Err()
+	})
+	spawn("closer", parallel.Fail, func(ctx context.Context) error {
+		defer close(msgCh)
+
+		<-ctx.Done()
+		if err := sub.Drain(); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+}
+
+// reject publishes message rejected by dispatcher to the dead-letter subject. Error is returned if dead letter
+// hasn't been published.
+func (conn *natsConnection) reject(log *zap.Logger, m *nats.Msg, envelope schema.Envelope, rejection error) error {
+	log.Error("Message rejected", zap.Error(rejection), zap.String("messageID", envelope.MessageID),
+		zap.String("producer", envelope.Producer))
+
+	if conn.config.DeadLetterSubject == "" {
+		return nil
+	}
+
+	// ID of the rejected message is reused, so dead letter of redelivered message is discarded by JetStream
+	id := envelope.MessageID
+	if id == "" {
+		id = uuid.New().String()
+	}
+	dl := conn.newMsg(&DeadLetter{
+		Topic:      m.Subject,
+		Envelope:   envelope,
+		Data:       m.Data,
+		Error:      rejection.Error(),
+		RejectedAt: time.Now().UTC(),
+	}, id)
+	dl.Subject = conn.config.DeadLetterSubject
+
+	errCh := make(chan error, 1)
+	conn.publishConfirmed(dl, id, func(err error) {
+		errCh <- err
+	})
+	if err := <-errCh; err != nil {
+		log.Error("Publishing dead letter failed", zap.Error(err))
+		return fmt.Errorf("publishing dead letter failed: %w", err)
+	}
+	return nil
+}
+
+// subjectForTemplate returns subject to subscribe to, to receive entities of template's type. If shard subjects
+// are enabled, routable entities are received from the subject of the shard only.
+func (conn *natsConnection) subjectForTemplate(templatePtr Entity) string {
+	topic := topicForValue(templatePtr)
+	if _, ok := templatePtr.(RoutableEntity); ok && conn.config.ShardSubjects {
+		return shardSubject(topic, conn.config.ShardID)
+	}
+	return topic
+}
+
+// newMsg encodes message using configured codec and wraps it with the envelope, JSON is used if message
+// is not supported by the codec
+func (conn *natsConnection) newMsg(val interface{}, id string) *nats.Msg {
+	subject, msg := subjectForValue(val)
+	c, data, err := codec.Encode(conn.codec, msg)
+	must.OK(err)
+
+	m := nats.NewMsg(subject)
+	setEnvelope(m.Header, schema.Envelope{
+		ContentType:   c.ContentType(),
+		SchemaVersion: schema.VersionOf(msg),
+		MessageID:     id,
+		Producer:      conn.config.ReplicaID,
+		Timestamp:     time.Now().UTC(),
+	})
+	m.Data = data
+	return m
+}
+
+// setEnvelope stores envelope in the header of the message, empty fields are skipped
+func setEnvelope(header nats.Header, envelope schema.Envelope) {
+	if envelope.ContentType != "" {
+		header.Set(codec.HeaderContentType, envelope.ContentType)
+	}
+	if envelope.SchemaVersion != 0 {
+		header.Set(headerSchemaVersion, strconv.FormatUint(envelope.SchemaVersion, 10))
+	}
+	if envelope.MessageID != "" {
+		header.Set(headerMessageID, envelope.MessageID)
+	}
+	if envelope.Producer != "" {
+		header.Set(headerProducer, envelope.Producer)
+	}
+	if !envelope.Timestamp.IsZero() {
+		header.Set(headerTimestamp, envelope.Timestamp.Format(time.RFC3339Nano))
+	}
+}
+
+// envelopeFromHeader reads envelope of the message from its header. Messages published without envelope
+// have zero schema version.
+func envelopeFromHeader(header nats.Header) schema.Envelope {
+	envelope := schema.Envelope{
+		ContentType: header.Get(codec.HeaderContentType),
+		MessageID:   header.Get(headerMessageID),
+		Producer:    header.Get(headerProducer),
+	}
+	// Invalid values are ignored, they are not required to decode the message
+	envelope.SchemaVersion, _ = strconv.ParseUint(header.Get(headerSchemaVersion), 10, 64)
+	envelope.Timestamp, _ = time.Parse(time.RFC3339Nano, header.Get(headerTimestamp))
+	return envelope
+}
+
+// queueGroup returns queue group used to subscribe to entities of template's type. Messages are split between
+// subscribers of the same group. Only routers split routable entities, all the other entities are received
+// by all the subscribers.
+func (conn *natsConnection) queueGroup(templatePtr Entity) string {
+	if _, ok := templatePtr.(RoutableEntity); ok && conn.config.Router {
+		return conn.config.QueueGroup
+	}
+	return ""
+}
+
+// subjectForValue returns subject message is published to and the message to encode
+func subjectForValue(val interface{}) (string, interface{}) {
+	switch v := val.(type) {
+	case Routed:
+		return shardSubject(topicForValue(v.Msg), v.ShardID), v.Msg
+	case Reply:
+		return v.Subject, v.Msg
+	}
+	return topicForValue(val), val
+}
+
+// shardSubject returns subject where entities of the topic owned by the shard are published
+func shardSubject(topic string, shardID sharding.ID) string {
+	return fmt.Sprintf("%s.%d", topic, shardID)
+}
+
+// topicForValue returns topic of the message, it is taken from the name of the type if it is not defined explicitly
 func topicForValue(val interface{}) string {
+	if v, ok := val.(schema.Versioned); ok {
+		return v.Topic()
+	}
 	t := reflect.TypeOf(val)
 	if t.Kind() != reflect.Ptr {
 		panic(fmt.Errorf("type %T is not a pointer", val))
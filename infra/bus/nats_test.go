@@ -2,13 +2,67 @@ package bus
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/codec"
+	"github.com/wojciech-malota-wojcik/netdata/infra/schema"
 )
 
 type someEntity struct {
 }
 
+type versionedEntity struct {
+}
+
+func (e versionedEntity) Topic() string {
+	return "Versioned"
+}
+
+func (e versionedEntity) SchemaVersion() uint64 {
+	return 3
+}
+
 func TestTypeToTopic(t *testing.T) {
 	assert.Equal(t, "someEntity", topicForValue(&someEntity{}))
 }
+
+func TestExplicitTopic(t *testing.T) {
+	assert.Equal(t, "Versioned", topicForValue(&versionedEntity{}))
+}
+
+func TestRoutedMessageIsPublishedToShardSubject(t *testing.T) {
+	subject, msg := subjectForValue(Routed{ShardID: 3, Msg: &someEntity{}})
+	assert.Equal(t, "someEntity.3", subject)
+	assert.Equal(t, &someEntity{}, msg)
+
+	subject, msg = subjectForValue(&someEntity{})
+	assert.Equal(t, "someEntity", subject)
+	assert.Equal(t, &someEntity{}, msg)
+}
+
+func TestMessageIsWrappedWithEnvelope(t *testing.T) {
+	conn := newNATSConnection(infra.Config{ReplicaID: "replica"}, nil)
+
+	before := time.Now().UTC()
+	m := conn.newMsg(&versionedEntity{}, "id")
+	envelope := envelopeFromHeader(m.Header)
+
+	assert.Equal(t, "Versioned", m.Subject)
+	assert.Equal(t, codec.NewJSONCodec().ContentType(), envelope.ContentType)
+	assert.Equal(t, uint64(3), envelope.SchemaVersion)
+	assert.Equal(t, "id", envelope.MessageID)
+	assert.Equal(t, "replica", envelope.Producer)
+	assert.False(t, envelope.Timestamp.Before(before))
+}
+
+func TestMessageWithoutEnvelopeHasZeroVersion(t *testing.T) {
+	conn := newNATSConnection(infra.Config{}, nil)
+
+	m := conn.newMsg(&someEntity{}, "id")
+	assert.Equal(t, "1", m.Header.Get(headerSchemaVersion))
+
+	m.Header = nil
+	assert.Equal(t, schema.Envelope{}, envelopeFromHeader(m.Header))
+}
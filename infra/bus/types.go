@@ -2,8 +2,11 @@ package bus
 
 import (
 	"context"
+	"time"
 
 	"github.com/ridge/parallel"
+	"github.com/wojciech-malota-wojcik/netdata/infra/schema"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
 	"go.uber.org/zap"
 )
 
@@ -16,6 +19,31 @@ type Entity interface {
 	Validate() error
 }
 
+// BroadcastEntity is implemented by entities delivered to all the receiving channels no matter what the shard ID is
+type BroadcastEntity interface {
+	Entity
+
+	// Broadcast marks entity as delivered to all the shards
+	Broadcast()
+}
+
+// RoutableEntity is implemented by entities which router republishes to subjects of shards owning them
+type RoutableEntity interface {
+	Entity
+
+	// Routable marks entity as routed to shard subjects
+	Routable()
+}
+
+// RequestEntity is implemented by entities received using request/reply, they are always received from plain
+// subscriptions because JetStream doesn't keep reply subjects
+type RequestEntity interface {
+	Entity
+
+	// Request marks entity as a request expecting reply
+	Request()
+}
+
 // Connection is an interface of event broker client
 type Connection interface {
 	// Run is a task which maintains and closes connection
@@ -25,9 +53,88 @@ type Connection interface {
 	Subscribe(ctx context.Context, templatePtr Entity, recvChs []chan<- interface{}) parallel.Task
 }
 
+// AckFunc acknowledges that message has been processed and broker may forget it
+type AckFunc func()
+
+// Delivery is sent to local shard instead of bare entity if broker expects message to be acknowledged
+// once it is applied
+type Delivery struct {
+	// Entity is the received entity
+	Entity interface{}
+
+	// MessageID is the ID of the received message taken from its envelope
+	MessageID string
+
+	// Ack acknowledges the message
+	Ack AckFunc
+}
+
+// Request is sent to local shard instead of bare entity if requester expects reply
+type Request struct {
+	// Entity is the received entity
+	Entity interface{}
+
+	// Reply is the subject where reply is published
+	Reply string
+}
+
+// Reply is sent to publishing channel instead of bare message if message is a reply to the request
+type Reply struct {
+	// Subject is the reply subject of the request
+	Subject string
+
+	// Msg is the message to publish
+	Msg interface{}
+}
+
+// Outgoing is sent to publishing channel instead of bare message if sender has to know when broker confirms
+// that message has been published
+type Outgoing struct {
+	// ID is the unique ID of the message, broker may use it to discard duplicates
+	ID string
+
+	// Msg is the message to publish
+	Msg interface{}
+
+	// Confirm is called with nil once broker confirms the message or with an error if publishing failed.
+	// It may be called from another goroutine after next messages are published.
+	Confirm func(err error)
+}
+
+// Routed is sent to publishing channel instead of bare message if message has to be published to the subject of the shard
+// instead of the type-specific topic. It may be wrapped by Outgoing.
+type Routed struct {
+	// ShardID is the ID of the shard owning the message
+	ShardID sharding.ID
+
+	// Msg is the message to publish
+	Msg interface{}
+}
+
+// DeadLetter is published to the dead-letter subject if received message is rejected by dispatcher
+type DeadLetter struct {
+	// Topic is the subject message was received from
+	Topic string
+
+	// Envelope is the envelope of the rejected message
+	Envelope schema.Envelope
+
+	// Data is the raw content of the rejected message
+	Data []byte
+
+	// Error is the reason of rejection
+	Error string
+
+	// RejectedAt is the time when message was rejected
+	RejectedAt time.Time
+}
+
 // Dispatcher decodes, validates and sends message to local shard
 type Dispatcher interface {
-	Dispatch(ctx context.Context, msg []byte)
+	// Dispatch dispatches message described by the envelope, ack is nil if broker doesn't expect
+	// message to be acknowledged. Error is returned if message is rejected because it can't be decoded
+	// or is invalid, such message is not acknowledged.
+	Dispatch(ctx context.Context, envelope schema.Envelope, msg []byte, ack AckFunc) error
 }
 
 // DispatcherFactory creates dispatchers
@@ -0,0 +1,78 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// JSON is the name of JSON codec
+	JSON = "json"
+
+	// Protobuf is the name of Protobuf codec
+	Protobuf = "protobuf"
+
+	// MsgPack is the name of MessagePack codec
+	MsgPack = "msgpack"
+)
+
+// HeaderContentType is the name of message header carrying content type of the encoded message
+const HeaderContentType = "Content-Type"
+
+// ErrNotSupported is returned if message can't be encoded or decoded by the codec
+var ErrNotSupported = errors.New("message not supported by codec")
+
+// Codec encodes and decodes messages
+type Codec interface {
+	// ContentType returns the content type of messages encoded by the codec
+	ContentType() string
+
+	// Encode encodes message
+	Encode(msg interface{}) ([]byte, error)
+
+	// Decode decodes data into the message
+	Decode(data []byte, msgPtr interface{}) error
+}
+
+var codecs = []Codec{
+	NewJSONCodec(),
+	NewProtobufCodec(),
+	NewMsgPackCodec(),
+}
+
+// New returns codec of the given name, JSON is returned if name is empty
+func New(name string) (Codec, error) {
+	switch name {
+	case JSON, "":
+		return jsonCodec{}, nil
+	case Protobuf:
+		return protobufCodec{}, nil
+	case MsgPack:
+		return msgPackCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+}
+
+// ForContentType returns codec used to decode message of the content type, JSON is used if content type is empty
+func ForContentType(contentType string) (Codec, error) {
+	if contentType == "" {
+		return jsonCodec{}, nil
+	}
+	for _, c := range codecs {
+		if c.ContentType() == contentType {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown content type %q", contentType)
+}
+
+// Encode encodes message using the codec, JSON is used if message is not supported by the codec
+func Encode(c Codec, msg interface{}) (Codec, []byte, error) {
+	data, err := c.Encode(msg)
+	if errors.Is(err, ErrNotSupported) {
+		c = jsonCodec{}
+		data, err = c.Encode(msg)
+	}
+	return c, data, err
+}
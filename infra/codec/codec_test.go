@@ -0,0 +1,83 @@
+package codec
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+var changedAt = time.Date(2021, 10, 18, 12, 30, 15, 123, time.UTC)
+
+func TestCodecsEncodeAndDecodeMessages(t *testing.T) {
+	for _, name := range []string{JSON, Protobuf, MsgPack} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			c, err := New(name)
+			require.NoError(t, err)
+
+			c2, err := ForContentType(c.ContentType())
+			require.NoError(t, err)
+			assert.Equal(t, c, c2)
+
+			msg := wire.AlarmStatusChanged{
+				ShardedEntity: wire.ShardedEntity{UserID: "user"},
+				AlarmID:       "alarm",
+				Status:        wire.StatusCritical,
+				ChangedAt:     changedAt,
+			}
+			data, err := c.Encode(msg)
+			require.NoError(t, err)
+
+			var decoded wire.AlarmStatusChanged
+			require.NoError(t, c.Decode(data, &decoded))
+			assert.Equal(t, msg.UserID, decoded.UserID)
+			assert.Equal(t, msg.AlarmID, decoded.AlarmID)
+			assert.Equal(t, msg.Status, decoded.Status)
+			assert.True(t, msg.ChangedAt.Equal(decoded.ChangedAt))
+
+			digest := wire.AlarmDigest{
+				UserID: "user",
+				ActiveAlarms: []wire.Alarm{
+					{AlarmID: "alarm1", Status: wire.StatusWarning, LatestChangedAt: changedAt},
+					{AlarmID: "alarm2", Status: wire.StatusCritical, LatestChangedAt: changedAt.Add(time.Second)},
+				},
+			}
+			data, err = c.Encode(digest)
+			require.NoError(t, err)
+
+			var decodedDigest wire.AlarmDigest
+			require.NoError(t, c.Decode(data, &decodedDigest))
+			require.Len(t, decodedDigest.ActiveAlarms, 2)
+			for i, alarm := range digest.ActiveAlarms {
+				assert.Equal(t, alarm.AlarmID, decodedDigest.ActiveAlarms[i].AlarmID)
+				assert.Equal(t, alarm.Status, decodedDigest.ActiveAlarms[i].Status)
+				assert.True(t, alarm.LatestChangedAt.Equal(decodedDigest.ActiveAlarms[i].LatestChangedAt))
+			}
+		})
+	}
+}
+
+func TestJSONIsUsedIfMessageIsNotSupported(t *testing.T) {
+	msg := wire.ReshardRequested{Epoch: 1, NumOfShards: 2}
+
+	_, err := NewProtobufCodec().Encode(msg)
+	assert.True(t, errors.Is(err, ErrNotSupported))
+
+	c, data, err := Encode(NewProtobufCodec(), msg)
+	require.NoError(t, err)
+	assert.Equal(t, NewJSONCodec(), c)
+	assert.JSONEq(t, `{"Epoch":1,"NumOfShards":2}`, string(data))
+}
+
+func TestJSONIsUsedIfContentTypeIsEmpty(t *testing.T) {
+	c, err := ForContentType("")
+	require.NoError(t, err)
+	assert.Equal(t, NewJSONCodec(), c)
+
+	_, err = ForContentType("text/plain")
+	assert.Error(t, err)
+}
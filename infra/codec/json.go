@@ -0,0 +1,25 @@
+package codec
+
+import "encoding/json"
+
+// NewJSONCodec returns JSON codec
+func NewJSONCodec() Codec {
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+// ContentType returns the content type of messages encoded by the codec
+func (c jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+// Encode encodes message
+func (c jsonCodec) Encode(msg interface{}) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// Decode decodes data into the message
+func (c jsonCodec) Decode(data []byte, msgPtr interface{}) error {
+	return json.Unmarshal(data, msgPtr)
+}
@@ -0,0 +1,38 @@
+package codec
+
+import (
+	"bytes"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// NewMsgPackCodec returns MessagePack codec, field names and options are taken from json tags
+// so messages have the same structure as JSON ones
+func NewMsgPackCodec() Codec {
+	return msgPackCodec{}
+}
+
+type msgPackCodec struct{}
+
+// ContentType returns the content type of messages encoded by the codec
+func (c msgPackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+// Encode encodes message
+func (c msgPackCodec) Encode(msg interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes data into the message
+func (c msgPackCodec) Decode(data []byte, msgPtr interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(msgPtr)
+}
@@ -0,0 +1,45 @@
+package codec
+
+import "fmt"
+
+// ProtoMessage is implemented by messages which may be encoded using Protobuf codec
+type ProtoMessage interface {
+	// MarshalProto encodes message using Protobuf wire format
+	MarshalProto() ([]byte, error)
+}
+
+// ProtoMessagePtr is implemented by pointers to messages which may be decoded by Protobuf codec
+type ProtoMessagePtr interface {
+	// UnmarshalProto decodes message from Protobuf wire format
+	UnmarshalProto(data []byte) error
+}
+
+// NewProtobufCodec returns Protobuf codec, it supports messages implementing ProtoMessage and ProtoMessagePtr only
+func NewProtobufCodec() Codec {
+	return protobufCodec{}
+}
+
+type protobufCodec struct{}
+
+// ContentType returns the content type of messages encoded by the codec
+func (c protobufCodec) ContentType() string {
+	return "application/protobuf"
+}
+
+// Encode encodes message
+func (c protobufCodec) Encode(msg interface{}) ([]byte, error) {
+	m, ok := msg.(ProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("encoding %T failed: %w", msg, ErrNotSupported)
+	}
+	return m.MarshalProto()
+}
+
+// Decode decodes data into the message
+func (c protobufCodec) Decode(data []byte, msgPtr interface{}) error {
+	m, ok := msgPtr.(ProtoMessagePtr)
+	if !ok {
+		return fmt.Errorf("decoding %T failed: %w", msgPtr, ErrNotSupported)
+	}
+	return m.UnmarshalProto(data)
+}
@@ -1,13 +1,31 @@
 package infra
 
 import (
+	"errors"
+	"fmt"
 	"runtime"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 	"github.com/spf13/pflag"
+	"github.com/wojciech-malota-wojcik/netdata/infra/codec"
 	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
 )
 
+// Policies applied when new alarm exceeds the quota
+const (
+	// QuotaReject causes new alarm to be ignored
+	QuotaReject = "reject"
+
+	// QuotaEvictCleared causes the least recently changed cleared alarm to be removed to make room for new one
+	QuotaEvictCleared = "evict-cleared"
+
+	// QuotaLRU causes the least recently changed alarm to be removed to make room for new one
+	QuotaLRU = "lru"
+)
+
 // NewConfigFromCLI creates new config based on CLI flags
 func NewConfigFromCLI() Config {
 	cfg := Config{}
@@ -15,19 +33,95 @@ func NewConfigFromCLI() Config {
 	pflag.StringSliceVar(&cfg.NATSAddresses, "nats-addr", []string{nats.DefaultURL}, "Addresses of NATS cluster")
 	pflag.Uint64Var(&shardID, "shard-id", 0, "Shard ID of node")
 	pflag.Uint64Var(&cfg.NumOfShards, "shards", 1, "Total number of shards managed by all nodes")
+	pflag.BoolVar(&cfg.Joining, "joining", false, "Allow shard ID greater than or equal to number of shards, node stays idle until resharding assigns users to it")
 	pflag.Uint64Var(&cfg.NumOfLocalShards, "local-shards", uint64(runtime.NumCPU()), "Number of local shards")
+	pflag.StringVar(&cfg.ShardIDGenerator, "shard-id-generator", sharding.XORModulo, "Algorithm used to assign users to shards: xor-modulo, xxhash, jump or rendezvous")
+	pflag.BoolVar(&cfg.JetStream, "jetstream", false, "Receive messages from JetStream durable consumers so messages not applied before node terminated are redelivered")
+	pflag.DurationVar(&cfg.JetStreamAckWait, "jetstream-ack-wait", 30*time.Second, "Time after which JetStream redelivers message which hasn't been acknowledged")
+	pflag.DurationVar(&cfg.JetStreamMaxAge, "jetstream-max-age", 7*24*time.Hour, "Time after which messages are removed from JetStream streams created by the node, 0 keeps them forever")
+	pflag.StringVar(&cfg.Codec, "codec", codec.JSON, "Codec used to encode published messages: json, protobuf or msgpack")
+	pflag.StringVar(&cfg.DeadLetterSubject, "dead-letter-subject", "DeadLetter", "Subject where messages which can't be decoded or are invalid are published, they are discarded if empty")
+	pflag.StringVar(&cfg.StateDir, "state-dir", "", "Directory where state of local shards is persisted, state is kept in memory only if empty")
+	pflag.Uint64Var(&cfg.SnapshotChanges, "snapshot-changes", 10000, "Number of changes recorded by local shard after which snapshot of its state is taken, 0 turns it off")
+	pflag.DurationVar(&cfg.SnapshotInterval, "snapshot-interval", time.Minute, "Interval of taking snapshots of local shard state if anything changed, 0 turns it off")
+	pflag.DurationVar(&cfg.OutboxRetryInterval, "outbox-retry-interval", 10*time.Second, "Interval of publishing again digests which haven't been confirmed by the broker, 0 turns it off")
+	pflag.DurationVar(&cfg.RetentionHorizon, "retention-horizon", 0, "Time after which cleared alarms are removed from memory, it should be greater than the maximum delay of out-of-order updates, 0 turns it off")
+	pflag.DurationVar(&cfg.RetentionInterval, "retention-interval", time.Minute, "Interval of removing cleared alarms older than retention horizon")
+	pflag.BoolVar(&cfg.EscalateCritical, "escalate-critical", false, "Publish digest containing single alarm immediately when alarm becomes CRITICAL, it is not sent again in the next regular digest")
+	pflag.DurationVar(&cfg.EscalateWarningAfter, "escalate-warning-after", 0, "Time after which alarm being WARNING all the time is published immediately in digest containing single alarm, 0 turns it off")
+	pflag.DurationVar(&cfg.FlappingWindow, "flapping-window", 0, "Period in which status changes of alarm are counted to detect flapping, 0 turns detection off")
+	pflag.Uint64Var(&cfg.FlappingThreshold, "flapping-threshold", 5, "Number of status changes in flapping window after which alarm is flapping, it is sent once until it settles")
+	pflag.BoolVar(&cfg.ResolvedAlarms, "resolved-alarms", false, "Include alarms sent as active before and cleared since then in ResolvedAlarms of the digest")
+	pflag.DurationVar(&cfg.DigestInterval, "digest-interval", 0, "Time in which user earns one more digest, requests exceeding the limit are deferred and coalesced into single digest, 0 turns limiting off")
+	pflag.Uint64Var(&cfg.DigestBurst, "digest-burst", 1, "Number of digests which may be sent to the user at once before requests are deferred by digest interval")
+	pflag.Uint64Var(&cfg.MaxAlarmsPerUser, "max-alarms-per-user", 0, "Maximum number of alarms tracked for single user, 0 means there is no limit")
+	pflag.Uint64Var(&cfg.MaxAlarmsPerShard, "max-alarms-per-shard", 0, "Maximum number of alarms tracked by single local shard, 0 means there is no limit")
+	pflag.StringVar(&cfg.QuotaPolicy, "quota-policy", QuotaReject, "Policy applied when new alarm exceeds the quota: reject, evict-cleared or lru")
+	pflag.DurationVar(&cfg.SchedulerInterval, "scheduler-interval", 0, "Interval of checking digest schedules of users set by SetDigestSchedule messages, 0 turns the scheduler off")
+	pflag.DurationVar(&cfg.RequestIDWindow, "request-id-window", 10*time.Minute, "Time for which IDs of answered SendAlarmDigest requests are remembered to answer duplicates with the same digest, 0 turns it off")
+	pflag.BoolVar(&cfg.Router, "router", false, "Run as router republishing messages to subjects of shards owning them instead of processing them")
+	pflag.StringVar(&cfg.QueueGroup, "queue-group", "", "Queue group joined by router, messages are split between routers of the same group")
+	pflag.BoolVar(&cfg.ShardSubjects, "shard-subjects", false, "Receive messages from the subjects of the shard, to which router republishes them, instead of type-specific topics")
+	pflag.BoolVar(&cfg.LeaderElection, "leader-election", false, "Elect leader among replicas of the shard, only the leader publishes digests")
+	pflag.DurationVar(&cfg.LeaderLease, "leader-lease", 10*time.Second, "Time after which lease of the leader expires if it is not renewed")
+	pflag.StringVar(&cfg.ReplicaID, "replica-id", "", "Unique ID of the replica used in leader election and as a producer of published messages, random one is generated if empty, it is required if JetStream is used with leader election")
 	pflag.BoolVarP(&cfg.VerboseLogging, "verbose", "v", false, "Turns on verbose logging")
 	pflag.Parse()
 
 	cfg.ShardID = sharding.ID(shardID)
-
-	if shardID >= cfg.NumOfShards {
-		panic("shard ID has to be less than number of shards")
+	if err := cfg.Validate(); err != nil {
+		panic(err)
+	}
+	if cfg.ReplicaID == "" {
+		cfg.ReplicaID = uuid.New().String()
 	}
-
 	return cfg
 }
 
+// Validate returns an error if config is invalid
+func (cfg Config) Validate() error {
+	if uint64(cfg.ShardID) >= cfg.NumOfShards && !cfg.Joining && !cfg.Router {
+		return errors.New("shard ID has to be less than number of shards, unless node is joining the next shard map")
+	}
+	if _, err := sharding.NewIDGenerator(cfg.ShardIDGenerator); err != nil {
+		return err
+	}
+	if _, err := codec.New(cfg.Codec); err != nil {
+		return err
+	}
+	if cfg.QueueGroup != "" && !cfg.Router {
+		return errors.New("queue group may be used by routers only")
+	}
+	if cfg.RetentionHorizon > 0 && cfg.RetentionInterval <= 0 {
+		return errors.New("retention interval has to be positive if retention horizon is set")
+	}
+	if cfg.FlappingWindow > 0 && cfg.FlappingThreshold < 2 {
+		return errors.New("flapping threshold has to be at least 2")
+	}
+	if cfg.DigestInterval > 0 && cfg.DigestBurst < 1 {
+		return errors.New("digest burst has to be at least 1")
+	}
+	switch cfg.QuotaPolicy {
+	case "", QuotaReject, QuotaEvictCleared, QuotaLRU:
+	default:
+		return fmt.Errorf("unknown quota policy %q", cfg.QuotaPolicy)
+	}
+	if cfg.LeaderElection && cfg.LeaderLease <= 0 {
+		return errors.New("leader lease has to be greater than 0")
+	}
+	if cfg.JetStreamMaxAge < 0 {
+		return errors.New("JetStream max age can't be negative")
+	}
+	if cfg.JetStream && cfg.LeaderElection && cfg.ReplicaID == "" {
+		// Replica has its own durable consumer, random ID would create new one on every restart
+		return errors.New("replica ID has to be set if JetStream is used with leader election")
+	}
+	if strings.ContainsAny(cfg.ReplicaID, ".*> ") {
+		return errors.New("replica ID can't contain dots, wildcards or spaces")
+	}
+	return nil
+}
+
 // Config stores configuration
 type Config struct {
 	// ShardID is the shard ID of the node
@@ -36,12 +130,105 @@ type Config struct {
 	// NumOfShards is the total number of running shards
 	NumOfShards uint64
 
+	// Joining allows shard ID outside the current shard map, node stays idle until resharding assigns users to it
+	Joining bool
+
 	// NumOfLocalShards is the number of shards managed using local resources
 	NumOfLocalShards uint64
 
+	// ShardIDGenerator is the name of algorithm used to assign users to shards
+	ShardIDGenerator string
+
 	// NATSAddresses contains addresses of NATS cluster
 	NATSAddresses []string
 
+	// JetStream turns on receiving messages from JetStream durable consumers
+	JetStream bool
+
+	// JetStreamAckWait is the time after which JetStream redelivers message which hasn't been acknowledged
+	JetStreamAckWait time.Duration
+
+	// JetStreamMaxAge is the time after which messages are removed from JetStream streams created by the node
+	JetStreamMaxAge time.Duration
+
+	// Codec is the name of codec used to encode published messages
+	Codec string
+
+	// DeadLetterSubject is the subject where rejected messages are published, they are discarded if empty
+	DeadLetterSubject string
+
+	// StateDir is the directory where state of local shards is persisted, persistence is turned off if empty
+	StateDir string
+
+	// SnapshotChanges is the number of changes recorded by local shard after which snapshot of its state is taken
+	SnapshotChanges uint64
+
+	// SnapshotInterval is the interval of taking snapshots of local shard state
+	SnapshotInterval time.Duration
+
+	// OutboxRetryInterval is the interval of publishing again digests which haven't been confirmed by the broker
+	OutboxRetryInterval time.Duration
+
+	// RetentionHorizon is the time after which cleared alarms are removed from memory, 0 turns it off
+	RetentionHorizon time.Duration
+
+	// RetentionInterval is the interval of removing cleared alarms older than retention horizon
+	RetentionInterval time.Duration
+
+	// EscalateCritical causes alarm to be published immediately when it becomes CRITICAL
+	EscalateCritical bool
+
+	// EscalateWarningAfter is the time after which WARNING alarm is published immediately, 0 turns it off
+	EscalateWarningAfter time.Duration
+
+	// FlappingWindow is the period in which status changes are counted to detect flapping, 0 turns detection off
+	FlappingWindow time.Duration
+
+	// FlappingThreshold is the number of status changes in the window after which alarm is flapping
+	FlappingThreshold uint64
+
+	// ResolvedAlarms causes alarms sent as active and cleared since then to be sent in ResolvedAlarms of the digest
+	ResolvedAlarms bool
+
+	// DigestInterval is the time in which user earns one more digest, 0 turns rate limiting off
+	DigestInterval time.Duration
+
+	// DigestBurst is the number of digests which may be sent to the user at once
+	DigestBurst uint64
+
+	// MaxAlarmsPerUser is the maximum number of alarms tracked for single user, 0 means there is no limit
+	MaxAlarmsPerUser uint64
+
+	// MaxAlarmsPerShard is the maximum number of alarms tracked by single local shard, 0 means there is no limit
+	MaxAlarmsPerShard uint64
+
+	// QuotaPolicy is the policy applied when new alarm exceeds the quota, reject is used if empty
+	QuotaPolicy string
+
+	// SchedulerInterval is the interval of checking digest schedules of users, 0 turns the scheduler off
+	SchedulerInterval time.Duration
+
+	// RequestIDWindow is the time for which IDs of answered SendAlarmDigest requests are remembered
+	RequestIDWindow time.Duration
+
+	// Router turns on router mode in which messages are republished to subjects of shards owning them
+	Router bool
+
+	// QueueGroup is the queue group joined by router to split messages between routers
+	QueueGroup string
+
+	// ShardSubjects turns on receiving messages from the subjects of the shard instead of type-specific topics
+	ShardSubjects bool
+
+	// LeaderElection turns on electing leader among replicas of the shard
+	LeaderElection bool
+
+	// LeaderLease is the time after which lease of the leader expires if it is not renewed
+	LeaderLease time.Duration
+
+	// ReplicaID is the unique ID of the replica used in leader election and as a producer of published messages
+	ReplicaID string
+
 	// VerboseLogging turns on verbose logging
 	VerboseLogging bool
 }
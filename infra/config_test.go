@@ -0,0 +1,55 @@
+package infra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wojciech-malota-wojcik/netdata/infra/codec"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
+)
+
+func TestValidateShardID(t *testing.T) {
+	cfg := Config{
+		ShardID:          1,
+		NumOfShards:      2,
+		ShardIDGenerator: sharding.XORModulo,
+		Codec:            codec.JSON,
+	}
+	assert.NoError(t, cfg.Validate())
+
+	c := cfg
+	c.ShardID = 5
+	assert.Error(t, c.Validate())
+
+	// Node joining the next shard map stays idle until resharding
+	c.Joining = true
+	assert.NoError(t, c.Validate())
+
+	c = cfg
+	c.QuotaPolicy = "random"
+	assert.Error(t, c.Validate())
+
+	c = cfg
+	c.RetentionHorizon = time.Hour
+	assert.Error(t, c.Validate())
+
+	c.RetentionInterval = time.Minute
+	assert.NoError(t, c.Validate())
+
+	c = cfg
+	c.JetStreamMaxAge = -time.Hour
+	assert.Error(t, c.Validate())
+
+	c = cfg
+	c.JetStream = true
+	c.LeaderElection = true
+	c.LeaderLease = time.Second
+	assert.Error(t, c.Validate())
+
+	c.ReplicaID = "replica1"
+	assert.NoError(t, c.Validate())
+
+	c.ReplicaID = "replica.1"
+	assert.Error(t, c.Validate())
+}
@@ -0,0 +1,66 @@
+package election
+
+import (
+	"context"
+)
+
+// Role is the role of the replica in its shard
+type Role int
+
+const (
+	// RoleUnknown means that replica doesn't know if any replica is the leader
+	RoleUnknown Role = iota
+
+	// RoleFollower means that another replica is the leader
+	RoleFollower
+
+	// RoleLeader means that replica is the leader
+	RoleLeader
+)
+
+// String returns string representation of the role
+func (r Role) String() string {
+	switch r {
+	case RoleFollower:
+		return "follower"
+	case RoleLeader:
+		return "leader"
+	default:
+		return "unknown"
+	}
+}
+
+// Leadership tells if this replica is the leader of its shard
+type Leadership interface {
+	// Run is a task which maintains the leadership
+	Run(ctx context.Context) error
+
+	// Role returns the current role of the replica
+	Role() Role
+
+	// Changed returns channel which is closed when role changes next time
+	Changed() <-chan struct{}
+}
+
+// NewStaticLeadership returns leadership used when there are no replicas, node is always the leader
+func NewStaticLeadership() Leadership {
+	return staticLeadership{}
+}
+
+type staticLeadership struct{}
+
+// Run is a task which maintains the leadership
+func (l staticLeadership) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Role returns the current role of the replica
+func (l staticLeadership) Role() Role {
+	return RoleLeader
+}
+
+// Changed returns channel which is closed when role changes next time
+func (l staticLeadership) Changed() <-chan struct{} {
+	return nil
+}
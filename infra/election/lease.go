@@ -0,0 +1,215 @@
+package election
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/lib/retry"
+	"go.uber.org/zap"
+)
+
+// bucket is the name of key-value bucket storing leases of all the shards
+const bucket = "ShardLeaders"
+
+// NewLease returns leadership maintained by the lease stored in NATS key-value bucket.
+// Replica holding the lease is the leader. It renews the lease until it terminates or loses connection,
+// then the lease expires and one of other replicas acquires it.
+func NewLease(config infra.Config) Leadership {
+	return &lease{
+		config:  config,
+		key:     fmt.Sprintf("shard-%d", config.ShardID),
+		changed: make(chan struct{}),
+	}
+}
+
+// lease is the leadership maintained by the lease stored in NATS key-value bucket
+type lease struct {
+	config infra.Config
+	key    string
+
+	mu      sync.Mutex
+	role    Role
+	changed chan struct{}
+}
+
+// Run is a task which maintains the leadership
+func (l *lease) Run(ctx context.Context) error {
+	log := logger.Get(ctx).With(zap.String("key", l.key), zap.String("replicaID", l.config.ReplicaID))
+	defer l.setRole(log, RoleUnknown)
+
+	var nc *nats.Conn
+	_ = retry.Do(ctx, time.Second, func() error {
+		var err error
+		nc, err = nats.Connect(strings.Join(l.config.NATSAddresses, ","), nats.Name("Netdata"), nats.Timeout(10*time.Second))
+		if err != nil {
+			return retry.Retryable(fmt.Errorf("can't connect to NATS: %w", err))
+		}
+		return nil
+	})
+	if nc == nil {
+		return ctx.Err()
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("creating JetStream context failed: %w", err)
+	}
+	// Requests renewing the lease time out early enough for the leader to step down before the lease expires
+	renewJS, err := nc.JetStream(nats.MaxWait(renewTimeout(l.config.LeaderLease)))
+	if err != nil {
+		return fmt.Errorf("creating JetStream context failed: %w", err)
+	}
+
+	var kv nats.KeyValue
+	err = retry.Do(ctx, time.Second, func() error {
+		// Values expire if they are not renewed
+		_, err := js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  bucket,
+			TTL:     l.config.LeaderLease,
+			History: 1,
+		})
+		if err != nil {
+			return retry.Retryable(fmt.Errorf("creating key-value bucket failed: %w", err))
+		}
+		kv, err = renewJS.KeyValue(bucket)
+		if err != nil {
+			return retry.Retryable(fmt.Errorf("opening key-value bucket failed: %w", err))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("Leader election started")
+
+	ticker := time.NewTicker(l.config.LeaderLease / 3)
+	defer ticker.Stop()
+
+	// Leader steps down before its lease expires if it can't renew it, so two replicas are never
+	// leaders at the same time. Validity is counted from the moment renewal started because lease might
+	// have been renewed by the server at any time after that.
+	var validUntil time.Time
+	for {
+		renewedAt := time.Now()
+		role, err := l.renew(kv)
+		if err == nil {
+			validUntil = renewedAt.Add(l.config.LeaderLease / 2)
+		}
+		switch {
+		case role == RoleLeader && time.Now().After(validUntil):
+			log.Warn("Renewing lease took too long")
+			l.setRole(log, RoleUnknown)
+		case err == nil:
+			l.setRole(log, role)
+		case time.Now().After(validUntil):
+			log.Warn("Renewing lease failed", zap.Error(err))
+			l.setRole(log, RoleUnknown)
+		default:
+			log.Warn("Renewing lease failed, it will be retried", zap.Error(err))
+		}
+
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if l.Role() == RoleLeader {
+			timer = time.NewTimer(time.Until(validUntil))
+			expired = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			l.release(log, kv)
+			return ctx.Err()
+		case <-expired:
+			log.Warn("Lease expired before it was renewed")
+			l.setRole(log, RoleUnknown)
+		case <-ticker.C:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// renewTimeout returns the timeout of requests renewing the lease. Renewal consists of two requests
+// and both of them have to finish before the leader has to step down.
+func renewTimeout(leaderLease time.Duration) time.Duration {
+	return leaderLease / 5
+}
+
+// Role returns the current role of the replica
+func (l *lease) Role() Role {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.role
+}
+
+// Changed returns channel which is closed when role changes next time
+func (l *lease) Changed() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.changed
+}
+
+// renew acquires the lease if nobody holds it or renews it if it is held by this replica
+func (l *lease) renew(kv nats.KeyValue) (Role, error) {
+	replicaID := []byte(l.config.ReplicaID)
+
+	entry, err := kv.Get(l.key)
+	switch {
+	case errors.Is(err, nats.ErrKeyNotFound):
+		if _, err := kv.Create(l.key, replicaID); err != nil {
+			// Most probably lease has been acquired by another replica in the meantime, it is checked next time
+			return RoleUnknown, nil
+		}
+		return RoleLeader, nil
+	case err != nil:
+		return RoleUnknown, fmt.Errorf("reading lease failed: %w", err)
+	case string(entry.Value()) != l.config.ReplicaID:
+		return RoleFollower, nil
+	}
+
+	if _, err := kv.Update(l.key, replicaID, entry.Revision()); err != nil {
+		return RoleUnknown, fmt.Errorf("updating lease failed: %w", err)
+	}
+	return RoleLeader, nil
+}
+
+// release steps down and deletes the lease so another replica doesn't have to wait until it expires
+func (l *lease) release(log *zap.Logger, kv nats.KeyValue) {
+	if l.Role() != RoleLeader {
+		return
+	}
+	l.setRole(log, RoleUnknown)
+
+	entry, err := kv.Get(l.key)
+	if err != nil || string(entry.Value()) != l.config.ReplicaID {
+		return
+	}
+	if err := kv.Delete(l.key); err != nil {
+		log.Warn("Releasing lease failed", zap.Error(err))
+	}
+}
+
+func (l *lease) setRole(log *zap.Logger, role Role) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.role == role {
+		return
+	}
+	log.Info("Role changed", zap.Stringer("from", l.role), zap.Stringer("to", role))
+	l.role = role
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
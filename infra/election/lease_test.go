@@ -0,0 +1,122 @@
+package election
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+)
+
+func runJetStreamServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	require.True(t, s.ReadyForConnections(10*time.Second))
+	return s
+}
+
+func startLease(ctx context.Context, s *server.Server, replicaID string) (Leadership, <-chan error) {
+	l := NewLease(infra.Config{
+		ShardID:       1,
+		NATSAddresses: []string{s.ClientURL()},
+		LeaderLease:   time.Second,
+		ReplicaID:     replicaID,
+	})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- l.Run(ctx)
+	}()
+	return l, errCh
+}
+
+func awaitRole(t *testing.T, l Leadership, role Role) {
+	require.Eventually(t, func() bool {
+		return l.Role() == role
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestSingleLeaderIsElected(t *testing.T) {
+	s := runJetStreamServer(t)
+
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	l1, errCh1 := startLease(ctx, s, "replica1")
+	awaitRole(t, l1, RoleLeader)
+
+	l2, errCh2 := startLease(ctx, s, "replica2")
+	awaitRole(t, l2, RoleFollower)
+	assert.Equal(t, RoleLeader, l1.Role())
+
+	cancel()
+	assert.ErrorIs(t, <-errCh1, context.Canceled)
+	assert.ErrorIs(t, <-errCh2, context.Canceled)
+	assert.Equal(t, RoleUnknown, l1.Role())
+	assert.Equal(t, RoleUnknown, l2.Role())
+}
+
+func TestFollowerTakesOverWhenLeaderTerminates(t *testing.T) {
+	s := runJetStreamServer(t)
+
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	ctx1, cancel1 := context.WithCancel(ctx)
+	defer cancel1()
+
+	l1, errCh1 := startLease(ctx1, s, "replica1")
+	awaitRole(t, l1, RoleLeader)
+
+	l2, errCh2 := startLease(ctx, s, "replica2")
+	awaitRole(t, l2, RoleFollower)
+
+	changed := l2.Changed()
+	cancel1()
+	assert.ErrorIs(t, <-errCh1, context.Canceled)
+
+	select {
+	case <-changed:
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "role not changed")
+	}
+	awaitRole(t, l2, RoleLeader)
+
+	cancel()
+	assert.ErrorIs(t, <-errCh2, context.Canceled)
+}
+
+func TestLeaderStepsDownBeforeLeaseExpires(t *testing.T) {
+	s := runJetStreamServer(t)
+
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	l, errCh := startLease(ctx, s, "replica1")
+	awaitRole(t, l, RoleLeader)
+
+	// Requests renewing the lease hang until they time out, leader must not wait for them
+	s.Shutdown()
+	require.Eventually(t, func() bool {
+		return l.Role() == RoleUnknown
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+}
+
+func TestStaticLeadershipIsAlwaysLeader(t *testing.T) {
+	l := NewStaticLeadership()
+	assert.Equal(t, RoleLeader, l.Role())
+	assert.Nil(t, l.Changed())
+}
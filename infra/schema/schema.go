@@ -0,0 +1,104 @@
+package schema
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Envelope contains metadata of the message
+type Envelope struct {
+	// ContentType is the content type of encoded message
+	ContentType string
+
+	// SchemaVersion is the version of schema used to encode message, 0 means that message has been sent
+	// without envelope and its version is 1
+	SchemaVersion uint64
+
+	// MessageID is the unique ID of the message
+	MessageID string
+
+	// Producer is the ID of the node which produced the message
+	Producer string
+
+	// Timestamp is the time when message was produced
+	Timestamp time.Time
+
+	// Reply is the subject where reply to the request is expected, it is not a part of the headers
+	Reply string
+}
+
+// Versioned is implemented by messages having explicit topic and schema version
+type Versioned interface {
+	// Topic returns the name of topic where message is published
+	Topic() string
+
+	// SchemaVersion returns the current version of message schema
+	SchemaVersion() uint64
+}
+
+// Upgradable is implemented by messages which may be received in older versions
+type Upgradable interface {
+	// Upgrades returns upgrades from older versions of the schema
+	Upgrades() []Upgrade
+}
+
+// Upgrade converts message of older schema version to the next version
+type Upgrade struct {
+	// Version is the version of the older message
+	Version uint64
+
+	// New returns pointer to the empty message of older version
+	New func() interface{}
+
+	// Apply converts pointer to the message of older version to the pointer to the message of the next version
+	Apply func(msgPtr interface{}) interface{}
+}
+
+// VersionOf returns the current schema version of the message, messages not implementing Versioned are at version 1
+func VersionOf(msg interface{}) uint64 {
+	if v, ok := msg.(Versioned); ok {
+		return v.SchemaVersion()
+	}
+	return 1
+}
+
+// Decode decodes data encoded using the schema version into the message of the current version,
+// upgrading it if it was encoded using older version
+func Decode(decode func(data []byte, msgPtr interface{}) error, data []byte, version uint64, msgPtr interface{}) error {
+	if version == 0 {
+		version = 1
+	}
+	current := VersionOf(msgPtr)
+	if version >= current {
+		// Message of newer version is decoded the best way possible, so new optional fields may be added
+		// without breaking older consumers
+		return decode(data, msgPtr)
+	}
+
+	upgrades := map[uint64]Upgrade{}
+	if u, ok := msgPtr.(Upgradable); ok {
+		for _, upgrade := range u.Upgrades() {
+			upgrades[upgrade.Version] = upgrade
+		}
+	}
+
+	upgrade, exists := upgrades[version]
+	if !exists {
+		return fmt.Errorf("upgrade of %T from version %d doesn't exist", msgPtr, version)
+	}
+	oldPtr := upgrade.New()
+	if err := decode(data, oldPtr); err != nil {
+		return err
+	}
+	for v := version; v < current; v++ {
+		upgrade, exists := upgrades[v]
+		if !exists {
+			return fmt.Errorf("upgrade of %T from version %d doesn't exist", msgPtr, v)
+		}
+		oldPtr = upgrade.Apply(oldPtr)
+	}
+
+	reflect.ValueOf(msgPtr).Elem().Set(reflect.ValueOf(oldPtr).Elem())
+	return nil
+}
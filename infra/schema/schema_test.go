@@ -0,0 +1,94 @@
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type messageV1 struct {
+	Name string
+}
+
+type messageV2 struct {
+	FirstName string
+}
+
+type message struct {
+	FirstName string
+	LastName  string
+}
+
+func (m message) Topic() string {
+	return "Message"
+}
+
+func (m message) SchemaVersion() uint64 {
+	return 3
+}
+
+func (m message) Upgrades() []Upgrade {
+	return []Upgrade{
+		{
+			Version: 1,
+			New: func() interface{} {
+				return &messageV1{}
+			},
+			Apply: func(msgPtr interface{}) interface{} {
+				return &messageV2{FirstName: msgPtr.(*messageV1).Name}
+			},
+		},
+		{
+			Version: 2,
+			New: func() interface{} {
+				return &messageV2{}
+			},
+			Apply: func(msgPtr interface{}) interface{} {
+				return &message{FirstName: msgPtr.(*messageV2).FirstName, LastName: "unknown"}
+			},
+		},
+	}
+}
+
+func TestMessageIsUpgradedFromOlderVersions(t *testing.T) {
+	var msg message
+	require.NoError(t, Decode(json.Unmarshal, []byte(`{"Name":"John"}`), 1, &msg))
+	assert.Equal(t, message{FirstName: "John", LastName: "unknown"}, msg)
+
+	msg = message{}
+	require.NoError(t, Decode(json.Unmarshal, []byte(`{"FirstName":"John"}`), 2, &msg))
+	assert.Equal(t, message{FirstName: "John", LastName: "unknown"}, msg)
+}
+
+func TestMessageWithoutVersionIsTreatedAsVersion1(t *testing.T) {
+	var msg message
+	require.NoError(t, Decode(json.Unmarshal, []byte(`{"Name":"John"}`), 0, &msg))
+	assert.Equal(t, message{FirstName: "John", LastName: "unknown"}, msg)
+}
+
+func TestMessageOfCurrentOrNewerVersionIsDecodedDirectly(t *testing.T) {
+	var msg message
+	require.NoError(t, Decode(json.Unmarshal, []byte(`{"FirstName":"John","LastName":"Doe"}`), 3, &msg))
+	assert.Equal(t, message{FirstName: "John", LastName: "Doe"}, msg)
+
+	msg = message{}
+	require.NoError(t, Decode(json.Unmarshal, []byte(`{"FirstName":"John","LastName":"Doe","Age":30}`), 4, &msg))
+	assert.Equal(t, message{FirstName: "John", LastName: "Doe"}, msg)
+}
+
+type messageWithoutUpgrades struct{}
+
+func (m messageWithoutUpgrades) Topic() string {
+	return "MessageWithoutUpgrades"
+}
+
+func (m messageWithoutUpgrades) SchemaVersion() uint64 {
+	return 2
+}
+
+func TestMessageWithoutUpgradeIsRejected(t *testing.T) {
+	var msg messageWithoutUpgrades
+	assert.Error(t, Decode(json.Unmarshal, []byte(`{}`), 1, &msg))
+}
@@ -0,0 +1,99 @@
+package sharding
+
+import (
+	"encoding/binary"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// NewXXHashModuloIDGenerator returns shard ID generator which computes IDs by taking xxhash of seed
+// and dividing modulo result
+func NewXXHashModuloIDGenerator() IDGenerator {
+	return &xxhashModuloShardIDGenerator{}
+}
+
+type xxhashModuloShardIDGenerator struct {
+}
+
+func (g *xxhashModuloShardIDGenerator) Generate(seed []byte, counts ...uint64) []ID {
+	results := make([]ID, 0, len(counts))
+	for i, c := range counts {
+		results = append(results, ID(key(seed, uint64(i))%c))
+	}
+	return results
+}
+
+// NewJumpHashIDGenerator returns shard ID generator which computes IDs using jump consistent hash,
+// if count is increased from N to N+1 only 1/(N+1) of seeds are moved to the new shard
+func NewJumpHashIDGenerator() IDGenerator {
+	return &jumpHashShardIDGenerator{}
+}
+
+type jumpHashShardIDGenerator struct {
+}
+
+func (g *jumpHashShardIDGenerator) Generate(seed []byte, counts ...uint64) []ID {
+	results := make([]ID, 0, len(counts))
+	for i, c := range counts {
+		results = append(results, jumpHash(key(seed, uint64(i)), c))
+	}
+	return results
+}
+
+// jumpHash implements algorithm described in "A Fast, Minimal Memory, Consistent Hash Algorithm" by Lamping and Veach
+func jumpHash(key uint64, count uint64) ID {
+	var b, j int64 = -1, 0
+	for uint64(j) < count {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return ID(b)
+}
+
+// NewRendezvousIDGenerator returns shard ID generator which computes IDs using rendezvous (highest random weight) hashing,
+// seed goes to the shard for which hash of seed and shard ID is the highest. If shard is added only seeds for which it wins
+// are moved. Cost of generating ID grows linearly with the number of shards.
+func NewRendezvousIDGenerator() IDGenerator {
+	return &rendezvousShardIDGenerator{}
+}
+
+type rendezvousShardIDGenerator struct {
+}
+
+func (g *rendezvousShardIDGenerator) Generate(seed []byte, counts ...uint64) []ID {
+	results := make([]ID, 0, len(counts))
+	for i, c := range counts {
+		k := key(seed, uint64(i))
+		var winner ID
+		var highest uint64
+		for shardID := uint64(0); shardID < c; shardID++ {
+			if weight := mix(k ^ mix(shardID)); shardID == 0 || weight > highest {
+				winner = ID(shardID)
+				highest = weight
+			}
+		}
+		results = append(results, winner)
+	}
+	return results
+}
+
+// key computes hash of seed. Index of count is included so global and local shard IDs are not correlated.
+func key(seed []byte, index uint64) uint64 {
+	d := xxhash.New()
+	_, _ = d.Write(seed)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], index)
+	_, _ = d.Write(b[:])
+	return d.Sum64()
+}
+
+// mix is the finalizer of splitmix64, it spreads bits of value uniformly
+func mix(v uint64) uint64 {
+	v ^= v >> 30
+	v *= 0xbf58476d1ce4e5b9
+	v ^= v >> 27
+	v *= 0x94d049bb133111eb
+	v ^= v >> 31
+	return v
+}
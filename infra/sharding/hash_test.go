@@ -0,0 +1,104 @@
+package sharding
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var hashGenerators = map[string]IDGenerator{
+	XXHashModulo: NewXXHashModuloIDGenerator(),
+	JumpHash:     NewJumpHashIDGenerator(),
+	Rendezvous:   NewRendezvousIDGenerator(),
+}
+
+func TestHashGeneratorsDistributeSeeds(t *testing.T) {
+	const numOfShards1 uint64 = 10
+	const numOfShards2 uint64 = 4
+	const numOfSeeds = 10000
+
+	for name, generator := range hashGenerators {
+		generator := generator
+		t.Run(name, func(t *testing.T) {
+			counts1 := make([]int, numOfShards1)
+			counts2 := make([]int, numOfShards2)
+			for i := 0; i < numOfSeeds; i++ {
+				id, err := uuid.NewRandom()
+				require.NoError(t, err)
+				shardIDs := generator.Generate(id[:], numOfShards1, numOfShards2)
+				require.Less(t, uint64(shardIDs[0]), numOfShards1)
+				require.Less(t, uint64(shardIDs[1]), numOfShards2)
+				counts1[shardIDs[0]]++
+				counts2[shardIDs[1]]++
+			}
+			for _, c := range counts1 {
+				assert.InDelta(t, numOfSeeds/numOfShards1, c, float64(numOfSeeds/numOfShards1/5))
+			}
+			for _, c := range counts2 {
+				assert.InDelta(t, numOfSeeds/numOfShards2, c, float64(numOfSeeds/numOfShards2/5))
+			}
+		})
+	}
+}
+
+func TestHashGeneratorsAreDeterministic(t *testing.T) {
+	id, err := uuid.NewRandom()
+	require.NoError(t, err)
+
+	for name := range hashGenerators {
+		generator1, err := NewIDGenerator(name)
+		require.NoError(t, err)
+		generator2, err := NewIDGenerator(name)
+		require.NoError(t, err)
+
+		assert.Equal(t, generator1.Generate(id[:], 100, 10), generator2.Generate(id[:], 100, 10), name)
+	}
+}
+
+func TestHashGeneratorsDistinguishPermutations(t *testing.T) {
+	for name, generator := range hashGenerators {
+		different := false
+		for i := byte(0); i < 10; i++ {
+			if generator.Generate([]byte{i, i + 1}, 1000)[0] != generator.Generate([]byte{i + 1, i}, 1000)[0] {
+				different = true
+			}
+		}
+		assert.True(t, different, name)
+	}
+}
+
+func TestAddingShardMovesFractionOfSeeds(t *testing.T) {
+	const numOfShards uint64 = 10
+	const numOfSeeds = 10000
+
+	for _, name := range []string{JumpHash, Rendezvous} {
+		generator := hashGenerators[name]
+		t.Run(name, func(t *testing.T) {
+			moved := 0
+			for i := 0; i < numOfSeeds; i++ {
+				id, err := uuid.NewRandom()
+				require.NoError(t, err)
+				before := generator.Generate(id[:], numOfShards)[0]
+				after := generator.Generate(id[:], numOfShards+1)[0]
+				if before != after {
+					// Seeds may be moved only to the new shard
+					require.Equal(t, ID(numOfShards), after)
+					moved++
+				}
+			}
+			expected := numOfSeeds / (numOfShards + 1)
+			assert.InDelta(t, expected, moved, float64(expected)/5)
+		})
+	}
+}
+
+func TestUnknownGeneratorIsRejected(t *testing.T) {
+	_, err := NewIDGenerator("unknown")
+	assert.Error(t, err)
+
+	generator, err := NewIDGenerator(XORModulo)
+	require.NoError(t, err)
+	assert.IsType(t, &xorModuloShardIDGenerator{}, generator)
+}
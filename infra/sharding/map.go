@@ -0,0 +1,72 @@
+package sharding
+
+import "sync"
+
+// NewMap returns shard map with the initial number of shards
+func NewMap(numOfShards uint64) *Map {
+	return &Map{
+		numOfShards: numOfShards,
+	}
+}
+
+// Map stores the number of shards, it is shared by all the components of the node and changed by resharding.
+// While resharding is in progress the map contains both the current and the next number of shards.
+type Map struct {
+	mu sync.RWMutex
+
+	epoch       uint64
+	numOfShards uint64
+
+	nextEpoch       uint64
+	nextNumOfShards uint64
+}
+
+// Current returns epoch and number of shards of the current map
+func (m *Map) Current() (epoch uint64, numOfShards uint64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.epoch, m.numOfShards
+}
+
+// Next returns epoch and number of shards of the map being introduced by resharding, zeros are returned
+// if resharding is not in progress
+func (m *Map) Next() (epoch uint64, numOfShards uint64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.nextEpoch, m.nextNumOfShards
+}
+
+// Restore sets epoch of the current map restored from persistent storage
+func (m *Map) Restore(epoch uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.epoch = epoch
+}
+
+// Prepare starts resharding
+func (m *Map) Prepare(epoch uint64, numOfShards uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextEpoch = epoch
+	m.nextNumOfShards = numOfShards
+}
+
+// Commit finishes resharding by replacing the current map with the next one
+func (m *Map) Commit() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.epoch = m.nextEpoch
+	m.numOfShards = m.nextNumOfShards
+	m.nextEpoch = 0
+	m.nextNumOfShards = 0
+}
+
+// Owner returns the shard owning the seed if there are numOfShards shards
+func Owner(generator IDGenerator, seed []byte, numOfShards uint64) ID {
+	return generator.Generate(seed, numOfShards)[0]
+}
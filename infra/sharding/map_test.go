@@ -0,0 +1,36 @@
+package sharding
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMapResharding(t *testing.T) {
+	m := NewMap(3)
+
+	epoch, numOfShards := m.Current()
+	assert.EqualValues(t, 0, epoch)
+	assert.EqualValues(t, 3, numOfShards)
+	epoch, numOfShards = m.Next()
+	assert.EqualValues(t, 0, epoch)
+	assert.EqualValues(t, 0, numOfShards)
+
+	m.Prepare(1, 5)
+
+	epoch, numOfShards = m.Current()
+	assert.EqualValues(t, 0, epoch)
+	assert.EqualValues(t, 3, numOfShards)
+	epoch, numOfShards = m.Next()
+	assert.EqualValues(t, 1, epoch)
+	assert.EqualValues(t, 5, numOfShards)
+
+	m.Commit()
+
+	epoch, numOfShards = m.Current()
+	assert.EqualValues(t, 1, epoch)
+	assert.EqualValues(t, 5, numOfShards)
+	epoch, numOfShards = m.Next()
+	assert.EqualValues(t, 0, epoch)
+	assert.EqualValues(t, 0, numOfShards)
+}
@@ -1,6 +1,9 @@
 package sharding
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+)
 
 // ID is the ID of the shard
 type ID uint64
@@ -11,6 +14,36 @@ type IDGenerator interface {
 	Generate(seed []byte, counts ...uint64) []ID
 }
 
+const (
+	// XORModulo is the name of generator returned by NewXORModuloIDGenerator
+	XORModulo = "xor-modulo"
+
+	// XXHashModulo is the name of generator returned by NewXXHashModuloIDGenerator
+	XXHashModulo = "xxhash"
+
+	// JumpHash is the name of generator returned by NewJumpHashIDGenerator
+	JumpHash = "jump"
+
+	// Rendezvous is the name of generator returned by NewRendezvousIDGenerator
+	Rendezvous = "rendezvous"
+)
+
+// NewIDGenerator returns shard ID generator of given name
+func NewIDGenerator(name string) (IDGenerator, error) {
+	switch name {
+	case XORModulo:
+		return NewXORModuloIDGenerator(), nil
+	case XXHashModulo:
+		return NewXXHashModuloIDGenerator(), nil
+	case JumpHash:
+		return NewJumpHashIDGenerator(), nil
+	case Rendezvous:
+		return NewRendezvousIDGenerator(), nil
+	default:
+		return nil, fmt.Errorf("unknown shard ID generator: %s", name)
+	}
+}
+
 // NewXORModuloIDGenerator returns shard ID generator which computes IDs by taking xor of seed
 // and dividing modulo result
 func NewXORModuloIDGenerator() IDGenerator {
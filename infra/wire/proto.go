@@ -0,0 +1,711 @@
+package wire
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf encoding of the messages defined in wire.proto
+
+// MarshalProto encodes message using Protobuf wire format
+func (o AlarmStatusChanged) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(o.UserID))
+	b = appendString(b, 2, string(o.AlarmID))
+	b = appendString(b, 3, string(o.Status))
+	b = appendTime(b, 4, o.ChangedAt)
+	b = appendLabels(b, 5, o.Labels)
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *AlarmStatusChanged) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, (*string)(&o.UserID))
+		case 2:
+			return consumeString(typ, b, (*string)(&o.AlarmID))
+		case 3:
+			return consumeString(typ, b, (*string)(&o.Status))
+		case 4:
+			return consumeTime(typ, b, &o.ChangedAt)
+		case 5:
+			return consumeLabel(typ, b, &o.Labels)
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o SendAlarmDigest) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(o.UserID))
+	b = appendString(b, 2, o.RequestID)
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *SendAlarmDigest) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, (*string)(&o.UserID))
+		case 2:
+			return consumeString(typ, b, &o.RequestID)
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o AcknowledgeAlarm) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(o.UserID))
+	b = appendString(b, 2, string(o.AlarmID))
+	b = appendTime(b, 3, o.AcknowledgedAt)
+	b = appendTime(b, 4, o.ExpiresAt)
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *AcknowledgeAlarm) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, (*string)(&o.UserID))
+		case 2:
+			return consumeString(typ, b, (*string)(&o.AlarmID))
+		case 3:
+			return consumeTime(typ, b, &o.AcknowledgedAt)
+		case 4:
+			return consumeTime(typ, b, &o.ExpiresAt)
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o SetDigestSchedule) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(o.UserID))
+	b = appendString(b, 2, o.Spec)
+	b = appendString(b, 3, o.TimeZone)
+	b = appendTime(b, 4, o.SetAt)
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *SetDigestSchedule) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, (*string)(&o.UserID))
+		case 2:
+			return consumeString(typ, b, &o.Spec)
+		case 3:
+			return consumeString(typ, b, &o.TimeZone)
+		case 4:
+			return consumeTime(typ, b, &o.SetAt)
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o SetDigestPreferences) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(o.UserID))
+	b = appendString(b, 2, string(o.MinSeverity))
+	b = appendString(b, 3, string(o.Order))
+	b = appendString(b, 4, o.PrefixSeparator)
+	b = appendUint64(b, 5, o.MaxAlarms)
+	b = appendTime(b, 6, o.SetAt)
+	b = appendString(b, 7, o.GroupByLabel)
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *SetDigestPreferences) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, (*string)(&o.UserID))
+		case 2:
+			return consumeString(typ, b, (*string)(&o.MinSeverity))
+		case 3:
+			return consumeString(typ, b, (*string)(&o.Order))
+		case 4:
+			return consumeString(typ, b, &o.PrefixSeparator)
+		case 5:
+			return consumeUint64(typ, b, &o.MaxAlarms)
+		case 6:
+			return consumeTime(typ, b, &o.SetAt)
+		case 7:
+			return consumeString(typ, b, &o.GroupByLabel)
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o CreateSilence) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(o.UserID))
+	b = appendString(b, 2, o.SilenceID)
+	b = appendString(b, 3, string(o.MatchType))
+	b = appendString(b, 4, o.Pattern)
+	b = appendTime(b, 5, o.StartsAt)
+	b = appendTime(b, 6, o.EndsAt)
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *CreateSilence) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, (*string)(&o.UserID))
+		case 2:
+			return consumeString(typ, b, &o.SilenceID)
+		case 3:
+			return consumeString(typ, b, (*string)(&o.MatchType))
+		case 4:
+			return consumeString(typ, b, &o.Pattern)
+		case 5:
+			return consumeTime(typ, b, &o.StartsAt)
+		case 6:
+			return consumeTime(typ, b, &o.EndsAt)
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o DeleteSilence) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(o.UserID))
+	b = appendString(b, 2, o.SilenceID)
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *DeleteSilence) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, (*string)(&o.UserID))
+		case 2:
+			return consumeString(typ, b, &o.SilenceID)
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o Alarm) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(o.AlarmID))
+	b = appendString(b, 2, string(o.Status))
+	b = appendTime(b, 3, o.LatestChangedAt)
+	b = appendBool(b, 4, o.Flapping)
+	b = appendUint64(b, 5, o.Transitions)
+	b = appendLabels(b, 6, o.Labels)
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *Alarm) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, (*string)(&o.AlarmID))
+		case 2:
+			return consumeString(typ, b, (*string)(&o.Status))
+		case 3:
+			return consumeTime(typ, b, &o.LatestChangedAt)
+		case 4:
+			return consumeBool(typ, b, &o.Flapping)
+		case 5:
+			return consumeUint64(typ, b, &o.Transitions)
+		case 6:
+			return consumeLabel(typ, b, &o.Labels)
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o AlarmDigest) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(o.UserID))
+	for _, alarm := range o.ActiveAlarms {
+		alarmData, err := alarm.MarshalProto()
+		if err != nil {
+			return nil, err
+		}
+		b = appendMessage(b, 2, alarmData)
+	}
+	for _, alarm := range o.ResolvedAlarms {
+		alarmData, err := alarm.MarshalProto()
+		if err != nil {
+			return nil, err
+		}
+		b = appendMessage(b, 3, alarmData)
+	}
+	b = appendString(b, 4, o.GroupedBy)
+	for _, group := range o.Groups {
+		groupData, err := group.MarshalProto()
+		if err != nil {
+			return nil, err
+		}
+		b = appendMessage(b, 5, groupData)
+	}
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *AlarmDigest) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, (*string)(&o.UserID))
+		case 2:
+			return consumeMessage(typ, b, func(data []byte) error {
+				var alarm Alarm
+				if err := alarm.UnmarshalProto(data); err != nil {
+					return err
+				}
+				o.ActiveAlarms = append(o.ActiveAlarms, alarm)
+				return nil
+			})
+		case 3:
+			return consumeMessage(typ, b, func(data []byte) error {
+				var alarm Alarm
+				if err := alarm.UnmarshalProto(data); err != nil {
+					return err
+				}
+				o.ResolvedAlarms = append(o.ResolvedAlarms, alarm)
+				return nil
+			})
+		case 4:
+			return consumeString(typ, b, &o.GroupedBy)
+		case 5:
+			return consumeMessage(typ, b, func(data []byte) error {
+				var group AlarmGroup
+				if err := group.UnmarshalProto(data); err != nil {
+					return err
+				}
+				o.Groups = append(o.Groups, group)
+				return nil
+			})
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o AlarmGroup) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, o.Value)
+	b = appendUint64(b, 2, o.Count)
+	for _, alarm := range o.Alarms {
+		alarmData, err := alarm.MarshalProto()
+		if err != nil {
+			return nil, err
+		}
+		b = appendMessage(b, 3, alarmData)
+	}
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *AlarmGroup) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &o.Value)
+		case 2:
+			return consumeUint64(typ, b, &o.Count)
+		case 3:
+			return consumeMessage(typ, b, func(data []byte) error {
+				var alarm Alarm
+				if err := alarm.UnmarshalProto(data); err != nil {
+					return err
+				}
+				o.Alarms = append(o.Alarms, alarm)
+				return nil
+			})
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o QueryAlarms) MarshalProto() ([]byte, error) {
+	return appendString(nil, 1, string(o.UserID)), nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *QueryAlarms) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 {
+			return consumeString(typ, b, (*string)(&o.UserID))
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o AlarmState) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(o.AlarmID))
+	b = appendString(b, 2, string(o.Status))
+	b = appendTime(b, 3, o.LatestChangedAt)
+	b = appendBool(b, 4, o.ToSend)
+	b = appendBool(b, 5, o.Acknowledged)
+	b = appendTime(b, 6, o.AcknowledgementExpiresAt)
+	b = appendTime(b, 7, o.StatusChangedAt)
+	b = appendBool(b, 8, o.Flapping)
+	for _, t := range o.Transitions {
+		b = appendTime(b, 9, t)
+	}
+	b = appendBool(b, 10, o.Notified)
+	b = appendLabels(b, 11, o.Labels)
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *AlarmState) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, (*string)(&o.AlarmID))
+		case 2:
+			return consumeString(typ, b, (*string)(&o.Status))
+		case 3:
+			return consumeTime(typ, b, &o.LatestChangedAt)
+		case 4:
+			return consumeBool(typ, b, &o.ToSend)
+		case 5:
+			return consumeBool(typ, b, &o.Acknowledged)
+		case 6:
+			return consumeTime(typ, b, &o.AcknowledgementExpiresAt)
+		case 7:
+			return consumeTime(typ, b, &o.StatusChangedAt)
+		case 8:
+			return consumeBool(typ, b, &o.Flapping)
+		case 9:
+			var t time.Time
+			n, err := consumeTime(typ, b, &t)
+			if err == nil {
+				o.Transitions = append(o.Transitions, t)
+			}
+			return n, err
+		case 10:
+			return consumeBool(typ, b, &o.Notified)
+		case 11:
+			return consumeLabel(typ, b, &o.Labels)
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o QueryAlarmsReply) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(o.UserID))
+	for _, alarm := range o.Alarms {
+		alarmData, err := alarm.MarshalProto()
+		if err != nil {
+			return nil, err
+		}
+		b = appendMessage(b, 2, alarmData)
+	}
+	if o.Quota != nil {
+		quotaData, err := o.Quota.MarshalProto()
+		if err != nil {
+			return nil, err
+		}
+		b = appendMessage(b, 3, quotaData)
+	}
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *QueryAlarmsReply) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, (*string)(&o.UserID))
+		case 2:
+			return consumeMessage(typ, b, func(data []byte) error {
+				var alarm AlarmState
+				if err := alarm.UnmarshalProto(data); err != nil {
+					return err
+				}
+				o.Alarms = append(o.Alarms, alarm)
+				return nil
+			})
+		case 3:
+			return consumeMessage(typ, b, func(data []byte) error {
+				o.Quota = &QuotaState{}
+				return o.Quota.UnmarshalProto(data)
+			})
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o QuotaState) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendUint64(b, 1, o.UserAlarms)
+	b = appendUint64(b, 2, o.UserLimit)
+	b = appendUint64(b, 3, o.ShardAlarms)
+	b = appendUint64(b, 4, o.ShardLimit)
+	b = appendString(b, 5, o.Policy)
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *QuotaState) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeUint64(typ, b, &o.UserAlarms)
+		case 2:
+			return consumeUint64(typ, b, &o.UserLimit)
+		case 3:
+			return consumeUint64(typ, b, &o.ShardAlarms)
+		case 4:
+			return consumeUint64(typ, b, &o.ShardLimit)
+		case 5:
+			return consumeString(typ, b, &o.Policy)
+		}
+		return 0, nil
+	})
+}
+
+// MarshalProto encodes message using Protobuf wire format
+func (o QuotaExceeded) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(o.UserID))
+	b = appendString(b, 2, string(o.AlarmID))
+	b = appendString(b, 3, string(o.Scope))
+	b = appendUint64(b, 4, o.Limit)
+	b = appendString(b, 5, o.Policy)
+	b = appendTime(b, 6, o.ExceededAt)
+	return b, nil
+}
+
+// UnmarshalProto decodes message from Protobuf wire format
+func (o *QuotaExceeded) UnmarshalProto(data []byte) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, (*string)(&o.UserID))
+		case 2:
+			return consumeString(typ, b, (*string)(&o.AlarmID))
+		case 3:
+			return consumeString(typ, b, (*string)(&o.Scope))
+		case 4:
+			return consumeUint64(typ, b, &o.Limit)
+		case 5:
+			return consumeString(typ, b, &o.Policy)
+		case 6:
+			return consumeTime(typ, b, &o.ExceededAt)
+		}
+		return 0, nil
+	})
+}
+
+// appendString appends string field, empty string is skipped as in proto3
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendBool appends bool field, false is skipped as in proto3
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeBool(v))
+}
+
+// appendUint64 appends uint64 field, 0 is skipped as in proto3
+func appendUint64(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendMessage appends field containing encoded message
+func appendMessage(b []byte, num protowire.Number, data []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, data)
+}
+
+// appendLabels appends map<string, string> field, entries are sorted by key so encoding is deterministic
+func appendLabels(b []byte, num protowire.Number, labels map[string]string) []byte {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var entry []byte
+		entry = appendString(entry, 1, key)
+		entry = appendString(entry, 2, labels[key])
+		b = appendMessage(b, num, entry)
+	}
+	return b
+}
+
+// appendTime appends field containing google.protobuf.Timestamp message, zero time is skipped
+func appendTime(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	var ts []byte
+	ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, uint64(t.Unix()))
+	if nanos := t.Nanosecond(); nanos != 0 {
+		ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(nanos))
+	}
+	return appendMessage(b, num, ts)
+}
+
+// consumeFields calls fn for each field of the message. Fn returns the number of bytes consumed,
+// field is skipped if 0 is returned.
+func consumeFields(data []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("decoding tag failed: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		n, err := fn(num, typ, data)
+		if err != nil {
+			return fmt.Errorf("decoding field %d failed: %w", num, err)
+		}
+		if n == 0 {
+			// Unknown fields are skipped so new fields may be added to the schema
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return fmt.Errorf("skipping field %d failed: %w", num, protowire.ParseError(n))
+			}
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func consumeString(typ protowire.Type, b []byte, s *string) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, fmt.Errorf("unexpected wire type %d", typ)
+	}
+	v, n := protowire.ConsumeString(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	*s = v
+	return n, nil
+}
+
+func consumeBool(typ protowire.Type, b []byte, v *bool) (int, error) {
+	if typ != protowire.VarintType {
+		return 0, fmt.Errorf("unexpected wire type %d", typ)
+	}
+	x, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	*v = protowire.DecodeBool(x)
+	return n, nil
+}
+
+func consumeUint64(typ protowire.Type, b []byte, v *uint64) (int, error) {
+	if typ != protowire.VarintType {
+		return 0, fmt.Errorf("unexpected wire type %d", typ)
+	}
+	x, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	*v = x
+	return n, nil
+}
+
+func consumeMessage(typ protowire.Type, b []byte, fn func(data []byte) error) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, fmt.Errorf("unexpected wire type %d", typ)
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	return n, fn(v)
+}
+
+// consumeLabel decodes single entry of map<string, string> field
+func consumeLabel(typ protowire.Type, b []byte, labels *map[string]string) (int, error) {
+	return consumeMessage(typ, b, func(data []byte) error {
+		var key, value string
+		err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			switch num {
+			case 1:
+				return consumeString(typ, b, &key)
+			case 2:
+				return consumeString(typ, b, &value)
+			}
+			return 0, nil
+		})
+		if err != nil {
+			return err
+		}
+		if *labels == nil {
+			*labels = map[string]string{}
+		}
+		(*labels)[key] = value
+		return nil
+	})
+}
+
+func consumeTime(typ protowire.Type, b []byte, t *time.Time) (int, error) {
+	return consumeMessage(typ, b, func(data []byte) error {
+		var seconds, nanos uint64
+		err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			if typ != protowire.VarintType || (num != 1 && num != 2) {
+				return 0, nil
+			}
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			if num == 1 {
+				seconds = v
+			} else {
+				nanos = v
+			}
+			return n, nil
+		})
+		if err != nil {
+			return err
+		}
+		*t = time.Unix(int64(seconds), int64(nanos)).UTC()
+		return nil
+	})
+}
@@ -0,0 +1,564 @@
+package wire
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	// timestamp.proto is imported by wire.proto, so it has to be registered
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSendAlarmDigestProtoRoundTrip(t *testing.T) {
+	msg := SendAlarmDigest{
+		ShardedEntity: ShardedEntity{UserID: "user"},
+		RequestID:     "request",
+	}
+	data, err := msg.MarshalProto()
+	require.NoError(t, err)
+
+	var decoded SendAlarmDigest
+	require.NoError(t, decoded.UnmarshalProto(data))
+	assert.Equal(t, msg, decoded)
+}
+
+func TestSetDigestScheduleProtoRoundTrip(t *testing.T) {
+	msg := SetDigestSchedule{
+		ShardedEntity: ShardedEntity{UserID: "user"},
+		DigestSchedule: DigestSchedule{
+			Spec:     "0 8 * * 1-5",
+			TimeZone: "Europe/Warsaw",
+			SetAt:    time.Date(2021, 10, 1, 8, 0, 0, 0, time.UTC),
+		},
+	}
+	data, err := msg.MarshalProto()
+	require.NoError(t, err)
+
+	var decoded SetDigestSchedule
+	require.NoError(t, decoded.UnmarshalProto(data))
+	assert.Equal(t, msg, decoded)
+}
+
+func TestCreateSilenceProtoRoundTrip(t *testing.T) {
+	msg := CreateSilence{
+		ShardedEntity: ShardedEntity{UserID: "user"},
+		Silence: Silence{
+			SilenceID: "silence",
+			MatchType: MatchPrefix,
+			Pattern:   "disk",
+			StartsAt:  time.Date(2021, 10, 1, 8, 0, 0, 0, time.UTC),
+			EndsAt:    time.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC),
+		},
+	}
+	data, err := msg.MarshalProto()
+	require.NoError(t, err)
+
+	var decoded CreateSilence
+	require.NoError(t, decoded.UnmarshalProto(data))
+	assert.Equal(t, msg, decoded)
+}
+
+func TestFlappingAlarmProtoRoundTrip(t *testing.T) {
+	msg := Alarm{
+		AlarmID:         "alarm",
+		Status:          StatusWarning,
+		LatestChangedAt: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		Flapping:        true,
+		Transitions:     5,
+	}
+	data, err := msg.MarshalProto()
+	require.NoError(t, err)
+
+	var decoded Alarm
+	require.NoError(t, decoded.UnmarshalProto(data))
+	assert.Equal(t, msg, decoded)
+}
+
+func TestTimeBeforeEpochIsEncodedInProto(t *testing.T) {
+	msg := Alarm{
+		AlarmID:         "alarm",
+		Status:          StatusWarning,
+		LatestChangedAt: time.Date(1969, 12, 31, 23, 59, 58, 500, time.UTC),
+	}
+	data, err := msg.MarshalProto()
+	require.NoError(t, err)
+
+	var decoded Alarm
+	require.NoError(t, decoded.UnmarshalProto(data))
+	assert.Equal(t, msg, decoded)
+}
+
+func TestUnknownProtoFieldsAreSkipped(t *testing.T) {
+	data, err := SendAlarmDigest{ShardedEntity: ShardedEntity{UserID: "user"}}.MarshalProto()
+	require.NoError(t, err)
+	data = protowire.AppendTag(data, 10, protowire.VarintType)
+	data = protowire.AppendVarint(data, 5)
+
+	var decoded SendAlarmDigest
+	require.NoError(t, decoded.UnmarshalProto(data))
+	assert.Equal(t, UserID("user"), decoded.UserID)
+}
+
+func TestInvalidProtoIsRejected(t *testing.T) {
+	var decoded SendAlarmDigest
+	assert.Error(t, decoded.UnmarshalProto([]byte{0x0a, 0x05, 'u'}))
+}
+
+func TestQueryAlarmsReplyProtoRoundTrip(t *testing.T) {
+	msg := QueryAlarmsReply{
+		UserID: "user",
+		Alarms: []AlarmState{
+			{AlarmID: "alarm1", Status: StatusCleared, LatestChangedAt: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), Flapping: true, Transitions: []time.Time{
+				time.Date(2020, 12, 31, 0, 0, 0, 0, time.UTC),
+				time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			}},
+			{AlarmID: "alarm2", Status: StatusCritical, LatestChangedAt: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), StatusChangedAt: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), ToSend: true},
+		},
+		Quota: &QuotaState{UserAlarms: 2, UserLimit: 10, ShardAlarms: 5, ShardLimit: 100, Policy: "lru"},
+	}
+
+	data, err := msg.MarshalProto()
+	require.NoError(t, err)
+
+	var decoded QueryAlarmsReply
+	require.NoError(t, decoded.UnmarshalProto(data))
+	assert.Equal(t, msg, decoded)
+}
+
+func TestSetDigestPreferencesProtoRoundTrip(t *testing.T) {
+	msg := SetDigestPreferences{
+		ShardedEntity: ShardedEntity{UserID: "user"},
+		DigestPreferences: DigestPreferences{
+			MinSeverity:     StatusCritical,
+			Order:           OrderPrefix,
+			PrefixSeparator: "/",
+			MaxAlarms:       10,
+			SetAt:           time.Date(2021, 10, 1, 8, 0, 0, 0, time.UTC),
+		},
+	}
+	data, err := msg.MarshalProto()
+	require.NoError(t, err)
+
+	var decoded SetDigestPreferences
+	require.NoError(t, decoded.UnmarshalProto(data))
+	assert.Equal(t, msg, decoded)
+}
+
+func TestAlarmDigestWithResolvedAlarmsProtoRoundTrip(t *testing.T) {
+	msg := AlarmDigest{
+		UserID: "user",
+		ActiveAlarms: []Alarm{
+			{AlarmID: "alarm1", Status: StatusCritical, LatestChangedAt: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		ResolvedAlarms: []Alarm{
+			{AlarmID: "alarm2", Status: StatusCleared, LatestChangedAt: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+	data, err := msg.MarshalProto()
+	require.NoError(t, err)
+
+	var decoded AlarmDigest
+	require.NoError(t, decoded.UnmarshalProto(data))
+	assert.Equal(t, msg, decoded)
+}
+
+func TestAlarmStatusChangedWithLabelsProtoRoundTrip(t *testing.T) {
+	msg := AlarmStatusChanged{
+		ShardedEntity: ShardedEntity{UserID: "user"},
+		AlarmID:       "alarm",
+		Status:        StatusCritical,
+		ChangedAt:     time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		Labels:        map[string]string{"host": "server1", "room": "", "chart": "disk"},
+	}
+	data, err := msg.MarshalProto()
+	require.NoError(t, err)
+
+	var decoded AlarmStatusChanged
+	require.NoError(t, decoded.UnmarshalProto(data))
+	assert.Equal(t, msg, decoded)
+
+	// Encoding doesn't depend on the order of map iteration
+	data2, err := msg.MarshalProto()
+	require.NoError(t, err)
+	assert.Equal(t, data, data2)
+}
+
+func TestGroupedAlarmDigestProtoRoundTrip(t *testing.T) {
+	msg := AlarmDigest{
+		UserID:    "user",
+		GroupedBy: "host",
+		Groups: []AlarmGroup{
+			{
+				Value: "server1",
+				Count: 1,
+				Alarms: []Alarm{
+					{AlarmID: "alarm1", Status: StatusCritical, LatestChangedAt: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), Labels: map[string]string{"host": "server1"}},
+				},
+			},
+			{
+				Count: 1,
+				Alarms: []Alarm{
+					{AlarmID: "alarm2", Status: StatusWarning, LatestChangedAt: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+				},
+			},
+		},
+	}
+	data, err := msg.MarshalProto()
+	require.NoError(t, err)
+
+	var decoded AlarmDigest
+	require.NoError(t, decoded.UnmarshalProto(data))
+	assert.Equal(t, msg, decoded)
+}
+
+func TestQuotaExceededProtoRoundTrip(t *testing.T) {
+	msg := QuotaExceeded{
+		UserID:     "user",
+		AlarmID:    "alarm",
+		Scope:      QuotaScopeShard,
+		Limit:      100,
+		Policy:     "evict-cleared",
+		ExceededAt: time.Date(2021, 10, 1, 8, 0, 0, 0, time.UTC),
+	}
+
+	data, err := msg.MarshalProto()
+	require.NoError(t, err)
+
+	var decoded QuotaExceeded
+	require.NoError(t, decoded.UnmarshalProto(data))
+	assert.Equal(t, msg, decoded)
+}
+
+var (
+	protoCommentRegexp = regexp.MustCompile(`//.*`)
+	protoMessageRegexp = regexp.MustCompile(`(?s)message\s+(\w+)\s*\{(.*?)\}`)
+	protoFieldRegexp   = regexp.MustCompile(`^(repeated\s+)?(map<string,\s*string>|[\w.]+)\s+(\w+)\s*=\s*(\d+);$`)
+)
+
+// protoMessage is the message which is encoded by hand in proto.go
+type protoMessage interface {
+	MarshalProto() ([]byte, error)
+	UnmarshalProto(data []byte) error
+}
+
+// parseWireProto builds file descriptor from wire.proto. Parser supports only the subset of the language used by the file.
+func parseWireProto(t *testing.T) protoreflect.FileDescriptor {
+	data, err := ioutil.ReadFile("wire.proto")
+	require.NoError(t, err)
+	src := protoCommentRegexp.ReplaceAllString(string(data), "")
+
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("wire.proto"),
+		Package:    proto.String("netdata.wire"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+	}
+	for _, m := range protoMessageRegexp.FindAllStringSubmatch(src, -1) {
+		msg := &descriptorpb.DescriptorProto{Name: proto.String(m[1])}
+		for _, line := range strings.Split(m[2], "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			f := protoFieldRegexp.FindStringSubmatch(line)
+			require.NotNil(t, f, "unsupported line in message %s: %s", m[1], line)
+
+			number, err := strconv.ParseInt(f[4], 10, 32)
+			require.NoError(t, err)
+			field := &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String(f[3]),
+				JsonName: proto.String(protoJSONName(f[3])),
+				Number:   proto.Int32(int32(number)),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}
+			if f[1] != "" {
+				field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			}
+			switch f[2] {
+			case "string":
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()
+			case "bool":
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_BOOL.Enum()
+			case "uint64":
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_UINT64.Enum()
+			case "google.protobuf.Timestamp":
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				field.TypeName = proto.String(".google.protobuf.Timestamp")
+			default:
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				if !strings.HasPrefix(f[2], "map<") {
+					field.TypeName = proto.String(".netdata.wire." + f[2])
+					break
+				}
+
+				// Map is the repeated nested entry message with key and value fields
+				entry := strings.ToUpper(f[3][:1]) + f[3][1:] + "Entry"
+				field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+				field.TypeName = proto.String(".netdata.wire." + m[1] + "." + entry)
+				msg.NestedType = append(msg.NestedType, &descriptorpb.DescriptorProto{
+					Name: proto.String(entry),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						{
+							Name:     proto.String("key"),
+							JsonName: proto.String("key"),
+							Number:   proto.Int32(1),
+							Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+							Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+						},
+						{
+							Name:     proto.String("value"),
+							JsonName: proto.String("value"),
+							Number:   proto.Int32(2),
+							Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+							Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+						},
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				})
+			}
+			msg.Field = append(msg.Field, field)
+		}
+		fdp.MessageType = append(fdp.MessageType, msg)
+	}
+
+	fd, err := protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+	require.NoError(t, err)
+	return fd
+}
+
+// protoJSONName converts snake case field name to lower camel case, the way protoc does it
+func protoJSONName(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+	}
+	return strings.Join(parts, "")
+}
+
+// requireAllFieldsKnown checks that every field defined by the schema is set and there are no fields unknown to it
+func requireAllFieldsKnown(t *testing.T, msg protoreflect.Message) {
+	name := msg.Descriptor().FullName()
+	require.Empty(t, msg.GetUnknown(), "message %s contains fields not defined in wire.proto", name)
+
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		require.True(t, msg.Has(fd), "field %s.%s is not set", name, fd.Name())
+
+		if fd.Kind() != protoreflect.MessageKind || fd.IsMap() {
+			continue
+		}
+		if !fd.IsList() {
+			requireAllFieldsKnown(t, msg.Get(fd).Message())
+			continue
+		}
+		list := msg.Get(fd).List()
+		for j := 0; j < list.Len(); j++ {
+			requireAllFieldsKnown(t, list.Get(j).Message())
+		}
+	}
+}
+
+func TestProtoEncodingMatchesSchema(t *testing.T) {
+	fd := parseWireProto(t)
+
+	ts := func(hour int) time.Time {
+		return time.Date(2021, 10, 1, hour, 0, 0, 500, time.UTC)
+	}
+	alarm := func(alarmID AlarmID) Alarm {
+		return Alarm{
+			AlarmID:         alarmID,
+			Status:          StatusWarning,
+			LatestChangedAt: ts(1),
+			Flapping:        true,
+			Transitions:     3,
+			Labels:          map[string]string{"host": "a"},
+		}
+	}
+
+	// Every field has to be set to a non-zero value, so fields missing in the encoding are detected
+	tests := []struct {
+		Name     string
+		Msg      protoMessage
+		Decoded  protoMessage
+		Expected protoMessage
+	}{
+		{
+			Name: "AlarmStatusChanged",
+			Msg: &AlarmStatusChanged{
+				ShardedEntity: ShardedEntity{UserID: "user"},
+				AlarmID:       "alarm",
+				Status:        StatusCritical,
+				ChangedAt:     ts(1),
+				Labels:        map[string]string{"host": "a", "disk": "sda"},
+			},
+			Decoded: &AlarmStatusChanged{},
+		},
+		{
+			Name: "SendAlarmDigest",
+			Msg: &SendAlarmDigest{
+				ShardedEntity: ShardedEntity{UserID: "user"},
+				RequestID:     "request",
+			},
+			Decoded: &SendAlarmDigest{},
+		},
+		{
+			Name: "AcknowledgeAlarm",
+			Msg: &AcknowledgeAlarm{
+				ShardedEntity:  ShardedEntity{UserID: "user"},
+				AlarmID:        "alarm",
+				AcknowledgedAt: ts(1),
+				ExpiresAt:      ts(2),
+			},
+			Decoded: &AcknowledgeAlarm{},
+		},
+		{
+			Name: "SetDigestSchedule",
+			Msg: &SetDigestSchedule{
+				ShardedEntity: ShardedEntity{UserID: "user"},
+				DigestSchedule: DigestSchedule{
+					Spec:     "0 8 * * 1-5",
+					TimeZone: "Europe/Warsaw",
+					SetAt:    ts(1),
+				},
+			},
+			Decoded: &SetDigestSchedule{},
+		},
+		{
+			Name: "SetDigestPreferences",
+			Msg: &SetDigestPreferences{
+				ShardedEntity: ShardedEntity{UserID: "user"},
+				DigestPreferences: DigestPreferences{
+					MinSeverity:     StatusCritical,
+					Order:           OrderPrefix,
+					PrefixSeparator: ".",
+					MaxAlarms:       10,
+					GroupByLabel:    "host",
+					SetAt:           ts(1),
+				},
+			},
+			Decoded: &SetDigestPreferences{},
+		},
+		{
+			Name: "CreateSilence",
+			Msg: &CreateSilence{
+				ShardedEntity: ShardedEntity{UserID: "user"},
+				Silence: Silence{
+					SilenceID: "silence",
+					MatchType: MatchRegex,
+					Pattern:   "^disk",
+					StartsAt:  ts(1),
+					EndsAt:    ts(2),
+				},
+			},
+			Decoded: &CreateSilence{},
+		},
+		{
+			Name: "DeleteSilence",
+			Msg: &DeleteSilence{
+				ShardedEntity: ShardedEntity{UserID: "user"},
+				SilenceID:     "silence",
+			},
+			Decoded: &DeleteSilence{},
+		},
+		{
+			Name: "AlarmDigest",
+			Msg: &AlarmDigest{
+				UserID:         "user",
+				ActiveAlarms:   []Alarm{alarm("alarm1"), alarm("alarm2")},
+				ResolvedAlarms: []Alarm{alarm("alarm3")},
+				GroupedBy:      "host",
+				Groups: []AlarmGroup{
+					{
+						Value:  "a",
+						Count:  2,
+						Alarms: []Alarm{alarm("alarm1"), alarm("alarm2")},
+					},
+				},
+			},
+			Decoded: &AlarmDigest{},
+		},
+		{
+			Name: "QueryAlarms",
+			Msg: &QueryAlarms{
+				ShardedEntity: ShardedEntity{UserID: "user"},
+			},
+			Decoded: &QueryAlarms{},
+		},
+		{
+			Name: "QueryAlarmsReply",
+			Msg: &QueryAlarmsReply{
+				UserID: "user",
+				Alarms: []AlarmState{
+					{
+						AlarmID:                  "alarm",
+						Status:                   StatusWarning,
+						LatestChangedAt:          ts(3),
+						StatusChangedAt:          ts(2),
+						ToSend:                   true,
+						Acknowledged:             true,
+						AcknowledgementExpiresAt: ts(4),
+						Flapping:                 true,
+						Transitions:              []time.Time{ts(1), ts(2)},
+						Notified:                 true,
+						Labels:                   map[string]string{"host": "a"},
+					},
+				},
+				Quota: &QuotaState{
+					UserAlarms:  1,
+					UserLimit:   10,
+					ShardAlarms: 5,
+					ShardLimit:  100,
+					Policy:      "reject",
+				},
+			},
+			Decoded: &QueryAlarmsReply{},
+		},
+		{
+			Name: "QuotaExceeded",
+			Msg: &QuotaExceeded{
+				UserID:     "user",
+				AlarmID:    "alarm",
+				Scope:      QuotaScopeUser,
+				Limit:      10,
+				Policy:     "evict-cleared",
+				ExceededAt: ts(1),
+			},
+			Decoded: &QuotaExceeded{},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			desc := fd.Messages().ByName(protoreflect.Name(test.Name))
+			require.NotNil(t, desc, "message %s is not defined in wire.proto", test.Name)
+
+			// Message encoded by proto.go is decoded using the schema
+			data, err := test.Msg.MarshalProto()
+			require.NoError(t, err)
+			msg := dynamicpb.NewMessage(desc)
+			require.NoError(t, proto.Unmarshal(data, msg))
+			requireAllFieldsKnown(t, msg)
+
+			// Message encoded using the schema is decoded by proto.go
+			data, err = proto.Marshal(msg)
+			require.NoError(t, err)
+			require.NoError(t, test.Decoded.UnmarshalProto(data))
+			assert.Equal(t, test.Msg, test.Decoded)
+		})
+	}
+}
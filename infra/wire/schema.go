@@ -0,0 +1,165 @@
+package wire
+
+// Topics and schema versions of the messages. Topic names are defined explicitly, so renaming Go types
+// doesn't change them. Schema version has to be increased whenever message changes in a way older consumers
+// can't handle, upgrade from the previous version has to be added then.
+
+// Topic returns the name of topic where message is published
+func (o AlarmStatusChanged) Topic() string {
+	return "AlarmStatusChanged"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o AlarmStatusChanged) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o SendAlarmDigest) Topic() string {
+	return "SendAlarmDigest"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o SendAlarmDigest) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o AcknowledgeAlarm) Topic() string {
+	return "AcknowledgeAlarm"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o AcknowledgeAlarm) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o SetDigestSchedule) Topic() string {
+	return "SetDigestSchedule"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o SetDigestSchedule) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o SetDigestPreferences) Topic() string {
+	return "SetDigestPreferences"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o SetDigestPreferences) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o CreateSilence) Topic() string {
+	return "CreateSilence"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o CreateSilence) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o DeleteSilence) Topic() string {
+	return "DeleteSilence"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o DeleteSilence) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o AlarmDigest) Topic() string {
+	return "AlarmDigest"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o AlarmDigest) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o QueryAlarms) Topic() string {
+	return "QueryAlarms"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o QueryAlarms) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o QuotaExceeded) Topic() string {
+	return "QuotaExceeded"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o QuotaExceeded) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published, reply is published to the subject of the request
+func (o QueryAlarmsReply) Topic() string {
+	return "QueryAlarmsReply"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o QueryAlarmsReply) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o ReshardRequested) Topic() string {
+	return "ReshardRequested"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o ReshardRequested) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o ReshardPrepared) Topic() string {
+	return "ReshardPrepared"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o ReshardPrepared) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o HandoffCompleted) Topic() string {
+	return "HandoffCompleted"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o HandoffCompleted) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o DigestPublished) Topic() string {
+	return "DigestPublished"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o DigestPublished) SchemaVersion() uint64 {
+	return 1
+}
+
+// Topic returns the name of topic where message is published
+func (o AlarmsHandedOff) Topic() string {
+	return "AlarmsHandedOff"
+}
+
+// SchemaVersion returns the current version of message schema
+func (o AlarmsHandedOff) SchemaVersion() uint64 {
+	return 1
+}
@@ -0,0 +1,17 @@
+package wire
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/netdata/infra/schema"
+)
+
+func TestSendAlarmDigestWithoutEnvelopeKeepsRequestID(t *testing.T) {
+	// External producers publish plain JSON without headers, so message has zero schema version
+	var msg SendAlarmDigest
+	require.NoError(t, schema.Decode(json.Unmarshal, []byte(`{"UserID":"user","RequestID":"request"}`), 0, &msg))
+	assert.Equal(t, SendAlarmDigest{ShardedEntity: ShardedEntity{UserID: "user"}, RequestID: "request"}, msg)
+}
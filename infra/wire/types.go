@@ -3,7 +3,10 @@ package wire
 import (
 	"errors"
 	"fmt"
+	"regexp"
 	"time"
+
+	"github.com/wojciech-malota-wojcik/netdata/lib/schedule"
 )
 
 // UserID is the user ID
@@ -26,6 +29,34 @@ const (
 	StatusCritical Status = "CRITICAL"
 )
 
+// DigestOrder is the order of alarms in the digest
+type DigestOrder string
+
+const (
+	// OrderChronological sorts alarms from the oldest to the newest
+	OrderChronological DigestOrder = "CHRONOLOGICAL"
+
+	// OrderSeverity sorts CRITICAL alarms before WARNING ones, then chronologically
+	OrderSeverity DigestOrder = "SEVERITY"
+
+	// OrderPrefix groups alarms by the prefix of alarm ID, then sorts them chronologically
+	OrderPrefix DigestOrder = "PREFIX"
+)
+
+// MatchType is the way silence matches alarm IDs
+type MatchType string
+
+const (
+	// MatchExact matches alarm ID equal to the pattern
+	MatchExact MatchType = "EXACT"
+
+	// MatchPrefix matches alarm IDs starting with the pattern
+	MatchPrefix MatchType = "PREFIX"
+
+	// MatchRegex matches alarm IDs fully matching regular expression
+	MatchRegex MatchType = "REGEX"
+)
+
 // ShardedEntity is data entity which is a subject of sharding
 type ShardedEntity struct {
 	// UserID is the user ID
@@ -37,6 +68,17 @@ func (e *ShardedEntity) ShardSeed() []byte {
 	return []byte(e.UserID)
 }
 
+// BroadcastEntity is data entity delivered to all the shards
+type BroadcastEntity struct{}
+
+// ShardSeed returns nil because entity is not a subject of sharding
+func (e *BroadcastEntity) ShardSeed() []byte {
+	return nil
+}
+
+// Broadcast marks entity as delivered to all the shards
+func (e *BroadcastEntity) Broadcast() {}
+
 // AlarmStatusChanged is the incoming AlarmStatusChanged message
 type AlarmStatusChanged struct {
 	ShardedEntity
@@ -49,6 +91,9 @@ type AlarmStatusChanged struct {
 
 	// ChangedAt is the time when the status changed
 	ChangedAt time.Time
+
+	// Labels are the optional labels of the alarm like host, chart or room, they replace the ones sent before
+	Labels map[string]string `json:",omitempty"`
 }
 
 // Validate validates if message contains valid data
@@ -62,12 +107,21 @@ func (o AlarmStatusChanged) Validate() error {
 	if o.ChangedAt.IsZero() {
 		return errors.New("field ChangedAt is a zero time")
 	}
+	if _, exists := o.Labels[""]; exists {
+		return errors.New("label key is empty")
+	}
 	return verifyStatus(o.Status)
 }
 
+// Routable marks entity as routed to shard subjects
+func (o AlarmStatusChanged) Routable() {}
+
 // SendAlarmDigest is the incoming SendAlarmDigest message
 type SendAlarmDigest struct {
 	ShardedEntity
+
+	// RequestID is the optional ID of the request, duplicated request with the same ID gets the same digest
+	RequestID string `json:",omitempty"`
 }
 
 // Validate validates if message contains valid data
@@ -78,6 +132,219 @@ func (o SendAlarmDigest) Validate() error {
 	return nil
 }
 
+// Routable marks entity as routed to shard subjects
+func (o SendAlarmDigest) Routable() {}
+
+// AcknowledgeAlarm is the incoming AcknowledgeAlarm message, acknowledged alarm is left out of digests until its status
+// changes or acknowledgement expires
+type AcknowledgeAlarm struct {
+	ShardedEntity
+
+	// AlarmID is the alarm ID
+	AlarmID AlarmID
+
+	// AcknowledgedAt is the time when user acknowledged the alarm, acknowledgement is ignored if status changed after that
+	AcknowledgedAt time.Time
+
+	// ExpiresAt is the optional time when acknowledgement expires, it lasts until status changes if zero
+	ExpiresAt time.Time
+}
+
+// Validate validates if message contains valid data
+func (o AcknowledgeAlarm) Validate() error {
+	if o.UserID == "" {
+		return errors.New("field UserID is empty")
+	}
+	if o.AlarmID == "" {
+		return errors.New("field AlarmID is empty")
+	}
+	if o.AcknowledgedAt.IsZero() {
+		return errors.New("field AcknowledgedAt is a zero time")
+	}
+	if !o.ExpiresAt.IsZero() && !o.ExpiresAt.After(o.AcknowledgedAt) {
+		return errors.New("field ExpiresAt is not after AcknowledgedAt")
+	}
+	return nil
+}
+
+// Routable marks entity as routed to shard subjects
+func (o AcknowledgeAlarm) Routable() {}
+
+// DigestSchedule defines when digests are sent to the user by the scheduler
+type DigestSchedule struct {
+	// Spec is the schedule: "@every 15m", "@daily 08:00" or cron expression like "0 8 * * 1-5", empty one removes the schedule
+	Spec string `json:",omitempty"`
+
+	// TimeZone is the IANA name of time zone used by daily and cron schedules, UTC is used if empty
+	TimeZone string `json:",omitempty"`
+
+	// SetAt is the time when schedule was set, schedule set earlier than the current one is ignored
+	SetAt time.Time
+}
+
+// SetDigestSchedule is the incoming SetDigestSchedule message, it replaces the digest schedule of the user
+type SetDigestSchedule struct {
+	ShardedEntity
+	DigestSchedule
+}
+
+// Validate validates if message contains valid data
+func (o SetDigestSchedule) Validate() error {
+	if o.UserID == "" {
+		return errors.New("field UserID is empty")
+	}
+	if o.SetAt.IsZero() {
+		return errors.New("field SetAt is a zero time")
+	}
+	if o.Spec == "" {
+		return nil
+	}
+	if _, err := schedule.Parse(o.Spec, o.TimeZone); err != nil {
+		return fmt.Errorf("schedule is invalid: %w", err)
+	}
+	return nil
+}
+
+// Routable marks entity as routed to shard subjects
+func (o SetDigestSchedule) Routable() {}
+
+// DigestPreferences defines how digests of the user are built
+type DigestPreferences struct {
+	// MinSeverity is the lowest status of alarms included in digests, all of them are included if empty
+	MinSeverity Status `json:",omitempty"`
+
+	// Order is the order of alarms in digests, alarms are sorted chronologically if empty
+	Order DigestOrder `json:",omitempty"`
+
+	// PrefixSeparator ends the prefix of alarm ID used to group alarms by OrderPrefix, "." is used if empty
+	PrefixSeparator string `json:",omitempty"`
+
+	// MaxAlarms is the maximum number of alarms in a digest, remaining ones are sent in the next digest, 0 means no limit
+	MaxAlarms uint64 `json:",omitempty"`
+
+	// GroupByLabel is the label key by which active alarms are grouped in digests, they are not grouped if empty
+	GroupByLabel string `json:",omitempty"`
+
+	// SetAt is the time when preferences were set, preferences set earlier than the current ones are ignored
+	SetAt time.Time
+}
+
+// SetDigestPreferences is the incoming SetDigestPreferences message, it replaces digest preferences of the user
+type SetDigestPreferences struct {
+	ShardedEntity
+	DigestPreferences
+}
+
+// Validate validates if message contains valid data
+func (o SetDigestPreferences) Validate() error {
+	if o.UserID == "" {
+		return errors.New("field UserID is empty")
+	}
+	if o.SetAt.IsZero() {
+		return errors.New("field SetAt is a zero time")
+	}
+	switch o.MinSeverity {
+	case "", StatusWarning, StatusCritical:
+	default:
+		return fmt.Errorf("invalid minimum severity: %s", o.MinSeverity)
+	}
+	switch o.Order {
+	case "", OrderChronological, OrderSeverity, OrderPrefix:
+	default:
+		return fmt.Errorf("unknown order: %s", o.Order)
+	}
+	return nil
+}
+
+// Routable marks entity as routed to shard subjects
+func (o SetDigestPreferences) Routable() {}
+
+// Silence mutes matching alarms of the user during the time window
+type Silence struct {
+	// SilenceID is the unique ID of the silence
+	SilenceID string
+
+	// MatchType is the way alarm IDs are matched
+	MatchType MatchType
+
+	// Pattern is matched against alarm IDs, empty prefix matches all the alarms
+	Pattern string `json:",omitempty"`
+
+	// StartsAt is the time when silence starts, it starts immediately if zero
+	StartsAt time.Time
+
+	// EndsAt is the time when silence ends
+	EndsAt time.Time
+}
+
+// Validate validates if silence contains valid data
+func (o Silence) Validate() error {
+	if o.SilenceID == "" {
+		return errors.New("field SilenceID is empty")
+	}
+	switch o.MatchType {
+	case MatchExact:
+		if o.Pattern == "" {
+			return errors.New("field Pattern is empty")
+		}
+	case MatchPrefix:
+	case MatchRegex:
+		if _, err := regexp.Compile(o.Pattern); err != nil {
+			return fmt.Errorf("field Pattern is not a valid regular expression: %w", err)
+		}
+	case "":
+		return errors.New("match type is empty")
+	default:
+		return fmt.Errorf("unknown match type: %s", o.MatchType)
+	}
+	if o.EndsAt.IsZero() {
+		return errors.New("field EndsAt is a zero time")
+	}
+	if !o.EndsAt.After(o.StartsAt) {
+		return errors.New("field EndsAt is not after StartsAt")
+	}
+	return nil
+}
+
+// CreateSilence is the incoming CreateSilence message, matching alarms are left out of digests until silence ends
+type CreateSilence struct {
+	ShardedEntity
+	Silence
+}
+
+// Validate validates if message contains valid data
+func (o CreateSilence) Validate() error {
+	if o.UserID == "" {
+		return errors.New("field UserID is empty")
+	}
+	return o.Silence.Validate()
+}
+
+// Routable marks entity as routed to shard subjects
+func (o CreateSilence) Routable() {}
+
+// DeleteSilence is the incoming DeleteSilence message, it ends the silence before its time
+type DeleteSilence struct {
+	ShardedEntity
+
+	// SilenceID is the ID of the silence
+	SilenceID string
+}
+
+// Validate validates if message contains valid data
+func (o DeleteSilence) Validate() error {
+	if o.UserID == "" {
+		return errors.New("field UserID is empty")
+	}
+	if o.SilenceID == "" {
+		return errors.New("field SilenceID is empty")
+	}
+	return nil
+}
+
+// Routable marks entity as routed to shard subjects
+func (o DeleteSilence) Routable() {}
+
 // Alarm contains the current state of the alarm
 type Alarm struct {
 	// AlarmID is the alarm ID
@@ -88,6 +355,27 @@ type Alarm struct {
 
 	// LatestChangedAt is the time when status was updated
 	LatestChangedAt time.Time
+
+	// Flapping is true if status of the alarm changes too often, alarm is not sent again until it settles
+	Flapping bool `json:",omitempty"`
+
+	// Transitions is the number of recent status changes of flapping alarm
+	Transitions uint64 `json:",omitempty"`
+
+	// Labels are the labels of the alarm
+	Labels map[string]string `json:",omitempty"`
+}
+
+// AlarmGroup contains active alarms having the same value of the label
+type AlarmGroup struct {
+	// Value is the value of the label, it is empty for alarms without the label
+	Value string
+
+	// Count is the number of alarms in the group
+	Count uint64
+
+	// Alarms are the alarms of the group
+	Alarms []Alarm
 }
 
 // AlarmDigest is the outgoing AlarmDigest message
@@ -97,6 +385,306 @@ type AlarmDigest struct {
 
 	// ActiveAlarms is the list of active alarms
 	ActiveAlarms []Alarm
+
+	// ResolvedAlarms is the list of alarms sent as active before which have been cleared since then
+	ResolvedAlarms []Alarm `json:",omitempty"`
+
+	// GroupedBy is the label key by which active alarms are grouped, alarms from ActiveAlarms are in Groups then
+	GroupedBy string `json:",omitempty"`
+
+	// Groups are the groups of active alarms sorted by label value, group of alarms without the label is the last one
+	Groups []AlarmGroup `json:",omitempty"`
+}
+
+// QueryAlarms is the incoming QueryAlarms request, it is answered with QueryAlarmsReply without changing the state
+type QueryAlarms struct {
+	ShardedEntity
+}
+
+// Validate validates if message contains valid data
+func (o QueryAlarms) Validate() error {
+	if o.UserID == "" {
+		return errors.New("field UserID is empty")
+	}
+	return nil
+}
+
+// Request marks entity as a request expecting reply
+func (o QueryAlarms) Request() {}
+
+// QueryAlarmsReply is the reply to QueryAlarms request
+type QueryAlarmsReply struct {
+	// UserID is the user ID
+	UserID UserID
+
+	// Alarms contains all the alarms tracked for the user, sorted by LatestChangedAt
+	Alarms []AlarmState
+
+	// Quota is the state of alarm quotas, it is set only if any quota is configured
+	Quota *QuotaState `json:",omitempty"`
+}
+
+// QuotaState is the usage of alarm quotas, limit equal to 0 means there is no limit
+type QuotaState struct {
+	// UserAlarms is the number of alarms tracked for the user
+	UserAlarms uint64
+
+	// UserLimit is the maximum number of alarms tracked for single user
+	UserLimit uint64
+
+	// ShardAlarms is the number of alarms tracked by the local shard owning the user
+	ShardAlarms uint64
+
+	// ShardLimit is the maximum number of alarms tracked by single local shard
+	ShardLimit uint64
+
+	// Policy is the policy applied when new alarm exceeds the quota
+	Policy string
+}
+
+// QuotaScope is the scope of alarm quota
+type QuotaScope string
+
+const (
+	// QuotaScopeUser is the quota of alarms tracked for single user
+	QuotaScopeUser QuotaScope = "USER"
+
+	// QuotaScopeShard is the quota of alarms tracked by single local shard
+	QuotaScopeShard QuotaScope = "SHARD"
+)
+
+// QuotaExceeded is the outgoing QuotaExceeded event, it is published when new alarm hits the quota
+type QuotaExceeded struct {
+	// UserID is the ID of the user whose alarm hit the quota
+	UserID UserID
+
+	// AlarmID is the ID of the new alarm, it is empty if quota is exceeded by alarms taken over during resharding
+	AlarmID AlarmID
+
+	// Scope is the scope of the quota
+	Scope QuotaScope
+
+	// Limit is the limit of the quota
+	Limit uint64
+
+	// Policy is the policy applied
+	Policy string
+
+	// ExceededAt is the time when quota was hit
+	ExceededAt time.Time
+}
+
+// ReshardRequested is the incoming ReshardRequested message, it starts resharding
+type ReshardRequested struct {
+	BroadcastEntity
+
+	// Epoch is the epoch of the new shard map, it has to be greater than the current one
+	Epoch uint64
+
+	// NumOfShards is the total number of shards in the new shard map
+	NumOfShards uint64
+}
+
+// Validate validates if message contains valid data
+func (o ReshardRequested) Validate() error {
+	if o.Epoch == 0 {
+		return errors.New("field Epoch is zero")
+	}
+	if o.NumOfShards == 0 {
+		return errors.New("field NumOfShards is zero")
+	}
+	return nil
+}
+
+// ReshardPrepared is published by node once it routes messages using both the current and the new shard map
+type ReshardPrepared struct {
+	BroadcastEntity
+
+	// Epoch is the epoch of the new shard map
+	Epoch uint64
+
+	// ShardID is the shard ID of the node
+	ShardID uint64
+}
+
+// Validate validates if message contains valid data
+func (o ReshardPrepared) Validate() error {
+	if o.Epoch == 0 {
+		return errors.New("field Epoch is zero")
+	}
+	return nil
+}
+
+// HandoffCompleted is published by node once all the users it no longer owns are handed off to the new owners
+type HandoffCompleted struct {
+	BroadcastEntity
+
+	// Epoch is the epoch of the new shard map
+	Epoch uint64
+
+	// ShardID is the shard ID of the node
+	ShardID uint64
+
+	// Handoffs contains number of users handed off to each shard
+	Handoffs map[uint64]uint64
+}
+
+// Validate validates if message contains valid data
+func (o HandoffCompleted) Validate() error {
+	if o.Epoch == 0 {
+		return errors.New("field Epoch is zero")
+	}
+	return nil
+}
+
+// AlarmState is the complete state of the alarm handed off to the new owner
+type AlarmState struct {
+	// AlarmID is the alarm ID
+	AlarmID AlarmID
+
+	// Status is the last reported status
+	Status Status
+
+	// LatestChangedAt is the time when status was updated
+	LatestChangedAt time.Time
+
+	// StatusChangedAt is the time when the current status was reported first
+	StatusChangedAt time.Time
+
+	// ToSend is true if alarm should be sent in the next digest
+	ToSend bool
+
+	// Acknowledged is true if alarm has been acknowledged by the user since its status changed
+	Acknowledged bool `json:",omitempty"`
+
+	// AcknowledgementExpiresAt is the time when acknowledgement expires, it lasts until status changes if zero
+	AcknowledgementExpiresAt time.Time
+
+	// Flapping is true if status of the alarm changes too often
+	Flapping bool `json:",omitempty"`
+
+	// Transitions contains times of recent status changes used to detect flapping
+	Transitions []time.Time `json:",omitempty"`
+
+	// Notified is true if the user has been notified about alarm being active and not about its resolution
+	Notified bool `json:",omitempty"`
+
+	// Labels are the labels of the alarm
+	Labels map[string]string `json:",omitempty"`
+}
+
+// AnsweredRequest is the SendAlarmDigest request answered recently, handed off so its duplicates are still recognized
+type AnsweredRequest struct {
+	// RequestID is the ID of the request
+	RequestID string
+
+	// AnsweredAt is the time when request was answered
+	AnsweredAt time.Time
+
+	// Digest is the digest sent in response, nil if there was nothing to send
+	Digest *AlarmDigest `json:",omitempty"`
+}
+
+// AlarmsHandedOff contains alarms of the user handed off to the new owner during resharding
+type AlarmsHandedOff struct {
+	ShardedEntity
+
+	// Epoch is the epoch of the new shard map
+	Epoch uint64
+
+	// Alarms are the alarms of the user
+	Alarms []AlarmState
+
+	// Watermark is the latest change of the user's alarms removed by retention, older updates of unknown alarms are ignored
+	Watermark time.Time
+
+	// Schedule is the digest schedule of the user
+	Schedule DigestSchedule
+
+	// NextDigestAt is the time when the next scheduled digest is sent
+	NextDigestAt time.Time
+
+	// Silences are the silences of the user which haven't ended yet
+	Silences []Silence `json:",omitempty"`
+
+	// Preferences are the digest preferences of the user
+	Preferences DigestPreferences
+
+	// DigestDeferred is true if digest of the user has been deferred by rate limit
+	DigestDeferred bool `json:",omitempty"`
+
+	// Requests are the SendAlarmDigest requests of the user answered recently
+	Requests []AnsweredRequest `json:",omitempty"`
+}
+
+// Validate validates if message contains valid data
+func (o AlarmsHandedOff) Validate() error {
+	if o.UserID == "" {
+		return errors.New("field UserID is empty")
+	}
+	if o.Epoch == 0 {
+		return errors.New("field Epoch is zero")
+	}
+	for _, alarm := range o.Alarms {
+		if alarm.AlarmID == "" {
+			return errors.New("field AlarmID is empty")
+		}
+		if err := verifyStatus(alarm.Status); err != nil {
+			return err
+		}
+	}
+	for _, request := range o.Requests {
+		if request.RequestID == "" {
+			return errors.New("field RequestID is empty")
+		}
+	}
+	return nil
+}
+
+// PublishedAlarm is the alarm included in the digest published by the leader
+type PublishedAlarm struct {
+	// AlarmID is the alarm ID
+	AlarmID AlarmID
+
+	// Revision is the revision of the alarm included in the digest
+	Revision uint64
+
+	// LatestChangedAt is the time of the latest change of the alarm included in the digest
+	LatestChangedAt time.Time
+}
+
+// DigestPublished is published by the leader of replicated shard once broker confirms the digest,
+// so followers remove the same alarms from their outboxes
+type DigestPublished struct {
+	ShardedEntity
+
+	// DigestID is the ID of the digest
+	DigestID string
+
+	// Alarms contains alarms included in the digest
+	Alarms []PublishedAlarm `json:",omitempty"`
+
+	// PublishedAt is the time when broker confirmed the digest
+	PublishedAt time.Time
+}
+
+// Validate validates if message contains valid data
+func (o DigestPublished) Validate() error {
+	if o.UserID == "" {
+		return errors.New("field UserID is empty")
+	}
+	if o.DigestID == "" {
+		return errors.New("field DigestID is empty")
+	}
+	if o.PublishedAt.IsZero() {
+		return errors.New("field PublishedAt is empty")
+	}
+	for _, alarm := range o.Alarms {
+		if alarm.AlarmID == "" {
+			return errors.New("field AlarmID of published alarm is empty")
+		}
+	}
+	return nil
 }
 
 // verifyStatus verifies that incoming status is one of accepted values
@@ -65,6 +65,14 @@ func TestValidateAlarmStatusChanged(t *testing.T) {
 	e = entity
 	e.ChangedAt = time.Time{}
 	assert.Error(t, e.Validate())
+
+	e = entity
+	e.Labels = map[string]string{"host": "server1", "room": ""}
+	assert.NoError(t, e.Validate())
+
+	e = entity
+	e.Labels = map[string]string{"": "server1"}
+	assert.Error(t, e.Validate())
 }
 
 func TestValidateSendAlarmDigest(t *testing.T) {
@@ -80,6 +88,187 @@ func TestValidateSendAlarmDigest(t *testing.T) {
 	assert.Error(t, e.Validate())
 }
 
+func TestValidateAcknowledgeAlarm(t *testing.T) {
+	now := time.Now()
+	entity := AcknowledgeAlarm{
+		ShardedEntity: ShardedEntity{
+			UserID: "userID",
+		},
+		AlarmID:        "alarmID",
+		AcknowledgedAt: now,
+	}
+	assert.NoError(t, entity.Validate())
+
+	e := entity
+	e.ExpiresAt = now.Add(time.Hour)
+	assert.NoError(t, e.Validate())
+
+	e = entity
+	e.UserID = ""
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.AlarmID = ""
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.AcknowledgedAt = time.Time{}
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.ExpiresAt = now.Add(-time.Hour)
+	assert.Error(t, e.Validate())
+}
+
+func TestValidateSetDigestSchedule(t *testing.T) {
+	entity := SetDigestSchedule{
+		ShardedEntity: ShardedEntity{
+			UserID: "userID",
+		},
+		DigestSchedule: DigestSchedule{
+			Spec:     "@daily 08:00",
+			TimeZone: "Europe/Warsaw",
+			SetAt:    time.Now(),
+		},
+	}
+	assert.NoError(t, entity.Validate())
+
+	e := entity
+	e.Spec = ""
+	e.TimeZone = ""
+	assert.NoError(t, e.Validate())
+
+	e = entity
+	e.UserID = ""
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.SetAt = time.Time{}
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.Spec = "@daily 8"
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.TimeZone = "Europe/Unknown"
+	assert.Error(t, e.Validate())
+}
+
+func TestValidateSetDigestPreferences(t *testing.T) {
+	entity := SetDigestPreferences{
+		ShardedEntity: ShardedEntity{
+			UserID: "userID",
+		},
+		DigestPreferences: DigestPreferences{
+			MinSeverity: StatusWarning,
+			Order:       OrderSeverity,
+			MaxAlarms:   10,
+			SetAt:       time.Now(),
+		},
+	}
+	assert.NoError(t, entity.Validate())
+
+	e := entity
+	e.MinSeverity = ""
+	e.Order = ""
+	e.MaxAlarms = 0
+	assert.NoError(t, e.Validate())
+
+	e = entity
+	e.UserID = ""
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.SetAt = time.Time{}
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.MinSeverity = StatusCleared
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.Order = "RANDOM"
+	assert.Error(t, e.Validate())
+}
+
+func TestValidateCreateSilence(t *testing.T) {
+	now := time.Now()
+	entity := CreateSilence{
+		ShardedEntity: ShardedEntity{
+			UserID: "userID",
+		},
+		Silence: Silence{
+			SilenceID: "silenceID",
+			MatchType: MatchRegex,
+			Pattern:   "disk[0-9]+",
+			StartsAt:  now,
+			EndsAt:    now.Add(time.Hour),
+		},
+	}
+	assert.NoError(t, entity.Validate())
+
+	e := entity
+	e.StartsAt = time.Time{}
+	assert.NoError(t, e.Validate())
+
+	e = entity
+	e.MatchType = MatchPrefix
+	e.Pattern = ""
+	assert.NoError(t, e.Validate())
+
+	e = entity
+	e.UserID = ""
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.SilenceID = ""
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.MatchType = ""
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.MatchType = "GLOB"
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.MatchType = MatchExact
+	e.Pattern = ""
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.Pattern = "disk["
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.EndsAt = time.Time{}
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.EndsAt = now
+	assert.Error(t, e.Validate())
+}
+
+func TestValidateDeleteSilence(t *testing.T) {
+	entity := DeleteSilence{
+		ShardedEntity: ShardedEntity{
+			UserID: "userID",
+		},
+		SilenceID: "silenceID",
+	}
+	assert.NoError(t, entity.Validate())
+
+	e := entity
+	e.UserID = ""
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.SilenceID = ""
+	assert.Error(t, e.Validate())
+}
+
 func TestShardSeedAlarmStatusChanged(t *testing.T) {
 	entity := AlarmStatusChanged{
 		ShardedEntity: ShardedEntity{
@@ -100,3 +289,86 @@ func TestShardSeedSendAlarmDigest(t *testing.T) {
 	}
 	assert.Equal(t, []byte("userID"), entity.ShardSeed())
 }
+
+func TestValidateReshardRequested(t *testing.T) {
+	entity := ReshardRequested{
+		Epoch:       1,
+		NumOfShards: 2,
+	}
+	assert.NoError(t, entity.Validate())
+
+	e := entity
+	e.Epoch = 0
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.NumOfShards = 0
+	assert.Error(t, e.Validate())
+}
+
+func TestValidateAlarmsHandedOff(t *testing.T) {
+	entity := AlarmsHandedOff{
+		ShardedEntity: ShardedEntity{
+			UserID: "userID",
+		},
+		Epoch: 1,
+		Alarms: []AlarmState{
+			{
+				AlarmID:         "alarmID",
+				Status:          StatusWarning,
+				LatestChangedAt: time.Now(),
+				ToSend:          true,
+			},
+		},
+	}
+	assert.NoError(t, entity.Validate())
+
+	e := entity
+	e.UserID = ""
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.Epoch = 0
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.Alarms = []AlarmState{{AlarmID: "alarmID", Status: "invalid"}}
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.Requests = []AnsweredRequest{{AnsweredAt: time.Now()}}
+	assert.Error(t, e.Validate())
+}
+
+func TestValidateDigestPublished(t *testing.T) {
+	entity := DigestPublished{
+		ShardedEntity: ShardedEntity{
+			UserID: "userID",
+		},
+		DigestID:    "digestID",
+		Alarms:      []PublishedAlarm{{AlarmID: "alarmID", Revision: 1, LatestChangedAt: time.Now()}},
+		PublishedAt: time.Now(),
+	}
+	assert.NoError(t, entity.Validate())
+
+	e := entity
+	e.UserID = ""
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.DigestID = ""
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.PublishedAt = time.Time{}
+	assert.Error(t, e.Validate())
+
+	e = entity
+	e.Alarms = []PublishedAlarm{{Revision: 1}}
+	assert.Error(t, e.Validate())
+}
+
+func TestShardSeedBroadcastEntity(t *testing.T) {
+	entity := ReshardRequested{}
+	assert.Nil(t, entity.ShardSeed())
+}
@@ -0,0 +1,362 @@
+package netdata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ridge/must"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"github.com/wojciech-malota-wojcik/netdata/lib/wal"
+	"go.uber.org/zap"
+)
+
+const (
+	layoutFile     = "layout.json"
+	reshardingFile = "resharding.json"
+)
+
+// journal persists changes applied to the state of local shard
+type journal interface {
+	// Record stores the change in the journal
+	Record(change journalRecord) error
+
+	// Compact stores snapshot of the state and removes changes it already contains from the journal
+	Compact(state *shardState) error
+
+	// Close closes the journal
+	Close() error
+}
+
+// journalRecord is the change applied to the state of local shard, exactly one field is set
+type journalRecord struct {
+	// AlarmStatusChanged is set if alarm status update was applied
+	AlarmStatusChanged *wire.AlarmStatusChanged `json:",omitempty"`
+
+	// AlarmAcknowledged is set if alarm acknowledgement was applied
+	AlarmAcknowledged *wire.AcknowledgeAlarm `json:",omitempty"`
+
+	// DigestStaged is set if digest was put into the outbox
+	DigestStaged *stagedDigest `json:",omitempty"`
+
+	// DigestPublished is set to the ID of digest confirmed by the broker
+	DigestPublished string `json:",omitempty"`
+
+	// DigestAnnounced is set if leader announced that digest was published
+	DigestAnnounced *wire.DigestPublished `json:",omitempty"`
+
+	// UsersHandedOff is set if users were handed off to other nodes during resharding
+	UsersHandedOff *usersHandedOff `json:",omitempty"`
+
+	// AlarmsHandedOff is set if user was taken over from another node during resharding
+	AlarmsHandedOff *wire.AlarmsHandedOff `json:",omitempty"`
+
+	// ReshardCommitted is set to the epoch of shard map committed by resharding
+	ReshardCommitted uint64 `json:",omitempty"`
+
+	// SilenceCreated is set if silence was created
+	SilenceCreated *wire.CreateSilence `json:",omitempty"`
+
+	// SilenceDeleted is set if silence was deleted
+	SilenceDeleted *wire.DeleteSilence `json:",omitempty"`
+
+	// FlappingSettled is set if alarms stopped flapping
+	FlappingSettled *settledAlarms `json:",omitempty"`
+
+	// ScheduleUpdated is set if digest schedule of the user was set or advanced
+	ScheduleUpdated *scheduleUpdate `json:",omitempty"`
+
+	// PreferencesSet is set if digest preferences of the user were set
+	PreferencesSet *wire.SetDigestPreferences `json:",omitempty"`
+
+	// LimitUpdated is set if bucket limiting rate of digests sent to the user was updated
+	LimitUpdated *limitUpdate `json:",omitempty"`
+
+	// AlarmEvicted is set if alarm was removed to make room for new one when quota was hit
+	AlarmEvicted *evictedAlarm `json:",omitempty"`
+
+	// AlarmsExpired is set if cleared alarms older than retention horizon were removed
+	AlarmsExpired []evictedAlarm `json:",omitempty"`
+
+	// RequestAnswered is set if SendAlarmDigest request with ID was answered without sending digest
+	RequestAnswered *answeredRequest `json:",omitempty"`
+}
+
+// layout describes how users are distributed between shards
+type layout struct {
+	// ShardID is the shard ID of the node
+	ShardID sharding.ID
+
+	// NumOfShards is the total number of running shards
+	NumOfShards uint64
+
+	// NumOfLocalShards is the number of shards managed using local resources
+	NumOfLocalShards uint64
+
+	// ShardIDGenerator is the name of algorithm used to assign users to shards
+	ShardIDGenerator string
+
+	// ShardMapEpoch is the epoch of shard map set by the last resharding
+	ShardMapEpoch uint64 `json:",omitempty"`
+}
+
+// openJournal opens the journal of local shard and restores the state stored there
+func openJournal(config infra.Config, localShardID uint64, log *zap.Logger) (journal, *shardState, error) {
+	state := newShardState()
+	state.flapping = newFlappingPolicy(config)
+	state.resolve = config.ResolvedAlarms
+	if config.StateDir == "" {
+		return noJournal{}, state, nil
+	}
+
+	dir := filepath.Join(config.StateDir, fmt.Sprintf("local-shard-%d", localShardID))
+	walLog, err := wal.Open(dir, func(snapshot []byte) error {
+		if err := json.Unmarshal(snapshot, state); err != nil {
+			return fmt.Errorf("decoding snapshot failed: %w", err)
+		}
+		return nil
+	}, func(record []byte) error {
+		var change journalRecord
+		if err := json.Unmarshal(record, &change); err != nil {
+			return fmt.Errorf("decoding journal record failed: %w", err)
+		}
+		return state.replay(log, change)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return walJournal{log: walLog}, state, nil
+}
+
+// prepareStateDir creates state directory and verifies that state stored there was produced using the same sharding layout,
+// epoch of the shard map is restored from there
+func prepareStateDir(config infra.Config, shardMap *sharding.Map) error {
+	if config.StateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(config.StateDir, 0o700); err != nil {
+		return fmt.Errorf("creating state directory failed: %w", err)
+	}
+
+	current := currentLayout(config)
+	stored, err := readLayout(config)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return writeLayout(config, current)
+	case err != nil:
+		return err
+	}
+
+	// Epoch is not configured, it is set by resharding
+	current.ShardMapEpoch = stored.ShardMapEpoch
+	if stored != current {
+		return fmt.Errorf("state in %s was stored using different sharding layout %+v, current one is %+v", config.StateDir, stored, current)
+	}
+	shardMap.Restore(stored.ShardMapEpoch)
+	return nil
+}
+
+// updateLayout stores shard map set by resharding
+func updateLayout(config infra.Config, epoch uint64, numOfShards uint64) error {
+	if config.StateDir == "" {
+		return nil
+	}
+
+	l := currentLayout(config)
+	l.NumOfShards = numOfShards
+	l.ShardMapEpoch = epoch
+	return writeLayout(config, l)
+}
+
+func currentLayout(config infra.Config) layout {
+	return layout{
+		ShardID:          config.ShardID,
+		NumOfShards:      config.NumOfShards,
+		NumOfLocalShards: config.NumOfLocalShards,
+		ShardIDGenerator: layoutShardIDGenerator(config.ShardIDGenerator),
+	}
+}
+
+// layoutShardIDGenerator returns name of shard ID generator stored in layout, layouts written before
+// generator was configurable don't contain it and were produced by xor-modulo one
+func layoutShardIDGenerator(name string) string {
+	if name == "" {
+		return sharding.XORModulo
+	}
+	return name
+}
+
+func readLayout(config infra.Config) (layout, error) {
+	data, err := os.ReadFile(filepath.Join(config.StateDir, layoutFile))
+	if err != nil {
+		return layout{}, fmt.Errorf("reading layout file failed: %w", err)
+	}
+
+	var l layout
+	if err := json.Unmarshal(data, &l); err != nil {
+		return layout{}, fmt.Errorf("decoding layout file failed: %w", err)
+	}
+	l.ShardIDGenerator = layoutShardIDGenerator(l.ShardIDGenerator)
+	return l, nil
+}
+
+// writeLayout replaces layout file atomically
+func writeLayout(config infra.Config, l layout) error {
+	if err := writeStateFile(config, layoutFile, l); err != nil {
+		return fmt.Errorf("writing layout file failed: %w", err)
+	}
+	return nil
+}
+
+// readReshardingProgress reads progress of resharding in progress, zero value is returned if there is none
+func readReshardingProgress(config infra.Config) (reshardingProgress, error) {
+	if config.StateDir == "" {
+		return reshardingProgress{}, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(config.StateDir, reshardingFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return reshardingProgress{}, nil
+	case err != nil:
+		return reshardingProgress{}, fmt.Errorf("reading resharding file failed: %w", err)
+	}
+
+	var p reshardingProgress
+	if err := json.Unmarshal(data, &p); err != nil {
+		return reshardingProgress{}, fmt.Errorf("decoding resharding file failed: %w", err)
+	}
+	return p, nil
+}
+
+// writeReshardingProgress replaces resharding file atomically
+func writeReshardingProgress(config infra.Config, p reshardingProgress) error {
+	if config.StateDir == "" {
+		return nil
+	}
+	if err := writeStateFile(config, reshardingFile, p); err != nil {
+		return fmt.Errorf("writing resharding file failed: %w", err)
+	}
+	return nil
+}
+
+// writeStateFile replaces file in the state directory atomically
+func writeStateFile(config infra.Config, name string, v interface{}) error {
+	path := filepath.Join(config.StateDir, name)
+	if err := writeSynced(path+".tmp", must.Bytes(json.Marshal(v))); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	// Rename is durable only after directory is synced
+	return syncDir(config.StateDir)
+}
+
+// writeSynced writes data to file and flushes it to disk
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes directory entries to disk
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		_ = dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+// replay applies change stored in the journal
+func (st *shardState) replay(log *zap.Logger, change journalRecord) error {
+	switch {
+	case change.AlarmStatusChanged != nil:
+		st.applyAlarmStatusChanged(log, *change.AlarmStatusChanged)
+	case change.AlarmAcknowledged != nil:
+		st.Users.applyAcknowledgeAlarm(log, *change.AlarmAcknowledged)
+	case change.DigestStaged != nil:
+		st.stage(change.DigestStaged)
+	case change.DigestPublished != "":
+		st.markPublished(change.DigestPublished)
+	case change.DigestAnnounced != nil:
+		st.applyDigestPublished(*change.DigestAnnounced)
+	case change.SilenceCreated != nil:
+		st.applyCreateSilence(log, *change.SilenceCreated)
+	case change.SilenceDeleted != nil:
+		st.applyDeleteSilence(log, *change.SilenceDeleted)
+	case change.FlappingSettled != nil:
+		st.settle(change.FlappingSettled)
+	case change.ScheduleUpdated != nil:
+		st.setSchedule(change.ScheduleUpdated)
+	case change.PreferencesSet != nil:
+		st.setPreferences(change.PreferencesSet.UserID, change.PreferencesSet.DigestPreferences)
+	case change.LimitUpdated != nil:
+		st.setLimit(change.LimitUpdated)
+	case change.AlarmEvicted != nil:
+		st.evictAlarm(change.AlarmEvicted)
+	case change.AlarmsExpired != nil:
+		st.expireAlarms(change.AlarmsExpired)
+	case change.RequestAnswered != nil:
+		st.rememberRequest(change.RequestAnswered)
+	case change.UsersHandedOff != nil:
+		st.handOffUsers(change.UsersHandedOff)
+	case change.AlarmsHandedOff != nil:
+		st.takeOverUser(*change.AlarmsHandedOff)
+	case change.ReshardCommitted != 0:
+		st.commitHandoff(change.ReshardCommitted)
+	default:
+		return errors.New("empty journal record")
+	}
+	return nil
+}
+
+type walJournal struct {
+	log *wal.Log
+}
+
+func (j walJournal) Record(change journalRecord) error {
+	return j.log.Append(must.Bytes(json.Marshal(change)))
+}
+
+func (j walJournal) Compact(state *shardState) error {
+	return j.log.Compact(must.Bytes(json.Marshal(state)))
+}
+
+func (j walJournal) Close() error {
+	return j.log.Close()
+}
+
+// noJournal is used when persistence is turned off
+type noJournal struct{}
+
+func (noJournal) Record(change journalRecord) error {
+	return nil
+}
+
+func (noJournal) Compact(state *shardState) error {
+	return nil
+}
+
+func (noJournal) Close() error {
+	return nil
+}
@@ -0,0 +1,160 @@
+package netdata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func runWithJournalTest(t *testing.T, config infra.Config, messages ...interface{}) []wire.AlarmDigest {
+	j, state, err := openJournal(config, 0, logger.New())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, j.Close())
+	}()
+
+	return runLocalShardWithStateTest(t, config, state, j, messages...)
+}
+
+func TestStateIsRestoredFromJournal(t *testing.T) {
+	config := infra.Config{StateDir: t.TempDir()}
+
+	assert.Len(t, runWithJournalTest(t, config,
+		change(user1, alarm1, wire.StatusCritical, time1),
+		change(user1, alarm2, wire.StatusWarning, time2),
+		change(user2, alarm1, wire.StatusWarning, time1),
+	), 0)
+
+	result := runWithJournalTest(t, config,
+		change(user1, alarm2, wire.StatusCleared, time3),
+		send(user1),
+		send(user2),
+	)
+	require.Len(t, result, 2)
+	assert.Equal(t, wire.AlarmDigest{
+		UserID: user1,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm1,
+				Status:          wire.StatusCritical,
+				LatestChangedAt: time1,
+			},
+		},
+	}, result[0])
+	assert.Equal(t, wire.AlarmDigest{
+		UserID: user2,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm1,
+				Status:          wire.StatusWarning,
+				LatestChangedAt: time1,
+			},
+		},
+	}, result[1])
+
+	// Status updated before restart is still stored
+	assert.Len(t, runWithJournalTest(t, config,
+		change(user1, alarm2, wire.StatusWarning, time2),
+		send(user1),
+	), 0)
+}
+
+func TestSentAlarmsAreNotSentAgainAfterRestart(t *testing.T) {
+	config := infra.Config{StateDir: t.TempDir()}
+
+	require.Len(t, runWithJournalTest(t, config,
+		change(user1, alarm1, wire.StatusCritical, time1),
+		send(user1),
+	), 1)
+
+	assert.Len(t, runWithJournalTest(t, config,
+		send(user1),
+	), 0)
+}
+
+func TestStateDirWithDifferentLayoutIsRejected(t *testing.T) {
+	config := infra.Config{
+		StateDir:         t.TempDir(),
+		NumOfShards:      1,
+		NumOfLocalShards: 2,
+	}
+	require.NoError(t, prepareStateDir(config, sharding.NewMap(config.NumOfShards)))
+	require.NoError(t, prepareStateDir(config, sharding.NewMap(config.NumOfShards)))
+
+	config.NumOfLocalShards = 3
+	assert.Error(t, prepareStateDir(config, sharding.NewMap(config.NumOfShards)))
+
+	config.NumOfLocalShards = 2
+	config.ShardIDGenerator = sharding.JumpHash
+	assert.Error(t, prepareStateDir(config, sharding.NewMap(config.NumOfShards)))
+}
+
+func TestStateFileIsReplaced(t *testing.T) {
+	config := infra.Config{StateDir: t.TempDir()}
+	require.NoError(t, writeStateFile(config, layoutFile, layout{NumOfShards: 1}))
+	require.NoError(t, writeStateFile(config, layoutFile, layout{NumOfShards: 2}))
+
+	stored, err := readLayout(config)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), stored.NumOfShards)
+
+	_, err = os.Stat(filepath.Join(config.StateDir, layoutFile+".tmp"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLayoutWithoutShardIDGeneratorIsAcceptedForXORModulo(t *testing.T) {
+	config := infra.Config{
+		StateDir:         t.TempDir(),
+		NumOfShards:      1,
+		NumOfLocalShards: 2,
+		ShardIDGenerator: sharding.XORModulo,
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(config.StateDir, layoutFile),
+		[]byte(`{"ShardID":0,"NumOfShards":1,"NumOfLocalShards":2}`), 0o600))
+	require.NoError(t, prepareStateDir(config, sharding.NewMap(config.NumOfShards)))
+
+	config.ShardIDGenerator = sharding.JumpHash
+	assert.Error(t, prepareStateDir(config, sharding.NewMap(config.NumOfShards)))
+}
+
+func TestStateIsRestoredFromSnapshot(t *testing.T) {
+	config := infra.Config{
+		StateDir:        t.TempDir(),
+		SnapshotChanges: 2,
+	}
+
+	require.Len(t, runWithJournalTest(t, config,
+		change(user1, alarm1, wire.StatusCritical, time1),
+		change(user1, alarm2, wire.StatusWarning, time2),
+		change(user2, alarm1, wire.StatusWarning, time1),
+		send(user2),
+		change(user1, alarm1, wire.StatusCleared, time3),
+	), 1)
+
+	snapshots, err := filepath.Glob(filepath.Join(config.StateDir, "local-shard-0", "snapshot-*"))
+	require.NoError(t, err)
+	assert.Len(t, snapshots, 2)
+
+	result := runWithJournalTest(t, config,
+		send(user1),
+		send(user2),
+	)
+	require.Len(t, result, 1)
+	assert.Equal(t, wire.AlarmDigest{
+		UserID: user1,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm2,
+				Status:          wire.StatusWarning,
+				LatestChangedAt: time2,
+			},
+		},
+	}, result[0])
+}
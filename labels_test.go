@@ -0,0 +1,140 @@
+package netdata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func changeWithLabels(userID wire.UserID, alarmID wire.AlarmID, status wire.Status, labels map[string]string) wire.AlarmStatusChanged {
+	m := change(userID, alarmID, status, time1)
+	m.Labels = labels
+	return m
+}
+
+func TestLabelsAreSentInDigest(t *testing.T) {
+	state := newShardState()
+	result := runLocalShardWithStateTest(t, infra.Config{}, state, noJournal{},
+		changeWithLabels(user1, alarm1, wire.StatusWarning, map[string]string{"host": "server1"}),
+		change(user1, alarm1, wire.StatusCritical, time2),
+		send(user1),
+		changeWithLabels(user1, alarm1, wire.StatusCritical, map[string]string{"host": "server2"}),
+	)
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusCritical,
+					LatestChangedAt: time2,
+					Labels:          map[string]string{"host": "server1"},
+				},
+			},
+		},
+	}, result)
+
+	// Outdated update doesn't replace labels
+	assert.Equal(t, map[string]string{"host": "server1"}, state.Users[user1][alarm1].Labels)
+}
+
+func TestAlarmsAreGroupedByLabel(t *testing.T) {
+	result := runLocalShardWithStateTest(t, infra.Config{}, newShardState(), noJournal{},
+		setPreferences(user1, wire.DigestPreferences{GroupByLabel: "host"}),
+		changeWithLabels(user1, "a", wire.StatusWarning, map[string]string{"host": "server2"}),
+		changeWithLabels(user1, "b", wire.StatusWarning, map[string]string{"room": "room1"}),
+		changeWithLabels(user1, "c", wire.StatusCritical, map[string]string{"host": "server1"}),
+		changeWithLabels(user1, "d", wire.StatusWarning, map[string]string{"host": "server2"}),
+		send(user1),
+	)
+	assert.Len(t, result, 1)
+	digest := result[0]
+	assert.Len(t, digest.ActiveAlarms, 4)
+	assert.Equal(t, "host", digest.GroupedBy)
+
+	groups := map[string][]wire.AlarmID{}
+	values := []string{}
+	for _, group := range digest.Groups {
+		assert.EqualValues(t, len(group.Alarms), group.Count)
+		values = append(values, group.Value)
+		for _, alarm := range group.Alarms {
+			groups[group.Value] = append(groups[group.Value], alarm.AlarmID)
+		}
+	}
+	assert.Equal(t, []string{"server1", "server2", ""}, values)
+	assert.Equal(t, map[string][]wire.AlarmID{
+		"server1": {"c"},
+		"server2": {"a", "d"},
+		"":        {"b"},
+	}, groups)
+}
+
+func TestGroupedAlarmsAreSentAsResolved(t *testing.T) {
+	result := runLocalShardWithStateTest(t, infra.Config{ResolvedAlarms: true}, newShardState(), noJournal{},
+		setPreferences(user1, wire.DigestPreferences{GroupByLabel: "host"}),
+		changeWithLabels(user1, alarm1, wire.StatusWarning, map[string]string{"host": "server1"}),
+		changeWithLabels(user1, alarm2, wire.StatusCritical, map[string]string{"host": "server2"}),
+		send(user1),
+		change(user1, alarm1, wire.StatusCleared, time2),
+		send(user1),
+	)
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusWarning,
+					LatestChangedAt: time1,
+					Labels:          map[string]string{"host": "server1"},
+				},
+				{
+					AlarmID:         alarm2,
+					Status:          wire.StatusCritical,
+					LatestChangedAt: time1,
+					Labels:          map[string]string{"host": "server2"},
+				},
+			},
+			GroupedBy: "host",
+			Groups: []wire.AlarmGroup{
+				{
+					Value: "server1",
+					Count: 1,
+					Alarms: []wire.Alarm{
+						{
+							AlarmID:         alarm1,
+							Status:          wire.StatusWarning,
+							LatestChangedAt: time1,
+							Labels:          map[string]string{"host": "server1"},
+						},
+					},
+				},
+				{
+					Value: "server2",
+					Count: 1,
+					Alarms: []wire.Alarm{
+						{
+							AlarmID:         alarm2,
+							Status:          wire.StatusCritical,
+							LatestChangedAt: time1,
+							Labels:          map[string]string{"host": "server2"},
+						},
+					},
+				},
+			},
+		},
+		{
+			UserID: user1,
+			ResolvedAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusCleared,
+					LatestChangedAt: time2,
+					Labels:          map[string]string{"host": "server1"},
+				},
+			},
+		},
+	}, result)
+}
@@ -0,0 +1,300 @@
+package netdata
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func newTestLeadership(role election.Role) *testLeadership {
+	return &testLeadership{
+		role:    role,
+		changed: make(chan struct{}),
+	}
+}
+
+// testLeadership is the leadership with role set by the test
+type testLeadership struct {
+	mu      sync.Mutex
+	role    election.Role
+	changed chan struct{}
+}
+
+func (l *testLeadership) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (l *testLeadership) Role() election.Role {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.role
+}
+
+func (l *testLeadership) Changed() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.changed
+}
+
+func (l *testLeadership) setRole(role election.Role) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.role = role
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func startReplica(ctx context.Context, state *shardState, leadership election.Leadership) (chan<- interface{}, <-chan interface{}, <-chan error) {
+	config := infra.Config{LeaderElection: true}
+	rx := make(chan interface{})
+	tx := make(chan interface{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runLocalShard(config, state, noJournal{}, newTestResharder(config), leadership, rx, tx)(ctx)
+	}()
+	return rx, tx, errCh
+}
+
+func TestFollowerDoesNotPublishDigests(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	state := newShardState()
+	rx, tx, errCh := startReplica(ctx, state, newTestLeadership(election.RoleFollower))
+
+	rx <- change(user1, alarm1, wire.StatusCritical, time1)
+	rx <- send(user1)
+
+	// Digest is kept until leader announces it is published
+	select {
+	case msg := <-tx:
+		require.Fail(t, "digest published by follower", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.Len(t, state.Outbox, 1)
+	assert.True(t, state.Users[user1][alarm1].ToSend)
+
+	for digestID := range state.Outbox {
+		rx <- wire.DigestPublished{
+			ShardedEntity: wire.ShardedEntity{UserID: user1},
+			DigestID:      digestID,
+			PublishedAt:   time.Now(),
+		}
+	}
+	close(rx)
+	require.NoError(t, <-errCh)
+
+	// Follower's state is the same as the leader's one
+	assert.Empty(t, state.Outbox)
+	assert.False(t, state.Users[user1][alarm1].ToSend)
+}
+
+func TestDigestAnnouncedBeforeFollowerStagedItIsNotKept(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	state := newShardState()
+	rx, tx, errCh := startReplica(ctx, state, newTestLeadership(election.RoleFollower))
+
+	// Leader staged digest containing different alarms, so it has different ID
+	rx <- wire.DigestPublished{
+		ShardedEntity: wire.ShardedEntity{UserID: user1},
+		DigestID:      "digest",
+		Alarms: []wire.PublishedAlarm{
+			{AlarmID: alarm1, Revision: 1, LatestChangedAt: time1},
+			{AlarmID: alarm2, Revision: 1, LatestChangedAt: time1},
+		},
+		PublishedAt: time.Now(),
+	}
+	rx <- change(user1, alarm1, wire.StatusCritical, time1)
+	rx <- send(user1)
+	close(rx)
+	require.NoError(t, <-errCh)
+
+	select {
+	case msg := <-tx:
+		require.Fail(t, "digest published by follower", msg)
+	default:
+	}
+	assert.Empty(t, state.Outbox)
+	assert.False(t, state.Users[user1][alarm1].ToSend)
+}
+
+func TestAlarmsPublishedByLeaderAreRemovedFromFollowerDigest(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	leadership := newTestLeadership(election.RoleFollower)
+	state := newShardState()
+	rx, tx, errCh := startReplica(ctx, state, leadership)
+
+	rx <- change(user1, alarm1, wire.StatusCritical, time1)
+	rx <- change(user1, alarm2, wire.StatusCritical, time2)
+	rx <- change(user1, alarm3, wire.StatusCritical, time1)
+	rx <- send(user1)
+
+	// Leader received change of alarm2 after it published the digest, and alarm3 was created again in the meantime
+	rx <- wire.DigestPublished{
+		ShardedEntity: wire.ShardedEntity{UserID: user1},
+		DigestID:      "digest",
+		Alarms: []wire.PublishedAlarm{
+			{AlarmID: alarm1, Revision: 1, LatestChangedAt: time1},
+			{AlarmID: alarm3, Revision: 2, LatestChangedAt: time1.Add(-time.Hour)},
+		},
+		PublishedAt: time.Now(),
+	}
+
+	// Alarms not published by the leader are published after failover
+	leadership.setRole(election.RoleLeader)
+
+	out := receiveOutgoing(t, tx)
+	assert.Equal(t, &wire.AlarmDigest{
+		UserID: user1,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm3,
+				Status:          wire.StatusCritical,
+				LatestChangedAt: time1,
+			},
+			{
+				AlarmID:         alarm2,
+				Status:          wire.StatusCritical,
+				LatestChangedAt: time2,
+			},
+		},
+	}, out.Msg)
+	out.Confirm(nil)
+	assert.IsType(t, &wire.DigestPublished{}, <-tx)
+
+	close(rx)
+	require.NoError(t, <-errCh)
+	assert.Empty(t, state.Outbox)
+	assert.False(t, state.Users[user1][alarm1].ToSend)
+	assert.False(t, state.Users[user1][alarm2].ToSend)
+	assert.False(t, state.Users[user1][alarm3].ToSend)
+}
+
+func TestDigestsStagedByFollowerExpire(t *testing.T) {
+	state := newShardState()
+	state.applyAlarmStatusChanged(logger.New(), change(user1, alarm1, wire.StatusCritical, time1))
+	digest := &stagedDigest{
+		Digest: wire.AlarmDigest{
+			UserID:       user1,
+			ActiveAlarms: []wire.Alarm{state.Users[user1][alarm1].digestEntry(alarm1)},
+		},
+		Revisions: map[wire.AlarmID]uint64{alarm1: 1},
+		StagedAt:  time.Now().Add(-2 * announcementWindow),
+	}
+	digest.ID = state.digestID(digest)
+	state.stage(digest)
+
+	state.forgetStaged(time.Now().Add(-announcementWindow))
+	assert.Empty(t, state.Outbox)
+	assert.False(t, state.Users[user1][alarm1].ToSend)
+}
+
+func TestDigestIsPublishedOnceReplicaBecomesLeader(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	leadership := newTestLeadership(election.RoleUnknown)
+	state := newShardState()
+	rx, tx, errCh := startReplica(ctx, state, leadership)
+
+	rx <- change(user1, alarm1, wire.StatusCritical, time1)
+	rx <- send(user1)
+	rx <- change(user2, alarm1, wire.StatusCritical, time1)
+
+	// Digest waits in the outbox until it is known who the leader is
+	select {
+	case msg := <-tx:
+		require.Fail(t, "digest published while leader is unknown", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Len(t, state.Outbox, 1)
+
+	leadership.setRole(election.RoleLeader)
+
+	out := receiveOutgoing(t, tx)
+	assert.Equal(t, &wire.AlarmDigest{
+		UserID: user1,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm1,
+				Status:          wire.StatusCritical,
+				LatestChangedAt: time1,
+			},
+		},
+	}, out.Msg)
+	out.Confirm(nil)
+
+	// Leader announces published digest to followers
+	announcement := (<-tx).(*wire.DigestPublished)
+	assert.Equal(t, out.ID, announcement.DigestID)
+	assert.Equal(t, []wire.PublishedAlarm{{AlarmID: alarm1, Revision: 1, LatestChangedAt: time1}}, announcement.Alarms)
+
+	close(rx)
+	require.NoError(t, <-errCh)
+	assert.Empty(t, state.Outbox)
+	assert.False(t, state.Users[user1][alarm1].ToSend)
+}
+
+func TestDigestStagedByFollowerIsPublishedAfterFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	// Leader crashed after staging the digest and before broker confirmed it, so it was never announced
+	leadership := newTestLeadership(election.RoleFollower)
+	state := newShardState()
+	rx, tx, errCh := startReplica(ctx, state, leadership)
+
+	rx <- change(user1, alarm1, wire.StatusCritical, time1)
+	rx <- send(user1)
+
+	select {
+	case msg := <-tx:
+		require.Fail(t, "digest published by follower", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	leadership.setRole(election.RoleLeader)
+
+	out := receiveOutgoing(t, tx)
+	assert.Equal(t, &wire.AlarmDigest{
+		UserID: user1,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm1,
+				Status:          wire.StatusCritical,
+				LatestChangedAt: time1,
+			},
+		},
+	}, out.Msg)
+	out.Confirm(nil)
+	assert.IsType(t, &wire.DigestPublished{}, <-tx)
+
+	// Digest is delivered once
+	rx <- send(user1)
+	select {
+	case msg := <-tx:
+		require.Fail(t, "digest published again", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(rx)
+	require.NoError(t, <-errCh)
+	assert.Empty(t, state.Outbox)
+	assert.False(t, state.Users[user1][alarm1].ToSend)
+}
@@ -0,0 +1,203 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Time zone database is embedded so time zones are available even if system doesn't provide them
+	_ "time/tzdata"
+)
+
+// maxSearch is the period searched for the next time matching cron expression
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+// Schedule computes times of scheduled events
+type Schedule interface {
+	// Next returns the first scheduled time after t, zero time is returned if there is no such time
+	Next(t time.Time) time.Time
+}
+
+// Parse parses the schedule. Supported formats are:
+// - "@every <duration>" - events happen every duration, aligned to the multiples of duration since zero time
+// - "@daily HH:MM" - events happen every day at the time of day in the time zone
+// - "<minute> <hour> <day of month> <month> <day of week>" - cron expression evaluated in the time zone
+func Parse(spec string, timeZone string) (Schedule, error) {
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, fmt.Errorf("loading time zone failed: %w", err)
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, errors.New("schedule is empty")
+	}
+	switch fields[0] {
+	case "@every":
+		if len(fields) != 2 {
+			return nil, errors.New("@every expects duration")
+		}
+		d, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing duration failed: %w", err)
+		}
+		if d < time.Minute {
+			return nil, errors.New("duration must be at least one minute")
+		}
+		return every(d), nil
+	case "@daily":
+		if len(fields) != 2 {
+			return nil, errors.New("@daily expects time of day")
+		}
+		t, err := time.Parse("15:04", fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing time of day failed: %w", err)
+		}
+		return parseCron([]string{strconv.Itoa(t.Minute()), strconv.Itoa(t.Hour()), "*", "*", "*"}, loc)
+	default:
+		return parseCron(fields, loc)
+	}
+}
+
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Truncate(time.Duration(e)).Add(time.Duration(e))
+}
+
+// cron is the parsed cron expression, each field contains set of matching values
+type cron struct {
+	loc     *time.Location
+	minutes uint64
+	hours   uint64
+	days    uint64
+	months  uint64
+	weekday uint64
+
+	// anyDay and anyWeekday are set if fields are "*", day matches if any of restricted fields matches otherwise
+	anyDay     bool
+	anyWeekday bool
+}
+
+func parseCron(fields []string, loc *time.Location) (Schedule, error) {
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields, %d given", len(fields))
+	}
+
+	c := &cron{loc: loc, anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+	for _, f := range []struct {
+		name     string
+		spec     string
+		min, max int
+		set      *uint64
+	}{
+		{name: "minute", spec: fields[0], min: 0, max: 59, set: &c.minutes},
+		{name: "hour", spec: fields[1], min: 0, max: 23, set: &c.hours},
+		{name: "day of month", spec: fields[2], min: 1, max: 31, set: &c.days},
+		{name: "month", spec: fields[3], min: 1, max: 12, set: &c.months},
+		{name: "day of week", spec: fields[4], min: 0, max: 7, set: &c.weekday},
+	} {
+		set, err := parseField(f.spec, f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s failed: %w", f.name, err)
+		}
+		*f.set = set
+	}
+
+	// Both 0 and 7 mean Sunday
+	if c.weekday&(1<<7) != 0 {
+		c.weekday |= 1
+	}
+	return c, nil
+}
+
+// parseField parses comma-separated list of values, ranges and steps into set of values
+func parseField(spec string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(spec, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		from, to := min, max
+		switch i := strings.Index(part, "-"); {
+		case part == "*":
+		case i >= 0:
+			var err1, err2 error
+			from, err1 = strconv.Atoi(part[:i])
+			to, err2 = strconv.Atoi(part[i+1:])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			v, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			from, to = v, v
+			if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("value out of range [%d, %d] in %q", min, max, part)
+		}
+
+		for v := from; v <= to; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (c *cron) Next(t time.Time) time.Time {
+	origLoc := t.Location()
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxSearch)
+
+	for t.Before(limit) {
+		if !has(c.months, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if !has(c.hours, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+			continue
+		}
+		if !has(c.minutes, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t.In(origLoc)
+	}
+	return time.Time{}
+}
+
+func (c *cron) dayMatches(t time.Time) bool {
+	day := has(c.days, t.Day())
+	weekday := has(c.weekday, int(t.Weekday()))
+	switch {
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+func has(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
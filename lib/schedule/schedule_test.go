@@ -0,0 +1,83 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func next(t *testing.T, spec string, timeZone string, now time.Time) time.Time {
+	s, err := Parse(spec, timeZone)
+	require.NoError(t, err)
+	return s.Next(now)
+}
+
+func TestEvery(t *testing.T) {
+	now := time.Date(2021, 10, 1, 10, 7, 30, 0, time.UTC)
+	assert.Equal(t, time.Date(2021, 10, 1, 10, 15, 0, 0, time.UTC), next(t, "@every 15m", "", now))
+	assert.Equal(t, time.Date(2021, 10, 1, 10, 30, 0, 0, time.UTC), next(t, "@every 15m", "", time.Date(2021, 10, 1, 10, 15, 0, 0, time.UTC)))
+}
+
+func TestDailyInTimeZone(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	require.NoError(t, err)
+
+	now := time.Date(2021, 10, 1, 7, 0, 0, 0, time.UTC)
+	assert.True(t, time.Date(2021, 10, 2, 8, 0, 0, 0, warsaw).Equal(next(t, "@daily 08:00", "Europe/Warsaw", now)))
+	assert.True(t, time.Date(2021, 10, 1, 8, 0, 0, 0, time.UTC).Equal(next(t, "@daily 08:00", "", now)))
+
+	// Daylight saving time ends on 31st of October
+	assert.True(t, time.Date(2021, 11, 1, 8, 0, 0, 0, warsaw).Equal(next(t, "@daily 08:00", "Europe/Warsaw", time.Date(2021, 10, 31, 8, 0, 0, 0, warsaw))))
+}
+
+func TestCron(t *testing.T) {
+	now := time.Date(2021, 10, 1, 10, 7, 0, 0, time.UTC) // Friday
+
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{spec: "* * * * *", expected: time.Date(2021, 10, 1, 10, 8, 0, 0, time.UTC)},
+		{spec: "*/10 * * * *", expected: time.Date(2021, 10, 1, 10, 10, 0, 0, time.UTC)},
+		{spec: "0 8 * * 1-5", expected: time.Date(2021, 10, 4, 8, 0, 0, 0, time.UTC)},
+		{spec: "30 9,18 * * *", expected: time.Date(2021, 10, 1, 18, 30, 0, 0, time.UTC)},
+		{spec: "0 0 1 1 *", expected: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 12 * * 7", expected: time.Date(2021, 10, 3, 12, 0, 0, 0, time.UTC)},
+		{spec: "0 12 15 * 0", expected: time.Date(2021, 10, 3, 12, 0, 0, 0, time.UTC)},
+		{spec: "0 0 29 2 *", expected: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 30 2 *", expected: time.Time{}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.spec, func(t *testing.T) {
+			assert.Equal(t, test.expected, next(t, test.spec, "", now))
+		})
+	}
+}
+
+func TestInvalidSchedulesAreRejected(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"@every",
+		"@every 10s",
+		"@every abc",
+		"@daily 25:00",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		_, err := Parse(spec, "")
+		assert.Error(t, err, spec)
+	}
+
+	_, err := Parse("@daily 08:00", "Mars/Olympus")
+	assert.Error(t, err)
+}
@@ -0,0 +1,329 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// headerSize is the size of the header stored before each record: 4 bytes of length and 4 bytes of CRC32 checksum
+	headerSize = 8
+
+	segmentPrefix  = "segment-"
+	snapshotPrefix = "snapshot-"
+	tmpSuffix      = ".tmp"
+)
+
+// Log is an append-only log of records stored in a directory.
+//
+// Records are stored in a sequence of segment files. Whenever log is compacted, snapshot of the state built
+// from all the records appended so far is stored, new segment is started and segments covered by the previous
+// snapshot are removed. Two newest snapshots are kept so the older one is used if the newest one is corrupted.
+type Log struct {
+	dir        string
+	generation uint64
+	file       *os.File
+	buf        []byte
+}
+
+// Open opens the log stored in the directory, creating it if it doesn't exist.
+// Before log is returned, the newest valid snapshot (if any) is passed to restore and then all the records appended
+// after that snapshot are passed to fn in the order they were appended. Slices passed to restore and fn are valid
+// only until they return. Partially written record at the end of the log (it happens if process crashes
+// in the middle of writing) is discarded.
+func Open(dir string, restore func(snapshot []byte) error, fn func(record []byte) error) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating log directory failed: %w", err)
+	}
+
+	segments, snapshots, err := listGenerations(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshot of generation N contains the state built from all the records stored in segments older than N
+	var base uint64
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot, err := readSnapshot(filepath.Join(dir, fileName(snapshotPrefix, snapshots[i])))
+		if err != nil {
+			return nil, err
+		}
+		if snapshot == nil {
+			continue
+		}
+		if err := restore(snapshot); err != nil {
+			return nil, err
+		}
+		base = snapshots[i]
+		break
+	}
+
+	var toReplay []uint64
+	for _, g := range segments {
+		if g >= base {
+			toReplay = append(toReplay, g)
+		}
+	}
+	switch {
+	case len(toReplay) == 0:
+		toReplay = append(toReplay, base)
+	case toReplay[0] != base:
+		return nil, fmt.Errorf("log in %s is incomplete, segment %d is missing", dir, base)
+	}
+
+	l := &Log{dir: dir}
+	for i, g := range toReplay {
+		last := i == len(toReplay)-1
+		file, err := os.OpenFile(filepath.Join(dir, fileName(segmentPrefix, g)), os.O_RDWR|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("opening log segment failed: %w", err)
+		}
+		complete, err := replay(file, fn)
+		if err == nil && !complete && !last {
+			err = fmt.Errorf("log segment %d is corrupted", g)
+		}
+		if err != nil || !last {
+			_ = file.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			l.file = file
+			l.generation = g
+		}
+	}
+	return l, nil
+}
+
+// Append appends record to the log and flushes it to the disk
+func (l *Log) Append(record []byte) error {
+	if _, err := l.file.Write(l.frame(record)); err != nil {
+		return fmt.Errorf("writing record failed: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("syncing log file failed: %w", err)
+	}
+	return nil
+}
+
+// Compact stores snapshot of the state built from all the records appended so far and removes
+// the records which are no longer needed
+func (l *Log) Compact(snapshot []byte) error {
+	next := l.generation + 1
+
+	path := filepath.Join(l.dir, fileName(snapshotPrefix, next))
+	if err := writeFileSynced(path+tmpSuffix, l.frame(snapshot)); err != nil {
+		return fmt.Errorf("writing snapshot failed: %w", err)
+	}
+	if err := os.Rename(path+tmpSuffix, path); err != nil {
+		return fmt.Errorf("storing snapshot failed: %w", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(l.dir, fileName(segmentPrefix, next)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("creating log segment failed: %w", err)
+	}
+	if err := syncDir(l.dir); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("closing log segment failed: %w", err)
+	}
+	l.file = file
+	l.generation = next
+
+	return l.removeOlderThan(next - 1)
+}
+
+// Close closes the log
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// frame returns record prefixed with header, returned slice is valid until next call
+func (l *Log) frame(record []byte) []byte {
+	if cap(l.buf) < headerSize+len(record) {
+		l.buf = make([]byte, headerSize+len(record))
+	}
+	buf := l.buf[:headerSize+len(record)]
+	binary.BigEndian.PutUint32(buf, uint32(len(record)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(record))
+	copy(buf[headerSize:], record)
+	return buf
+}
+
+// removeOlderThan removes segments and snapshots of generations older than the given one
+func (l *Log) removeOlderThan(generation uint64) error {
+	segments, snapshots, err := listGenerations(l.dir)
+	if err != nil {
+		return err
+	}
+	for prefix, generations := range map[string][]uint64{segmentPrefix: segments, snapshotPrefix: snapshots} {
+		for _, g := range generations {
+			if g >= generation {
+				continue
+			}
+			if err := os.Remove(filepath.Join(l.dir, fileName(prefix, g))); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("removing compacted file failed: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// replay reads records from the file and leaves the file offset at the end of the last valid record.
+// False is returned if garbage was found after the last valid record.
+func replay(file *os.File, fn func(record []byte) error) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("reading log file info failed: %w", err)
+	}
+
+	var offset int64
+	header := make([]byte, headerSize)
+	var record []byte
+	for {
+		valid, err := readRecord(file, info.Size()-offset, header, &record)
+		if err != nil {
+			return false, err
+		}
+		if !valid {
+			break
+		}
+		if err := fn(record); err != nil {
+			return false, err
+		}
+		offset += int64(headerSize + len(record))
+	}
+	if offset == info.Size() {
+		return true, nil
+	}
+
+	// Everything after the last valid record is a garbage left by interrupted write
+	if err := file.Truncate(offset); err != nil {
+		return false, fmt.Errorf("truncating log file failed: %w", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return false, fmt.Errorf("seeking log file failed: %w", err)
+	}
+	return false, nil
+}
+
+// readRecord reads next record from the file, false is returned if there is no complete and valid record to read
+func readRecord(file *os.File, remaining int64, header []byte, record *[]byte) (bool, error) {
+	if _, err := io.ReadFull(file, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, fmt.Errorf("reading record header failed: %w", err)
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if int64(headerSize)+int64(size) > remaining {
+		return false, nil
+	}
+	if cap(*record) < int(size) {
+		*record = make([]byte, size)
+	}
+	*record = (*record)[:size]
+	if _, err := io.ReadFull(file, *record); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, fmt.Errorf("reading record failed: %w", err)
+	}
+	return crc32.ChecksumIEEE(*record) == binary.BigEndian.Uint32(header[4:]), nil
+}
+
+// readSnapshot reads snapshot stored in the file, nil is returned if snapshot is corrupted
+func readSnapshot(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot failed: %w", err)
+	}
+	if len(data) < headerSize || int(binary.BigEndian.Uint32(data)) != len(data)-headerSize {
+		return nil, nil
+	}
+	snapshot := data[headerSize:]
+	if crc32.ChecksumIEEE(snapshot) != binary.BigEndian.Uint32(data[4:]) {
+		return nil, nil
+	}
+	return snapshot, nil
+}
+
+// listGenerations returns sorted generations of segments and snapshots stored in the directory
+func listGenerations(dir string) ([]uint64, []uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing log directory failed: %w", err)
+	}
+
+	var segments, snapshots []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, tmpSuffix) {
+			// Leftover of snapshot which was not completed
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, nil, fmt.Errorf("removing incomplete snapshot failed: %w", err)
+			}
+			continue
+		}
+		for prefix, generations := range map[string]*[]uint64{segmentPrefix: &segments, snapshotPrefix: &snapshots} {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			g, err := strconv.ParseUint(strings.TrimPrefix(name, prefix), 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unexpected file %s found in log directory", name)
+			}
+			*generations = append(*generations, g)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] < snapshots[j] })
+	return segments, snapshots, nil
+}
+
+func fileName(prefix string, generation uint64) string {
+	return fmt.Sprintf("%s%020d", prefix, generation)
+}
+
+func writeFileSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("opening log directory failed: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("syncing log directory failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, dir string) ([]byte, [][]byte) {
+	var snapshot []byte
+	var records [][]byte
+	log, err := Open(dir, func(s []byte) error {
+		snapshot = append([]byte{}, s...)
+		return nil
+	}, func(record []byte) error {
+		records = append(records, append([]byte{}, record...))
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	return snapshot, records
+}
+
+func open(t *testing.T, dir string) *Log {
+	log, err := Open(dir, func(snapshot []byte) error {
+		return nil
+	}, func(record []byte) error {
+		return nil
+	})
+	require.NoError(t, err)
+	return log
+}
+
+func lastSegment(t *testing.T, dir string) string {
+	segments, _, err := listGenerations(dir)
+	require.NoError(t, err)
+	return filepath.Join(dir, fileName(segmentPrefix, segments[len(segments)-1]))
+}
+
+func TestEmptyLog(t *testing.T) {
+	snapshot, records := readAll(t, t.TempDir())
+	assert.Nil(t, snapshot)
+	assert.Empty(t, records)
+}
+
+func TestRecordsAreReplayed(t *testing.T) {
+	dir := t.TempDir()
+
+	log := open(t, dir)
+	require.NoError(t, log.Append([]byte("record1")))
+	require.NoError(t, log.Append([]byte("record2")))
+	require.NoError(t, log.Close())
+
+	log = open(t, dir)
+	require.NoError(t, log.Append([]byte("record3")))
+	require.NoError(t, log.Close())
+
+	_, records := readAll(t, dir)
+	assert.Equal(t, [][]byte{[]byte("record1"), []byte("record2"), []byte("record3")}, records)
+}
+
+func TestPartialRecordIsDiscarded(t *testing.T) {
+	dir := t.TempDir()
+
+	log := open(t, dir)
+	require.NoError(t, log.Append([]byte("record1")))
+	require.NoError(t, log.Append([]byte("record2")))
+	require.NoError(t, log.Close())
+
+	path := lastSegment(t, dir)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-1))
+
+	_, records := readAll(t, dir)
+	assert.Equal(t, [][]byte{[]byte("record1")}, records)
+
+	log = open(t, dir)
+	require.NoError(t, log.Append([]byte("record3")))
+	require.NoError(t, log.Close())
+
+	_, records = readAll(t, dir)
+	assert.Equal(t, [][]byte{[]byte("record1"), []byte("record3")}, records)
+}
+
+func TestCorruptedRecordIsDiscarded(t *testing.T) {
+	dir := t.TempDir()
+
+	log := open(t, dir)
+	require.NoError(t, log.Append([]byte("record1")))
+	require.NoError(t, log.Append([]byte("record2")))
+	require.NoError(t, log.Close())
+
+	path := lastSegment(t, dir)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	_, records := readAll(t, dir)
+	assert.Equal(t, [][]byte{[]byte("record1")}, records)
+}
+
+func TestOnlyRecordsAfterSnapshotAreReplayed(t *testing.T) {
+	dir := t.TempDir()
+
+	log := open(t, dir)
+	require.NoError(t, log.Append([]byte("record1")))
+	require.NoError(t, log.Append([]byte("record2")))
+	require.NoError(t, log.Compact([]byte("snapshot1")))
+	require.NoError(t, log.Append([]byte("record3")))
+	require.NoError(t, log.Close())
+
+	snapshot, records := readAll(t, dir)
+	assert.Equal(t, []byte("snapshot1"), snapshot)
+	assert.Equal(t, [][]byte{[]byte("record3")}, records)
+}
+
+func TestCompactedFilesAreRemoved(t *testing.T) {
+	dir := t.TempDir()
+
+	log := open(t, dir)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, log.Append([]byte("record")))
+		require.NoError(t, log.Compact([]byte("snapshot")))
+	}
+	require.NoError(t, log.Close())
+
+	segments, snapshots, err := listGenerations(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{4, 5}, segments)
+	assert.Equal(t, []uint64{4, 5}, snapshots)
+}
+
+func TestOlderSnapshotIsUsedIfNewestIsCorrupted(t *testing.T) {
+	dir := t.TempDir()
+
+	log := open(t, dir)
+	require.NoError(t, log.Append([]byte("record1")))
+	require.NoError(t, log.Compact([]byte("snapshot1")))
+	require.NoError(t, log.Append([]byte("record2")))
+	require.NoError(t, log.Compact([]byte("snapshot2")))
+	require.NoError(t, log.Append([]byte("record3")))
+	require.NoError(t, log.Close())
+
+	path := filepath.Join(dir, fileName(snapshotPrefix, 2))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	snapshot, records := readAll(t, dir)
+	assert.Equal(t, []byte("snapshot1"), snapshot)
+	assert.Equal(t, [][]byte{[]byte("record2"), []byte("record3")}, records)
+}
+
+func TestIncompleteSnapshotIsIgnored(t *testing.T) {
+	dir := t.TempDir()
+
+	log := open(t, dir)
+	require.NoError(t, log.Append([]byte("record1")))
+	require.NoError(t, log.Close())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, fileName(snapshotPrefix, 1)+tmpSuffix), []byte("garbage"), 0o600))
+
+	snapshot, records := readAll(t, dir)
+	assert.Nil(t, snapshot)
+	assert.Equal(t, [][]byte{[]byte("record1")}, records)
+
+	_, err := os.Stat(filepath.Join(dir, fileName(snapshotPrefix, 1)+tmpSuffix))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,391 @@
+package netdata
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"go.uber.org/zap"
+)
+
+// announcementWindow is the time for which digests announced by the leader are remembered, digests staged by follower
+// which haven't been published by the leader during that time are dropped
+const announcementWindow = time.Hour
+
+// stagedDigest is the digest waiting in the outbox for confirmation from the broker
+type stagedDigest struct {
+	// ID is the unique ID of the digest
+	ID string
+
+	// Digest is the digest to publish
+	Digest wire.AlarmDigest
+
+	// Revisions contains revisions of alarms included in the digest
+	Revisions map[wire.AlarmID]uint64
+
+	// RequestID is the ID of SendAlarmDigest request answered by the digest, if it was set
+	RequestID string `json:",omitempty"`
+
+	// StagedAt is the time when digest was staged
+	StagedAt time.Time
+}
+
+// confirmation is the result of publishing message
+type confirmation struct {
+	// ID is the ID of published message
+	ID string
+
+	// Err is set if publishing failed
+	Err error
+}
+
+// digestID returns ID of the digest derived from the alarms included in it, so replicas staging the same digest
+// use the same ID. Broker discards digest published again after failover using it.
+func (st *shardState) digestID(digest *stagedDigest) string {
+	alarmIDs := make([]string, 0, len(digest.Revisions))
+	for alarmID := range digest.Revisions {
+		alarmIDs = append(alarmIDs, string(alarmID))
+	}
+	sort.Strings(alarmIDs)
+
+	// Time of the latest change distinguishes alarm created again after it was removed by retention or quota
+	alarms := st.Users[digest.Digest.UserID]
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q", digest.Digest.UserID, digest.RequestID)
+	for _, alarmID := range alarmIDs {
+		var changedAt int64
+		if alarm := alarms[wire.AlarmID(alarmID)]; alarm != nil {
+			changedAt = alarm.LatestChangedAt.UnixNano()
+		}
+		fmt.Fprintf(h, " %q:%d:%d", alarmID, digest.Revisions[wire.AlarmID(alarmID)], changedAt)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// stage puts digest into the outbox. Alarms staged as active are remembered to be notified, so user is told
+// when they are resolved, even if it happens before digest is confirmed.
+func (st *shardState) stage(digest *stagedDigest) {
+	st.Outbox[digest.ID] = digest
+
+	alarms := st.Users[digest.Digest.UserID]
+	for _, entry := range digest.Digest.ActiveAlarms {
+		if alarm := alarms[entry.AlarmID]; alarm != nil && alarm.Revision == digest.Revisions[entry.AlarmID] {
+			alarm.Notified = alarm.Status != wire.StatusCleared
+		}
+	}
+	for _, entry := range digest.Digest.ResolvedAlarms {
+		if alarm := alarms[entry.AlarmID]; alarm != nil && alarm.Revision == digest.Revisions[entry.AlarmID] {
+			alarm.Notified = false
+		}
+	}
+
+	if digest.RequestID != "" {
+		// Digest in the outbox might be modified if leader publishes some of its alarms, answer stays untouched
+		answer := digest.Digest
+		st.rememberRequest(&answeredRequest{
+			UserID:     digest.Digest.UserID,
+			RequestID:  digest.RequestID,
+			AnsweredAt: digest.StagedAt,
+			Digest:     &answer,
+		})
+	}
+
+	// Leader might have published the alarms before follower staged them
+	for _, m := range st.Announced[digest.Digest.UserID] {
+		if m.DigestID == digest.ID {
+			st.markPublished(digest.ID)
+			return
+		}
+		st.dropPublished(digest, m.Alarms)
+	}
+}
+
+// applyDigestPublished removes alarms published by the leader from the outbox. Replicas consume messages
+// independently, so digests staged by them might differ from the published one. That's why alarms are matched
+// by their revisions and not by the ID of the digest. Announcement is remembered, so alarms staged later are
+// removed too.
+func (st *shardState) applyDigestPublished(m wire.DigestPublished) {
+	st.markPublished(m.DigestID)
+	for _, digest := range st.Outbox {
+		if digest.Digest.UserID == m.UserID {
+			st.dropPublished(digest, m.Alarms)
+		}
+	}
+
+	if st.Announced == nil {
+		st.Announced = map[wire.UserID][]wire.DigestPublished{}
+	}
+	st.Announced[m.UserID] = append(st.Announced[m.UserID], m)
+}
+
+// dropPublished removes alarms published by the leader from the staged digest, digest is removed from the outbox
+// once all its alarms are published. Alarm is published if the leader published the same or newer revision of it.
+// Time of the latest change distinguishes alarm created again after it was removed by retention or quota.
+func (st *shardState) dropPublished(digest *stagedDigest, published []wire.PublishedAlarm) {
+	latest := map[wire.AlarmID]wire.PublishedAlarm{}
+	for _, alarm := range published {
+		latest[alarm.AlarmID] = alarm
+	}
+
+	dropped := map[wire.AlarmID]bool{}
+	for _, alarm := range digest.alarms() {
+		if p, exists := latest[alarm.AlarmID]; exists && alarm.Revision <= p.Revision &&
+			!alarm.LatestChangedAt.After(p.LatestChangedAt) {
+			dropped[alarm.AlarmID] = true
+		}
+	}
+	if len(dropped) == 0 {
+		return
+	}
+
+	alarms := st.Users[digest.Digest.UserID]
+	for alarmID := range dropped {
+		if alarm := alarms[alarmID]; alarm != nil && alarm.Revision == digest.Revisions[alarmID] {
+			alarm.ToSend = false
+		}
+		delete(digest.Revisions, alarmID)
+	}
+	if len(digest.Revisions) == 0 {
+		delete(st.Outbox, digest.ID)
+		return
+	}
+
+	digest.Digest.ActiveAlarms = withoutAlarms(digest.Digest.ActiveAlarms, dropped)
+	digest.Digest.ResolvedAlarms = withoutAlarms(digest.Digest.ResolvedAlarms, dropped)
+	label := digest.Digest.GroupedBy
+	digest.Digest.GroupedBy = ""
+	digest.Digest.Groups = nil
+	groupAlarms(&digest.Digest, label)
+}
+
+// withoutAlarms returns alarms except the dropped ones
+func withoutAlarms(alarms []wire.Alarm, dropped map[wire.AlarmID]bool) []wire.Alarm {
+	var result []wire.Alarm
+	for _, alarm := range alarms {
+		if !dropped[alarm.AlarmID] {
+			result = append(result, alarm)
+		}
+	}
+	return result
+}
+
+// alarms returns alarms of the digest which are marked as sent once it is published
+func (d *stagedDigest) alarms() []wire.PublishedAlarm {
+	alarms := make([]wire.PublishedAlarm, 0, len(d.Revisions))
+	for _, entries := range [][]wire.Alarm{d.Digest.ActiveAlarms, d.Digest.ResolvedAlarms} {
+		for _, entry := range entries {
+			if revision, exists := d.Revisions[entry.AlarmID]; exists {
+				alarms = append(alarms, wire.PublishedAlarm{
+					AlarmID:         entry.AlarmID,
+					Revision:        revision,
+					LatestChangedAt: entry.LatestChangedAt,
+				})
+			}
+		}
+	}
+	return alarms
+}
+
+// forgetAnnouncements forgets digests announced by the leader until the time passed
+func (st *shardState) forgetAnnouncements(until time.Time) {
+	for userID, announced := range st.Announced {
+		var remaining []wire.DigestPublished
+		for _, m := range announced {
+			if m.PublishedAt.After(until) {
+				remaining = append(remaining, m)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(st.Announced, userID)
+			continue
+		}
+		st.Announced[userID] = remaining
+	}
+}
+
+// forgetStaged drops digests staged by follower until the time passed. Alarms which leader never publishes
+// with the same or newer revision, e.g. because it removed them from its state, would stay in the outbox forever otherwise.
+func (st *shardState) forgetStaged(until time.Time) {
+	for digestID, digest := range st.Outbox {
+		if len(digest.Revisions) > 0 && !digest.StagedAt.After(until) {
+			st.markPublished(digestID)
+		}
+	}
+}
+
+// markPublished removes digest from the outbox and marks its alarms as sent unless they were triggered again in the meantime
+func (st *shardState) markPublished(digestID string) {
+	digest := st.Outbox[digestID]
+	if digest == nil {
+		return
+	}
+	delete(st.Outbox, digestID)
+
+	alarms := st.Users[digest.Digest.UserID]
+	for alarmID, revision := range digest.Revisions {
+		if alarm := alarms[alarmID]; alarm != nil && alarm.Revision == revision {
+			alarm.ToSend = false
+		}
+	}
+}
+
+// stagedRevisions returns the latest revisions of user's alarms waiting in the outbox
+func (st *shardState) stagedRevisions(userID wire.UserID) map[wire.AlarmID]uint64 {
+	revisions := map[wire.AlarmID]uint64{}
+	for _, digest := range st.Outbox {
+		if digest.Digest.UserID != userID {
+			continue
+		}
+		for alarmID, revision := range digest.Revisions {
+			if revision > revisions[alarmID] {
+				revisions[alarmID] = revision
+			}
+		}
+	}
+	return revisions
+}
+
+// release publishes staged digest if replica is the leader. Follower keeps digest in the outbox until the leader
+// announces it is published, so it is published by the follower if it becomes the leader before that.
+// If leader is unknown, digest waits in the outbox until it is known which replica publishes it.
+func (s *localShard) release(ctx context.Context, log *zap.Logger, digest *stagedDigest) error {
+	switch s.leadership.Role() {
+	case election.RoleLeader:
+		return s.publish(ctx, log, digest)
+	case election.RoleFollower:
+		if len(digest.Revisions) == 0 {
+			// Digest sent again to duplicated request doesn't change the state, requester retries if it is lost
+			return s.skip(log, digest.ID)
+		}
+		log.Debug("Digest waits in the outbox until leader publishes it", zap.String("digestID", digest.ID))
+		return nil
+	default:
+		log.Info("Leader is unknown, digest waits in the outbox", zap.String("digestID", digest.ID))
+		return nil
+	}
+}
+
+// skip marks digest as published without publishing it
+func (s *localShard) skip(log *zap.Logger, digestID string) error {
+	s.markPublished(digestID)
+	if err := s.record(log, journalRecord{DigestPublished: digestID}); err != nil {
+		return fmt.Errorf("recording published digest failed: %w", err)
+	}
+
+	log.Debug("Digest is published by the leader", zap.String("digestID", digestID))
+	return nil
+}
+
+// publish passes digest to the bus, it stays in the outbox until broker confirms it
+func (s *localShard) publish(ctx context.Context, log *zap.Logger, digest *stagedDigest) error {
+	s.inFlight[digest.ID] = true
+
+	msg := digest.Digest
+	out := bus.Outgoing{
+		ID:  digest.ID,
+		Msg: &msg,
+		Confirm: func(err error) {
+			select {
+			case s.confirmCh <- confirmation{ID: digest.ID, Err: err}:
+			case <-s.done:
+				// Local shard has been terminated, digest is still in the outbox so it will be sent after restart
+			}
+		},
+	}
+
+	return s.pass(ctx, log, out)
+}
+
+// pass passes message to the bus
+func (s *localShard) pass(ctx context.Context, log *zap.Logger, msg interface{}) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case s.tx <- msg:
+			return nil
+		case c := <-s.confirmCh:
+			// Confirmations are handled while waiting, otherwise bus waiting to deliver one would get stuck
+			if err := s.confirm(ctx, log, c); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// confirm handles the result of publishing digest
+func (s *localShard) confirm(ctx context.Context, log *zap.Logger, c confirmation) error {
+	delete(s.inFlight, c.ID)
+
+	log = log.With(zap.String("digestID", c.ID))
+	if c.Err != nil {
+		log.Warn("Publishing digest failed, it will be retried", zap.Error(c.Err))
+		return nil
+	}
+
+	digest := s.Outbox[c.ID]
+	if digest == nil {
+		return nil
+	}
+
+	s.markPublished(c.ID)
+	if err := s.record(log, journalRecord{DigestPublished: c.ID}); err != nil {
+		return fmt.Errorf("recording published digest failed: %w", err)
+	}
+
+	log.Info("Alarms sent", zap.Any("alarms", digest.Digest))
+
+	if !s.config.LeaderElection {
+		return nil
+	}
+
+	// Announcement is not confirmed, if it is lost follower publishes the digest again after failover
+	// and broker discards it if it is still in its deduplication window
+	return s.pass(ctx, log, &wire.DigestPublished{
+		ShardedEntity: wire.ShardedEntity{UserID: digest.Digest.UserID},
+		DigestID:      c.ID,
+		Alarms:        digest.alarms(),
+		PublishedAt:   time.Now(),
+	})
+}
+
+// retryOutbox releases digests from the outbox which are not waiting for confirmation
+func (s *localShard) retryOutbox(ctx context.Context, log *zap.Logger) error {
+	if s.leadership.Role() == election.RoleUnknown {
+		return nil
+	}
+
+	leader := s.leadership.Role() == election.RoleLeader
+	for digestID, digest := range s.Outbox {
+		if s.inFlight[digestID] || (!leader && len(digest.Revisions) > 0) {
+			continue
+		}
+
+		log.Info("Releasing digest again", zap.String("digestID", digestID))
+		if err := s.release(ctx, log, digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// awaitConfirmations waits until all the digests passed to the bus are confirmed
+func (s *localShard) awaitConfirmations(ctx context.Context, log *zap.Logger) error {
+	for len(s.inFlight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case c := <-s.confirmCh:
+			if err := s.confirm(ctx, log, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package netdata
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+// startLocalShard runs local shard in the background, it terminates when rx is closed or ctx is canceled
+func startLocalShard(ctx context.Context, config infra.Config, state *shardState, j journal) (chan<- interface{}, <-chan interface{}, <-chan error) {
+	rx := make(chan interface{})
+	tx := make(chan interface{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runLocalShard(config, state, j, newTestResharder(config), election.NewStaticLeadership(), rx, tx)(ctx)
+	}()
+	return rx, tx, errCh
+}
+
+func receiveOutgoing(t *testing.T, tx <-chan interface{}) bus.Outgoing {
+	select {
+	case msg := <-tx:
+		out, ok := msg.(bus.Outgoing)
+		require.True(t, ok)
+		return out
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "digest not published")
+		return bus.Outgoing{}
+	}
+}
+
+func TestDigestIsPublishedAgainIfPublishingFailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	state := newShardState()
+	rx, tx, errCh := startLocalShard(ctx, infra.Config{OutboxRetryInterval: 10 * time.Millisecond}, state, noJournal{})
+
+	rx <- change(user1, alarm1, wire.StatusCritical, time1)
+	rx <- send(user1)
+
+	out1 := receiveOutgoing(t, tx)
+	out1.Confirm(errors.New("test error"))
+
+	out2 := receiveOutgoing(t, tx)
+	assert.Equal(t, out1.ID, out2.ID)
+	assert.Equal(t, out1.Msg, out2.Msg)
+	out2.Confirm(nil)
+
+	close(rx)
+	require.NoError(t, <-errCh)
+
+	assert.Empty(t, state.Outbox)
+	assert.False(t, state.Users[user1][alarm1].ToSend)
+}
+
+func TestAlarmTriggeredAgainBeforeConfirmationIsStillToSend(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	state := newShardState()
+	rx, tx, errCh := startLocalShard(ctx, infra.Config{}, state, noJournal{})
+
+	rx <- change(user1, alarm1, wire.StatusCritical, time1)
+	rx <- send(user1)
+	out := receiveOutgoing(t, tx)
+
+	rx <- change(user1, alarm1, wire.StatusCleared, time2)
+	rx <- change(user1, alarm1, wire.StatusWarning, time3)
+	out.Confirm(nil)
+
+	close(rx)
+	require.NoError(t, <-errCh)
+
+	assert.Empty(t, state.Outbox)
+	assert.True(t, state.Users[user1][alarm1].ToSend)
+}
+
+func TestNotConfirmedDigestIsPublishedAfterRestart(t *testing.T) {
+	config := infra.Config{StateDir: t.TempDir()}
+	log := logger.New()
+
+	j, state, err := openJournal(config, 0, log)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), log))
+	rx, tx, errCh := startLocalShard(ctx, config, state, j)
+	rx <- change(user1, alarm1, wire.StatusCritical, time1)
+	rx <- send(user1)
+	out1 := receiveOutgoing(t, tx)
+
+	// Node terminates before digest is confirmed
+	cancel()
+	require.ErrorIs(t, <-errCh, context.Canceled)
+	out1.Confirm(nil)
+	require.NoError(t, j.Close())
+
+	j, state, err = openJournal(config, 0, log)
+	require.NoError(t, err)
+
+	ctx, cancel = context.WithCancel(logger.WithLogger(context.Background(), log))
+	defer cancel()
+	rx, tx, errCh = startLocalShard(ctx, config, state, j)
+
+	out2 := receiveOutgoing(t, tx)
+	assert.Equal(t, out1.ID, out2.ID)
+	assert.Equal(t, out1.Msg, out2.Msg)
+	out2.Confirm(nil)
+
+	close(rx)
+	require.NoError(t, <-errCh)
+	require.NoError(t, j.Close())
+
+	assert.Len(t, runWithJournalTest(t, config,
+		send(user1),
+	), 0)
+}
@@ -0,0 +1,135 @@
+package netdata
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"go.uber.org/zap"
+)
+
+// defaultPrefixSeparator ends the prefix of alarm ID if user hasn't set the separator
+const defaultPrefixSeparator = "."
+
+// severity returns the rank of the status, higher rank is more severe
+func severity(status wire.Status) int {
+	switch status {
+	case wire.StatusCritical:
+		return 2
+	case wire.StatusWarning:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// meetsMinSeverity returns true if alarm having the status is included in digests of the user
+func meetsMinSeverity(prefs wire.DigestPreferences, status wire.Status) bool {
+	return prefs.MinSeverity == "" || severity(status) >= severity(prefs.MinSeverity)
+}
+
+// alarmPrefix returns the part of alarm ID preceding the separator, the whole ID is returned if there is no separator
+func alarmPrefix(alarmID wire.AlarmID, separator string) string {
+	if separator == "" {
+		separator = defaultPrefixSeparator
+	}
+	if i := strings.Index(string(alarmID), separator); i >= 0 {
+		return string(alarmID[:i])
+	}
+	return string(alarmID)
+}
+
+// sortAlarms sorts alarms of the digest in the order preferred by the user
+func sortAlarms(alarms []wire.Alarm, prefs wire.DigestPreferences) {
+	chronological := func(i, j int) bool {
+		if !alarms[i].LatestChangedAt.Equal(alarms[j].LatestChangedAt) {
+			return alarms[i].LatestChangedAt.Before(alarms[j].LatestChangedAt)
+		}
+		return alarms[i].AlarmID < alarms[j].AlarmID
+	}
+
+	switch prefs.Order {
+	case wire.OrderSeverity:
+		sort.Slice(alarms, func(i, j int) bool {
+			if si, sj := severity(alarms[i].Status), severity(alarms[j].Status); si != sj {
+				return si > sj
+			}
+			return chronological(i, j)
+		})
+	case wire.OrderPrefix:
+		sort.Slice(alarms, func(i, j int) bool {
+			if pi, pj := alarmPrefix(alarms[i].AlarmID, prefs.PrefixSeparator), alarmPrefix(alarms[j].AlarmID, prefs.PrefixSeparator); pi != pj {
+				return pi < pj
+			}
+			return chronological(i, j)
+		})
+	default:
+		sort.Slice(alarms, chronological)
+	}
+}
+
+// groupAlarms puts active alarms of the digest into groups of alarms having the same value of the label.
+// ActiveAlarms are kept, so staging the digest still sees them. Order of alarms is kept within each group. Groups are sorted by the value, alarms without the label are the last group.
+func groupAlarms(digest *wire.AlarmDigest, label string) {
+	if label == "" || len(digest.ActiveAlarms) == 0 {
+		return
+	}
+
+	groups := map[string]*wire.AlarmGroup{}
+	values := []string{}
+	var unlabeled *wire.AlarmGroup
+	for _, alarm := range digest.ActiveAlarms {
+		value, exists := alarm.Labels[label]
+		var group *wire.AlarmGroup
+		switch {
+		case !exists:
+			if unlabeled == nil {
+				unlabeled = &wire.AlarmGroup{}
+			}
+			group = unlabeled
+		case groups[value] == nil:
+			group = &wire.AlarmGroup{Value: value}
+			groups[value] = group
+			values = append(values, value)
+		default:
+			group = groups[value]
+		}
+		group.Alarms = append(group.Alarms, alarm)
+		group.Count++
+	}
+
+	sort.Strings(values)
+	digest.Groups = make([]wire.AlarmGroup, 0, len(values)+1)
+	for _, value := range values {
+		digest.Groups = append(digest.Groups, *groups[value])
+	}
+	if unlabeled != nil {
+		digest.Groups = append(digest.Groups, *unlabeled)
+	}
+	digest.GroupedBy = label
+}
+
+// setPreferences stores digest preferences of the user
+func (st *shardState) setPreferences(userID wire.UserID, prefs wire.DigestPreferences) {
+	if st.Preferences == nil {
+		st.Preferences = map[wire.UserID]wire.DigestPreferences{}
+	}
+	st.Preferences[userID] = prefs
+}
+
+// setDigestPreferences replaces digest preferences of the user, preferences set earlier than the current ones are ignored
+func (s *localShard) setDigestPreferences(log *zap.Logger, m wire.SetDigestPreferences) error {
+	if current, exists := s.Preferences[m.UserID]; exists && current.SetAt.After(m.SetAt) {
+		log.Info("Newer digest preferences are set already, ignoring")
+		return nil
+	}
+
+	s.setPreferences(m.UserID, m.DigestPreferences)
+	if err := s.record(log, journalRecord{PreferencesSet: &m}); err != nil {
+		return fmt.Errorf("recording digest preferences failed: %w", err)
+	}
+
+	log.Info("Digest preferences set", zap.Any("preferences", m.DigestPreferences))
+	return nil
+}
@@ -0,0 +1,139 @@
+package netdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func setPreferences(userID wire.UserID, prefs wire.DigestPreferences) wire.SetDigestPreferences {
+	if prefs.SetAt.IsZero() {
+		prefs.SetAt = time1
+	}
+	return wire.SetDigestPreferences{
+		ShardedEntity: wire.ShardedEntity{
+			UserID: userID,
+		},
+		DigestPreferences: prefs,
+	}
+}
+
+func alarmIDs(digest wire.AlarmDigest) []wire.AlarmID {
+	ids := make([]wire.AlarmID, 0, len(digest.ActiveAlarms))
+	for _, alarm := range digest.ActiveAlarms {
+		ids = append(ids, alarm.AlarmID)
+	}
+	return ids
+}
+
+func TestAlarmsBelowMinSeverityAreNotSent(t *testing.T) {
+	state := newShardState()
+	result := runLocalShardWithStateTest(t, infra.Config{}, state, noJournal{},
+		setPreferences(user1, wire.DigestPreferences{MinSeverity: wire.StatusCritical}),
+		change(user1, alarm1, wire.StatusWarning, time1),
+		change(user1, alarm2, wire.StatusCritical, time2),
+		change(user2, alarm1, wire.StatusWarning, time1),
+		send(user1),
+		send(user2),
+	)
+	assert.Len(t, result, 2)
+	assert.Equal(t, []wire.AlarmID{alarm2}, alarmIDs(result[0]))
+	assert.Equal(t, []wire.AlarmID{alarm1}, alarmIDs(result[1]))
+
+	// Alarm is sent once it becomes severe enough
+	assert.True(t, state.Users[user1][alarm1].ToSend)
+	result = runLocalShardWithStateTest(t, infra.Config{}, state, noJournal{},
+		change(user1, alarm1, wire.StatusCritical, time3),
+		send(user1),
+	)
+	assert.Len(t, result, 1)
+	assert.Equal(t, []wire.AlarmID{alarm1}, alarmIDs(result[0]))
+}
+
+func TestAlarmsAreSortedBySeverity(t *testing.T) {
+	result := runLocalShardWithStateTest(t, infra.Config{}, newShardState(), noJournal{},
+		setPreferences(user1, wire.DigestPreferences{Order: wire.OrderSeverity}),
+		change(user1, "a", wire.StatusWarning, time1),
+		change(user1, "b", wire.StatusCritical, time3),
+		change(user1, "c", wire.StatusWarning, time2),
+		change(user1, "d", wire.StatusCritical, time2),
+		send(user1),
+	)
+	assert.Len(t, result, 1)
+	assert.Equal(t, []wire.AlarmID{"d", "b", "a", "c"}, alarmIDs(result[0]))
+}
+
+func TestAlarmsAreGroupedByPrefix(t *testing.T) {
+	result := runLocalShardWithStateTest(t, infra.Config{}, newShardState(), noJournal{},
+		setPreferences(user1, wire.DigestPreferences{Order: wire.OrderPrefix}),
+		change(user1, "disk.sdb", wire.StatusWarning, time1),
+		change(user1, "cpu.load", wire.StatusCritical, time3),
+		change(user1, "disk.sda", wire.StatusWarning, time2),
+		change(user1, "cpu", wire.StatusWarning, time4),
+		change(user1, "cpu.temp", wire.StatusWarning, time2),
+		send(user1),
+		setPreferences(user2, wire.DigestPreferences{Order: wire.OrderPrefix, PrefixSeparator: "/"}),
+		change(user2, "net/eth0", wire.StatusWarning, time2),
+		change(user2, "disk/sda", wire.StatusWarning, time3),
+		change(user2, "net/eth1", wire.StatusWarning, time4),
+		send(user2),
+	)
+	assert.Len(t, result, 2)
+	assert.Equal(t, []wire.AlarmID{"cpu.temp", "cpu.load", "cpu", "disk.sdb", "disk.sda"}, alarmIDs(result[0]))
+	assert.Equal(t, []wire.AlarmID{"disk/sda", "net/eth0", "net/eth1"}, alarmIDs(result[1]))
+}
+
+func TestAlarmsExceedingMaxAreSentInNextDigest(t *testing.T) {
+	state := newShardState()
+	result := runLocalShardWithStateTest(t, infra.Config{}, state, noJournal{},
+		setPreferences(user1, wire.DigestPreferences{Order: wire.OrderSeverity, MaxAlarms: 2}),
+		change(user1, "a", wire.StatusWarning, time1),
+		change(user1, "b", wire.StatusCritical, time2),
+		change(user1, "c", wire.StatusWarning, time3),
+		send(user1),
+		send(user1),
+		send(user1),
+	)
+	assert.Len(t, result, 2)
+	assert.Equal(t, []wire.AlarmID{"b", "a"}, alarmIDs(result[0]))
+	assert.Equal(t, []wire.AlarmID{"c"}, alarmIDs(result[1]))
+}
+
+func TestOlderPreferencesAreIgnored(t *testing.T) {
+	state := newShardState()
+	runLocalShardWithStateTest(t, infra.Config{}, state, noJournal{},
+		setPreferences(user1, wire.DigestPreferences{MaxAlarms: 1, SetAt: time2}),
+		setPreferences(user1, wire.DigestPreferences{MaxAlarms: 2, SetAt: time1}),
+	)
+	assert.EqualValues(t, 1, state.Preferences[user1].MaxAlarms)
+}
+
+func TestPreferencesAreRestoredFromJournal(t *testing.T) {
+	config := infra.Config{StateDir: t.TempDir()}
+
+	assert.Len(t, runWithJournalTest(t, config,
+		setPreferences(user1, wire.DigestPreferences{MinSeverity: wire.StatusCritical}),
+		change(user1, alarm1, wire.StatusWarning, time1),
+		change(user1, alarm2, wire.StatusCritical, time2),
+	), 0)
+
+	result := runWithJournalTest(t, config,
+		send(user1),
+	)
+	assert.Len(t, result, 1)
+	assert.Equal(t, []wire.AlarmID{alarm2}, alarmIDs(result[0]))
+}
+
+func TestWarningBelowMinSeverityIsNotEscalated(t *testing.T) {
+	now := time.Now()
+	result := runLocalShardWithStateTest(t, infra.Config{EscalateCritical: true, EscalateWarningAfter: time.Minute}, newShardState(), noJournal{},
+		setPreferences(user1, wire.DigestPreferences{MinSeverity: wire.StatusCritical}),
+		change(user1, alarm1, wire.StatusWarning, now.Add(-time.Hour)),
+		change(user1, alarm2, wire.StatusCritical, now),
+	)
+	assert.Len(t, result, 1)
+	assert.Equal(t, []wire.AlarmID{alarm2}, alarmIDs(result[0]))
+}
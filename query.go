@@ -0,0 +1,56 @@
+package netdata
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"go.uber.org/zap"
+)
+
+// answer publishes reply to the request
+func (s *localShard) answer(ctx context.Context, log *zap.Logger, request bus.Request) error {
+	var reply interface{}
+	switch m := request.Entity.(type) {
+	case wire.QueryAlarms:
+		reply = s.queryAlarms(m)
+	default:
+		log.Warn(fmt.Sprintf("Request of unknown type %T received", request.Entity))
+		return nil
+	}
+
+	log.Debug("Request answered", zap.String("reply", request.Reply))
+	return enqueue(ctx, s.tx, bus.Reply{Subject: request.Reply, Msg: reply})
+}
+
+// queryAlarms returns all the alarms tracked for the user, state is not changed
+func (s *localShard) queryAlarms(m wire.QueryAlarms) *wire.QueryAlarmsReply {
+	reply := &wire.QueryAlarmsReply{
+		UserID: m.UserID,
+		Alarms: []wire.AlarmState{},
+		Quota:  s.quotaState(m.UserID),
+	}
+	for alarmID, alarm := range s.Users[m.UserID] {
+		reply.Alarms = append(reply.Alarms, wire.AlarmState{
+			AlarmID:                  alarmID,
+			Status:                   alarm.Status,
+			LatestChangedAt:          alarm.LatestChangedAt,
+			StatusChangedAt:          alarm.StatusChangedAt,
+			ToSend:                   alarm.ToSend,
+			Acknowledged:             alarm.Acknowledged,
+			AcknowledgementExpiresAt: alarm.AcknowledgementExpiresAt,
+			Flapping:                 alarm.Flapping,
+			Transitions:              alarm.Transitions,
+			Labels:                   alarm.Labels,
+		})
+	}
+	sort.Slice(reply.Alarms, func(i int, j int) bool {
+		if reply.Alarms[i].LatestChangedAt.Equal(reply.Alarms[j].LatestChangedAt) {
+			return reply.Alarms[i].AlarmID < reply.Alarms[j].AlarmID
+		}
+		return reply.Alarms[i].LatestChangedAt.Before(reply.Alarms[j].LatestChangedAt)
+	})
+	return reply
+}
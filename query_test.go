@@ -0,0 +1,146 @@
+package netdata
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func query(userID wire.UserID) bus.Request {
+	return bus.Request{
+		Entity: wire.QueryAlarms{ShardedEntity: wire.ShardedEntity{UserID: userID}},
+		Reply:  "reply",
+	}
+}
+
+func TestQueryAlarmsDoesNotChangeState(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	messages := []interface{}{
+		change(user1, alarm1, wire.StatusWarning, time2),
+		change(user1, alarm2, wire.StatusCleared, time1),
+		query(user1),
+		send(user1),
+		query(user2),
+	}
+	rx := make(chan interface{}, len(messages))
+	for _, msg := range messages {
+		rx <- msg
+	}
+	close(rx)
+
+	tx := make(chan interface{})
+	var replies []wire.QueryAlarmsReply
+	var digests []wire.AlarmDigest
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for msg := range tx {
+			switch m := msg.(type) {
+			case bus.Reply:
+				assert.Equal(t, "reply", m.Subject)
+				replies = append(replies, *m.Msg.(*wire.QueryAlarmsReply))
+			case bus.Outgoing:
+				digests = append(digests, *m.Msg.(*wire.AlarmDigest))
+				m.Confirm(nil)
+			}
+		}
+	}()
+
+	config := infra.Config{}
+	require.NoError(t, runLocalShard(config, newShardState(), noJournal{}, newTestResharder(config), election.NewStaticLeadership(), rx, tx)(ctx))
+	close(tx)
+	<-doneCh
+
+	assert.Equal(t, []wire.QueryAlarmsReply{
+		{
+			UserID: user1,
+			Alarms: []wire.AlarmState{
+				{AlarmID: alarm2, Status: wire.StatusCleared, LatestChangedAt: time1, StatusChangedAt: time1},
+				{AlarmID: alarm1, Status: wire.StatusWarning, LatestChangedAt: time2, StatusChangedAt: time2, ToSend: true},
+			},
+		},
+		{UserID: user2, Alarms: []wire.AlarmState{}},
+	}, replies)
+
+	// Query before digest doesn't clear ToSend, so alarm is sent
+	require.Len(t, digests, 1)
+	assert.Equal(t, []wire.Alarm{{AlarmID: alarm1, Status: wire.StatusWarning, LatestChangedAt: time2}}, digests[0].ActiveAlarms)
+}
+
+func TestQueryAlarmsIsAnsweredOverNATS(t *testing.T) {
+	s, err := server.NewServer(&server.Options{
+		Host: "127.0.0.1",
+		Port: -1,
+	})
+	require.NoError(t, err)
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	require.True(t, s.ReadyForConnections(10*time.Second))
+
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	config := infra.Config{
+		NumOfShards:      1,
+		NumOfLocalShards: 2,
+		NATSAddresses:    []string{s.ClientURL()},
+	}
+	shardIDGen := sharding.NewXORModuloIDGenerator()
+	shardMap := sharding.NewMap(config.NumOfShards)
+	conn := bus.NewNATSConnection(config, bus.NewDispatcherFactory(config, shardIDGen, shardMap))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- App(ctx, config, shardIDGen, shardMap, conn, election.NewStaticLeadership())
+	}()
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	require.Eventually(t, func() bool {
+		return s.NumSubscriptions() >= 12
+	}, 10*time.Second, 10*time.Millisecond)
+
+	data, err := json.Marshal(change(user1, alarm1, wire.StatusCritical, time1))
+	require.NoError(t, err)
+	require.NoError(t, nc.Publish("AlarmStatusChanged", data))
+	require.NoError(t, nc.Flush())
+
+	data, err = json.Marshal(wire.QueryAlarms{ShardedEntity: wire.ShardedEntity{UserID: user1}})
+	require.NoError(t, err)
+
+	// Status change and query are received by different subscriptions, so query is repeated until change is applied
+	var reply wire.QueryAlarmsReply
+	require.Eventually(t, func() bool {
+		m, err := nc.Request("QueryAlarms", data, time.Second)
+		require.NoError(t, err)
+		reply = wire.QueryAlarmsReply{}
+		require.NoError(t, json.Unmarshal(m.Data, &reply))
+		return len(reply.Alarms) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, wire.QueryAlarmsReply{
+		UserID: user1,
+		Alarms: []wire.AlarmState{
+			{AlarmID: alarm1, Status: wire.StatusCritical, LatestChangedAt: time1, StatusChangedAt: time1, ToSend: true},
+		},
+	}, reply)
+
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+}
@@ -0,0 +1,411 @@
+package netdata
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"go.uber.org/zap"
+)
+
+// evictedAlarm identifies alarm removed to make room for new one
+type evictedAlarm struct {
+	// UserID is the ID of the user owning the alarm
+	UserID wire.UserID
+
+	// AlarmID is the ID of the alarm
+	AlarmID wire.AlarmID
+}
+
+// quotaWarningInterval is the minimal time between QuotaExceeded events published for the same quota
+const quotaWarningInterval = time.Minute
+
+// quotaWarning is the QuotaExceeded event published for the quota
+type quotaWarning struct {
+	// At is the time when event was published
+	At time.Time
+
+	// Exceeded is true until usage drops below the limit
+	Exceeded bool
+}
+
+// quotaWarnings tracks QuotaExceeded events published for quotas of users and of the local shard (empty user ID),
+// so event is published once until usage drops below the limit again, and not more often than quotaWarningInterval
+type quotaWarnings map[wire.UserID]*quotaWarning
+
+// warn returns true if event has to be published for the quota which is hit
+func (w quotaWarnings) warn(userID wire.UserID, now time.Time) bool {
+	if warning := w[userID]; warning != nil && (warning.Exceeded || now.Sub(warning.At) < quotaWarningInterval) {
+		warning.Exceeded = true
+		return false
+	}
+	w[userID] = &quotaWarning{At: now, Exceeded: true}
+	return true
+}
+
+// reset is called when usage of the quota is below the limit
+func (w quotaWarnings) reset(userID wire.UserID, now time.Time) {
+	warning := w[userID]
+	switch {
+	case warning == nil:
+	case now.Sub(warning.At) >= quotaWarningInterval:
+		delete(w, userID)
+	default:
+		warning.Exceeded = false
+	}
+}
+
+// indexedAlarm is the alarm kept in alarmHeap
+type indexedAlarm struct {
+	alarm     evictedAlarm
+	changedAt time.Time
+	pos       int
+}
+
+// alarmHeap orders alarms from the least recently changed one, it implements heap.Interface
+type alarmHeap []*indexedAlarm
+
+func (h alarmHeap) Len() int {
+	return len(h)
+}
+
+func (h alarmHeap) Less(i, j int) bool {
+	if !h[i].changedAt.Equal(h[j].changedAt) {
+		return h[i].changedAt.Before(h[j].changedAt)
+	}
+	if h[i].alarm.UserID != h[j].alarm.UserID {
+		return h[i].alarm.UserID < h[j].alarm.UserID
+	}
+	return h[i].alarm.AlarmID < h[j].alarm.AlarmID
+}
+
+func (h alarmHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *alarmHeap) Push(x interface{}) {
+	item := x.(*indexedAlarm)
+	item.pos = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *alarmHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// alarmOrder keeps alarms ordered by the time of their latest change
+type alarmOrder struct {
+	heap   alarmHeap
+	alarms map[evictedAlarm]*indexedAlarm
+}
+
+func newAlarmOrder() *alarmOrder {
+	return &alarmOrder{alarms: map[evictedAlarm]*indexedAlarm{}}
+}
+
+// set adds the alarm or updates the time of its latest change
+func (o *alarmOrder) set(alarm evictedAlarm, changedAt time.Time) {
+	if item := o.alarms[alarm]; item != nil {
+		item.changedAt = changedAt
+		heap.Fix(&o.heap, item.pos)
+		return
+	}
+	item := &indexedAlarm{alarm: alarm, changedAt: changedAt}
+	o.alarms[alarm] = item
+	heap.Push(&o.heap, item)
+}
+
+// remove removes the alarm if it exists
+func (o *alarmOrder) remove(alarm evictedAlarm) {
+	if item := o.alarms[alarm]; item != nil {
+		heap.Remove(&o.heap, item.pos)
+		delete(o.alarms, alarm)
+	}
+}
+
+// first returns the least recently changed alarm accepted by the filter, nil is returned if there is no such one.
+// Only alarms preceding the returned one are visited.
+func (o *alarmOrder) first(accept func(alarm evictedAlarm) bool) *evictedAlarm {
+	visited := []*indexedAlarm{}
+	defer func() {
+		for _, item := range visited {
+			heap.Push(&o.heap, item)
+		}
+	}()
+
+	for o.heap.Len() > 0 {
+		item := heap.Pop(&o.heap).(*indexedAlarm)
+		visited = append(visited, item)
+		if accept(item.alarm) {
+			alarm := item.alarm
+			return &alarm
+		}
+	}
+	return nil
+}
+
+// quotaIndex indexes alarms of the local shard, so quotas are enforced without scanning all of them.
+// It is maintained only if quotas are configured.
+type quotaIndex struct {
+	// all contains all the alarms, its size is the number of alarms tracked by the local shard
+	all *alarmOrder
+
+	// cleared contains cleared alarms
+	cleared *alarmOrder
+}
+
+// indexAlarms builds the quota index, from then on it is maintained on each change of alarms
+func (st *shardState) indexAlarms() {
+	st.quota = &quotaIndex{
+		all:     newAlarmOrder(),
+		cleared: newAlarmOrder(),
+	}
+	for userID, alarms := range st.Users {
+		for alarmID := range alarms {
+			st.reindexAlarm(userID, alarmID)
+		}
+	}
+}
+
+// reindexAlarm updates the alarm in the quota index after it was changed or removed
+func (st *shardState) reindexAlarm(userID wire.UserID, alarmID wire.AlarmID) {
+	if st.quota == nil {
+		return
+	}
+
+	key := evictedAlarm{UserID: userID, AlarmID: alarmID}
+	alarm := st.Users[userID][alarmID]
+	switch {
+	case alarm == nil:
+		st.quota.all.remove(key)
+		st.quota.cleared.remove(key)
+	case alarm.Status == wire.StatusCleared:
+		st.quota.all.set(key, alarm.LatestChangedAt)
+		st.quota.cleared.set(key, alarm.LatestChangedAt)
+	default:
+		st.quota.all.set(key, alarm.LatestChangedAt)
+		st.quota.cleared.remove(key)
+	}
+}
+
+// unindexUser removes alarms of the user from the quota index before they are removed or replaced
+func (st *shardState) unindexUser(userID wire.UserID) {
+	if st.quota == nil {
+		return
+	}
+
+	for alarmID := range st.Users[userID] {
+		key := evictedAlarm{UserID: userID, AlarmID: alarmID}
+		st.quota.all.remove(key)
+		st.quota.cleared.remove(key)
+	}
+}
+
+// createsAlarm returns true if update creates new alarm
+func (st *shardState) createsAlarm(m wire.AlarmStatusChanged) bool {
+	return st.Users[m.UserID][m.AlarmID] == nil && m.ChangedAt.After(st.Watermarks[m.UserID])
+}
+
+// numOfAlarms returns the number of alarms tracked by the local shard, it is available only if quotas are configured
+func (st *shardState) numOfAlarms() uint64 {
+	return uint64(len(st.quota.all.alarms))
+}
+
+// evictAlarm removes the alarm and the user left without alarms. Watermark isn't updated, so older updates
+// of other alarms are still applied.
+func (st *shardState) evictAlarm(e *evictedAlarm) {
+	alarms := st.Users[e.UserID]
+	delete(alarms, e.AlarmID)
+	if len(alarms) == 0 {
+		delete(st.Users, e.UserID)
+	}
+	st.reindexAlarm(e.UserID, e.AlarmID)
+}
+
+// quotaVictim returns the least recently changed alarm which may be evicted according to the policy.
+// Alarms waiting in the outbox are never evicted. If userID is empty, alarms of all the users are considered,
+// using the quota index, otherwise alarms of the user are scanned, their number is limited by the quota of the user.
+// Nil is returned if there is no such alarm.
+func (st *shardState) quotaVictim(policy string, userID wire.UserID) *evictedAlarm {
+	if policy != infra.QuotaEvictCleared && policy != infra.QuotaLRU {
+		return nil
+	}
+
+	if userID == "" {
+		staged := st.stagedAlarms()
+		order := st.quota.all
+		if policy == infra.QuotaEvictCleared {
+			order = st.quota.cleared
+		}
+		return order.first(func(e evictedAlarm) bool {
+			return !staged[e.UserID][e.AlarmID] && (policy == infra.QuotaLRU || !st.Users[e.UserID][e.AlarmID].ToSend)
+		})
+	}
+
+	staged := st.stagedRevisions(userID)
+	var victim *evictedAlarm
+	var victimChangedAt time.Time
+	for alarmID, alarm := range st.Users[userID] {
+		if _, exists := staged[alarmID]; exists {
+			continue
+		}
+		if policy == infra.QuotaEvictCleared && (alarm.Status != wire.StatusCleared || alarm.ToSend) {
+			continue
+		}
+		if victim != nil {
+			if alarm.LatestChangedAt.After(victimChangedAt) {
+				continue
+			}
+			if alarm.LatestChangedAt.Equal(victimChangedAt) && alarmID > victim.AlarmID {
+				continue
+			}
+		}
+		victim = &evictedAlarm{UserID: userID, AlarmID: alarmID}
+		victimChangedAt = alarm.LatestChangedAt
+	}
+	return victim
+}
+
+// admitAlarm enforces quotas before new alarm is created. If quota is hit, alarm is evicted according to the policy
+// to make room for the new one. False is returned if there is no room and update has to be ignored.
+func (s *localShard) admitAlarm(ctx context.Context, log *zap.Logger, m wire.AlarmStatusChanged) (bool, error) {
+	if limit := s.config.MaxAlarmsPerUser; limit > 0 {
+		if uint64(len(s.Users[m.UserID])) < limit {
+			s.warned.reset(m.UserID, time.Now())
+		} else {
+			ok, err := s.makeRoom(ctx, log, m.UserID, m.AlarmID, wire.QuotaScopeUser, limit)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				log.Warn("Quota exceeded, update ignored", zap.Uint64("limit", limit))
+				return false, nil
+			}
+		}
+	}
+	if limit := s.config.MaxAlarmsPerShard; limit > 0 {
+		if s.numOfAlarms() < limit {
+			s.warned.reset("", time.Now())
+		} else {
+			ok, err := s.makeRoom(ctx, log, m.UserID, m.AlarmID, wire.QuotaScopeShard, limit)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				log.Warn("Quota of local shard exceeded, update ignored", zap.Uint64("limit", limit))
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// enforceQuotas evicts alarms according to the policy if user taken over during resharding exceeds quotas.
+// Alarms which can't be evicted are kept, so quota stays exceeded until they are removed.
+func (s *localShard) enforceQuotas(ctx context.Context, log *zap.Logger, userID wire.UserID) error {
+	if limit := s.config.MaxAlarmsPerUser; limit > 0 {
+		for uint64(len(s.Users[userID])) > limit {
+			ok, err := s.makeRoom(ctx, log, userID, "", wire.QuotaScopeUser, limit)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				log.Warn("Quota exceeded by alarms taken over, they are kept", zap.Uint64("limit", limit))
+				break
+			}
+		}
+	}
+	if limit := s.config.MaxAlarmsPerShard; limit > 0 {
+		for s.numOfAlarms() > limit {
+			ok, err := s.makeRoom(ctx, log, userID, "", wire.QuotaScopeShard, limit)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				log.Warn("Quota of local shard exceeded by alarms taken over, they are kept", zap.Uint64("limit", limit))
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// makeRoom is called when quota is hit by alarm of the user, it publishes the warning and evicts alarm
+// if policy allows it. False is returned if nothing was evicted.
+func (s *localShard) makeRoom(ctx context.Context, log *zap.Logger, userID wire.UserID, alarmID wire.AlarmID, scope wire.QuotaScope, limit uint64) (bool, error) {
+	log = log.With(zap.String("scope", string(scope)), zap.Uint64("limit", limit))
+
+	// Quota of the local shard is tracked under empty user ID
+	quotaUserID := userID
+	if scope == wire.QuotaScopeShard {
+		quotaUserID = ""
+	}
+
+	if s.warned.warn(quotaUserID, time.Now()) {
+		if err := s.warnQuota(ctx, log, userID, alarmID, scope, limit); err != nil {
+			return false, err
+		}
+	}
+
+	victim := s.quotaVictim(s.quotaPolicy(), quotaUserID)
+	if victim == nil {
+		return false, nil
+	}
+
+	s.evictAlarm(victim)
+	if err := s.record(log, journalRecord{AlarmEvicted: victim}); err != nil {
+		return false, fmt.Errorf("recording evicted alarm failed: %w", err)
+	}
+	log.Warn("Quota exceeded, alarm evicted", zap.String("evictedUserID", string(victim.UserID)),
+		zap.String("evictedAlarmID", string(victim.AlarmID)))
+	return true, nil
+}
+
+// warnQuota publishes QuotaExceeded event, it is done by the leader only. Event is a best-effort warning, so it is
+// published without waiting for confirmation from the broker.
+func (s *localShard) warnQuota(ctx context.Context, log *zap.Logger, userID wire.UserID, alarmID wire.AlarmID, scope wire.QuotaScope, limit uint64) error {
+	if s.leadership.Role() != election.RoleLeader {
+		return nil
+	}
+
+	return s.pass(ctx, log, &wire.QuotaExceeded{
+		UserID:     userID,
+		AlarmID:    alarmID,
+		Scope:      scope,
+		Limit:      limit,
+		Policy:     s.quotaPolicy(),
+		ExceededAt: time.Now(),
+	})
+}
+
+// quotaPolicy returns the policy applied when quota is hit
+func (s *localShard) quotaPolicy() string {
+	if s.config.QuotaPolicy == "" {
+		return infra.QuotaReject
+	}
+	return s.config.QuotaPolicy
+}
+
+// quotaState returns the usage of quotas by the user, nil is returned if quotas are not configured
+func (s *localShard) quotaState(userID wire.UserID) *wire.QuotaState {
+	if s.config.MaxAlarmsPerUser == 0 && s.config.MaxAlarmsPerShard == 0 {
+		return nil
+	}
+	return &wire.QuotaState{
+		UserAlarms:  uint64(len(s.Users[userID])),
+		UserLimit:   s.config.MaxAlarmsPerUser,
+		ShardAlarms: s.numOfAlarms(),
+		ShardLimit:  s.config.MaxAlarmsPerShard,
+		Policy:      s.quotaPolicy(),
+	}
+}
@@ -0,0 +1,255 @@
+package netdata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func TestNewAlarmIsRejectedWhenUserQuotaIsHit(t *testing.T) {
+	state := newShardState()
+	runLocalShardWithStateTest(t, infra.Config{MaxAlarmsPerUser: 2}, state, noJournal{},
+		change(user1, alarm1, wire.StatusWarning, time1),
+		change(user1, alarm2, wire.StatusWarning, time2),
+		change(user1, alarm3, wire.StatusWarning, time3),
+		change(user2, alarm3, wire.StatusWarning, time3),
+
+		// Existing alarms are still updated
+		change(user1, alarm1, wire.StatusCritical, time4),
+	)
+	assert.Len(t, state.Users[user1], 2)
+	assert.Nil(t, state.Users[user1][alarm3])
+	assert.Equal(t, wire.StatusCritical, state.Users[user1][alarm1].Status)
+	assert.NotNil(t, state.Users[user2][alarm3])
+}
+
+func TestClearedAlarmIsEvictedWhenUserQuotaIsHit(t *testing.T) {
+	state := newShardState()
+	config := infra.Config{MaxAlarmsPerUser: 2, QuotaPolicy: infra.QuotaEvictCleared}
+	runLocalShardWithStateTest(t, config, state, noJournal{},
+		change(user1, alarm1, wire.StatusWarning, time1),
+		change(user1, alarm2, wire.StatusCleared, time2),
+		change(user1, alarm3, wire.StatusWarning, time3),
+	)
+	assert.Len(t, state.Users[user1], 2)
+	assert.Nil(t, state.Users[user1][alarm2])
+
+	// There are no cleared alarms left, so new one is rejected
+	runLocalShardWithStateTest(t, config, state, noJournal{},
+		change(user1, "alarm4", wire.StatusWarning, time4),
+	)
+	assert.Len(t, state.Users[user1], 2)
+	assert.Nil(t, state.Users[user1]["alarm4"])
+}
+
+func TestLeastRecentlyChangedAlarmIsEvictedWhenShardQuotaIsHit(t *testing.T) {
+	state := newShardState()
+	config := infra.Config{MaxAlarmsPerShard: 2, QuotaPolicy: infra.QuotaLRU}
+	runLocalShardWithStateTest(t, config, state, noJournal{},
+		change(user1, alarm1, wire.StatusWarning, time1),
+		change(user2, alarm1, wire.StatusWarning, time2),
+		change(user1, alarm1, wire.StatusCritical, time3),
+		change(user3, alarm1, wire.StatusWarning, time4),
+	)
+	assert.Nil(t, state.Users[user2])
+	assert.NotNil(t, state.Users[user1][alarm1])
+	assert.NotNil(t, state.Users[user3][alarm1])
+}
+
+func TestStagedAlarmIsNotEvicted(t *testing.T) {
+	state := newShardState()
+	state.indexAlarms()
+	state.applyAlarmStatusChanged(logger.New(), change(user1, alarm1, wire.StatusWarning, time1))
+	state.applyAlarmStatusChanged(logger.New(), change(user1, alarm2, wire.StatusWarning, time2))
+	state.stage(&stagedDigest{
+		ID:        "digest",
+		Digest:    wire.AlarmDigest{UserID: user1},
+		Revisions: map[wire.AlarmID]uint64{alarm1: 1},
+	})
+
+	for _, userID := range []wire.UserID{user1, ""} {
+		assert.Equal(t, &evictedAlarm{UserID: user1, AlarmID: alarm2}, state.quotaVictim(infra.QuotaLRU, userID))
+		assert.Nil(t, state.quotaVictim(infra.QuotaEvictCleared, userID))
+		assert.Nil(t, state.quotaVictim(infra.QuotaReject, userID))
+	}
+}
+
+func TestQuotaIndexFollowsChangesOfAlarms(t *testing.T) {
+	log := logger.New()
+	state := newShardState()
+	state.applyAlarmStatusChanged(log, change(user1, alarm1, wire.StatusCleared, time1))
+	state.indexAlarms()
+	assert.EqualValues(t, 1, state.numOfAlarms())
+
+	state.applyAlarmStatusChanged(log, change(user1, alarm2, wire.StatusCleared, time2))
+	state.applyAlarmStatusChanged(log, change(user2, alarm1, wire.StatusWarning, time3))
+	assert.EqualValues(t, 3, state.numOfAlarms())
+	assert.Equal(t, &evictedAlarm{UserID: user1, AlarmID: alarm1}, state.quotaVictim(infra.QuotaLRU, ""))
+
+	// Update moves the alarm to the end
+	state.applyAlarmStatusChanged(log, change(user1, alarm1, wire.StatusCleared, time4))
+	assert.Equal(t, &evictedAlarm{UserID: user1, AlarmID: alarm2}, state.quotaVictim(infra.QuotaLRU, ""))
+	assert.Equal(t, &evictedAlarm{UserID: user1, AlarmID: alarm2}, state.quotaVictim(infra.QuotaEvictCleared, ""))
+
+	// Triggered alarm is not cleared anymore
+	state.applyAlarmStatusChanged(log, change(user1, alarm2, wire.StatusCritical, time4))
+	assert.Equal(t, &evictedAlarm{UserID: user1, AlarmID: alarm1}, state.quotaVictim(infra.QuotaEvictCleared, ""))
+
+	state.evictAlarm(&evictedAlarm{UserID: user1, AlarmID: alarm1})
+	assert.EqualValues(t, 2, state.numOfAlarms())
+	assert.Nil(t, state.quotaVictim(infra.QuotaEvictCleared, ""))
+
+	state.removeUsers([]wire.UserID{user2})
+	assert.EqualValues(t, 1, state.numOfAlarms())
+
+	state.restoreUser(wire.AlarmsHandedOff{
+		ShardedEntity: wire.ShardedEntity{UserID: user1},
+		Epoch:         1,
+		Alarms: []wire.AlarmState{
+			{AlarmID: alarm1, Status: wire.StatusCleared, LatestChangedAt: time1},
+			{AlarmID: alarm3, Status: wire.StatusWarning, LatestChangedAt: time2},
+		},
+	})
+	assert.EqualValues(t, 2, state.numOfAlarms())
+	assert.Equal(t, &evictedAlarm{UserID: user1, AlarmID: alarm1}, state.quotaVictim(infra.QuotaEvictCleared, ""))
+
+	assert.Len(t, state.evictAlarms(time2), 1)
+	assert.EqualValues(t, 1, state.numOfAlarms())
+	assert.Equal(t, &evictedAlarm{UserID: user1, AlarmID: alarm3}, state.quotaVictim(infra.QuotaLRU, ""))
+}
+
+func TestEvictionIsReplayed(t *testing.T) {
+	config := infra.Config{StateDir: t.TempDir(), MaxAlarmsPerUser: 1, QuotaPolicy: infra.QuotaLRU}
+	runWithJournalTest(t, config,
+		change(user1, alarm1, wire.StatusWarning, time1),
+		change(user1, alarm2, wire.StatusWarning, time2),
+	)
+
+	j, state, err := openJournal(config, 0, logger.New())
+	require.NoError(t, err)
+	require.NoError(t, j.Close())
+	assert.Len(t, state.Users[user1], 1)
+	assert.NotNil(t, state.Users[user1][alarm2])
+}
+
+func TestQuotaExceededIsPublishedOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	config := infra.Config{MaxAlarmsPerUser: 1, QuotaPolicy: infra.QuotaLRU}
+	rx, tx, errCh := startLocalShard(ctx, config, newShardState(), noJournal{})
+
+	rx <- change(user1, alarm1, wire.StatusCleared, time1)
+	rx <- change(user1, alarm2, wire.StatusCleared, time2)
+
+	// Event is published without confirmation
+	event := (<-tx).(*wire.QuotaExceeded)
+	assert.Equal(t, user1, event.UserID)
+	assert.Equal(t, alarm2, event.AlarmID)
+	assert.Equal(t, wire.QuotaScopeUser, event.Scope)
+	assert.EqualValues(t, 1, event.Limit)
+	assert.Equal(t, infra.QuotaLRU, event.Policy)
+
+	// Digest is the next published message, so the second hit didn't publish another event
+	rx <- change(user1, alarm3, wire.StatusWarning, time3)
+	rx <- send(user1)
+	out := receiveOutgoing(t, tx)
+	out.Confirm(nil)
+	assert.IsType(t, &wire.AlarmDigest{}, out.Msg)
+
+	close(rx)
+	require.NoError(t, <-errCh)
+}
+
+func TestQuotaIsEnforcedOnUserTakenOver(t *testing.T) {
+	for _, policy := range []string{infra.QuotaReject, infra.QuotaLRU} {
+		policy := policy
+		t.Run(policy, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+			defer cancel()
+
+			config := infra.Config{ShardID: 1, NumOfShards: 1, NumOfLocalShards: 1, MaxAlarmsPerUser: 1, QuotaPolicy: policy}
+			r := newResharder(config, sharding.NewJumpHashIDGenerator(), sharding.NewMap(config.NumOfShards))
+			r.shardMap.Prepare(1, 2)
+			userID := userOwnedBy(r, 1, 2)
+
+			state := newShardState()
+			rx := make(chan interface{}, 10)
+			tx := make(chan interface{}, 10)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- runLocalShard(config, state, noJournal{}, r, election.NewStaticLeadership(), rx, tx)(ctx)
+			}()
+
+			rx <- wire.AlarmsHandedOff{
+				ShardedEntity: wire.ShardedEntity{UserID: userID},
+				Epoch:         1,
+				Alarms: []wire.AlarmState{
+					{AlarmID: alarm1, Status: wire.StatusWarning, LatestChangedAt: time1},
+					{AlarmID: alarm2, Status: wire.StatusWarning, LatestChangedAt: time2},
+				},
+			}
+			close(rx)
+			require.NoError(t, <-errCh)
+
+			require.Len(t, tx, 1)
+			event := (<-tx).(*wire.QuotaExceeded)
+			assert.Equal(t, userID, event.UserID)
+			assert.Empty(t, event.AlarmID)
+			assert.Equal(t, wire.QuotaScopeUser, event.Scope)
+
+			if policy == infra.QuotaReject {
+				// Alarms taken over are kept if policy doesn't allow eviction
+				assert.Len(t, state.Users[userID], 2)
+				return
+			}
+			assert.Len(t, state.Users[userID], 1)
+			assert.NotNil(t, state.Users[userID][alarm2])
+		})
+	}
+}
+
+func TestQuotaWarningsAreRateLimited(t *testing.T) {
+	w := quotaWarnings{}
+	assert.True(t, w.warn(user1, time1))
+	assert.False(t, w.warn(user1, time1.Add(time.Second)))
+	assert.True(t, w.warn("", time1))
+
+	// Usage dropped below the limit but warning was published recently
+	w.reset(user1, time1.Add(time.Second))
+	assert.False(t, w.warn(user1, time1.Add(2*time.Second)))
+
+	// Quota hit continuously is not warned again
+	assert.False(t, w.warn(user1, time1.Add(2*quotaWarningInterval)))
+
+	w.reset(user1, time1.Add(2*quotaWarningInterval))
+	assert.NotContains(t, w, user1)
+	assert.True(t, w.warn(user1, time1.Add(2*quotaWarningInterval)))
+}
+
+func TestQueryReturnsQuotaState(t *testing.T) {
+	state := newShardState()
+	state.indexAlarms()
+	state.applyAlarmStatusChanged(logger.New(), change(user1, alarm1, wire.StatusWarning, time1))
+	state.applyAlarmStatusChanged(logger.New(), change(user2, alarm1, wire.StatusWarning, time1))
+
+	s := &localShard{shardState: state, config: infra.Config{MaxAlarmsPerUser: 10, MaxAlarmsPerShard: 100}}
+	assert.Equal(t, &wire.QuotaState{
+		UserAlarms:  1,
+		UserLimit:   10,
+		ShardAlarms: 2,
+		ShardLimit:  100,
+		Policy:      infra.QuotaReject,
+	}, s.queryAlarms(wire.QueryAlarms{ShardedEntity: wire.ShardedEntity{UserID: user1}}).Quota)
+
+	s.config = infra.Config{}
+	assert.Nil(t, s.queryAlarms(wire.QueryAlarms{ShardedEntity: wire.ShardedEntity{UserID: user1}}).Quota)
+}
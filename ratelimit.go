@@ -0,0 +1,206 @@
+package netdata
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"go.uber.org/zap"
+)
+
+// deferredCheckInterval is the interval of checking if deferred digests may be sent
+const deferredCheckInterval = 100 * time.Millisecond
+
+// rateLimit defines how often digests are sent to the user
+type rateLimit struct {
+	// Interval is the time in which single token is added to the bucket, 0 turns limiting off
+	Interval time.Duration
+
+	// Burst is the capacity of the bucket
+	Burst float64
+}
+
+func newRateLimit(config infra.Config) rateLimit {
+	return rateLimit{
+		Interval: config.DigestInterval,
+		Burst:    float64(config.DigestBurst),
+	}
+}
+
+// digestLimit is the token bucket limiting digests sent to the user
+type digestLimit struct {
+	// Tokens is the number of tokens in the bucket at UpdatedAt
+	Tokens float64
+
+	// UpdatedAt is the time when bucket was updated
+	UpdatedAt time.Time
+
+	// Deferred is true if request was deferred and digest is sent once token is available
+	Deferred bool `json:",omitempty"`
+}
+
+// limitUpdate is the new state of the bucket of the user
+type limitUpdate struct {
+	// UserID is the user ID
+	UserID wire.UserID
+
+	// Limit is the state of the bucket
+	Limit digestLimit
+}
+
+// refill returns the bucket with tokens added since it was updated. Bucket of the user seen first is full.
+func (l rateLimit) refill(limit *digestLimit, now time.Time) digestLimit {
+	if limit == nil {
+		return digestLimit{Tokens: l.Burst, UpdatedAt: now}
+	}
+	refilled := *limit
+	if elapsed := now.Sub(limit.UpdatedAt); elapsed > 0 {
+		refilled.Tokens += float64(elapsed) / float64(l.Interval)
+		refilled.UpdatedAt = now
+	}
+	if refilled.Tokens > l.Burst {
+		refilled.Tokens = l.Burst
+	}
+	return refilled
+}
+
+// availableAt returns the time when token is available in the bucket
+func (l rateLimit) availableAt(limit digestLimit) time.Time {
+	if limit.Tokens >= 1 {
+		return limit.UpdatedAt
+	}
+	return limit.UpdatedAt.Add(time.Duration(math.Ceil((1 - limit.Tokens) * float64(l.Interval))))
+}
+
+// setLimit stores the bucket of the user
+func (st *shardState) setLimit(update *limitUpdate) {
+	if st.Limits == nil {
+		st.Limits = map[wire.UserID]*digestLimit{}
+	}
+	limit := update.Limit
+	st.Limits[update.UserID] = &limit
+}
+
+// forgetLimits removes buckets which are full at the time passed and have no deferred digest
+func (st *shardState) forgetLimits(l rateLimit, now time.Time) {
+	for userID, limit := range st.Limits {
+		if refilled := l.refill(limit, now); !refilled.Deferred && refilled.Tokens >= l.Burst {
+			delete(st.Limits, userID)
+		}
+	}
+}
+
+// takeToken takes token from the bucket of the user, false is returned if there is none. In that case digest
+// is deferred until token is available and requests received in the meantime are coalesced into it.
+func (s *localShard) takeToken(log *zap.Logger, userID wire.UserID, now time.Time) (bool, error) {
+	limit := s.rateLimit.refill(s.Limits[userID], now)
+	switch {
+	case limit.Deferred:
+		log.Info("Digest is deferred already, request coalesced")
+		return false, nil
+	case limit.Tokens >= 1:
+		limit.Tokens--
+	default:
+		limit.Deferred = true
+	}
+
+	if err := s.updateLimit(log, &limitUpdate{UserID: userID, Limit: limit}); err != nil {
+		return false, err
+	}
+	if limit.Deferred {
+		log.Info("Digest rate limit exceeded, digest deferred", zap.Time("deferredUntil", s.rateLimit.availableAt(limit)))
+		return false, nil
+	}
+	return true, nil
+}
+
+// sendDeferredDigests sends digests deferred by rate limit if tokens are available
+func (s *localShard) sendDeferredDigests(ctx context.Context, log *zap.Logger, now time.Time) error {
+	for s.deferred.Len() > 0 && !s.deferred[0].At.After(now) {
+		item := heap.Pop(&s.deferred).(deferredDigest)
+
+		// Entry is outdated if digest has been sent or user handed off since it was queued
+		current := s.Limits[item.UserID]
+		if current == nil || !current.Deferred {
+			continue
+		}
+
+		log := log.With(zap.Any("userID", item.UserID))
+		limit := s.rateLimit.refill(current, now)
+		if limit.Tokens < 1 {
+			heap.Push(&s.deferred, deferredDigest{UserID: item.UserID, At: s.rateLimit.availableAt(limit)})
+			continue
+		}
+		limit.Tokens--
+		limit.Deferred = false
+
+		// Bucket is updated after digest is staged so it is sent again if node fails in between
+		log.Info("Deferred digest is due")
+		if err := s.stageDigest(ctx, log, item.UserID, "", now); err != nil {
+			return err
+		}
+		if err := s.updateLimit(log, &limitUpdate{UserID: item.UserID, Limit: limit}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateLimit stores and records the bucket of the user
+func (s *localShard) updateLimit(log *zap.Logger, update *limitUpdate) error {
+	s.setLimit(update)
+	s.enqueueDeferred(update.UserID)
+	if err := s.record(log, journalRecord{LimitUpdated: update}); err != nil {
+		return fmt.Errorf("recording digest rate limit failed: %w", err)
+	}
+	return nil
+}
+
+// enqueueDeferred puts deferred digest of the user into the queue if rate limiting is turned on
+func (s *localShard) enqueueDeferred(userID wire.UserID) {
+	if s.config.DigestInterval <= 0 {
+		return
+	}
+	if limit := s.Limits[userID]; limit != nil && limit.Deferred {
+		heap.Push(&s.deferred, deferredDigest{UserID: userID, At: s.rateLimit.availableAt(*limit)})
+	}
+}
+
+// deferredDigest is the digest deferred by rate limit until the time
+type deferredDigest struct {
+	// UserID is the user ID
+	UserID wire.UserID
+
+	// At is the time when token is available
+	At time.Time
+}
+
+// deferredQueue is the priority queue of deferred digests, the earliest one is at index 0
+type deferredQueue []deferredDigest
+
+func (q deferredQueue) Len() int {
+	return len(q)
+}
+
+func (q deferredQueue) Less(i, j int) bool {
+	return q[i].At.Before(q[j].At)
+}
+
+func (q deferredQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *deferredQueue) Push(x interface{}) {
+	*q = append(*q, x.(deferredDigest))
+}
+
+func (q *deferredQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,101 @@
+package netdata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func TestBucketIsRefilled(t *testing.T) {
+	l := rateLimit{Interval: time.Minute, Burst: 3}
+
+	limit := l.refill(nil, time1)
+	assert.Equal(t, digestLimit{Tokens: 3, UpdatedAt: time1}, limit)
+
+	limit.Tokens = 0
+	assert.Equal(t, time1.Add(time.Minute), l.availableAt(limit))
+	assert.Equal(t, digestLimit{Tokens: 0.5, UpdatedAt: time1.Add(30 * time.Second)}, l.refill(&limit, time1.Add(30*time.Second)))
+	assert.Equal(t, digestLimit{Tokens: 3, UpdatedAt: time1.Add(time.Hour)}, l.refill(&limit, time1.Add(time.Hour)))
+
+	// Time going backwards doesn't take tokens
+	assert.Equal(t, limit, l.refill(&limit, time1.Add(-time.Minute)))
+}
+
+func TestDigestsExceedingLimitAreDeferred(t *testing.T) {
+	state := newShardState()
+	result := runLocalShardWithStateTest(t, infra.Config{DigestInterval: time.Hour, DigestBurst: 2}, state, noJournal{},
+		change(user1, alarm1, wire.StatusWarning, time1),
+		send(user1),
+		change(user1, alarm2, wire.StatusWarning, time2),
+		send(user1),
+		change(user1, alarm3, wire.StatusWarning, time3),
+		send(user1),
+		send(user1),
+		change(user2, alarm1, wire.StatusWarning, time1),
+		send(user2),
+	)
+	assert.Len(t, result, 3)
+	assert.Equal(t, []wire.AlarmID{alarm1}, alarmIDs(result[0]))
+	assert.Equal(t, []wire.AlarmID{alarm2}, alarmIDs(result[1]))
+	assert.Equal(t, user2, result[2].UserID)
+
+	// Alarm is sent in the deferred digest
+	assert.True(t, state.Limits[user1].Deferred)
+	assert.True(t, state.Users[user1][alarm3].ToSend)
+}
+
+func TestDeferredRequestsAreCoalesced(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	const interval = 300 * time.Millisecond
+	state := newShardState()
+	rx, tx, errCh := startLocalShard(ctx, infra.Config{DigestInterval: interval, DigestBurst: 1, RequestIDWindow: time.Hour}, state, noJournal{})
+
+	rx <- change(user1, alarm1, wire.StatusWarning, time1)
+	rx <- send(user1)
+	out := receiveOutgoing(t, tx)
+	sentAt := time.Now()
+	assert.Equal(t, []wire.AlarmID{alarm1}, alarmIDs(*out.Msg.(*wire.AlarmDigest)))
+	out.Confirm(nil)
+
+	rx <- change(user1, alarm2, wire.StatusWarning, time2)
+	rx <- sendWithID(user1, "request1")
+	rx <- change(user1, alarm3, wire.StatusWarning, time3)
+	rx <- sendWithID(user1, "request2")
+	rx <- sendWithID(user1, "request1")
+
+	out = receiveOutgoing(t, tx)
+	assert.GreaterOrEqual(t, time.Since(sentAt), interval-deferredCheckInterval)
+	assert.Equal(t, []wire.AlarmID{alarm2, alarm3}, alarmIDs(*out.Msg.(*wire.AlarmDigest)))
+	out.Confirm(nil)
+
+	// Nothing else is sent for coalesced requests
+	select {
+	case msg := <-tx:
+		require.Fail(t, "unexpected digest published", "%v", msg)
+	case <-time.After(2 * interval):
+	}
+
+	close(rx)
+	require.NoError(t, <-errCh)
+	assert.False(t, state.Limits[user1].Deferred)
+}
+
+func TestDeferredDigestIsSentByNewOwner(t *testing.T) {
+	state := newShardState()
+	state.restoreUser(wire.AlarmsHandedOff{
+		ShardedEntity:  wire.ShardedEntity{UserID: user1},
+		DigestDeferred: true,
+	})
+	require.True(t, state.Limits[user1].Deferred)
+
+	l := rateLimit{Interval: time.Hour, Burst: 1}
+	assert.True(t, l.availableAt(l.refill(state.Limits[user1], time.Now())).Before(time.Now().Add(time.Second)))
+}
@@ -0,0 +1,66 @@
+package netdata
+
+import (
+	"time"
+
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+type requestList map[wire.UserID]map[string]*answeredRequest
+
+// answeredRequest is the SendAlarmDigest request answered recently
+type answeredRequest struct {
+	// UserID is the user ID
+	UserID wire.UserID
+
+	// RequestID is the ID of the request
+	RequestID string
+
+	// AnsweredAt is the time when request was answered
+	AnsweredAt time.Time
+
+	// Digest is the digest sent in response, nil if there was nothing to send
+	Digest *wire.AlarmDigest `json:",omitempty"`
+}
+
+// rememberRequest stores answered request so its duplicates get the same answer
+func (st *shardState) rememberRequest(request *answeredRequest) {
+	if st.Requests == nil {
+		st.Requests = requestList{}
+	}
+	requests := st.Requests[request.UserID]
+	if requests == nil {
+		requests = map[string]*answeredRequest{}
+		st.Requests[request.UserID] = requests
+	}
+	requests[request.RequestID] = request
+}
+
+// answeredRequest returns request answered after the time passed, nil is returned if there is no such one.
+// Requests of the user answered earlier are forgotten.
+func (st *shardState) answeredRequest(userID wire.UserID, requestID string, after time.Time) *answeredRequest {
+	requests := st.Requests[userID]
+	for id, request := range requests {
+		if !request.AnsweredAt.After(after) {
+			delete(requests, id)
+		}
+	}
+	if len(requests) == 0 {
+		delete(st.Requests, userID)
+	}
+	return requests[requestID]
+}
+
+// forgetRequests forgets all the requests answered until the time passed
+func (st *shardState) forgetRequests(until time.Time) {
+	for userID, requests := range st.Requests {
+		for id, request := range requests {
+			if !request.AnsweredAt.After(until) {
+				delete(requests, id)
+			}
+		}
+		if len(requests) == 0 {
+			delete(st.Requests, userID)
+		}
+	}
+}
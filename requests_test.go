@@ -0,0 +1,147 @@
+package netdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+const (
+	request1 = "request1"
+	request2 = "request2"
+)
+
+func sendWithID(userID wire.UserID, requestID string) wire.SendAlarmDigest {
+	m := send(userID)
+	m.RequestID = requestID
+	return m
+}
+
+func TestDuplicatedRequestGetsTheSameDigest(t *testing.T) {
+	result := runLocalShardWithStateTest(t, infra.Config{RequestIDWindow: time.Hour}, newShardState(), noJournal{},
+		change(user1, alarm1, wire.StatusCritical, time1),
+		sendWithID(user1, request1),
+		change(user1, alarm1, wire.StatusWarning, time2),
+		change(user1, alarm2, wire.StatusWarning, time3),
+		sendWithID(user1, request1),
+		sendWithID(user1, request2),
+	)
+	require.Len(t, result, 3)
+
+	expected := wire.AlarmDigest{
+		UserID: user1,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm1,
+				Status:          wire.StatusCritical,
+				LatestChangedAt: time1,
+			},
+		},
+	}
+	assert.Equal(t, expected, result[0])
+	assert.Equal(t, expected, result[1])
+	assert.Equal(t, wire.AlarmDigest{
+		UserID: user1,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm1,
+				Status:          wire.StatusWarning,
+				LatestChangedAt: time2,
+			},
+			{
+				AlarmID:         alarm2,
+				Status:          wire.StatusWarning,
+				LatestChangedAt: time3,
+			},
+		},
+	}, result[2])
+}
+
+func TestDuplicatedRequestAnsweredWithoutDigestGetsNothing(t *testing.T) {
+	result := runLocalShardWithStateTest(t, infra.Config{RequestIDWindow: time.Hour}, newShardState(), noJournal{},
+		sendWithID(user1, request1),
+		change(user1, alarm1, wire.StatusCritical, time1),
+		sendWithID(user1, request1),
+		sendWithID(user1, request2),
+	)
+	require.Len(t, result, 1)
+	assert.Equal(t, wire.AlarmDigest{
+		UserID: user1,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm1,
+				Status:          wire.StatusCritical,
+				LatestChangedAt: time1,
+			},
+		},
+	}, result[0])
+}
+
+func TestRequestIDIsIgnoredIfWindowIsNotSet(t *testing.T) {
+	result := runLocalShardTest(t,
+		change(user1, alarm1, wire.StatusCritical, time1),
+		sendWithID(user1, request1),
+		change(user1, alarm2, wire.StatusWarning, time2),
+		sendWithID(user1, request1),
+	)
+	require.Len(t, result, 2)
+	assert.Equal(t, wire.AlarmDigest{
+		UserID: user1,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm2,
+				Status:          wire.StatusWarning,
+				LatestChangedAt: time2,
+			},
+		},
+	}, result[1])
+}
+
+func TestAnsweredRequestsAreForgottenAfterWindow(t *testing.T) {
+	state := newShardState()
+	state.rememberRequest(&answeredRequest{UserID: user1, RequestID: request1, AnsweredAt: time1})
+	state.rememberRequest(&answeredRequest{UserID: user1, RequestID: request2, AnsweredAt: time3})
+	state.rememberRequest(&answeredRequest{UserID: user2, RequestID: request1, AnsweredAt: time1})
+
+	assert.Nil(t, state.answeredRequest(user1, request1, time2))
+	assert.NotNil(t, state.answeredRequest(user1, request2, time2))
+
+	state.forgetRequests(time2)
+	assert.Equal(t, requestList{
+		user1: {
+			request2: {UserID: user1, RequestID: request2, AnsweredAt: time3},
+		},
+	}, state.Requests)
+}
+
+func TestAnsweredRequestsAreRestoredFromJournal(t *testing.T) {
+	config := infra.Config{StateDir: t.TempDir(), RequestIDWindow: time.Hour}
+
+	require.Len(t, runWithJournalTest(t, config,
+		change(user1, alarm1, wire.StatusCritical, time1),
+		sendWithID(user1, request1),
+		sendWithID(user2, request1),
+	), 1)
+
+	result := runWithJournalTest(t, config,
+		change(user1, alarm2, wire.StatusCritical, time2),
+		change(user2, alarm1, wire.StatusCritical, time2),
+		sendWithID(user1, request1),
+		sendWithID(user2, request1),
+	)
+	require.Len(t, result, 1)
+	assert.Equal(t, wire.AlarmDigest{
+		UserID: user1,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm1,
+				Status:          wire.StatusCritical,
+				LatestChangedAt: time1,
+			},
+		},
+	}, result[0])
+}
@@ -0,0 +1,882 @@
+package netdata
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ridge/parallel"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"go.uber.org/zap"
+)
+
+// handoffStarted is sent by resharder to local shards once all the nodes receive messages using both shard maps
+type handoffStarted struct {
+	// Epoch is the epoch of the next shard map
+	Epoch uint64
+
+	// NumOfShards is the number of shards in the next shard map
+	NumOfShards uint64
+}
+
+// reshardCommitted is sent by resharder to local shards once the next shard map becomes the current one
+type reshardCommitted struct {
+	// Epoch is the epoch of the committed shard map
+	Epoch uint64
+}
+
+// handoffResult is reported by local shard once all the users it no longer owns are handed off
+type handoffResult struct {
+	// Epoch is the epoch of the next shard map
+	Epoch uint64
+
+	// Handoffs contains number of users handed off to each shard
+	Handoffs map[uint64]uint64
+}
+
+// handoffProgress contains users moved by resharding in progress, it is persisted so resharding is resumed after restart
+type handoffProgress struct {
+	// Epoch is the epoch of the next shard map
+	Epoch uint64
+
+	// HandedOff maps users handed off to other shards to their new owners
+	HandedOff map[wire.UserID]uint64 `json:",omitempty"`
+
+	// TakenOver contains users taken over from other shards
+	TakenOver map[wire.UserID]bool `json:",omitempty"`
+}
+
+// usersHandedOff contains users handed off to other shards
+type usersHandedOff struct {
+	// Epoch is the epoch of the next shard map
+	Epoch uint64
+
+	// Owners maps handed off users to their new owners
+	Owners map[wire.UserID]uint64
+}
+
+// reshardingProgress is the progress of resharding coordinated by resharder, it is persisted
+// so resharding is resumed after restart
+type reshardingProgress struct {
+	// Epoch is the epoch of resharding in progress, 0 if there is none
+	Epoch uint64
+
+	// NumOfShards is the number of shards in the next shard map
+	NumOfShards uint64 `json:",omitempty"`
+
+	// Prepared contains shard IDs of nodes prepared to resharding in each epoch
+	Prepared map[uint64]map[uint64]bool `json:",omitempty"`
+
+	// Completed contains numbers of users handed off by nodes in each epoch
+	Completed map[uint64]map[uint64]map[uint64]uint64 `json:",omitempty"`
+}
+
+// pendingMessage is the message held back until state of the user is taken over from another node
+type pendingMessage struct {
+	msg interface{}
+	ack bus.AckFunc
+}
+
+func newResharder(config infra.Config, shardIDGen sharding.IDGenerator, shardMap *sharding.Map) *resharder {
+	return &resharder{
+		config:      config,
+		shardIDGen:  shardIDGen,
+		shardMap:    shardMap,
+		resultCh:    make(chan handoffResult, config.NumOfLocalShards),
+		takenOverCh: make(chan struct{}, 1),
+		takenOver:   map[uint64]uint64{},
+		prepared:    map[uint64]map[uint64]bool{},
+		completed:   map[uint64]map[uint64]map[uint64]uint64{},
+	}
+}
+
+// resharder coordinates resharding on the node. Resharding goes through these phases:
+//   - on ReshardRequested each node starts receiving messages owned by it in both the current and the next shard map
+//     and publishes ReshardPrepared,
+//   - once all the nodes are prepared, local shards publish AlarmsHandedOff for each user they no longer own,
+//     new owners hold back messages of those users until their state is taken over,
+//   - once its local shards are done node publishes HandoffCompleted containing the number of users handed off to each shard,
+//   - once all the nodes completed their handoffs and all the users handed off to the node are taken over,
+//     the next shard map becomes the current one.
+type resharder struct {
+	config     infra.Config
+	shardIDGen sharding.IDGenerator
+	shardMap   *sharding.Map
+
+	// resultCh receives results of handoffs from local shards
+	resultCh chan handoffResult
+
+	// takenOverCh is notified each time local shard takes over the user
+	takenOverCh chan struct{}
+
+	mu sync.Mutex
+	// takenOver contains number of users taken over by local shards in each epoch
+	takenOver map[uint64]uint64
+
+	// Fields below are accessed by run only
+
+	// epoch is the epoch of resharding in progress, 0 if there is none
+	epoch uint64
+
+	// handoffStarted is true if local shards were asked to hand off users
+	handoffStarted bool
+
+	// results contains handoff results reported by local shards
+	results []handoffResult
+
+	// prepared contains shard IDs of nodes prepared to resharding in each epoch
+	prepared map[uint64]map[uint64]bool
+
+	// completed contains numbers of users handed off by nodes in each epoch
+	completed map[uint64]map[uint64]map[uint64]uint64
+
+	// changed is true if progress has to be persisted
+	changed bool
+}
+
+// restore restores progress of resharding interrupted by restart
+func (r *resharder) restore() error {
+	p, err := readReshardingProgress(r.config)
+	if err != nil {
+		return err
+	}
+
+	epoch, _ := r.shardMap.Current()
+	for e, shardIDs := range p.Prepared {
+		if e > epoch {
+			r.prepared[e] = shardIDs
+		}
+	}
+	for e, handoffs := range p.Completed {
+		if e > epoch {
+			r.completed[e] = handoffs
+		}
+	}
+	if p.Epoch <= epoch {
+		return nil
+	}
+
+	r.shardMap.Prepare(p.Epoch, p.NumOfShards)
+	r.epoch = p.Epoch
+
+	// If handoff hasn't been completed, local shards are asked again to hand off users they still have
+	_, r.handoffStarted = r.completed[p.Epoch][uint64(r.config.ShardID)]
+	return nil
+}
+
+// resume announces progress of resharding restored after restart again, so nodes which missed it can proceed
+func (r *resharder) resume(ctx context.Context, log *zap.Logger, tx chan<- interface{}) error {
+	if r.epoch == 0 {
+		return nil
+	}
+
+	log.Info("Resharding resumed", zap.Uint64("epoch", r.epoch))
+	if err := enqueue(ctx, tx, &wire.ReshardPrepared{
+		Epoch:   r.epoch,
+		ShardID: uint64(r.config.ShardID),
+	}); err != nil {
+		return err
+	}
+	if handoffs, exists := r.completed[r.epoch][uint64(r.config.ShardID)]; exists {
+		return enqueue(ctx, tx, &wire.HandoffCompleted{
+			Epoch:    r.epoch,
+			ShardID:  uint64(r.config.ShardID),
+			Handoffs: handoffs,
+		})
+	}
+	return nil
+}
+
+// persist stores progress of resharding if it changed
+func (r *resharder) persist() error {
+	if !r.changed {
+		return nil
+	}
+
+	p := reshardingProgress{
+		Epoch:     r.epoch,
+		Prepared:  r.prepared,
+		Completed: r.completed,
+	}
+	if r.epoch != 0 {
+		_, p.NumOfShards = r.shardMap.Next()
+	}
+	if err := writeReshardingProgress(r.config, p); err != nil {
+		return err
+	}
+	r.changed = false
+	return nil
+}
+
+// owner returns the shard owning the user if there are numOfShards shards
+func (r *resharder) owner(userID wire.UserID, numOfShards uint64) sharding.ID {
+	return sharding.Owner(r.shardIDGen, (&wire.ShardedEntity{UserID: userID}).ShardSeed(), numOfShards)
+}
+
+// usersTakenOver is called by local shard once users are taken over
+func (r *resharder) usersTakenOver(epoch uint64, n uint64) {
+	r.mu.Lock()
+	r.takenOver[epoch] += n
+	r.mu.Unlock()
+
+	select {
+	case r.takenOverCh <- struct{}{}:
+	default:
+	}
+}
+
+// run returns task coordinating resharding, recvCh receives resharding messages from other nodes,
+// rxes are used to pass commands to local shards
+func (r *resharder) run(recvCh <-chan interface{}, rxes []chan<- interface{}, tx chan<- interface{}) parallel.Task {
+	return func(ctx context.Context) error {
+		log := logger.Get(ctx).With(zap.Any("shardID", r.config.ShardID))
+		if err := r.resume(ctx, log, tx); err != nil {
+			return err
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-r.takenOverCh:
+			case result := <-r.resultCh:
+				r.results = append(r.results, result)
+			case msg := <-recvCh:
+				var ack bus.AckFunc
+				if d, ok := msg.(bus.Delivery); ok {
+					msg, ack = d.Entity, d.Ack
+				}
+				if err := r.handle(ctx, log, msg, tx); err != nil {
+					return err
+				}
+				// Message is acknowledged once its effect is persisted
+				if err := r.persist(); err != nil {
+					return err
+				}
+				if ack != nil {
+					ack()
+				}
+			}
+
+			if err := r.proceed(ctx, log, rxes, tx); err != nil {
+				return err
+			}
+			if err := r.persist(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *resharder) handle(ctx context.Context, log *zap.Logger, msg interface{}, tx chan<- interface{}) error {
+	switch m := msg.(type) {
+	case wire.ReshardRequested:
+		return r.prepare(ctx, log.With(zap.Uint64("epoch", m.Epoch)), m, tx)
+	case wire.ReshardPrepared:
+		r.markPrepared(m.Epoch, m.ShardID)
+	case wire.HandoffCompleted:
+		r.markCompleted(m.Epoch, m.ShardID, m.Handoffs)
+	default:
+		log.Warn(fmt.Sprintf("Message of unknown type %T received", msg))
+	}
+	return nil
+}
+
+// prepare starts receiving messages owned by the node in the next shard map
+func (r *resharder) prepare(ctx context.Context, log *zap.Logger, m wire.ReshardRequested, tx chan<- interface{}) error {
+	epoch, numOfShards := r.shardMap.Current()
+	switch {
+	case r.epoch != 0:
+		log.Warn("Resharding is in progress already, request ignored", zap.Uint64("epochInProgress", r.epoch))
+		return nil
+	case m.Epoch <= epoch:
+		log.Info("Outdated resharding request ignored", zap.Uint64("currentEpoch", epoch))
+		return nil
+	case m.NumOfShards == numOfShards:
+		log.Info("Number of shards is the same, resharding request ignored")
+		return nil
+	case uint64(r.config.ShardID) >= participants(numOfShards, m.NumOfShards):
+		log.Info("Node doesn't take part in resharding")
+		return nil
+	}
+
+	log.Info("Resharding started", zap.Uint64("numOfShards", numOfShards), zap.Uint64("nextNumOfShards", m.NumOfShards))
+
+	r.shardMap.Prepare(m.Epoch, m.NumOfShards)
+	r.epoch = m.Epoch
+	r.markPrepared(m.Epoch, uint64(r.config.ShardID))
+
+	return enqueue(ctx, tx, &wire.ReshardPrepared{
+		Epoch:   m.Epoch,
+		ShardID: uint64(r.config.ShardID),
+	})
+}
+
+// proceed moves resharding to the next phase if conditions are met
+func (r *resharder) proceed(ctx context.Context, log *zap.Logger, rxes []chan<- interface{}, tx chan<- interface{}) error {
+	if r.epoch == 0 {
+		return nil
+	}
+
+	_, numOfShards := r.shardMap.Current()
+	_, nextNumOfShards := r.shardMap.Next()
+	numOfParticipants := participants(numOfShards, nextNumOfShards)
+	log = log.With(zap.Uint64("epoch", r.epoch))
+
+	if !r.handoffStarted {
+		if uint64(len(r.prepared[r.epoch])) < numOfParticipants {
+			return nil
+		}
+
+		log.Info("All the nodes are prepared to resharding, handing off users")
+		r.handoffStarted = true
+		return enqueueAll(ctx, rxes, handoffStarted{Epoch: r.epoch, NumOfShards: nextNumOfShards})
+	}
+
+	if _, exists := r.completed[r.epoch][uint64(r.config.ShardID)]; !exists {
+		if len(r.results) < len(rxes) {
+			return nil
+		}
+
+		handoffs := map[uint64]uint64{}
+		for _, result := range r.results {
+			for shardID, n := range result.Handoffs {
+				handoffs[shardID] += n
+			}
+		}
+		r.results = nil
+
+		log.Info("Users handed off", zap.Any("handoffs", handoffs))
+		r.markCompleted(r.epoch, uint64(r.config.ShardID), handoffs)
+		if err := enqueue(ctx, tx, &wire.HandoffCompleted{
+			Epoch:    r.epoch,
+			ShardID:  uint64(r.config.ShardID),
+			Handoffs: handoffs,
+		}); err != nil {
+			return err
+		}
+	}
+
+	completed := r.completed[r.epoch]
+	if uint64(len(completed)) < numOfParticipants {
+		return nil
+	}
+
+	var expected uint64
+	for _, handoffs := range completed {
+		expected += handoffs[uint64(r.config.ShardID)]
+	}
+
+	r.mu.Lock()
+	takenOver := r.takenOver[r.epoch]
+	r.mu.Unlock()
+
+	if takenOver < expected {
+		return nil
+	}
+
+	if err := updateLayout(r.config, r.epoch, nextNumOfShards); err != nil {
+		return err
+	}
+	r.shardMap.Commit()
+
+	log.Info("Resharding committed", zap.Uint64("numOfShards", nextNumOfShards), zap.Uint64("takenOver", takenOver))
+
+	epoch := r.epoch
+	r.epoch = 0
+	r.handoffStarted = false
+	r.changed = true
+	for e := range r.prepared {
+		if e <= epoch {
+			delete(r.prepared, e)
+		}
+	}
+	for e := range r.completed {
+		if e <= epoch {
+			delete(r.completed, e)
+		}
+	}
+	r.mu.Lock()
+	for e := range r.takenOver {
+		if e <= epoch {
+			delete(r.takenOver, e)
+		}
+	}
+	r.mu.Unlock()
+
+	return enqueueAll(ctx, rxes, reshardCommitted{Epoch: epoch})
+}
+
+func (r *resharder) markPrepared(epoch uint64, shardID uint64) {
+	if r.prepared[epoch] == nil {
+		r.prepared[epoch] = map[uint64]bool{}
+	}
+	r.prepared[epoch][shardID] = true
+	r.changed = true
+}
+
+func (r *resharder) markCompleted(epoch uint64, shardID uint64, handoffs map[uint64]uint64) {
+	if r.completed[epoch] == nil {
+		r.completed[epoch] = map[uint64]map[uint64]uint64{}
+	}
+	r.completed[epoch][shardID] = handoffs
+	r.changed = true
+}
+
+// participants returns number of nodes taking part in resharding
+func participants(numOfShards uint64, nextNumOfShards uint64) uint64 {
+	if nextNumOfShards > numOfShards {
+		return nextNumOfShards
+	}
+	return numOfShards
+}
+
+// enqueue sends message to the channel unless context is canceled
+func enqueue(ctx context.Context, ch chan<- interface{}, msg interface{}) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case ch <- msg:
+		return nil
+	}
+}
+
+// enqueueAll sends message to all the channels unless context is canceled
+func enqueueAll(ctx context.Context, chs []chan<- interface{}, msg interface{}) error {
+	for _, ch := range chs {
+		if err := enqueue(ctx, ch, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// holdBack returns true if message is held back or dropped because of resharding
+func (s *localShard) holdBack(log *zap.Logger, msg interface{}, ack bus.AckFunc) bool {
+	var userID wire.UserID
+	switch m := msg.(type) {
+	case wire.AlarmStatusChanged:
+		userID = m.UserID
+	case wire.SendAlarmDigest:
+		userID = m.UserID
+	case wire.AcknowledgeAlarm:
+		userID = m.UserID
+	case wire.SetDigestSchedule:
+		userID = m.UserID
+	case wire.SetDigestPreferences:
+		userID = m.UserID
+	case wire.CreateSilence:
+		userID = m.UserID
+	case wire.DeleteSilence:
+		userID = m.UserID
+	case bus.Request:
+		q, ok := m.Entity.(wire.QueryAlarms)
+		if !ok {
+			return false
+		}
+		userID = q.UserID
+	default:
+		return false
+	}
+
+	if s.handedOff(userID) {
+		log.Info("User has been handed off to another shard, message ignored")
+		if ack != nil {
+			ack()
+		}
+		return true
+	}
+	if s.takenOver(userID) {
+		return false
+	}
+
+	epoch, _ := s.resharder.shardMap.Next()
+	if epoch == 0 {
+		return false
+	}
+	if _, numOfShards := s.resharder.shardMap.Current(); s.resharder.owner(userID, numOfShards) == s.config.ShardID {
+		return false
+	}
+
+	// User is going to be taken over from another node, message is applied once its state arrives
+	s.pending[userID] = append(s.pending[userID], pendingMessage{msg: msg, ack: ack})
+	return true
+}
+
+// handOff publishes state of users which are owned by other shards in the next shard map and removes them
+func (s *localShard) handOff(ctx context.Context, log *zap.Logger, m handoffStarted) error {
+	result := handoffResult{
+		Epoch:    m.Epoch,
+		Handoffs: map[uint64]uint64{},
+	}
+	handoffs := map[string]*wire.AlarmsHandedOff{}
+	handedOff := &usersHandedOff{Epoch: m.Epoch, Owners: map[wire.UserID]uint64{}}
+	for userID := range s.knownUsers() {
+		owner := s.resharder.owner(userID, m.NumOfShards)
+		if owner == s.config.ShardID {
+			continue
+		}
+
+		alarms := s.Users[userID]
+		handoff := &wire.AlarmsHandedOff{
+			ShardedEntity: wire.ShardedEntity{
+				UserID: userID,
+			},
+			Epoch:       m.Epoch,
+			Alarms:      make([]wire.AlarmState, 0, len(alarms)),
+			Watermark:   s.Watermarks[userID],
+			Preferences: s.Preferences[userID],
+		}
+		if limit := s.Limits[userID]; limit != nil && limit.Deferred {
+			handoff.DigestDeferred = true
+		}
+		if sch := s.Schedules[userID]; sch != nil {
+			handoff.Schedule = sch.DigestSchedule
+			handoff.NextDigestAt = sch.NextAt
+		}
+		for _, sil := range s.Silences[userID] {
+			if !sil.Deleted {
+				handoff.Silences = append(handoff.Silences, sil.Silence)
+			}
+		}
+		for _, request := range s.Requests[userID] {
+			handoff.Requests = append(handoff.Requests, wire.AnsweredRequest{
+				RequestID:  request.RequestID,
+				AnsweredAt: request.AnsweredAt,
+				Digest:     request.Digest,
+			})
+		}
+		// Alarms waiting in the outbox are still published by this node, so the new owner must not send them again
+		staged := s.stagedRevisions(userID)
+		for alarmID, alarm := range alarms {
+			revision, exists := staged[alarmID]
+			handoff.Alarms = append(handoff.Alarms, wire.AlarmState{
+				AlarmID:                  alarmID,
+				Status:                   alarm.Status,
+				LatestChangedAt:          alarm.LatestChangedAt,
+				StatusChangedAt:          alarm.StatusChangedAt,
+				ToSend:                   alarm.ToSend && (!exists || revision != alarm.Revision),
+				Acknowledged:             alarm.Acknowledged,
+				AcknowledgementExpiresAt: alarm.AcknowledgementExpiresAt,
+				Flapping:                 alarm.Flapping,
+				Transitions:              alarm.Transitions,
+				Notified:                 alarm.Notified,
+				Labels:                   alarm.Labels,
+			})
+		}
+		handoffs[uuid.New().String()] = handoff
+		handedOff.Owners[userID] = uint64(owner)
+	}
+
+	if err := s.publishHandoffs(ctx, log, handoffs); err != nil {
+		return err
+	}
+
+	if len(handedOff.Owners) > 0 {
+		s.handOffUsers(handedOff)
+		if err := s.record(log, journalRecord{UsersHandedOff: handedOff}); err != nil {
+			return fmt.Errorf("recording users handed off failed: %w", err)
+		}
+	}
+
+	// Users handed off before restart are counted too
+	if s.Handoff != nil && s.Handoff.Epoch == m.Epoch {
+		for _, owner := range s.Handoff.HandedOff {
+			result.Handoffs[owner]++
+		}
+	}
+
+	log.Info("Users handed off", zap.Uint64("epoch", m.Epoch), zap.Int("users", len(handedOff.Owners)))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s.resharder.resultCh <- result:
+		return nil
+	}
+}
+
+// publishHandoffs publishes handoffs and waits until broker confirms all of them
+func (s *localShard) publishHandoffs(ctx context.Context, log *zap.Logger, handoffs map[string]*wire.AlarmsHandedOff) error {
+	// Each published handoff is confirmed once and is not published again before that,
+	// so confirmation never blocks the bus even if local shard terminates
+	confirmCh := make(chan confirmation, len(handoffs))
+	outgoing := func(id string) bus.Outgoing {
+		return bus.Outgoing{
+			ID:  id,
+			Msg: handoffs[id],
+			Confirm: func(err error) {
+				confirmCh <- confirmation{ID: id, Err: err}
+			},
+		}
+	}
+
+	for id := range handoffs {
+		if err := s.pass(ctx, log, outgoing(id)); err != nil {
+			return err
+		}
+	}
+
+	for remaining := len(handoffs); remaining > 0; {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case c := <-s.confirmCh:
+			if err := s.confirm(ctx, log, c); err != nil {
+				return err
+			}
+		case c := <-confirmCh:
+			if c.Err == nil {
+				remaining--
+				continue
+			}
+			log.Warn("Publishing handoff failed, retrying", zap.Error(c.Err))
+			if err := s.pass(ctx, log, outgoing(c.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// takeOver stores state of the user handed off by the previous owner and applies messages held back
+func (s *localShard) takeOver(ctx context.Context, log *zap.Logger, m wire.AlarmsHandedOff) error {
+	if epoch, _ := s.resharder.shardMap.Next(); m.Epoch != epoch || s.takenOver(m.UserID) {
+		log.Warn("Unexpected handoff received, ignoring", zap.Uint64("epoch", epoch))
+		return nil
+	}
+
+	s.takeOverUser(m)
+	s.enqueueSchedule(m.UserID)
+	s.enqueueUserEscalations(m.UserID)
+	s.enqueueDeferred(m.UserID)
+	if err := s.record(log, journalRecord{AlarmsHandedOff: &m}); err != nil {
+		return fmt.Errorf("recording alarms handed off failed: %w", err)
+	}
+	if err := s.enforceQuotas(ctx, log, m.UserID); err != nil {
+		return err
+	}
+	s.resharder.usersTakenOver(m.Epoch, 1)
+
+	log.Info("User taken over", zap.Int("alarms", len(m.Alarms)))
+
+	pending := s.pending[m.UserID]
+	delete(s.pending, m.UserID)
+	for _, p := range pending {
+		if err := s.apply(ctx, log, p.msg, p.ack); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitResharding applies messages held back for users which had no state on other nodes
+func (s *localShard) commitResharding(ctx context.Context, log *zap.Logger, m reshardCommitted) error {
+	pending := s.pending
+	s.pending = map[wire.UserID][]pendingMessage{}
+	if s.Handoff != nil {
+		s.commitHandoff(m.Epoch)
+		if err := s.record(log, journalRecord{ReshardCommitted: m.Epoch}); err != nil {
+			return fmt.Errorf("recording committed resharding failed: %w", err)
+		}
+	}
+
+	for _, messages := range pending {
+		for _, p := range messages {
+			if err := s.apply(ctx, log, p.msg, p.ack); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Info("Resharding committed", zap.Uint64("epoch", m.Epoch))
+	return nil
+}
+
+// resumeHandoff restores progress of resharding interrupted by restart. Progress of resharding which is no longer
+// in progress is dropped.
+func (s *localShard) resumeHandoff() {
+	if s.Handoff == nil {
+		return
+	}
+	if epoch, _ := s.resharder.shardMap.Next(); s.Handoff.Epoch != epoch {
+		s.Handoff = nil
+		return
+	}
+	s.resharder.usersTakenOver(s.Handoff.Epoch, uint64(len(s.Handoff.TakenOver)))
+}
+
+// handoff returns progress of resharding to the epoch, progress of other epoch is replaced
+func (st *shardState) handoff(epoch uint64) *handoffProgress {
+	if st.Handoff == nil || st.Handoff.Epoch != epoch {
+		st.Handoff = &handoffProgress{
+			Epoch:     epoch,
+			HandedOff: map[wire.UserID]uint64{},
+			TakenOver: map[wire.UserID]bool{},
+		}
+	}
+	return st.Handoff
+}
+
+// handedOff returns true if user has been handed off to another shard by resharding in progress
+func (st *shardState) handedOff(userID wire.UserID) bool {
+	if st.Handoff == nil {
+		return false
+	}
+	_, exists := st.Handoff.HandedOff[userID]
+	return exists
+}
+
+// takenOver returns true if user has been taken over from another shard by resharding in progress
+func (st *shardState) takenOver(userID wire.UserID) bool {
+	return st.Handoff != nil && st.Handoff.TakenOver[userID]
+}
+
+// handOffUsers removes users handed off to other shards and remembers their new owners
+func (st *shardState) handOffUsers(m *usersHandedOff) {
+	progress := st.handoff(m.Epoch)
+	userIDs := make([]wire.UserID, 0, len(m.Owners))
+	for userID, owner := range m.Owners {
+		progress.HandedOff[userID] = owner
+		userIDs = append(userIDs, userID)
+	}
+	st.removeUsers(userIDs)
+}
+
+// takeOverUser stores state of the user handed off by the previous owner and remembers it was taken over
+func (st *shardState) takeOverUser(m wire.AlarmsHandedOff) {
+	st.restoreUser(m)
+	st.handoff(m.Epoch).TakenOver[m.UserID] = true
+}
+
+// commitHandoff forgets progress of resharding once it is committed
+func (st *shardState) commitHandoff(epoch uint64) {
+	if st.Handoff != nil && st.Handoff.Epoch <= epoch {
+		st.Handoff = nil
+	}
+}
+
+// knownUsers returns IDs of users having alarms, watermark, digest schedule, silences, digest preferences
+// or answered requests
+func (st *shardState) knownUsers() map[wire.UserID]bool {
+	userIDs := make(map[wire.UserID]bool, len(st.Users)+len(st.Watermarks)+len(st.Schedules)+len(st.Silences)+
+		len(st.Preferences)+len(st.Requests))
+	for userID := range st.Users {
+		userIDs[userID] = true
+	}
+	for userID := range st.Watermarks {
+		userIDs[userID] = true
+	}
+	for userID := range st.Schedules {
+		userIDs[userID] = true
+	}
+	for userID := range st.Silences {
+		userIDs[userID] = true
+	}
+	for userID := range st.Preferences {
+		userIDs[userID] = true
+	}
+	for userID := range st.Requests {
+		userIDs[userID] = true
+	}
+	return userIDs
+}
+
+// removeUsers removes state of users handed off to another shard
+func (st *shardState) removeUsers(userIDs []wire.UserID) {
+	for _, userID := range userIDs {
+		st.unindexUser(userID)
+		delete(st.Users, userID)
+		delete(st.Requests, userID)
+		delete(st.Watermarks, userID)
+		delete(st.Schedules, userID)
+		delete(st.Silences, userID)
+		delete(st.Preferences, userID)
+		delete(st.Limits, userID)
+		delete(st.Announced, userID)
+	}
+}
+
+// restoreUser replaces state of the user with the one handed off by the previous owner
+func (st *shardState) restoreUser(m wire.AlarmsHandedOff) {
+	st.unindexUser(m.UserID)
+	if m.Watermark.IsZero() {
+		delete(st.Watermarks, m.UserID)
+	} else {
+		if st.Watermarks == nil {
+			st.Watermarks = map[wire.UserID]time.Time{}
+		}
+		st.Watermarks[m.UserID] = m.Watermark
+	}
+	if m.Schedule.SetAt.IsZero() {
+		delete(st.Schedules, m.UserID)
+	} else {
+		st.setSchedule(&scheduleUpdate{
+			UserID: m.UserID,
+			Schedule: userSchedule{
+				DigestSchedule: m.Schedule,
+				NextAt:         m.NextDigestAt,
+			},
+		})
+	}
+	if m.DigestDeferred {
+		// Bucket of the new owner is full, so deferred digest is sent immediately
+		st.setLimit(&limitUpdate{UserID: m.UserID, Limit: digestLimit{Deferred: true}})
+	} else {
+		delete(st.Limits, m.UserID)
+	}
+	if m.Preferences.SetAt.IsZero() {
+		delete(st.Preferences, m.UserID)
+	} else {
+		st.setPreferences(m.UserID, m.Preferences)
+	}
+	if len(m.Silences) == 0 {
+		delete(st.Silences, m.UserID)
+	} else {
+		if st.Silences == nil {
+			st.Silences = map[wire.UserID]map[string]*silence{}
+		}
+		silences := map[string]*silence{}
+		for _, sil := range m.Silences {
+			silences[sil.SilenceID] = &silence{Silence: sil}
+		}
+		st.Silences[m.UserID] = silences
+	}
+	delete(st.Requests, m.UserID)
+	for _, request := range m.Requests {
+		st.rememberRequest(&answeredRequest{
+			UserID:     m.UserID,
+			RequestID:  request.RequestID,
+			AnsweredAt: request.AnsweredAt,
+			Digest:     request.Digest,
+		})
+	}
+	if len(m.Alarms) == 0 {
+		delete(st.Users, m.UserID)
+		return
+	}
+
+	alarms := alarmList{}
+	for _, alarm := range m.Alarms {
+		alarms[alarm.AlarmID] = &alarmStatus{
+			Status:                   alarm.Status,
+			LatestChangedAt:          alarm.LatestChangedAt,
+			StatusChangedAt:          alarm.StatusChangedAt,
+			ToSend:                   alarm.ToSend,
+			Acknowledged:             alarm.Acknowledged,
+			AcknowledgementExpiresAt: alarm.AcknowledgementExpiresAt,
+			Flapping:                 alarm.Flapping,
+			Transitions:              alarm.Transitions,
+			Notified:                 alarm.Notified,
+			Labels:                   alarm.Labels,
+		}
+	}
+	st.Users[m.UserID] = alarms
+	for alarmID := range alarms {
+		st.reindexAlarm(m.UserID, alarmID)
+	}
+}
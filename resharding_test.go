@@ -0,0 +1,481 @@
+package netdata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/ridge/parallel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+// userOwnedBy returns ID of user owned by the shard if there are numOfShards shards
+func userOwnedBy(r *resharder, shardID sharding.ID, numOfShards uint64) wire.UserID {
+	for i := 0; ; i++ {
+		userID := wire.UserID(fmt.Sprintf("user-%d", i))
+		if r.owner(userID, numOfShards) == shardID {
+			return userID
+		}
+	}
+}
+
+func TestMessagesAreHeldBackUntilUserIsTakenOver(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	config := infra.Config{ShardID: 1, NumOfShards: 1, NumOfLocalShards: 1}
+	r := newResharder(config, sharding.NewJumpHashIDGenerator(), sharding.NewMap(config.NumOfShards))
+	r.shardMap.Prepare(1, 2)
+	userID := userOwnedBy(r, 1, 2)
+
+	state := newShardState()
+	rx := make(chan interface{}, 10)
+	tx := make(chan interface{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runLocalShard(config, state, noJournal{}, r, election.NewStaticLeadership(), rx, tx)(ctx)
+	}()
+
+	rx <- change(userID, alarm2, wire.StatusCritical, time2)
+	rx <- send(userID)
+	rx <- wire.AlarmsHandedOff{
+		ShardedEntity: wire.ShardedEntity{UserID: userID},
+		Epoch:         1,
+		Alarms: []wire.AlarmState{
+			{
+				AlarmID:         alarm1,
+				Status:          wire.StatusWarning,
+				LatestChangedAt: time1,
+				ToSend:          true,
+			},
+			{
+				AlarmID:         alarm3,
+				Status:          wire.StatusWarning,
+				LatestChangedAt: time1,
+			},
+		},
+	}
+
+	out := receiveOutgoing(t, tx)
+	assert.Equal(t, &wire.AlarmDigest{
+		UserID: userID,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm1,
+				Status:          wire.StatusWarning,
+				LatestChangedAt: time1,
+			},
+			{
+				AlarmID:         alarm2,
+				Status:          wire.StatusCritical,
+				LatestChangedAt: time2,
+			},
+		},
+	}, out.Msg)
+	out.Confirm(nil)
+
+	close(rx)
+	require.NoError(t, <-errCh)
+	assert.EqualValues(t, 1, r.takenOver[1])
+}
+
+func TestUsersAreHandedOff(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	config := infra.Config{ShardID: 0, NumOfShards: 1, NumOfLocalShards: 1}
+	r := newResharder(config, sharding.NewJumpHashIDGenerator(), sharding.NewMap(config.NumOfShards))
+	movedUserID := userOwnedBy(r, 1, 2)
+	keptUserID := userOwnedBy(r, 0, 2)
+
+	state := newShardState()
+	rx := make(chan interface{}, 10)
+	tx := make(chan interface{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runLocalShard(config, state, noJournal{}, r, election.NewStaticLeadership(), rx, tx)(ctx)
+	}()
+
+	rx <- change(movedUserID, alarm1, wire.StatusCritical, time1)
+	rx <- change(keptUserID, alarm1, wire.StatusCritical, time1)
+	r.shardMap.Prepare(1, 2)
+	rx <- handoffStarted{Epoch: 1, NumOfShards: 2}
+
+	out1 := receiveOutgoing(t, tx)
+	out1.Confirm(fmt.Errorf("test error"))
+	out2 := receiveOutgoing(t, tx)
+	assert.Equal(t, out1.ID, out2.ID)
+	assert.Equal(t, &wire.AlarmsHandedOff{
+		ShardedEntity: wire.ShardedEntity{UserID: movedUserID},
+		Epoch:         1,
+		Alarms: []wire.AlarmState{
+			{
+				AlarmID:         alarm1,
+				Status:          wire.StatusCritical,
+				LatestChangedAt: time1,
+				StatusChangedAt: time1,
+				ToSend:          true,
+			},
+		},
+	}, out2.Msg)
+	out2.Confirm(nil)
+
+	select {
+	case result := <-r.resultCh:
+		assert.Equal(t, handoffResult{Epoch: 1, Handoffs: map[uint64]uint64{1: 1}}, result)
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "handoff not completed")
+	}
+
+	// Requests for handed off user are ignored
+	rx <- send(movedUserID)
+	rx <- send(keptUserID)
+
+	out := receiveOutgoing(t, tx)
+	assert.Equal(t, keptUserID, out.Msg.(*wire.AlarmDigest).UserID)
+	out.Confirm(nil)
+
+	close(rx)
+	require.NoError(t, <-errCh)
+	assert.NotContains(t, state.Users, movedUserID)
+	assert.Contains(t, state.Users, keptUserID)
+}
+
+func TestStagedAlarmsAreNotSentAgainByNewOwner(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	config := infra.Config{ShardID: 0, NumOfShards: 1, NumOfLocalShards: 1}
+	r := newResharder(config, sharding.NewJumpHashIDGenerator(), sharding.NewMap(config.NumOfShards))
+	userID := userOwnedBy(r, 1, 2)
+
+	state := newShardState()
+	rx := make(chan interface{}, 10)
+	tx := make(chan interface{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runLocalShard(config, state, noJournal{}, r, election.NewStaticLeadership(), rx, tx)(ctx)
+	}()
+
+	rx <- change(userID, alarm1, wire.StatusCritical, time1)
+	rx <- send(userID)
+	rx <- change(userID, alarm2, wire.StatusWarning, time2)
+
+	// Digest is not confirmed before handoff starts
+	digest := receiveOutgoing(t, tx)
+	r.shardMap.Prepare(1, 2)
+	rx <- handoffStarted{Epoch: 1, NumOfShards: 2}
+
+	out := receiveOutgoing(t, tx)
+	handoff := out.Msg.(*wire.AlarmsHandedOff)
+	require.Len(t, handoff.Alarms, 2)
+	for _, alarm := range handoff.Alarms {
+		assert.Equal(t, alarm.AlarmID == alarm2, alarm.ToSend, alarm.AlarmID)
+	}
+	digest.Confirm(nil)
+	out.Confirm(nil)
+
+	select {
+	case <-r.resultCh:
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "handoff not completed")
+	}
+
+	close(rx)
+	require.NoError(t, <-errCh)
+	assert.Empty(t, state.Outbox)
+}
+
+func TestAnsweredRequestsAreHandedOff(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	config := infra.Config{ShardID: 0, NumOfShards: 1, NumOfLocalShards: 1, RequestIDWindow: time.Hour}
+	r := newResharder(config, sharding.NewJumpHashIDGenerator(), sharding.NewMap(config.NumOfShards))
+	userID := userOwnedBy(r, 1, 2)
+
+	state := newShardState()
+	rx := make(chan interface{}, 10)
+	tx := make(chan interface{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- runLocalShard(config, state, noJournal{}, r, election.NewStaticLeadership(), rx, tx)(ctx)
+	}()
+
+	rx <- change(userID, alarm1, wire.StatusCritical, time1)
+	rx <- sendWithID(userID, request1)
+	digest := receiveOutgoing(t, tx)
+	digest.Confirm(nil)
+
+	r.shardMap.Prepare(1, 2)
+	rx <- handoffStarted{Epoch: 1, NumOfShards: 2}
+	out := receiveOutgoing(t, tx)
+	out.Confirm(nil)
+	handoff := out.Msg.(*wire.AlarmsHandedOff)
+	require.Len(t, handoff.Requests, 1)
+	assert.Equal(t, request1, handoff.Requests[0].RequestID)
+	assert.Equal(t, digest.Msg, handoff.Requests[0].Digest)
+
+	close(rx)
+	require.NoError(t, <-errCh)
+
+	// Duplicated request gets the same answer from the new owner
+	newState := newShardState()
+	newState.restoreUser(*handoff)
+	request := newState.answeredRequest(userID, request1, time.Now().Add(-time.Hour))
+	require.NotNil(t, request)
+	assert.Equal(t, digest.Msg, request.Digest)
+}
+
+func TestHandoffIsResumedAfterRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	config := infra.Config{ShardID: 0, NumOfShards: 1, NumOfLocalShards: 1, StateDir: t.TempDir()}
+	start := func() (*resharder, *shardState, chan interface{}, chan interface{}, chan error) {
+		r := newResharder(config, sharding.NewJumpHashIDGenerator(), sharding.NewMap(config.NumOfShards))
+		r.shardMap.Prepare(1, 2)
+
+		j, state, err := openJournal(config, 0, logger.New())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, j.Close())
+		})
+
+		rx := make(chan interface{}, 10)
+		tx := make(chan interface{})
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- runLocalShard(config, state, j, r, election.NewStaticLeadership(), rx, tx)(ctx)
+		}()
+		return r, state, rx, tx, errCh
+	}
+
+	r, _, rx, tx, errCh := start()
+	movedUserID := userOwnedBy(r, 1, 2)
+	rx <- change(movedUserID, alarm1, wire.StatusCritical, time1)
+	rx <- handoffStarted{Epoch: 1, NumOfShards: 2}
+	receiveOutgoing(t, tx).Confirm(nil)
+	assert.Equal(t, handoffResult{Epoch: 1, Handoffs: map[uint64]uint64{1: 1}}, <-r.resultCh)
+	close(rx)
+	require.NoError(t, <-errCh)
+
+	// Node restarts before resharding is committed
+	r, state, rx, tx, errCh := start()
+	assert.Contains(t, state.Handoff.HandedOff, movedUserID)
+
+	// Handed off user is still ignored and counted when handoff is requested again
+	rx <- change(movedUserID, alarm2, wire.StatusCritical, time2)
+	rx <- handoffStarted{Epoch: 1, NumOfShards: 2}
+	assert.Equal(t, handoffResult{Epoch: 1, Handoffs: map[uint64]uint64{1: 1}}, <-r.resultCh)
+
+	rx <- reshardCommitted{Epoch: 1}
+	close(rx)
+	require.NoError(t, <-errCh)
+	select {
+	case msg := <-tx:
+		require.Fail(t, "user handed off again", msg)
+	default:
+	}
+	assert.NotContains(t, state.Users, movedUserID)
+	assert.Nil(t, state.Handoff)
+
+	_, state, rx, _, errCh = start()
+	close(rx)
+	require.NoError(t, <-errCh)
+	assert.Nil(t, state.Handoff)
+}
+
+func TestReshardingProgressIsRestoredAfterRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	config := infra.Config{ShardID: 0, NumOfShards: 1, NumOfLocalShards: 1, StateDir: t.TempDir()}
+	run := func(r *resharder, recvCh chan interface{}, tx chan interface{}) func() {
+		ctx, cancel := context.WithCancel(ctx)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- r.run(recvCh, []chan<- interface{}{make(chan interface{}, 10)}, tx)(ctx)
+		}()
+		return func() {
+			cancel()
+			assert.ErrorIs(t, <-errCh, context.Canceled)
+		}
+	}
+
+	r := newResharder(config, sharding.NewJumpHashIDGenerator(), sharding.NewMap(config.NumOfShards))
+	require.NoError(t, r.restore())
+	recvCh := make(chan interface{})
+	tx := make(chan interface{}, 10)
+	stop := run(r, recvCh, tx)
+	recvCh <- wire.ReshardRequested{Epoch: 1, NumOfShards: 2}
+	assert.Equal(t, &wire.ReshardPrepared{Epoch: 1, ShardID: 0}, <-tx)
+	recvCh <- wire.ReshardPrepared{Epoch: 1, ShardID: 1}
+	recvCh <- wire.HandoffCompleted{Epoch: 1, ShardID: 1, Handoffs: map[uint64]uint64{0: 2}}
+	stop()
+
+	// Node restarts in the middle of resharding
+	r = newResharder(config, sharding.NewJumpHashIDGenerator(), sharding.NewMap(config.NumOfShards))
+	require.NoError(t, r.restore())
+	epoch, numOfShards := r.shardMap.Next()
+	assert.EqualValues(t, 1, epoch)
+	assert.EqualValues(t, 2, numOfShards)
+	assert.Equal(t, map[uint64]bool{0: true, 1: true}, r.prepared[1])
+	assert.Equal(t, map[uint64]uint64{0: 2}, r.completed[1][1])
+
+	// Progress is announced again
+	tx = make(chan interface{}, 10)
+	stop = run(r, make(chan interface{}), tx)
+	assert.Equal(t, &wire.ReshardPrepared{Epoch: 1, ShardID: 0}, <-tx)
+	stop()
+}
+
+func TestStateIsMovedToNewNodeDuringResharding(t *testing.T) {
+	const numOfUsers = 20
+
+	s, err := server.NewServer(&server.Options{
+		Host: "127.0.0.1",
+		Port: -1,
+	})
+	require.NoError(t, err)
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	require.True(t, s.ReadyForConnections(10*time.Second))
+
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	// Node 1 doesn't own anything until resharding is done
+	configs := []infra.Config{
+		{
+			ShardID:          0,
+			NumOfShards:      1,
+			NumOfLocalShards: 2,
+			NATSAddresses:    []string{s.ClientURL()},
+			ShardIDGenerator: sharding.JumpHash,
+			StateDir:         t.TempDir(),
+		},
+		{
+			ShardID:          1,
+			NumOfShards:      1,
+			NumOfLocalShards: 2,
+			NATSAddresses:    []string{s.ClientURL()},
+			ShardIDGenerator: sharding.JumpHash,
+			StateDir:         t.TempDir(),
+		},
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+			for i, config := range configs {
+				config := config
+				shardIDGen := sharding.NewJumpHashIDGenerator()
+				shardMap := sharding.NewMap(config.NumOfShards)
+				conn := bus.NewNATSConnection(config, bus.NewDispatcherFactory(config, shardIDGen, shardMap))
+				name := fmt.Sprintf("node-%d", i)
+				spawn(name, parallel.Fail, func(ctx context.Context) error {
+					return App(ctx, config, shardIDGen, shardMap, conn, election.NewStaticLeadership())
+				})
+			}
+			return nil
+		})
+	}()
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	var mu sync.Mutex
+	digests := map[wire.UserID][]wire.AlarmDigest{}
+	_, err = nc.Subscribe("AlarmDigest", func(m *nats.Msg) {
+		var digest wire.AlarmDigest
+		if err := json.Unmarshal(m.Data, &digest); err != nil {
+			panic(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		digests[digest.UserID] = append(digests[digest.UserID], digest)
+	})
+	require.NoError(t, err)
+
+	// Each node subscribes to 12 subjects
+	require.Eventually(t, func() bool {
+		return s.NumSubscriptions() >= 25
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Subscriptions of core NATS drop messages arriving faster than they are consumed, so they are published one by one
+	publish := func(subject string, msg interface{}) {
+		data, err := json.Marshal(msg)
+		require.NoError(t, err)
+		require.NoError(t, nc.Publish(subject, data))
+		require.NoError(t, nc.Flush())
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < numOfUsers; i++ {
+		publish("AlarmStatusChanged", change(wire.UserID(fmt.Sprintf("user-%d", i)), alarm1, wire.StatusCritical, time1))
+	}
+	publish("ReshardRequested", wire.ReshardRequested{Epoch: 1, NumOfShards: 2})
+
+	// Shard map is stored once resharding is committed
+	for _, config := range configs {
+		config := config
+		require.Eventually(t, func() bool {
+			l, err := readLayout(config)
+			return err == nil && l.NumOfShards == 2 && l.ShardMapEpoch == 1
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+
+	for i := 0; i < numOfUsers; i++ {
+		publish("SendAlarmDigest", send(wire.UserID(fmt.Sprintf("user-%d", i))))
+	}
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(digests) == numOfUsers
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Waiting for possible duplicates
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < numOfUsers; i++ {
+		userID := wire.UserID(fmt.Sprintf("user-%d", i))
+		assert.Equal(t, []wire.AlarmDigest{
+			{
+				UserID: userID,
+				ActiveAlarms: []wire.Alarm{
+					{
+						AlarmID:         alarm1,
+						Status:          wire.StatusCritical,
+						LatestChangedAt: time1,
+					},
+				},
+			},
+		}, digests[userID])
+	}
+
+	// State of the users moved to the new node is stored there
+	segments, err := filepath.Glob(filepath.Join(configs[1].StateDir, "local-shard-*", "segment-*"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, segments)
+
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+}
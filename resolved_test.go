@@ -0,0 +1,124 @@
+package netdata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func TestClearedAlarmsAreSentAsResolved(t *testing.T) {
+	result := runLocalShardWithStateTest(t, infra.Config{ResolvedAlarms: true}, newShardState(), noJournal{},
+		change(user1, alarm1, wire.StatusWarning, time1),
+		change(user1, alarm2, wire.StatusCritical, time1),
+		send(user1),
+		change(user1, alarm1, wire.StatusCleared, time2),
+		change(user1, alarm3, wire.StatusWarning, time2),
+		change(user1, alarm3, wire.StatusCleared, time3),
+		send(user1),
+		send(user1),
+	)
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusWarning,
+					LatestChangedAt: time1,
+				},
+				{
+					AlarmID:         alarm2,
+					Status:          wire.StatusCritical,
+					LatestChangedAt: time1,
+				},
+			},
+		},
+		{
+			// Alarm which has never been sent as active is not resolved
+			UserID: user1,
+			ResolvedAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusCleared,
+					LatestChangedAt: time2,
+				},
+			},
+		},
+	}, result)
+}
+
+func TestClearedAlarmsAreNotSentIfResolvedAlarmsAreOff(t *testing.T) {
+	result := runLocalShardWithStateTest(t, infra.Config{}, newShardState(), noJournal{},
+		change(user1, alarm1, wire.StatusWarning, time1),
+		send(user1),
+		change(user1, alarm1, wire.StatusCleared, time2),
+		send(user1),
+	)
+	assert.Len(t, result, 1)
+	assert.Empty(t, result[0].ResolvedAlarms)
+}
+
+func TestAlarmTriggeredAgainIsNotResolved(t *testing.T) {
+	result := runLocalShardWithStateTest(t, infra.Config{ResolvedAlarms: true}, newShardState(), noJournal{},
+		change(user1, alarm1, wire.StatusWarning, time1),
+		send(user1),
+		change(user1, alarm1, wire.StatusCleared, time2),
+		change(user1, alarm1, wire.StatusCritical, time3),
+		send(user1),
+		change(user1, alarm1, wire.StatusCleared, time4),
+		send(user1),
+	)
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusWarning,
+					LatestChangedAt: time1,
+				},
+			},
+		},
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusCritical,
+					LatestChangedAt: time3,
+				},
+			},
+		},
+		{
+			UserID: user1,
+			ResolvedAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusCleared,
+					LatestChangedAt: time4,
+				},
+			},
+		},
+	}, result)
+}
+
+func TestResolvedAlarmWaitingToBeSentIsNotEvicted(t *testing.T) {
+	log := logger.New()
+	state := newShardState()
+	state.resolve = true
+	require.True(t, state.applyAlarmStatusChanged(log, change(user1, alarm1, wire.StatusWarning, time1)))
+	state.stage(&stagedDigest{
+		ID:        "digest",
+		Digest:    wire.AlarmDigest{UserID: user1, ActiveAlarms: []wire.Alarm{{AlarmID: alarm1, Status: wire.StatusWarning}}},
+		Revisions: map[wire.AlarmID]uint64{alarm1: 1},
+	})
+	state.markPublished("digest")
+	require.True(t, state.applyAlarmStatusChanged(log, change(user1, alarm1, wire.StatusCleared, time2)))
+
+	assert.Empty(t, state.evictAlarms(time3))
+	assert.True(t, state.Users[user1][alarm1].ToSend)
+}
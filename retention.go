@@ -0,0 +1,92 @@
+package netdata
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"go.uber.org/zap"
+)
+
+// applyAlarmStatusChanged applies status update to the alarm, false is returned if update is outdated and was ignored.
+// Update of unknown alarm is outdated if it is not newer than the watermark of alarms removed by retention,
+// because it might be an update of the alarm cleared later.
+func (st *shardState) applyAlarmStatusChanged(log *zap.Logger, m wire.AlarmStatusChanged) bool {
+	if st.Users[m.UserID][m.AlarmID] == nil && !m.ChangedAt.After(st.Watermarks[m.UserID]) {
+		log.Info("Update ignored because it is older than alarms removed by retention")
+		return false
+	}
+	applied := st.Users.applyAlarmStatusChanged(log, m, st.flapping, st.resolve)
+	st.reindexAlarm(m.UserID, m.AlarmID)
+	return applied
+}
+
+// evictAlarms removes cleared alarms which haven't changed since the horizon and aren't waiting to be sent,
+// and users left without alarms. Removed alarms are returned.
+func (st *shardState) evictAlarms(horizon time.Time) []evictedAlarm {
+	// Alarms waiting in the outbox are kept, so confirmation of the digest doesn't affect alarm created again
+	staged := st.stagedAlarms()
+
+	var expired []evictedAlarm
+	for userID, alarms := range st.Users {
+		for alarmID, alarm := range alarms {
+			if alarm.Status != wire.StatusCleared || alarm.ToSend || !alarm.LatestChangedAt.Before(horizon) || staged[userID][alarmID] {
+				continue
+			}
+			expired = append(expired, evictedAlarm{UserID: userID, AlarmID: alarmID})
+		}
+	}
+	st.expireAlarms(expired)
+	return expired
+}
+
+// expireAlarms removes alarms selected by retention and users left without alarms. The latest change of removed alarms
+// is kept in the watermark of the user.
+func (st *shardState) expireAlarms(expired []evictedAlarm) {
+	if st.Watermarks == nil {
+		st.Watermarks = map[wire.UserID]time.Time{}
+	}
+
+	for _, e := range expired {
+		alarms := st.Users[e.UserID]
+		alarm := alarms[e.AlarmID]
+		if alarm == nil {
+			continue
+		}
+		if alarm.LatestChangedAt.After(st.Watermarks[e.UserID]) {
+			st.Watermarks[e.UserID] = alarm.LatestChangedAt
+		}
+		delete(alarms, e.AlarmID)
+		st.reindexAlarm(e.UserID, e.AlarmID)
+		if len(alarms) == 0 {
+			delete(st.Users, e.UserID)
+		}
+	}
+}
+
+// applyRetention removes cleared alarms older than retention horizon
+func (s *localShard) applyRetention(log *zap.Logger, now time.Time) error {
+	expired := s.evictAlarms(now.Add(-s.config.RetentionHorizon))
+	if len(expired) == 0 {
+		return nil
+	}
+	if err := s.record(log, journalRecord{AlarmsExpired: expired}); err != nil {
+		return fmt.Errorf("recording expired alarms failed: %w", err)
+	}
+	log.Debug("Cleared alarms removed", zap.Int("alarms", len(expired)))
+	return nil
+}
+
+// stagedAlarms returns alarms included in digests waiting in the outbox
+func (st *shardState) stagedAlarms() map[wire.UserID]map[wire.AlarmID]bool {
+	staged := map[wire.UserID]map[wire.AlarmID]bool{}
+	for _, digest := range st.Outbox {
+		if staged[digest.Digest.UserID] == nil {
+			staged[digest.Digest.UserID] = map[wire.AlarmID]bool{}
+		}
+		for alarmID := range digest.Revisions {
+			staged[digest.Digest.UserID][alarmID] = true
+		}
+	}
+	return staged
+}
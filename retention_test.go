@@ -0,0 +1,117 @@
+package netdata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func TestClearedAlarmsOlderThanHorizonAreEvicted(t *testing.T) {
+	log := logger.New()
+	state := newShardState()
+	for _, m := range []wire.AlarmStatusChanged{
+		change(user1, alarm1, wire.StatusCleared, time1),
+		change(user1, alarm2, wire.StatusCleared, time2),
+		change(user1, alarm3, wire.StatusCritical, time1),
+		change(user2, alarm1, wire.StatusCleared, time1),
+		change(user3, alarm1, wire.StatusCleared, time4),
+		change(user3, alarm2, wire.StatusCleared, time1),
+	} {
+		require.True(t, state.applyAlarmStatusChanged(log, m))
+	}
+	state.stage(&stagedDigest{
+		ID:        "digest",
+		Digest:    wire.AlarmDigest{UserID: user3},
+		Revisions: map[wire.AlarmID]uint64{alarm2: 1},
+	})
+
+	assert.Len(t, state.evictAlarms(time3), 3)
+
+	// Active alarms, alarms changed after horizon and alarms waiting in the outbox are kept
+	assert.Len(t, state.Users, 2)
+	assert.Contains(t, state.Users[user1], alarm3)
+	assert.NotContains(t, state.Users[user1], alarm1)
+	assert.NotContains(t, state.Users[user1], alarm2)
+	assert.NotContains(t, state.Users, user2)
+	assert.Len(t, state.Users[user3], 2)
+
+	assert.Equal(t, map[wire.UserID]time.Time{
+		user1: time2,
+		user2: time1,
+	}, state.Watermarks)
+}
+
+func TestUpdatesOlderThanWatermarkAreIgnored(t *testing.T) {
+	log := logger.New()
+	state := newShardState()
+	require.True(t, state.applyAlarmStatusChanged(log, change(user1, alarm1, wire.StatusCleared, time2)))
+	require.Len(t, state.evictAlarms(time3), 1)
+
+	// Outdated update of removed alarm
+	assert.False(t, state.applyAlarmStatusChanged(log, change(user1, alarm1, wire.StatusCritical, time1)))
+	assert.False(t, state.applyAlarmStatusChanged(log, change(user1, alarm2, wire.StatusCritical, time2)))
+	assert.Empty(t, state.Users)
+
+	// Watermark of one user doesn't affect others
+	assert.True(t, state.applyAlarmStatusChanged(log, change(user2, alarm1, wire.StatusCritical, time1)))
+
+	assert.True(t, state.applyAlarmStatusChanged(log, change(user1, alarm1, wire.StatusCritical, time3)))
+	assert.Equal(t, wire.StatusCritical, state.Users[user1][alarm1].Status)
+}
+
+func TestLocalShardEvictsClearedAlarmsPeriodically(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	// Snapshots are turned off, so eviction is restored from the journal
+	config := infra.Config{
+		StateDir:          t.TempDir(),
+		RetentionHorizon:  time.Hour,
+		RetentionInterval: 10 * time.Millisecond,
+	}
+	j, state, err := openJournal(config, 0, logger.New())
+	require.NoError(t, err)
+	rx, tx, errCh := startLocalShard(ctx, config, state, j)
+
+	rx <- change(user1, alarm1, wire.StatusCleared, time2)
+	time.Sleep(100 * time.Millisecond)
+	rx <- change(user1, alarm1, wire.StatusCritical, time1)
+	rx <- send(user1)
+	close(rx)
+	require.NoError(t, <-errCh)
+	require.NoError(t, j.Close())
+
+	select {
+	case msg := <-tx:
+		require.Fail(t, "outdated update sent", msg)
+	default:
+	}
+	assert.Empty(t, state.Users)
+	assert.Equal(t, time2, state.Watermarks[user1])
+
+	j, state, err = openJournal(config, 0, logger.New())
+	require.NoError(t, err)
+	require.NoError(t, j.Close())
+	assert.Empty(t, state.Users)
+	assert.Equal(t, time2, state.Watermarks[user1])
+}
+
+func TestWatermarkIsHandedOff(t *testing.T) {
+	state := newShardState()
+	state.restoreUser(wire.AlarmsHandedOff{
+		ShardedEntity: wire.ShardedEntity{UserID: user1},
+		Epoch:         1,
+		Watermark:     time1,
+	})
+	assert.Empty(t, state.Users)
+	assert.Equal(t, map[wire.UserID]bool{user1: true}, state.knownUsers())
+
+	state.removeUsers([]wire.UserID{user1})
+	assert.Empty(t, state.knownUsers())
+}
@@ -0,0 +1,214 @@
+package netdata
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"github.com/ridge/parallel"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"github.com/wojciech-malota-wojcik/netdata/lib/libctx"
+	"go.uber.org/zap"
+)
+
+// runRouter receives messages from type-specific topics and republishes them to subjects of shards owning them
+func runRouter(ctx context.Context, config infra.Config, shardIDGen sharding.IDGenerator, shardMap *sharding.Map, conn bus.Connection) error {
+	r := &router{
+		shardIDGen: shardIDGen,
+		shardMap:   shardMap,
+	}
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		tx := make(chan interface{})
+		rx := make(chan interface{}, localShardBufferSize)
+
+		spawn("bus", parallel.Fail, conn.Run(tx))
+		spawn("router", parallel.Fail, func(ctx context.Context) error {
+			defer close(tx)
+
+			// Messages received before subscriptions are closed are routed
+			ctx, cancel := context.WithCancel(libctx.Reopen(ctx))
+			defer cancel()
+
+			return r.run(ctx, rx, tx)
+		})
+		spawn("subscriptions", parallel.Fail, func(ctx context.Context) error {
+			defer close(rx)
+
+			return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+				rxes := []chan<- interface{}{rx}
+				spawn("subscription-rx", parallel.Fail, conn.Subscribe(ctx, &wire.AlarmStatusChanged{}, rxes))
+				spawn("subscription-tx", parallel.Fail, conn.Subscribe(ctx, &wire.SendAlarmDigest{}, rxes))
+				spawn("subscription-ack", parallel.Fail, conn.Subscribe(ctx, &wire.AcknowledgeAlarm{}, rxes))
+				spawn("subscription-schedule", parallel.Fail, conn.Subscribe(ctx, &wire.SetDigestSchedule{}, rxes))
+				spawn("subscription-preferences", parallel.Fail, conn.Subscribe(ctx, &wire.SetDigestPreferences{}, rxes))
+				spawn("subscription-silence-create", parallel.Fail, conn.Subscribe(ctx, &wire.CreateSilence{}, rxes))
+				spawn("subscription-silence-delete", parallel.Fail, conn.Subscribe(ctx, &wire.DeleteSilence{}, rxes))
+				spawn("subscription-reshard", parallel.Fail, conn.Subscribe(ctx, &wire.ReshardRequested{}, rxes))
+				spawn("subscription-completed", parallel.Fail, conn.Subscribe(ctx, &wire.HandoffCompleted{}, rxes))
+				return nil
+			})
+		})
+		return nil
+	})
+}
+
+// router republishes messages to subjects of shards owning them. During resharding messages are published
+// to both the current and the next owner.
+type router struct {
+	shardIDGen sharding.IDGenerator
+	shardMap   *sharding.Map
+
+	// completed contains shards which completed handoff in the resharding in progress
+	completed map[uint64]bool
+}
+
+func (r *router) run(ctx context.Context, rx <-chan interface{}, tx chan<- interface{}) error {
+	log := logger.Get(ctx)
+	log.Info("Router started")
+
+	for msg := range rx {
+		var ack bus.AckFunc
+		var messageID string
+		if d, ok := msg.(bus.Delivery); ok {
+			msg, messageID, ack = d.Entity, d.MessageID, d.Ack
+		}
+
+		log := log.With(zap.Any("msg", msg))
+		if entity, ok := msgPtr(msg).(bus.RoutableEntity); ok {
+			if err := r.route(ctx, log, entity, messageID, ack, tx); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch m := msg.(type) {
+		case wire.ReshardRequested:
+			r.prepare(log, m)
+		case wire.HandoffCompleted:
+			r.markCompleted(log, m)
+		default:
+			log.Warn(fmt.Sprintf("Message of unknown type %T received", msg))
+		}
+
+		if ack != nil {
+			ack()
+		}
+	}
+	return nil
+}
+
+// msgPtr returns pointer to the copy of received message, so methods with pointer receivers may be called on it
+func msgPtr(msg interface{}) interface{} {
+	ptr := reflect.New(reflect.TypeOf(msg))
+	ptr.Elem().Set(reflect.ValueOf(msg))
+	return ptr.Interface()
+}
+
+// route publishes message to the subjects of shards owning it. If broker expects message to be acknowledged,
+// it is done once all the shards received it, otherwise broker redelivers it. ID of republished message is derived
+// from the ID of the received one, so broker discards the copy republished after redelivery.
+func (r *router) route(ctx context.Context, log *zap.Logger, msg bus.RoutableEntity, messageID string, ack bus.AckFunc, tx chan<- interface{}) error {
+	owners := r.owners(msg.ShardSeed())
+	log.Debug("Routing message", zap.Any("shardIDs", owners))
+
+	if ack == nil {
+		for _, shardID := range owners {
+			if err := enqueue(ctx, tx, bus.Routed{ShardID: shardID, Msg: msg}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	remaining := int32(len(owners))
+	var failed int32
+	for _, shardID := range owners {
+		out := bus.Outgoing{
+			ID:  routedID(messageID, shardID),
+			Msg: bus.Routed{ShardID: shardID, Msg: msg},
+			Confirm: func(err error) {
+				if err != nil {
+					log.Warn("Routing message failed, it will be redelivered", zap.Error(err))
+					atomic.StoreInt32(&failed, 1)
+				}
+				if atomic.AddInt32(&remaining, -1) == 0 && atomic.LoadInt32(&failed) == 0 {
+					ack()
+				}
+			},
+		}
+		if err := enqueue(ctx, tx, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routedID returns ID of the message republished to the shard
+func routedID(messageID string, shardID sharding.ID) string {
+	if messageID == "" {
+		return uuid.New().String()
+	}
+	return fmt.Sprintf("%s-shard-%d", messageID, shardID)
+}
+
+// owners returns shards owning the seed, during resharding the next owner is returned too
+func (r *router) owners(seed []byte) []sharding.ID {
+	_, numOfShards := r.shardMap.Current()
+	owner := sharding.Owner(r.shardIDGen, seed, numOfShards)
+	owners := []sharding.ID{owner}
+	if _, nextNumOfShards := r.shardMap.Next(); nextNumOfShards > 0 {
+		if nextOwner := sharding.Owner(r.shardIDGen, seed, nextNumOfShards); nextOwner != owner {
+			owners = append(owners, nextOwner)
+		}
+	}
+	return owners
+}
+
+// prepare starts routing messages to the next owners too
+func (r *router) prepare(log *zap.Logger, m wire.ReshardRequested) {
+	epoch, numOfShards := r.shardMap.Current()
+	nextEpoch, _ := r.shardMap.Next()
+	switch {
+	case nextEpoch != 0:
+		log.Warn("Resharding is in progress already, request ignored", zap.Uint64("epochInProgress", nextEpoch))
+		return
+	case m.Epoch <= epoch:
+		log.Info("Outdated resharding request ignored", zap.Uint64("currentEpoch", epoch))
+		return
+	case m.NumOfShards == numOfShards:
+		log.Info("Number of shards is the same, resharding request ignored")
+		return
+	}
+
+	log.Info("Resharding started", zap.Uint64("numOfShards", numOfShards), zap.Uint64("nextNumOfShards", m.NumOfShards))
+	r.shardMap.Prepare(m.Epoch, m.NumOfShards)
+	r.completed = map[uint64]bool{}
+}
+
+// markCompleted marks shard as the one which completed handoff, once all the shards are completed messages
+// are routed to the next owners only
+func (r *router) markCompleted(log *zap.Logger, m wire.HandoffCompleted) {
+	nextEpoch, nextNumOfShards := r.shardMap.Next()
+	if nextEpoch == 0 || m.Epoch != nextEpoch {
+		return
+	}
+
+	r.completed[m.ShardID] = true
+	_, numOfShards := r.shardMap.Current()
+	for i := uint64(0); i < participants(numOfShards, nextNumOfShards); i++ {
+		if !r.completed[i] {
+			return
+		}
+	}
+
+	r.shardMap.Commit()
+	r.completed = nil
+	log.Info("Resharding committed", zap.Uint64("epoch", nextEpoch), zap.Uint64("numOfShards", nextNumOfShards))
+}
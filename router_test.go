@@ -0,0 +1,205 @@
+package netdata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/ridge/parallel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func TestRouterRoutesToBothOwnersDuringResharding(t *testing.T) {
+	log := logger.New()
+	r := &router{
+		shardIDGen: sharding.NewJumpHashIDGenerator(),
+		shardMap:   sharding.NewMap(1),
+	}
+
+	var seed []byte
+	for i := 0; ; i++ {
+		seed = []byte(fmt.Sprintf("user-%d", i))
+		if sharding.Owner(r.shardIDGen, seed, 2) == 1 {
+			break
+		}
+	}
+	assert.Equal(t, []sharding.ID{0}, r.owners(seed))
+
+	r.prepare(log, wire.ReshardRequested{Epoch: 1, NumOfShards: 2})
+	assert.Equal(t, []sharding.ID{0, 1}, r.owners(seed))
+
+	// Resharding is committed once all the shards completed handoff
+	r.markCompleted(log, wire.HandoffCompleted{Epoch: 1, ShardID: 1})
+	assert.Equal(t, []sharding.ID{0, 1}, r.owners(seed))
+	r.markCompleted(log, wire.HandoffCompleted{Epoch: 1, ShardID: 0})
+	assert.Equal(t, []sharding.ID{1}, r.owners(seed))
+
+	epoch, numOfShards := r.shardMap.Current()
+	assert.EqualValues(t, 1, epoch)
+	assert.EqualValues(t, 2, numOfShards)
+}
+
+func TestRedeliveredMessageIsRoutedUnderTheSameID(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	r := &router{
+		shardIDGen: sharding.NewJumpHashIDGenerator(),
+		shardMap:   sharding.NewMap(2),
+	}
+	owner := r.owners([]byte(user1))[0]
+
+	rx := make(chan interface{}, 2)
+	tx := make(chan interface{})
+	for i := 0; i < 2; i++ {
+		rx <- bus.Delivery{Entity: change(user1, alarm1, wire.StatusCritical, time1), MessageID: "message", Ack: func() {}}
+	}
+	close(rx)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- r.run(ctx, rx, tx)
+	}()
+
+	// Broker discards the second copy because both have the same ID
+	for i := 0; i < 2; i++ {
+		out := (<-tx).(bus.Outgoing)
+		assert.Equal(t, fmt.Sprintf("message-shard-%d", owner), out.ID)
+		out.Confirm(nil)
+	}
+	require.NoError(t, <-errCh)
+}
+
+func TestMessagesAreRoutedToShardSubjects(t *testing.T) {
+	const numOfUsers = 20
+
+	s, err := server.NewServer(&server.Options{
+		Host: "127.0.0.1",
+		Port: -1,
+	})
+	require.NoError(t, err)
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	require.True(t, s.ReadyForConnections(10*time.Second))
+
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	// Routers split messages between them
+	var configs []infra.Config
+	for i := 0; i < 2; i++ {
+		configs = append(configs, infra.Config{
+			NumOfShards:      2,
+			NumOfLocalShards: 1,
+			NATSAddresses:    []string{s.ClientURL()},
+			Router:           true,
+			QueueGroup:       "routers",
+		})
+	}
+	for i := sharding.ID(0); i < 2; i++ {
+		configs = append(configs, infra.Config{
+			ShardID:          i,
+			NumOfShards:      2,
+			NumOfLocalShards: 2,
+			NATSAddresses:    []string{s.ClientURL()},
+			ShardSubjects:    true,
+		})
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+			for i, config := range configs {
+				config := config
+				shardIDGen := sharding.NewJumpHashIDGenerator()
+				shardMap := sharding.NewMap(config.NumOfShards)
+				conn := bus.NewNATSConnection(config, bus.NewDispatcherFactory(config, shardIDGen, shardMap))
+				name := fmt.Sprintf("node-%d", i)
+				spawn(name, parallel.Fail, func(ctx context.Context) error {
+					return App(ctx, config, shardIDGen, shardMap, conn, election.NewStaticLeadership())
+				})
+			}
+			return nil
+		})
+	}()
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	var mu sync.Mutex
+	digests := map[wire.UserID][]wire.AlarmDigest{}
+	routed := map[string]int{}
+	_, err = nc.Subscribe("AlarmDigest", func(m *nats.Msg) {
+		var digest wire.AlarmDigest
+		if err := json.Unmarshal(m.Data, &digest); err != nil {
+			panic(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		digests[digest.UserID] = append(digests[digest.UserID], digest)
+	})
+	require.NoError(t, err)
+	_, err = nc.Subscribe("AlarmStatusChanged.*", func(m *nats.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		routed[m.Subject]++
+	})
+	require.NoError(t, err)
+
+	// Each router subscribes to 9 subjects and each shard to 12 subjects
+	require.Eventually(t, func() bool {
+		return s.NumSubscriptions() >= 43
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Subscriptions of core NATS drop messages arriving faster than they are consumed, so they are published one by one
+	publish := func(subject string, msg interface{}) {
+		data, err := json.Marshal(msg)
+		require.NoError(t, err)
+		require.NoError(t, nc.Publish(subject, data))
+		require.NoError(t, nc.Flush())
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < numOfUsers; i++ {
+		publish("AlarmStatusChanged", change(wire.UserID(fmt.Sprintf("user-%d", i)), alarm1, wire.StatusCritical, time1))
+	}
+	for i := 0; i < numOfUsers; i++ {
+		publish("SendAlarmDigest", send(wire.UserID(fmt.Sprintf("user-%d", i))))
+	}
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(digests) == numOfUsers
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Waiting for possible duplicates
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < numOfUsers; i++ {
+		assert.Len(t, digests[wire.UserID(fmt.Sprintf("user-%d", i))], 1)
+	}
+
+	// Each message is routed by one router to one shard only
+	assert.Equal(t, numOfUsers, routed["AlarmStatusChanged.0"]+routed["AlarmStatusChanged.1"])
+	assert.NotZero(t, routed["AlarmStatusChanged.0"])
+	assert.NotZero(t, routed["AlarmStatusChanged.1"])
+
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+}
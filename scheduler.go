@@ -0,0 +1,170 @@
+package netdata
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"github.com/wojciech-malota-wojcik/netdata/lib/schedule"
+	"go.uber.org/zap"
+)
+
+// userSchedule is the digest schedule of the user
+type userSchedule struct {
+	wire.DigestSchedule
+
+	// NextAt is the time when the next digest is sent, it is zero if schedule is removed or never fires
+	NextAt time.Time
+}
+
+// scheduleUpdate is the new digest schedule of the user
+type scheduleUpdate struct {
+	// UserID is the user ID
+	UserID wire.UserID
+
+	// Schedule is the schedule of the user
+	Schedule userSchedule
+}
+
+// setSchedule stores digest schedule of the user. Removed schedule is kept, so older one received later is ignored.
+func (st *shardState) setSchedule(update *scheduleUpdate) {
+	if st.Schedules == nil {
+		st.Schedules = map[wire.UserID]*userSchedule{}
+	}
+	sch := update.Schedule
+	st.Schedules[update.UserID] = &sch
+}
+
+// nextDigestAt returns the time of the first scheduled digest after now
+func nextDigestAt(ds wire.DigestSchedule, now time.Time) (time.Time, error) {
+	if ds.Spec == "" {
+		return time.Time{}, nil
+	}
+	sch, err := schedule.Parse(ds.Spec, ds.TimeZone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return sch.Next(now), nil
+}
+
+// setDigestSchedule replaces digest schedule of the user
+func (s *localShard) setDigestSchedule(log *zap.Logger, m wire.SetDigestSchedule) error {
+	if current := s.Schedules[m.UserID]; current != nil && current.SetAt.After(m.SetAt) {
+		log.Info("Schedule ignored because newer one exists")
+		return nil
+	}
+
+	next, err := nextDigestAt(m.DigestSchedule, time.Now())
+	if err != nil {
+		log.Warn("Schedule is invalid, ignoring", zap.Error(err))
+		return nil
+	}
+	if err := s.updateSchedule(log, &scheduleUpdate{
+		UserID: m.UserID,
+		Schedule: userSchedule{
+			DigestSchedule: m.DigestSchedule,
+			NextAt:         next,
+		},
+	}); err != nil {
+		return err
+	}
+
+	log.Info("Digest schedule set", zap.Time("nextDigestAt", next))
+	return nil
+}
+
+// sendScheduledDigests sends digests to the users whose schedules are due
+func (s *localShard) sendScheduledDigests(ctx context.Context, log *zap.Logger, now time.Time) error {
+	for s.scheduled.Len() > 0 && !s.scheduled[0].At.After(now) {
+		item := heap.Pop(&s.scheduled).(scheduledDigest)
+
+		// Entry is outdated if schedule has been changed, removed or handed off since it was queued
+		sch := s.Schedules[item.UserID]
+		if sch == nil || !sch.NextAt.Equal(item.At) {
+			continue
+		}
+
+		log := log.With(zap.Any("userID", item.UserID))
+		log.Info("Scheduled digest is due", zap.Time("scheduledAt", item.At))
+
+		// Schedule is advanced after digest is staged so it is sent again if node fails in between
+		if err := s.sendAlarmDigest(ctx, log, wire.SendAlarmDigest{ShardedEntity: wire.ShardedEntity{UserID: item.UserID}}); err != nil {
+			return err
+		}
+
+		next, err := nextDigestAt(sch.DigestSchedule, now)
+		if err != nil {
+			return fmt.Errorf("computing next digest time failed: %w", err)
+		}
+		if next.IsZero() {
+			log.Warn("Schedule doesn't fire anymore")
+		}
+		if err := s.updateSchedule(log, &scheduleUpdate{
+			UserID: item.UserID,
+			Schedule: userSchedule{
+				DigestSchedule: sch.DigestSchedule,
+				NextAt:         next,
+			},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateSchedule stores and records digest schedule of the user
+func (s *localShard) updateSchedule(log *zap.Logger, update *scheduleUpdate) error {
+	s.setSchedule(update)
+	s.enqueueSchedule(update.UserID)
+	if err := s.record(log, journalRecord{ScheduleUpdated: update}); err != nil {
+		return fmt.Errorf("recording digest schedule failed: %w", err)
+	}
+	return nil
+}
+
+// enqueueSchedule puts the next digest of the user into the queue if scheduler is turned on
+func (s *localShard) enqueueSchedule(userID wire.UserID) {
+	if s.config.SchedulerInterval <= 0 {
+		return
+	}
+	if sch := s.Schedules[userID]; sch != nil && !sch.NextAt.IsZero() {
+		heap.Push(&s.scheduled, scheduledDigest{UserID: userID, At: sch.NextAt})
+	}
+}
+
+// scheduledDigest is the digest scheduled at the time
+type scheduledDigest struct {
+	// UserID is the user ID
+	UserID wire.UserID
+
+	// At is the time when digest is sent
+	At time.Time
+}
+
+// scheduleQueue is the priority queue of scheduled digests, the earliest one is at index 0
+type scheduleQueue []scheduledDigest
+
+func (q scheduleQueue) Len() int {
+	return len(q)
+}
+
+func (q scheduleQueue) Less(i, j int) bool {
+	return q[i].At.Before(q[j].At)
+}
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	*q = append(*q, x.(scheduledDigest))
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
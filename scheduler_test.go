@@ -0,0 +1,141 @@
+package netdata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func setSchedule(userID wire.UserID, spec string, setAt time.Time) wire.SetDigestSchedule {
+	return wire.SetDigestSchedule{
+		ShardedEntity: wire.ShardedEntity{
+			UserID: userID,
+		},
+		DigestSchedule: wire.DigestSchedule{
+			Spec:  spec,
+			SetAt: setAt,
+		},
+	}
+}
+
+func TestScheduledDigestIsSent(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
+	defer cancel()
+
+	config := infra.Config{SchedulerInterval: 10 * time.Millisecond}
+	state := newShardState()
+	state.setSchedule(&scheduleUpdate{
+		UserID: user1,
+		Schedule: userSchedule{
+			DigestSchedule: wire.DigestSchedule{Spec: "@every 1h", SetAt: time1},
+			NextAt:         time2,
+		},
+	})
+	state.setSchedule(&scheduleUpdate{
+		UserID: user2,
+		Schedule: userSchedule{
+			DigestSchedule: wire.DigestSchedule{Spec: "@every 1h", SetAt: time1},
+			NextAt:         time.Now().Add(time.Hour),
+		},
+	})
+
+	rx := make(chan interface{}, 2)
+	rx <- change(user1, alarm1, wire.StatusCritical, time1)
+	rx <- change(user2, alarm1, wire.StatusCritical, time1)
+
+	// Local shard is stopped once the first digest is published
+	tx := make(chan interface{})
+	var result []wire.AlarmDigest
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for msg := range tx {
+			out := msg.(bus.Outgoing)
+			result = append(result, *out.Msg.(*wire.AlarmDigest))
+			out.Confirm(nil)
+			if len(result) == 1 {
+				close(rx)
+			}
+		}
+	}()
+
+	start := time.Now()
+	require.NoError(t, runLocalShard(config, state, noJournal{}, newTestResharder(config), election.NewStaticLeadership(), rx, tx)(ctx))
+	close(tx)
+	<-doneCh
+
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusCritical,
+					LatestChangedAt: time1,
+				},
+			},
+		},
+	}, result)
+
+	// Digest is sent once even if schedule was missed many times, next one is scheduled after now
+	assert.True(t, state.Schedules[user1].NextAt.After(start))
+	assert.True(t, state.Users[user2][alarm1].ToSend)
+}
+
+func TestDigestScheduleIsSet(t *testing.T) {
+	state := newShardState()
+	before := time.Now()
+	runLocalShardWithStateTest(t, infra.Config{}, state, noJournal{},
+		setSchedule(user1, "@every 15m", time2),
+		setSchedule(user1, "@daily 08:00", time1),
+		setSchedule(user2, "@daily 08:00", time1),
+		setSchedule(user2, "", time2),
+	)
+
+	// Older schedule is ignored
+	require.Contains(t, state.Schedules, user1)
+	assert.Equal(t, "@every 15m", state.Schedules[user1].Spec)
+	assert.True(t, state.Schedules[user1].NextAt.After(before))
+	assert.False(t, state.Schedules[user1].NextAt.After(time.Now().Add(15*time.Minute)))
+
+	// Removed schedule is kept so older one received later is ignored
+	require.Contains(t, state.Schedules, user2)
+	assert.Empty(t, state.Schedules[user2].Spec)
+	assert.True(t, state.Schedules[user2].NextAt.IsZero())
+}
+
+func TestScheduleIsHandedOff(t *testing.T) {
+	state := newShardState()
+	state.restoreUser(wire.AlarmsHandedOff{
+		ShardedEntity: wire.ShardedEntity{UserID: user1},
+		Epoch:         1,
+		Schedule:      wire.DigestSchedule{Spec: "@every 1h", SetAt: time1},
+		NextDigestAt:  time2,
+	})
+	assert.Equal(t, map[wire.UserID]bool{user1: true}, state.knownUsers())
+	assert.Equal(t, time2, state.Schedules[user1].NextAt)
+
+	state.removeUsers([]wire.UserID{user1})
+	assert.Empty(t, state.knownUsers())
+}
+
+func TestScheduleIsReplayed(t *testing.T) {
+	state := newShardState()
+	update := &scheduleUpdate{
+		UserID: user1,
+		Schedule: userSchedule{
+			DigestSchedule: wire.DigestSchedule{Spec: "@every 1h", SetAt: time1},
+			NextAt:         time2,
+		},
+	}
+	require.NoError(t, state.replay(logger.New(), journalRecord{ScheduleUpdated: update}))
+	assert.Equal(t, update.Schedule, *state.Schedules[user1])
+}
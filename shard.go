@@ -3,11 +3,14 @@ package netdata
 import (
 	"context"
 	"fmt"
-	"sort"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/ridge/parallel"
 	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
 	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
 	"go.uber.org/zap"
 )
@@ -23,109 +26,647 @@ type alarmStatus struct {
 	// LatestChangedAt is the time when status was updated
 	LatestChangedAt time.Time
 
+	// StatusChangedAt is the time when the current status was reported first
+	StatusChangedAt time.Time
+
 	// ToSend is true if current state should be sent next time
 	ToSend bool
+
+	// Revision is incremented each time alarm is triggered
+	Revision uint64
+
+	// Acknowledged is true if alarm has been acknowledged by the user since its status changed
+	Acknowledged bool `json:",omitempty"`
+
+	// AcknowledgementExpiresAt is the time when acknowledgement expires, it lasts until status changes if zero
+	AcknowledgementExpiresAt time.Time
+
+	// Flapping is true if status of the alarm changes too often, it is sent once until it settles
+	Flapping bool `json:",omitempty"`
+
+	// Transitions contains times of recent status changes used to detect flapping
+	Transitions []time.Time `json:",omitempty"`
+
+	// Notified is true if the last state sent to the user was active, so user should be notified about resolution
+	Notified bool `json:",omitempty"`
+
+	// Labels are the labels received in the latest update containing them
+	Labels map[string]string `json:",omitempty"`
+}
+
+// acknowledged returns true if alarm is acknowledged at the time
+func (a *alarmStatus) acknowledged(now time.Time) bool {
+	return a.Acknowledged && (a.AcknowledgementExpiresAt.IsZero() || now.Before(a.AcknowledgementExpiresAt))
+}
+
+// digestEntry returns the alarm as it is sent in the digest
+func (a *alarmStatus) digestEntry(alarmID wire.AlarmID) wire.Alarm {
+	alarm := wire.Alarm{
+		AlarmID:         alarmID,
+		Status:          a.Status,
+		LatestChangedAt: a.LatestChangedAt,
+		Labels:          a.Labels,
+	}
+	if a.Flapping {
+		alarm.Flapping = true
+		alarm.Transitions = uint64(len(a.Transitions))
+	}
+	return alarm
+}
+
+// shardState is the persistent state of local shard
+type shardState struct {
+	// Users contains alarms of users
+	Users userList
+
+	// Outbox contains digests waiting for confirmation from the broker
+	Outbox map[string]*stagedDigest
+
+	// Requests contains SendAlarmDigest requests answered recently
+	Requests requestList
+
+	// Watermarks contains the latest change of alarms removed by retention, per user
+	Watermarks map[wire.UserID]time.Time `json:",omitempty"`
+
+	// Schedules contains digest schedules of users
+	Schedules map[wire.UserID]*userSchedule `json:",omitempty"`
+
+	// Silences contains silences of users
+	Silences map[wire.UserID]map[string]*silence `json:",omitempty"`
+
+	// Preferences contains digest preferences of users
+	Preferences map[wire.UserID]wire.DigestPreferences `json:",omitempty"`
+
+	// Limits contains buckets limiting rate of digests sent to users
+	Limits map[wire.UserID]*digestLimit `json:",omitempty"`
+
+	// Announced contains digests announced as published by the leader recently
+	Announced map[wire.UserID][]wire.DigestPublished `json:",omitempty"`
+
+	// Handoff contains users moved by resharding in progress
+	Handoff *handoffProgress `json:",omitempty"`
+
+	// flapping is the policy of detecting flapping alarms, it is taken from config
+	flapping flappingPolicy
+
+	// resolve is true if alarms cleared after being sent as active are sent as resolved, it is taken from config
+	resolve bool
+
+	// quota indexes alarms if quotas are configured
+	quota *quotaIndex
+}
+
+func newShardState() *shardState {
+	return &shardState{
+		Users:       userList{},
+		Outbox:      map[string]*stagedDigest{},
+		Requests:    requestList{},
+		Watermarks:  map[wire.UserID]time.Time{},
+		Schedules:   map[wire.UserID]*userSchedule{},
+		Silences:    map[wire.UserID]map[string]*silence{},
+		Preferences: map[wire.UserID]wire.DigestPreferences{},
+		Limits:      map[wire.UserID]*digestLimit{},
+		Announced:   map[wire.UserID][]wire.DigestPublished{},
+	}
+}
+
+// localShard is the local shard, it is accessed by single goroutine only so no locking is needed
+type localShard struct {
+	*shardState
+
+	config     infra.Config
+	journal    journal
+	resharder  *resharder
+	leadership election.Leadership
+	tx         chan<- interface{}
+
+	// confirmCh receives confirmations of published digests
+	confirmCh chan confirmation
+
+	// done is closed when local shard terminates
+	done chan struct{}
+
+	// inFlight contains IDs of digests passed to the bus and not confirmed yet
+	inFlight map[string]bool
+
+	// changes is the number of changes recorded since the last snapshot
+	changes uint64
+
+	// pending contains messages held back until users are taken over from other nodes during resharding
+	pending map[wire.UserID][]pendingMessage
+
+	// scheduled contains digests scheduled for users, it is maintained only if scheduler is turned on
+	scheduled scheduleQueue
+
+	// escalations contains pending escalations of WARNING alarms, it is maintained only if they are turned on
+	escalations escalationQueue
+
+	// rateLimit is the limit of digests sent to each user, it is taken from config
+	rateLimit rateLimit
+
+	// deferred contains digests deferred by rate limit, it is maintained only if rate limiting is turned on
+	deferred deferredQueue
+
+	// warned tracks quotas for which QuotaExceeded event was published
+	warned quotaWarnings
 }
 
 // runLocalShard runs a local shard
-func runLocalShard(rx <-chan interface{}, tx chan<- interface{}) parallel.Task {
+func runLocalShard(config infra.Config, state *shardState, j journal, r *resharder, leadership election.Leadership, rx <-chan interface{}, tx chan<- interface{}) parallel.Task {
 	return func(ctx context.Context) error {
 		log := logger.Get(ctx)
 		log.Info("Local shard started")
 
-		users := userList{}
+		state.flapping = newFlappingPolicy(config)
+		state.resolve = config.ResolvedAlarms
+		if config.MaxAlarmsPerUser > 0 || config.MaxAlarmsPerShard > 0 {
+			state.indexAlarms()
+		}
+		s := &localShard{
+			shardState: state,
+			config:     config,
+			journal:    j,
+			resharder:  r,
+			leadership: leadership,
+			tx:         tx,
+			confirmCh:  make(chan confirmation, localShardBufferSize),
+			done:       make(chan struct{}),
+			inFlight:   map[string]bool{},
+			pending:    map[wire.UserID][]pendingMessage{},
+			rateLimit:  newRateLimit(config),
+			warned:     quotaWarnings{},
+		}
+		defer close(s.done)
+		s.resumeHandoff()
+
+		var snapshotTicks <-chan time.Time
+		if config.SnapshotInterval > 0 {
+			ticker := time.NewTicker(config.SnapshotInterval)
+			defer ticker.Stop()
+			snapshotTicks = ticker.C
+		}
+
+		var schedulerTicks <-chan time.Time
+		if config.SchedulerInterval > 0 {
+			ticker := time.NewTicker(config.SchedulerInterval)
+			defer ticker.Stop()
+			schedulerTicks = ticker.C
+
+			for userID := range s.Schedules {
+				s.enqueueSchedule(userID)
+			}
+		}
+
+		var escalationTicks <-chan time.Time
+		if config.EscalateWarningAfter > 0 {
+			ticker := time.NewTicker(escalationCheckInterval)
+			defer ticker.Stop()
+			escalationTicks = ticker.C
+
+			for userID := range s.Users {
+				s.enqueueUserEscalations(userID)
+			}
+		}
+
+		var deferredTicks <-chan time.Time
+		if config.DigestInterval > 0 {
+			ticker := time.NewTicker(deferredCheckInterval)
+			defer ticker.Stop()
+			deferredTicks = ticker.C
+
+			for userID := range s.Limits {
+				s.enqueueDeferred(userID)
+			}
+		}
+
+		var retentionTicks <-chan time.Time
+		if config.RetentionHorizon > 0 {
+			ticker := time.NewTicker(config.RetentionInterval)
+			defer ticker.Stop()
+			retentionTicks = ticker.C
+		}
+
+		var outboxTicks <-chan time.Time
+		if config.OutboxRetryInterval > 0 {
+			ticker := time.NewTicker(config.OutboxRetryInterval)
+			defer ticker.Stop()
+			outboxTicks = ticker.C
+		}
+
+		// Channel is taken before role is checked so change happening in between is not missed
+		roleChanged := leadership.Changed()
+
+		// Digests which were not confirmed before restart are sent again
+		if err := s.retryOutbox(ctx, log); err != nil {
+			return err
+		}
 
 		for {
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
+			case <-snapshotTicks:
+				if s.changes > 0 {
+					if err := s.compact(log); err != nil {
+						return err
+					}
+				}
+			case <-schedulerTicks:
+				if err := s.sendScheduledDigests(ctx, log, time.Now()); err != nil {
+					return err
+				}
+			case <-escalationTicks:
+				if err := s.escalateWarnings(ctx, log, time.Now()); err != nil {
+					return err
+				}
+			case <-deferredTicks:
+				if err := s.sendDeferredDigests(ctx, log, time.Now()); err != nil {
+					return err
+				}
+			case <-retentionTicks:
+				if err := s.applyRetention(log, time.Now()); err != nil {
+					return err
+				}
+			case <-outboxTicks:
+				if err := s.retryOutbox(ctx, log); err != nil {
+					return err
+				}
+			case <-roleChanged:
+				roleChanged = leadership.Changed()
+				if err := s.retryOutbox(ctx, log); err != nil {
+					return err
+				}
+			case c := <-s.confirmCh:
+				if err := s.confirm(ctx, log, c); err != nil {
+					return err
+				}
 			case msg, ok := <-rx:
 				if !ok {
-					return nil
+					// Bus is still running so confirmations of digests passed to it are awaited
+					// to avoid sending them again after restart
+					return s.awaitConfirmations(ctx, log)
 				}
+
+				var ack bus.AckFunc
+				if d, ok := msg.(bus.Delivery); ok {
+					msg, ack = d.Entity, d.Ack
+				}
+
 				log := log.With(zap.Any("msg", msg))
+				if s.holdBack(log, msg, ack) {
+					continue
+				}
+				if err := s.apply(ctx, log, msg, ack); err != nil {
+					return err
+				}
 
-				switch m := msg.(type) {
-				case wire.AlarmStatusChanged:
-					alarms := users[m.UserID]
-					if alarms == nil {
-						alarms = alarmList{}
-						users[m.UserID] = alarms
-					}
-					alarm := alarms[m.AlarmID]
-					if alarm == nil {
-						alarm = &alarmStatus{}
-						alarms[m.AlarmID] = alarm
-					}
+				// Updates received late might be due already
+				if err := s.escalateWarnings(ctx, log, time.Now()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
 
-					if alarm.LatestChangedAt.After(m.ChangedAt) {
-						log.Info("Update ignored because newer one exists")
-						continue
-					}
-					alarm.LatestChangedAt = m.ChangedAt
-
-					switch {
-					case alarm.Status != m.Status:
-						alarm.Status = m.Status
-						if alarm.Status == wire.StatusCleared {
-							log.Info(fmt.Sprintf("Status is %s, alarm won't be sent", alarm.Status))
-							alarm.ToSend = false
-						} else {
-							log.Info("Alarm triggered")
-							alarm.ToSend = true
-						}
-					case alarm.ToSend:
-						log.Info("Status hasn't changed, alarm was triggered earlier")
-					default:
-						log.Info("Status hasn't changed, alarm won't be sent")
-					}
-				case wire.SendAlarmDigest:
-					log := log.With(zap.Any("userID", m.UserID))
+// apply handles the message and acknowledges it
+func (s *localShard) apply(ctx context.Context, log *zap.Logger, msg interface{}, ack bus.AckFunc) error {
+	if err := s.handle(ctx, log, msg); err != nil {
+		return err
+	}
 
-					alarms := users[m.UserID]
-					if alarms == nil {
-						log.Info("No alarms for user, nothing to send")
-					}
+	// Message is acknowledged after it is applied and recorded so it is redelivered if node fails before that
+	if ack != nil {
+		ack()
+	}
+	return nil
+}
 
-					active := &wire.AlarmDigest{
-						UserID: m.UserID,
-					}
-					var sent []*alarmStatus
-					for alarmID, alarm := range alarms {
-						if alarm.ToSend {
-							active.ActiveAlarms = append(active.ActiveAlarms, wire.Alarm{
-								AlarmID:         alarmID,
-								Status:          alarm.Status,
-								LatestChangedAt: alarm.LatestChangedAt,
-							})
-							sent = append(sent, alarm)
-						}
-					}
+func (s *localShard) handle(ctx context.Context, log *zap.Logger, msg interface{}) error {
+	switch m := msg.(type) {
+	case wire.AlarmStatusChanged:
+		if s.createsAlarm(m) {
+			admitted, err := s.admitAlarm(ctx, log, m)
+			if err != nil || !admitted {
+				return err
+			}
+		}
+		if !s.applyAlarmStatusChanged(log, m) {
+			return nil
+		}
+		if err := s.record(log, journalRecord{AlarmStatusChanged: &m}); err != nil {
+			return fmt.Errorf("recording alarm status change failed: %w", err)
+		}
+		return s.escalateChanged(ctx, log, m)
+	case wire.AcknowledgeAlarm:
+		if !s.Users.applyAcknowledgeAlarm(log, m) {
+			return nil
+		}
+		if err := s.record(log, journalRecord{AlarmAcknowledged: &m}); err != nil {
+			return fmt.Errorf("recording alarm acknowledgement failed: %w", err)
+		}
+	case wire.SendAlarmDigest:
+		return s.sendAlarmDigest(ctx, log.With(zap.Any("userID", m.UserID)), m)
+	case wire.CreateSilence:
+		if !s.applyCreateSilence(log, m) {
+			return nil
+		}
+		if err := s.record(log, journalRecord{SilenceCreated: &m}); err != nil {
+			return fmt.Errorf("recording created silence failed: %w", err)
+		}
+	case wire.DeleteSilence:
+		if !s.applyDeleteSilence(log, m) {
+			return nil
+		}
+		if err := s.record(log, journalRecord{SilenceDeleted: &m}); err != nil {
+			return fmt.Errorf("recording deleted silence failed: %w", err)
+		}
+	case wire.SetDigestSchedule:
+		return s.setDigestSchedule(log.With(zap.Any("userID", m.UserID)), m)
+	case wire.SetDigestPreferences:
+		return s.setDigestPreferences(log.With(zap.Any("userID", m.UserID)), m)
+	case bus.Request:
+		return s.answer(ctx, log, m)
+	case wire.DigestPublished:
+		if s.Outbox[m.DigestID] == nil && s.leadership.Role() == election.RoleLeader {
+			// Leader receives its own announcements
+			return nil
+		}
+		s.applyDigestPublished(m)
+		if err := s.record(log, journalRecord{DigestAnnounced: &m}); err != nil {
+			return fmt.Errorf("recording announced digest failed: %w", err)
+		}
+		return nil
+	case wire.QueryAlarms:
+		log.Warn("Request received without reply subject, nothing to answer")
+	case wire.AlarmsHandedOff:
+		return s.takeOver(ctx, log.With(zap.Any("userID", m.UserID)), m)
+	case handoffStarted:
+		return s.handOff(ctx, log, m)
+	case reshardCommitted:
+		return s.commitResharding(ctx, log, m)
+	default:
+		log.Warn(fmt.Sprintf("Message of unknown type %T received", msg))
+	}
+	return nil
+}
 
-					if len(active.ActiveAlarms) == 0 {
-						continue
-					}
+func (s *localShard) sendAlarmDigest(ctx context.Context, log *zap.Logger, m wire.SendAlarmDigest) error {
+	now := time.Now()
 
-					sort.Slice(active.ActiveAlarms, func(i int, j int) bool {
-						return active.ActiveAlarms[i].LatestChangedAt.Before(active.ActiveAlarms[j].LatestChangedAt)
-					})
+	// Request ID is remembered only if window is set
+	requestID := m.RequestID
+	if s.config.RequestIDWindow <= 0 {
+		requestID = ""
+	}
+	if requestID != "" {
+		log = log.With(zap.String("requestID", requestID))
+		if request := s.answeredRequest(m.UserID, requestID, now.Add(-s.config.RequestIDWindow)); request != nil {
+			return s.answerAgain(ctx, log, request)
+		}
+	}
 
-					select {
-					case <-ctx.Done():
-						return ctx.Err()
-					case tx <- active:
-					}
+	if s.config.DigestInterval > 0 {
+		allowed, err := s.takeToken(log, m.UserID, now)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			// Alarms are sent in the deferred digest, so duplicates of the request don't send anything
+			return s.answerWithoutDigest(log, m.UserID, requestID, now)
+		}
+	}
 
-					for _, alarm := range sent {
-						alarm.ToSend = false
-					}
+	return s.stageDigest(ctx, log, m.UserID, requestID, now)
+}
+
+// answerWithoutDigest remembers request answered without sending digest, so its duplicates don't send anything either
+func (s *localShard) answerWithoutDigest(log *zap.Logger, userID wire.UserID, requestID string, now time.Time) error {
+	if requestID == "" {
+		return nil
+	}
+	request := &answeredRequest{
+		UserID:     userID,
+		RequestID:  requestID,
+		AnsweredAt: now,
+	}
+	s.rememberRequest(request)
+	if err := s.record(log, journalRecord{RequestAnswered: request}); err != nil {
+		return fmt.Errorf("recording answered request failed: %w", err)
+	}
+	return nil
+}
 
-					log.Info("Alarms sent", zap.Any("alarms", active))
+// stageDigest puts digest containing alarms of the user which haven't been sent yet into the outbox and publishes it
+func (s *localShard) stageDigest(ctx context.Context, log *zap.Logger, userID wire.UserID, requestID string, now time.Time) error {
+	if s.flapping.Window > 0 {
+		if err := s.settleFlapping(log, userID, now); err != nil {
+			return err
+		}
+	}
 
-				default:
-					log.Warn(fmt.Sprintf("Message of unknown type %T received", msg))
-				}
-			}
+	alarms := s.Users[userID]
+	if alarms == nil {
+		log.Info("No alarms for user, nothing to send")
+	}
+
+	// Alarms which are already waiting in the outbox are not sent again
+	staged := s.stagedRevisions(userID)
+	prefs := s.Preferences[userID]
+
+	digest := &stagedDigest{
+		Digest: wire.AlarmDigest{
+			UserID: userID,
+		},
+		Revisions: map[wire.AlarmID]uint64{},
+		RequestID: requestID,
+		StagedAt:  now,
+	}
+	for alarmID, alarm := range alarms {
+		if revision, exists := staged[alarmID]; exists && revision == alarm.Revision {
+			continue
+		}
+		if alarm.ToSend && alarm.acknowledged(now) {
+			log.Info("Alarm acknowledged by the user, it won't be sent", zap.Any("alarmID", alarmID))
+			continue
+		}
+		if alarm.ToSend && s.silenced(userID, alarmID, now) {
+			log.Info("Alarm silenced, it won't be sent until silence ends", zap.Any("alarmID", alarmID))
+			continue
 		}
+		if alarm.ToSend && alarm.Status == wire.StatusCleared && !alarm.Flapping {
+			digest.Digest.ResolvedAlarms = append(digest.Digest.ResolvedAlarms, alarm.digestEntry(alarmID))
+			digest.Revisions[alarmID] = alarm.Revision
+			continue
+		}
+		if alarm.ToSend && !meetsMinSeverity(prefs, alarm.Status) {
+			log.Debug("Alarm is below minimum severity, it won't be sent", zap.Any("alarmID", alarmID))
+			continue
+		}
+		if alarm.ToSend {
+			digest.Digest.ActiveAlarms = append(digest.Digest.ActiveAlarms, alarm.digestEntry(alarmID))
+			digest.Revisions[alarmID] = alarm.Revision
+		}
+	}
+
+	if len(digest.Digest.ActiveAlarms) == 0 && len(digest.Digest.ResolvedAlarms) == 0 {
+		// Duplicated request must not send anything either, even if alarms are triggered in the meantime
+		return s.answerWithoutDigest(log, userID, requestID, now)
+	}
+
+	sortAlarms(digest.Digest.ActiveAlarms, prefs)
+	sortAlarms(digest.Digest.ResolvedAlarms, prefs)
+
+	// Alarms exceeding the limit are not marked as sent, so they are included in the next digest
+	if max := prefs.MaxAlarms; max > 0 && uint64(len(digest.Digest.ActiveAlarms)) > max {
+		for _, alarm := range digest.Digest.ActiveAlarms[max:] {
+			delete(digest.Revisions, alarm.AlarmID)
+		}
+		log.Info("Digest truncated", zap.Int("remaining", len(digest.Digest.ActiveAlarms)-int(max)))
+		digest.Digest.ActiveAlarms = digest.Digest.ActiveAlarms[:max]
+	}
+	groupAlarms(&digest.Digest, prefs.GroupByLabel)
+
+	digest.ID = s.digestID(digest)
+	s.stage(digest)
+	if err := s.record(log, journalRecord{DigestStaged: digest}); err != nil {
+		return fmt.Errorf("recording staged digest failed: %w", err)
+	}
+
+	log.Info("Digest staged", zap.String("digestID", digest.ID), zap.Any("alarms", digest.Digest))
+	return s.release(ctx, log, digest)
+}
+
+// answerAgain sends the same digest which was sent in response to the original request
+func (s *localShard) answerAgain(ctx context.Context, log *zap.Logger, request *answeredRequest) error {
+	if request.Digest == nil {
+		log.Info("Request has been answered already, nothing to send")
+		return nil
+	}
+
+	// Revisions are not set so alarms state is not affected when digest is confirmed
+	digest := &stagedDigest{
+		ID:        uuid.New().String(),
+		Digest:    *request.Digest,
+		Revisions: map[wire.AlarmID]uint64{},
+		StagedAt:  time.Now(),
+	}
+	s.stage(digest)
+	if err := s.record(log, journalRecord{DigestStaged: digest}); err != nil {
+		return fmt.Errorf("recording staged digest failed: %w", err)
+	}
+
+	log.Info("Request has been answered already, digest staged again", zap.String("digestID", digest.ID), zap.Any("alarms", digest.Digest))
+	return s.release(ctx, log, digest)
+}
+
+// record stores change in the journal. Change has to be applied to the state before it is recorded
+// because snapshot might be taken here.
+func (s *localShard) record(log *zap.Logger, change journalRecord) error {
+	if err := s.journal.Record(change); err != nil {
+		return err
+	}
+	s.changes++
+	if s.config.SnapshotChanges > 0 && s.changes >= s.config.SnapshotChanges {
+		return s.compact(log)
 	}
+	return nil
+}
+
+// compact takes snapshot of the state
+func (s *localShard) compact(log *zap.Logger) error {
+	if s.config.RequestIDWindow > 0 {
+		s.forgetRequests(time.Now().Add(-s.config.RequestIDWindow))
+	}
+	s.forgetSilences(time.Now())
+	s.forgetAnnouncements(time.Now().Add(-announcementWindow))
+	if s.leadership.Role() == election.RoleFollower {
+		s.forgetStaged(time.Now().Add(-announcementWindow))
+	}
+	if s.config.DigestInterval > 0 {
+		s.forgetLimits(s.rateLimit, time.Now())
+	} else {
+		s.Limits = map[wire.UserID]*digestLimit{}
+	}
+	if err := s.journal.Compact(s.shardState); err != nil {
+		return fmt.Errorf("taking snapshot failed: %w", err)
+	}
+	log.Debug("Snapshot taken", zap.Uint64("changes", s.changes))
+	s.changes = 0
+	return nil
+}
+
+// applyAlarmStatusChanged applies status update to the alarm, false is returned if update is outdated and was ignored
+func (users userList) applyAlarmStatusChanged(log *zap.Logger, m wire.AlarmStatusChanged, flapping flappingPolicy, resolve bool) bool {
+	alarms := users[m.UserID]
+	if alarms == nil {
+		alarms = alarmList{}
+		users[m.UserID] = alarms
+	}
+	alarm := alarms[m.AlarmID]
+	if alarm == nil {
+		alarm = &alarmStatus{}
+		alarms[m.AlarmID] = alarm
+	}
+
+	if alarm.LatestChangedAt.After(m.ChangedAt) {
+		log.Info("Update ignored because newer one exists")
+		return false
+	}
+	alarm.LatestChangedAt = m.ChangedAt
+
+	// Labels are optional, so update without them doesn't remove the ones received before
+	if m.Labels != nil {
+		alarm.Labels = m.Labels
+	}
+
+	switch {
+	case alarm.Status != m.Status:
+		alarm.Status = m.Status
+		alarm.StatusChangedAt = m.ChangedAt
+		alarm.Acknowledged = false
+		alarm.AcknowledgementExpiresAt = time.Time{}
+		switch {
+		case flapping.recordTransition(alarm, m.ChangedAt):
+			log.Info("Alarm is flapping, it is sent once until it settles", zap.Int("transitions", len(alarm.Transitions)))
+			alarm.ToSend = true
+			alarm.Revision++
+		case alarm.Flapping:
+			log.Info("Alarm is flapping, status change won't be sent")
+		case alarm.Status == wire.StatusCleared && resolve && alarm.Notified:
+			log.Info("Alarm resolved")
+			alarm.ToSend = true
+			alarm.Revision++
+		case alarm.Status == wire.StatusCleared:
+			log.Info(fmt.Sprintf("Status is %s, alarm won't be sent", alarm.Status))
+			alarm.ToSend = false
+		default:
+			log.Info("Alarm triggered")
+			alarm.ToSend = true
+			alarm.Revision++
+		}
+	case alarm.ToSend:
+		log.Info("Status hasn't changed, alarm was triggered earlier")
+	default:
+		log.Info("Status hasn't changed, alarm won't be sent")
+	}
+	return true
+}
+
+// applyAcknowledgeAlarm marks alarm as acknowledged, false is returned if acknowledgement was ignored
+func (users userList) applyAcknowledgeAlarm(log *zap.Logger, m wire.AcknowledgeAlarm) bool {
+	alarm := users[m.UserID][m.AlarmID]
+	if alarm == nil {
+		log.Info("Alarm doesn't exist, acknowledgement ignored")
+		return false
+	}
+	if alarm.LatestChangedAt.After(m.AcknowledgedAt) {
+		log.Info("Acknowledgement ignored because status changed after it")
+		return false
+	}
+
+	log.Info("Alarm acknowledged")
+	alarm.Acknowledged = true
+	alarm.AcknowledgementExpiresAt = m.ExpiresAt
+	return true
 }
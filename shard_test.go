@@ -8,32 +8,56 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/wojciech-malota-wojcik/logger"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/bus"
+	"github.com/wojciech-malota-wojcik/netdata/infra/election"
+	"github.com/wojciech-malota-wojcik/netdata/infra/sharding"
 	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
 )
 
+func newTestResharder(config infra.Config) *resharder {
+	return newResharder(config, sharding.NewXORModuloIDGenerator(), sharding.NewMap(config.NumOfShards))
+}
+
 func runLocalShardTest(t *testing.T, messages ...interface{}) []wire.AlarmDigest {
+	return runLocalShardWithStateTest(t, infra.Config{}, newShardState(), noJournal{}, messages...)
+}
+
+func runLocalShardWithStateTest(t *testing.T, config infra.Config, state *shardState, j journal, messages ...interface{}) []wire.AlarmDigest {
 	ctx, cancel := context.WithCancel(logger.WithLogger(context.Background(), logger.New()))
 	defer cancel()
 	t.Cleanup(func() {
 		cancel()
 	})
-	responseCapacity := 0
 	rx := make(chan interface{}, len(messages))
 	for _, msg := range messages {
 		rx <- msg
-		if _, ok := msg.(wire.SendAlarmDigest); ok {
-			responseCapacity++
-		}
 	}
 	close(rx)
-	tx := make(chan interface{}, responseCapacity)
-	require.NoError(t, runLocalShard(rx, tx)(ctx))
+
+	// Digests are confirmed concurrently, the same way bus does it
+	tx := make(chan interface{})
+	var result []wire.AlarmDigest
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for msg := range tx {
+			// Messages published without confirmation are ignored
+			out, ok := msg.(bus.Outgoing)
+			if !ok {
+				continue
+			}
+			if digest, ok := out.Msg.(*wire.AlarmDigest); ok {
+				result = append(result, *digest)
+			}
+			out.Confirm(nil)
+		}
+	}()
+
+	require.NoError(t, runLocalShard(config, state, j, newTestResharder(config), election.NewStaticLeadership(), rx, tx)(ctx))
 	close(tx)
+	<-doneCh
 
-	result := make([]wire.AlarmDigest, 0, responseCapacity)
-	for resp := range tx {
-		result = append(result, *resp.(*wire.AlarmDigest))
-	}
 	return result
 }
 
@@ -568,3 +592,107 @@ func TestTwoUsersHavingTwoActiveAlarms(t *testing.T) {
 		},
 	}, result[1])
 }
+
+func TestDeliveriesAreAcknowledgedAfterApplying(t *testing.T) {
+	var acked []int
+	ack := func(i int) bus.AckFunc {
+		return func() {
+			acked = append(acked, i)
+		}
+	}
+
+	result := runLocalShardTest(t,
+		bus.Delivery{Entity: change(user1, alarm1, wire.StatusCritical, time2), Ack: ack(1)},
+		bus.Delivery{Entity: change(user1, alarm1, wire.StatusWarning, time1), Ack: ack(2)},
+		send(user1),
+		bus.Delivery{Entity: send(user1), Ack: ack(3)},
+	)
+	require.Len(t, result, 1)
+	assert.Equal(t, wire.AlarmDigest{
+		UserID: user1,
+		ActiveAlarms: []wire.Alarm{
+			{
+				AlarmID:         alarm1,
+				Status:          wire.StatusCritical,
+				LatestChangedAt: time2,
+			},
+		},
+	}, result[0])
+	assert.Equal(t, []int{1, 2, 3}, acked)
+}
+
+func acknowledge(userID wire.UserID, alarmID wire.AlarmID, acknowledgedAt time.Time, expiresAt time.Time) wire.AcknowledgeAlarm {
+	return wire.AcknowledgeAlarm{
+		ShardedEntity: wire.ShardedEntity{
+			UserID: userID,
+		},
+		AlarmID:        alarmID,
+		AcknowledgedAt: acknowledgedAt,
+		ExpiresAt:      expiresAt,
+	}
+}
+
+func TestAcknowledgedAlarmIsNotSent(t *testing.T) {
+	result := runLocalShardTest(t,
+		change(user1, alarm1, wire.StatusCritical, time1),
+		change(user1, alarm2, wire.StatusWarning, time1),
+		acknowledge(user1, alarm1, time2, time.Time{}),
+		send(user1),
+	)
+	require.Len(t, result, 1)
+	assert.Equal(t, []wire.Alarm{
+		{
+			AlarmID:         alarm2,
+			Status:          wire.StatusWarning,
+			LatestChangedAt: time1,
+		},
+	}, result[0].ActiveAlarms)
+}
+
+func TestAcknowledgementIsRemovedWhenStatusChanges(t *testing.T) {
+	result := runLocalShardTest(t,
+		change(user1, alarm1, wire.StatusCritical, time1),
+		acknowledge(user1, alarm1, time2, time.Time{}),
+		change(user1, alarm1, wire.StatusCritical, time3),
+		send(user1),
+		change(user1, alarm1, wire.StatusWarning, time4),
+		send(user1),
+	)
+	require.Len(t, result, 1)
+	assert.Equal(t, []wire.Alarm{
+		{
+			AlarmID:         alarm1,
+			Status:          wire.StatusWarning,
+			LatestChangedAt: time4,
+		},
+	}, result[0].ActiveAlarms)
+}
+
+func TestOutdatedAcknowledgementIsIgnored(t *testing.T) {
+	result := runLocalShardTest(t,
+		change(user1, alarm1, wire.StatusCritical, time2),
+		acknowledge(user1, alarm1, time1, time.Time{}),
+		acknowledge(user1, alarm2, time3, time.Time{}),
+		send(user1),
+	)
+	require.Len(t, result, 1)
+	assert.Len(t, result[0].ActiveAlarms, 1)
+}
+
+func TestExpiredAcknowledgementIsIgnored(t *testing.T) {
+	result := runLocalShardTest(t,
+		change(user1, alarm1, wire.StatusCritical, time1),
+		change(user1, alarm2, wire.StatusCritical, time1),
+		acknowledge(user1, alarm1, time2, time3),
+		acknowledge(user1, alarm2, time2, time.Now().Add(time.Hour)),
+		send(user1),
+	)
+	require.Len(t, result, 1)
+	assert.Equal(t, []wire.Alarm{
+		{
+			AlarmID:         alarm1,
+			Status:          wire.StatusCritical,
+			LatestChangedAt: time1,
+		},
+	}, result[0].ActiveAlarms)
+}
@@ -0,0 +1,121 @@
+package netdata
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+	"go.uber.org/zap"
+)
+
+// silence mutes matching alarms of the user during the time window
+type silence struct {
+	wire.Silence
+
+	// Deleted is true if silence has been deleted, it is kept until its end so creation received after deletion is ignored
+	Deleted bool `json:",omitempty"`
+
+	// regex is the compiled pattern of REGEX silence
+	regex *regexp.Regexp
+}
+
+// matches returns true if alarm is matched by the silence
+func (s *silence) matches(alarmID wire.AlarmID) bool {
+	switch s.MatchType {
+	case wire.MatchExact:
+		return string(alarmID) == s.Pattern
+	case wire.MatchPrefix:
+		return strings.HasPrefix(string(alarmID), s.Pattern)
+	case wire.MatchRegex:
+		if s.regex == nil {
+			regex, err := regexp.Compile("^(?:" + s.Pattern + ")$")
+			if err != nil {
+				// Pattern has been validated when message was received
+				return false
+			}
+			s.regex = regex
+		}
+		return s.regex.MatchString(string(alarmID))
+	default:
+		return false
+	}
+}
+
+// active returns true if silence mutes alarms at the time
+func (s *silence) active(now time.Time) bool {
+	return !s.Deleted && !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+// silenced returns true if alarm of the user is muted by any silence at the time
+func (st *shardState) silenced(userID wire.UserID, alarmID wire.AlarmID, now time.Time) bool {
+	for _, s := range st.Silences[userID] {
+		if s.active(now) && s.matches(alarmID) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyCreateSilence stores the silence, false is returned if message was ignored
+func (st *shardState) applyCreateSilence(log *zap.Logger, m wire.CreateSilence) bool {
+	existing := st.Silences[m.UserID][m.SilenceID]
+	switch {
+	case existing == nil:
+	case existing.Deleted && existing.EndsAt.IsZero():
+		// Deletion was received first, silence is remembered until its end to ignore redelivered creation
+		log.Info("Silence has been deleted already, ignoring")
+		existing.EndsAt = m.EndsAt
+		return true
+	default:
+		log.Info("Silence exists already, ignoring")
+		return false
+	}
+
+	if st.Silences == nil {
+		st.Silences = map[wire.UserID]map[string]*silence{}
+	}
+	if st.Silences[m.UserID] == nil {
+		st.Silences[m.UserID] = map[string]*silence{}
+	}
+	st.Silences[m.UserID][m.SilenceID] = &silence{Silence: m.Silence}
+	log.Info("Silence created")
+	return true
+}
+
+// applyDeleteSilence ends the silence, false is returned if message was ignored. Silence is kept as deleted
+// until its end, so creation received after deletion is ignored.
+func (st *shardState) applyDeleteSilence(log *zap.Logger, m wire.DeleteSilence) bool {
+	existing := st.Silences[m.UserID][m.SilenceID]
+	if existing != nil && existing.Deleted {
+		log.Info("Silence has been deleted already, ignoring")
+		return false
+	}
+	if existing == nil {
+		if st.Silences == nil {
+			st.Silences = map[wire.UserID]map[string]*silence{}
+		}
+		if st.Silences[m.UserID] == nil {
+			st.Silences[m.UserID] = map[string]*silence{}
+		}
+		existing = &silence{Silence: wire.Silence{SilenceID: m.SilenceID}}
+		st.Silences[m.UserID][m.SilenceID] = existing
+	}
+	existing.Deleted = true
+	log.Info("Silence deleted")
+	return true
+}
+
+// forgetSilences removes silences which ended before the time passed
+func (st *shardState) forgetSilences(until time.Time) {
+	for userID, silences := range st.Silences {
+		for id, s := range silences {
+			if !s.EndsAt.IsZero() && !s.EndsAt.After(until) {
+				delete(silences, id)
+			}
+		}
+		if len(silences) == 0 {
+			delete(st.Silences, userID)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package netdata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wojciech-malota-wojcik/netdata/infra"
+	"github.com/wojciech-malota-wojcik/netdata/infra/wire"
+)
+
+func createSilence(userID wire.UserID, silenceID string, matchType wire.MatchType, pattern string, startsAt time.Time, endsAt time.Time) wire.CreateSilence {
+	return wire.CreateSilence{
+		ShardedEntity: wire.ShardedEntity{
+			UserID: userID,
+		},
+		Silence: wire.Silence{
+			SilenceID: silenceID,
+			MatchType: matchType,
+			Pattern:   pattern,
+			StartsAt:  startsAt,
+			EndsAt:    endsAt,
+		},
+	}
+}
+
+func deleteSilence(userID wire.UserID, silenceID string) wire.DeleteSilence {
+	return wire.DeleteSilence{
+		ShardedEntity: wire.ShardedEntity{
+			UserID: userID,
+		},
+		SilenceID: silenceID,
+	}
+}
+
+func TestSilenceMatchesAlarms(t *testing.T) {
+	tests := []struct {
+		matchType wire.MatchType
+		pattern   string
+		alarmID   wire.AlarmID
+		expected  bool
+	}{
+		{matchType: wire.MatchExact, pattern: "disk", alarmID: "disk", expected: true},
+		{matchType: wire.MatchExact, pattern: "disk", alarmID: "disk1", expected: false},
+		{matchType: wire.MatchPrefix, pattern: "disk", alarmID: "disk1", expected: true},
+		{matchType: wire.MatchPrefix, pattern: "disk", alarmID: "cpu", expected: false},
+		{matchType: wire.MatchPrefix, pattern: "", alarmID: "cpu", expected: true},
+		{matchType: wire.MatchRegex, pattern: "disk[0-9]+", alarmID: "disk12", expected: true},
+		{matchType: wire.MatchRegex, pattern: "disk[0-9]+", alarmID: "disk12a", expected: false},
+		{matchType: wire.MatchRegex, pattern: "a|b", alarmID: "b", expected: true},
+		{matchType: wire.MatchRegex, pattern: "a|b", alarmID: "ab", expected: false},
+	}
+	for _, test := range tests {
+		s := &silence{Silence: wire.Silence{MatchType: test.matchType, Pattern: test.pattern}}
+		assert.Equal(t, test.expected, s.matches(test.alarmID), "%s %q %q", test.matchType, test.pattern, test.alarmID)
+	}
+}
+
+func TestSilencedAlarmsAreNotSent(t *testing.T) {
+	now := time.Now()
+	state := newShardState()
+	result := runLocalShardWithStateTest(t, infra.Config{EscalateCritical: true}, state, noJournal{},
+		createSilence(user1, "maintenance", wire.MatchPrefix, "disk", now.Add(-time.Hour), now.Add(time.Hour)),
+		createSilence(user1, "future", wire.MatchExact, "cpu", now.Add(time.Hour), now.Add(2*time.Hour)),
+		createSilence(user1, "past", wire.MatchExact, "memory", now.Add(-2*time.Hour), now.Add(-time.Hour)),
+		change(user1, "disk1", wire.StatusWarning, time1),
+		change(user1, "disk2", wire.StatusCritical, time1),
+		change(user1, "cpu", wire.StatusWarning, time1),
+		change(user1, "memory", wire.StatusWarning, time2),
+		change(user2, "disk1", wire.StatusWarning, time1),
+		send(user1),
+		send(user2),
+	)
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         "cpu",
+					Status:          wire.StatusWarning,
+					LatestChangedAt: time1,
+				},
+				{
+					AlarmID:         "memory",
+					Status:          wire.StatusWarning,
+					LatestChangedAt: time2,
+				},
+			},
+		},
+		{
+			UserID: user2,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         "disk1",
+					Status:          wire.StatusWarning,
+					LatestChangedAt: time1,
+				},
+			},
+		},
+	}, result)
+
+	// Silenced alarms are sent once silence ends
+	assert.True(t, state.Users[user1]["disk1"].ToSend)
+	assert.True(t, state.Users[user1]["disk2"].ToSend)
+}
+
+func TestActiveAlarmsAreSentWhenSilenceEnds(t *testing.T) {
+	now := time.Now()
+	state := newShardState()
+	runLocalShardWithStateTest(t, infra.Config{}, state, noJournal{},
+		createSilence(user1, "maintenance", wire.MatchPrefix, "", now.Add(-time.Hour), now.Add(time.Hour)),
+		change(user1, alarm1, wire.StatusWarning, time1),
+		change(user1, alarm2, wire.StatusWarning, time1),
+		change(user1, alarm2, wire.StatusCleared, time2),
+		send(user1),
+	)
+
+	state.Silences[user1]["maintenance"].EndsAt = now
+	result := runLocalShardWithStateTest(t, infra.Config{}, state, noJournal{},
+		send(user1),
+	)
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusWarning,
+					LatestChangedAt: time1,
+				},
+			},
+		},
+	}, result)
+}
+
+func TestDeletedSilenceDoesNotMuteAlarms(t *testing.T) {
+	now := time.Now()
+	state := newShardState()
+	result := runLocalShardWithStateTest(t, infra.Config{}, state, noJournal{},
+		createSilence(user1, "silence1", wire.MatchExact, string(alarm1), now.Add(-time.Hour), now.Add(time.Hour)),
+		deleteSilence(user1, "silence1"),
+		createSilence(user1, "silence1", wire.MatchExact, string(alarm1), now.Add(-time.Hour), now.Add(time.Hour)),
+
+		// Deletion received before creation
+		deleteSilence(user1, "silence2"),
+		createSilence(user1, "silence2", wire.MatchExact, string(alarm2), now.Add(-time.Hour), now.Add(time.Hour)),
+
+		change(user1, alarm1, wire.StatusWarning, time1),
+		change(user1, alarm2, wire.StatusWarning, time2),
+		send(user1),
+	)
+	assert.Equal(t, []wire.AlarmDigest{
+		{
+			UserID: user1,
+			ActiveAlarms: []wire.Alarm{
+				{
+					AlarmID:         alarm1,
+					Status:          wire.StatusWarning,
+					LatestChangedAt: time1,
+				},
+				{
+					AlarmID:         alarm2,
+					Status:          wire.StatusWarning,
+					LatestChangedAt: time2,
+				},
+			},
+		},
+	}, result)
+
+	// Deleted silences are forgotten when they end
+	state.forgetSilences(now.Add(time.Hour))
+	assert.Empty(t, state.Silences)
+}
+
+func TestSilencesAreHandedOff(t *testing.T) {
+	state := newShardState()
+	state.restoreUser(wire.AlarmsHandedOff{
+		ShardedEntity: wire.ShardedEntity{UserID: user1},
+		Epoch:         1,
+		Silences: []wire.Silence{
+			{SilenceID: "silence", MatchType: wire.MatchExact, Pattern: string(alarm1), StartsAt: time1, EndsAt: time3},
+		},
+	})
+	assert.Equal(t, map[wire.UserID]bool{user1: true}, state.knownUsers())
+	assert.True(t, state.silenced(user1, alarm1, time2))
+	assert.False(t, state.silenced(user1, alarm1, time3))
+
+	state.removeUsers([]wire.UserID{user1})
+	assert.Empty(t, state.knownUsers())
+}